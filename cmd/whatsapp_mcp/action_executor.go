@@ -1,11 +1,28 @@
 package main
 
 import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
   "encoding/json"
+  "errors"
   "fmt"
+  "math/rand"
   "os"
   "path/filepath"
+  "regexp"
+  "runtime/debug"
+  "slices"
+  "sort"
+  "strings"
+  "sync"
   "time"
+
+  "github.com/google/uuid"
+  "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/types"
+  "google.golang.org/protobuf/encoding/protojson"
 )
 
 // ActionExecutor handles execution of handler actions
@@ -13,6 +30,55 @@ type ActionExecutor struct {
   database     *Database
   errorState   *ErrorState
   eventMatcher *EventMatcher
+  flushMutex   sync.Mutex
+  batches      map[string]*eventBatch
+  batchesMutex sync.Mutex
+  presence      string // last presence we sent; empty means never set (unavailable)
+  presenceMutex sync.Mutex
+  recentSends   map[string]time.Time // content hash -> when it was last sent, for outbound dedup
+  recentMutex   sync.Mutex
+  pausedChats   map[string]time.Time // chat JID -> when handlers resume; zero means until resumed
+  pausedMutex   sync.RWMutex
+  running       map[string]*runningExecution // execution ID -> handler execution in progress
+  runningMutex  sync.Mutex
+  coalescing    map[string]*eventBatch // handler|chat|sender -> messages waiting out coalesce_window_seconds
+  coalesceMutex sync.Mutex
+}
+
+// runningExecution is a handler execution in progress, which cancel_handler_execution can stop
+type runningExecution struct {
+  handlerID string
+  event     map[string]interface{} // identifying fields of the triggering event
+  startedAt time.Time
+  cancel    context.CancelFunc
+}
+
+// sendActionTypes are the returned action types that deliver a message
+var sendActionTypes = map[string]bool{
+  "send_message": true,
+  "send_voice":   true,
+  "send_media":   true,
+  "send_sticker": true,
+  "send_link":    true,
+  "send_reaction": true,
+  "welcome":      true,
+}
+
+// errDuplicateSend is returned when outbound_dedup_window suppresses a send. Nothing failed,
+// so it is never dead-lettered.
+var errDuplicateSend = errors.New("suppressed duplicate send within outbound_dedup_window")
+
+// handlerIDKey carries the running handler's ID in an execution's context
+type handlerIDKey struct{}
+
+// deadLetterOmittedFields are bulky event fields left out of dead letters
+var deadLetterOmittedFields = []string{"context_messages", "quoted_message", "raw_message"}
+
+// eventBatch accumulates matching events for a handler running in batch mode
+type eventBatch struct {
+  handler map[string]interface{}
+  events  []map[string]interface{}
+  timer   *time.Timer
 }
 
 // NewActionExecutor creates a new action executor
@@ -21,11 +87,131 @@ func NewActionExecutor(database *Database, errorState *ErrorState, eventMatcher
     database:     database,
     errorState:   errorState,
     eventMatcher: eventMatcher,
+    batches:      make(map[string]*eventBatch),
+    recentSends:  make(map[string]time.Time),
+    pausedChats:  make(map[string]time.Time),
+    running:      make(map[string]*runningExecution),
+    coalescing:   make(map[string]*eventBatch),
+  }
+}
+
+// LoadPausedChats reads the chats whose handlers are paused from the database
+func (ae *ActionExecutor) LoadPausedChats() error {
+  chats, err := ae.database.GetPausedChats()
+  if err != nil {
+    return err
+  }
+
+  paused := make(map[string]time.Time, len(chats))
+  for _, chat := range chats {
+    var resumeAt time.Time
+    if at, ok := chat["resume_at"].(string); ok {
+      resumeAt, _ = time.Parse(time.RFC3339, at)
+    }
+    paused[chat["chat"].(string)] = resumeAt
   }
+
+  ae.pausedMutex.Lock()
+  ae.pausedChats = paused
+  ae.pausedMutex.Unlock()
+  return nil
+}
+
+// isChatPaused reports whether handlers are paused for a chat
+func (ae *ActionExecutor) isChatPaused(chat string) bool {
+  ae.pausedMutex.RLock()
+  resumeAt, paused := ae.pausedChats[chat]
+  ae.pausedMutex.RUnlock()
+  return paused && (resumeAt.IsZero() || time.Now().Before(resumeAt))
+}
+
+// startExecution registers a handler execution as running and returns its ID with a context
+// that is cancelled when cancel_handler_execution is called for it. The caller must call
+// finishExecution when the handler returns.
+func (ae *ActionExecutor) startExecution(handlerID string, event map[string]interface{}) (string, context.Context) {
+  ctx, cancel := context.WithCancel(context.WithValue(context.Background(), handlerIDKey{}, handlerID))
+  summary := map[string]interface{}{}
+  for _, key := range []string{"event_type", "message_id", "chat", "from"} {
+    if value, ok := event[key]; ok {
+      summary[key] = value
+    }
+  }
+
+  executionID := uuid.New().String()
+  ae.runningMutex.Lock()
+  ae.running[executionID] = &runningExecution{
+    handlerID: handlerID,
+    event:     summary,
+    startedAt: time.Now(),
+    cancel:    cancel,
+  }
+  ae.runningMutex.Unlock()
+  return executionID, ctx
+}
+
+// finishExecution removes a handler execution from the running set
+func (ae *ActionExecutor) finishExecution(executionID string) {
+  ae.runningMutex.Lock()
+  execution, ok := ae.running[executionID]
+  delete(ae.running, executionID)
+  ae.runningMutex.Unlock()
+  if ok {
+    execution.cancel()
+  }
+}
+
+// RunningExecutions lists the handler executions in progress, longest running first
+func (ae *ActionExecutor) RunningExecutions() []map[string]interface{} {
+  ae.runningMutex.Lock()
+  defer ae.runningMutex.Unlock()
+
+  executions := make([]map[string]interface{}, 0, len(ae.running))
+  for executionID, execution := range ae.running {
+    executions = append(executions, map[string]interface{}{
+      "execution_id": executionID,
+      "handler_id":   execution.handlerID,
+      "event":        execution.event,
+      "started_at":   execution.startedAt.Format(time.RFC3339),
+      "elapsed_ms":   time.Since(execution.startedAt).Milliseconds(),
+    })
+  }
+  sort.Slice(executions, func(i, j int) bool {
+    return executions[i]["elapsed_ms"].(int64) > executions[j]["elapsed_ms"].(int64)
+  })
+  return executions
+}
+
+// CancelExecution cancels a running handler execution. The handler stops at its next
+// cancellation point (the python call, a delay or between actions) and is logged as failed.
+// It returns the handler ID, or false if no execution has that ID.
+func (ae *ActionExecutor) CancelExecution(executionID string) (string, bool) {
+  ae.runningMutex.Lock()
+  execution, ok := ae.running[executionID]
+  ae.runningMutex.Unlock()
+  if !ok {
+    return "", false
+  }
+  execution.cancel()
+  return execution.handlerID, true
 }
 
 // ExecuteHandlersForEvent finds and executes all matching handlers for an event
 func (ae *ActionExecutor) ExecuteHandlersForEvent(event map[string]interface{}) {
+  // Skip stale events (e.g. old messages redelivered after a reconnect)
+  if maxAge := global_config.GetMaxHandlerEventAge(); maxAge > 0 {
+    if timestamp, ok := event["timestamp"].(time.Time); ok && time.Since(timestamp) > maxAge {
+      eventID, _ := event["message_id"].(string)
+      ae.errorState.LogError(ErrorSeverityInfo, "event_executor",
+        fmt.Sprintf("Skipped handlers for stale event %s (age %s)", eventID, time.Since(timestamp).Round(time.Second)), "")
+      return
+    }
+  }
+
+  // A user can take over a chat by pausing its handlers
+  if chat, _ := event["chat"].(string); chat != "" && ae.isChatPaused(chat) {
+    return
+  }
+
   // Find matching handlers
   matchingHandlers := ae.eventMatcher.MatchEvent(event)
 
@@ -37,19 +223,220 @@ func (ae *ActionExecutor) ExecuteHandlersForEvent(event map[string]interface{})
   ae.errorState.LogError(ErrorSeverityInfo, "event_executor", 
     fmt.Sprintf("Event matched %d handlers", len(matchingHandlers)), "")
 
+  // Sequential mode runs handlers in priority order (MatchEvent sorts them) and stops
+  // as soon as one returns halt. This already runs off the event goroutine.
+  if global_config.GetHandlerExecutionMode() == HandlerExecutionSequential {
+    for i, handler := range matchingHandlers {
+      if ae.addToCoalesce(handler, event) {
+        continue
+      }
+      if batch, _ := handler["batch"].(bool); batch {
+        ae.addToBatch(handler, event)
+        continue
+      }
+      if ae.executeHandler(handler, event) {
+        handlerID, _ := handler["handler_id"].(string)
+        ae.errorState.LogError(ErrorSeverityInfo, "event_executor",
+          fmt.Sprintf("Handler '%s' stopped propagation, skipped %d remaining handlers", handlerID, len(matchingHandlers)-i-1), "")
+        return
+      }
+    }
+    return
+  }
+
   // Execute each handler in a goroutine (non-blocking)
   for _, handler := range matchingHandlers {
+    if ae.addToCoalesce(handler, event) {
+      continue
+    }
+    if batch, _ := handler["batch"].(bool); batch {
+      ae.addToBatch(handler, event)
+      continue
+    }
     go ae.executeHandler(handler, event)
   }
 }
 
-// executeHandler executes a single handler for an event
-func (ae *ActionExecutor) executeHandler(handler map[string]interface{}, event map[string]interface{}) {
+// coalesceMaxMessages caps how many messages one coalesced event can hold
+const coalesceMaxMessages = 50
+
+// addToCoalesce buffers a message event for a handler with coalesce_window_seconds, so a
+// thought typed as several quick messages reaches the handler once. Each message from the
+// same sender in the same chat restarts the window; when it passes quietly (or
+// coalesceMaxMessages are buffered) the messages run as one event. It returns false, leaving
+// the event to the caller, if the handler doesn't coalesce or it isn't a message event.
+func (ae *ActionExecutor) addToCoalesce(handler map[string]interface{}, event map[string]interface{}) bool {
+  seconds, _ := handler["coalesce_window_seconds"].(int64)
+  if seconds <= 0 || event["event_type"] != "message" {
+    return false
+  }
+  window := time.Duration(seconds) * time.Second
+
+  handlerID, _ := handler["handler_id"].(string)
+  chat, _ := event["chat"].(string)
+  from, _ := event["from"].(string)
+  key := handlerID + "|" + chat + "|" + from
+
+  ae.coalesceMutex.Lock()
+  defer ae.coalesceMutex.Unlock()
+
+  pending, exists := ae.coalescing[key]
+  if !exists {
+    pending = &eventBatch{handler: handler}
+    pending.timer = time.AfterFunc(window, func() {
+      ae.flushCoalesced(key, pending)
+    })
+    ae.coalescing[key] = pending
+  } else {
+    pending.timer.Reset(window)
+  }
+
+  pending.events = append(pending.events, event)
+
+  if len(pending.events) >= coalesceMaxMessages {
+    pending.timer.Stop()
+    delete(ae.coalescing, key)
+    go ae.executeCoalesced(pending)
+  }
+  return true
+}
+
+// flushCoalesced runs buffered messages whose window has passed, unless they were already run
+func (ae *ActionExecutor) flushCoalesced(key string, pending *eventBatch) {
+  ae.coalesceMutex.Lock()
+  if ae.coalescing[key] != pending {
+    ae.coalesceMutex.Unlock()
+    return
+  }
+  delete(ae.coalescing, key)
+  ae.coalesceMutex.Unlock()
+
+  ae.executeCoalesced(pending)
+}
+
+// executeCoalesced runs the handler once for buffered messages: the event is the latest
+// message's, with text_content joined line by line and each message in a messages array.
+// A handler that also batches gets the combined event added to its batch.
+func (ae *ActionExecutor) executeCoalesced(pending *eventBatch) {
+  if len(pending.events) == 0 {
+    return
+  }
+
+  combined := make(map[string]interface{}, len(pending.events[0])+3)
+  for key, value := range pending.events[len(pending.events)-1] {
+    combined[key] = value
+  }
+
+  texts := make([]string, 0, len(pending.events))
+  messageIDs := make([]interface{}, 0, len(pending.events))
+  for _, event := range pending.events {
+    if text, _ := event["text_content"].(string); text != "" {
+      texts = append(texts, text)
+    }
+    messageIDs = append(messageIDs, event["message_id"])
+  }
+  combined["text_content"] = strings.Join(texts, "\n")
+  combined["messages"] = pending.events
+  combined["message_ids"] = messageIDs
+  combined["coalesced_count"] = len(pending.events)
+
+  if batch, _ := pending.handler["batch"].(bool); batch {
+    ae.addToBatch(pending.handler, combined)
+    return
+  }
+  ae.executeHandler(pending.handler, combined)
+}
+
+// addToBatch buffers an event for a batch-mode handler. The batch runs when it
+// reaches batch_max_size or when batch_window_seconds have passed since its first event.
+func (ae *ActionExecutor) addToBatch(handler map[string]interface{}, event map[string]interface{}) {
   handlerID := handler["handler_id"].(string)
+
+  window := 60 * time.Second // default
+  if w, ok := handler["batch_window_seconds"].(int64); ok && w > 0 {
+    window = time.Duration(w) * time.Second
+  }
+  maxSize := 10 // default
+  if m, ok := handler["batch_max_size"].(int64); ok && m > 0 {
+    maxSize = int(m)
+  }
+
+  ae.batchesMutex.Lock()
+  defer ae.batchesMutex.Unlock()
+
+  batch, exists := ae.batches[handlerID]
+  if !exists {
+    batch = &eventBatch{handler: handler}
+    batch.timer = time.AfterFunc(window, func() {
+      ae.flushBatch(handlerID, batch)
+    })
+    ae.batches[handlerID] = batch
+  }
+
+  batch.events = append(batch.events, event)
+
+  if len(batch.events) >= maxSize {
+    batch.timer.Stop()
+    delete(ae.batches, handlerID)
+    go ae.executeBatch(batch)
+  }
+}
+
+// flushBatch runs a batch whose window has elapsed, unless it was already run for being full
+func (ae *ActionExecutor) flushBatch(handlerID string, batch *eventBatch) {
+  ae.batchesMutex.Lock()
+  if ae.batches[handlerID] != batch {
+    ae.batchesMutex.Unlock()
+    return
+  }
+  delete(ae.batches, handlerID)
+  ae.batchesMutex.Unlock()
+
+  ae.executeBatch(batch)
+}
+
+// executeBatch runs a handler once with all buffered events in an events array
+func (ae *ActionExecutor) executeBatch(batch *eventBatch) {
+  if len(batch.events) == 0 {
+    return
+  }
+
+  last := batch.events[len(batch.events)-1]
+  batchEvent := map[string]interface{}{
+    "event_type": last["event_type"],
+    "message_id": last["message_id"],
+    "chat":       last["chat"],
+    "is_batch":   true,
+    "batch_size": len(batch.events),
+    "events":     batch.events,
+  }
+
+  ae.executeHandler(batch.handler, batchEvent)
+}
+
+// executeHandler runs one handler and reports whether it succeeded and returned halt (or
+// stop_propagation), asking that lower-priority handlers skip the event. This is honoured
+// in sequential mode only, where the execution log records which handler stopped the event.
+func (ae *ActionExecutor) executeHandler(handler map[string]interface{}, event map[string]interface{}) (halt bool) {
+  handlerID, _ := handler["handler_id"].(string)
   startTime := time.Now()
 
+  // A bug in one handler (bad result shape, substitution, ...) must not take down event
+  // processing, so a panic is recorded as a failed execution like any other error
+  defer func() {
+    if r := recover(); r != nil {
+      errorMsg := fmt.Sprintf("handler panicked: %v", r)
+      ae.errorState.LogError(ErrorSeverityError, "handler_execution", errorMsg, fmt.Sprintf("Handler: %s\n%s", handlerID, debug.Stack()))
+      ae.logExecutionError(handlerID, event, startTime, errorMsg)
+      ae.eventMatcher.UpdateCircuitBreaker(handlerID, false)
+      ae.database.UpdateHandlerStats(handlerID, false, errorMsg)
+    }
+  }()
+
   // Record execution start
   ae.eventMatcher.RecordExecution(handlerID, event)
+  executionID, ctx := ae.startExecution(handlerID, event)
+  defer ae.finishExecution(executionID)
 
   // Get timeout
   timeout := 30 // default
@@ -58,13 +445,13 @@ func (ae *ActionExecutor) executeHandler(handler map[string]interface{}, event m
   }
 
   // Prepare event data for handler
-  eventData := ae.prepareEventData(event)
+  eventData := ae.prepareEventData(handler, event)
 
   // Get action definition
   action, ok := handler["action"].(map[string]interface{})
   if !ok {
     ae.logExecutionError(handlerID, event, startTime, "Invalid action definition")
-    return
+    return false
   }
 
   // Execute based on action type
@@ -74,18 +461,24 @@ func (ae *ActionExecutor) executeHandler(handler map[string]interface{}, event m
 
   switch actionType {
   case "python":
-    result, err = ae.executePythonAction(action, eventData, timeout)
+    result, err = ae.executePythonAction(ctx, action, eventData, timeout)
   case "actions":
-    result, err = ae.executeDirectActions(action, eventData)
+    result, err = ae.executeDirectActions(ctx, action, eventData)
   default:
     err = fmt.Errorf("unknown action type: %s", actionType)
   }
 
   if err != nil {
     ae.logExecutionError(handlerID, event, startTime, err.Error())
-    ae.eventMatcher.UpdateCircuitBreaker(handlerID, false)
     ae.database.UpdateHandlerStats(handlerID, false, err.Error())
-    return
+    // A missing tool isn't the handler's fault, so flag it rather than trip its circuit breaker
+    if errors.Is(err, errToolNotRegistered) && global_config.GetMissingToolAttention() {
+      ae.errorState.LogError(ErrorSeverityWarning, "handler_execution", "Handler needs attention", fmt.Sprintf("Handler: %s: %v", handlerID, err))
+      ae.database.SetHandlerAttention(handlerID, err.Error())
+      return false
+    }
+    ae.eventMatcher.UpdateCircuitBreaker(handlerID, false)
+    return false
   }
 
   // Check if handler returned success
@@ -95,24 +488,39 @@ func (ae *ActionExecutor) executeHandler(handler map[string]interface{}, event m
     ae.logExecutionError(handlerID, event, startTime, errorMsg)
     ae.eventMatcher.UpdateCircuitBreaker(handlerID, false)
     ae.database.UpdateHandlerStats(handlerID, false, errorMsg)
-    return
+    return false
   }
 
   // Execute returned actions
   actionsExecuted := 0
   if actions, ok := result["actions"].([]interface{}); ok {
-    actionsExecuted = ae.executeReturnedActions(actions, eventData)
+    actionsExecuted = ae.executeReturnedActions(ctx, actions, eventData)
+  }
+  if ctx.Err() != nil {
+    errorMsg := "handler execution cancelled"
+    ae.logExecutionError(handlerID, event, startTime, errorMsg)
+    ae.database.UpdateHandlerStats(handlerID, false, errorMsg)
+    return false
+  }
+
+  halt, _ = result["halt"].(bool)
+  if stop, _ := result["stop_propagation"].(bool); stop {
+    halt = true
   }
+  stoppedPropagation := halt && global_config.GetHandlerExecutionMode() == HandlerExecutionSequential
 
   // Log success
   duration := time.Since(startTime).Milliseconds()
-  ae.logExecutionSuccess(handlerID, event, startTime, duration, actionsExecuted)
+  ae.logExecutionSuccess(handlerID, event, startTime, duration, actionsExecuted, stoppedPropagation)
   ae.eventMatcher.UpdateCircuitBreaker(handlerID, true)
   ae.database.UpdateHandlerStats(handlerID, true, "")
+  ae.database.SetHandlerAttention(handlerID, "")
+
+  return halt
 }
 
 // prepareEventData prepares event data for handler execution
-func (ae *ActionExecutor) prepareEventData(event map[string]interface{}) map[string]interface{} {
+func (ae *ActionExecutor) prepareEventData(handler map[string]interface{}, event map[string]interface{}) map[string]interface{} {
   eventData := make(map[string]interface{})
   
   // Copy all event fields
@@ -129,9 +537,98 @@ func (ae *ActionExecutor) prepareEventData(event map[string]interface{}) map[str
     }
   }
 
+  // What a reply (or reaction) refers to, so handlers needn't look it up themselves
+  if quotedID, _ := event["quoted_message_id"].(string); quotedID != "" {
+    if quoted := ae.quotedMessage(quotedID, event); quoted != nil {
+      eventData["quoted_message"] = quoted
+    }
+  }
+
+  // Recent messages from the same chat, for handlers that set include_context_messages
+  if count, ok := handler["include_context_messages"].(int64); ok && count > 0 {
+    if chat, _ := event["chat"].(string); chat != "" {
+      eventData["context_messages"] = ae.contextMessages(chat, event["message_id"], int(count))
+    }
+  }
+
   return eventData
 }
 
+// quotedMessage describes the message a reply quotes: from the database when it is stored,
+// otherwise from the copy WhatsApp embeds in the reply. Returns nil if neither is available.
+func (ae *ActionExecutor) quotedMessage(quotedID string, event map[string]interface{}) map[string]interface{} {
+  if stored, err := ae.database.GetMessage(quotedID); err == nil {
+    quoted := map[string]interface{}{
+      "message_id":   quotedID,
+      "from":         stored["from"],
+      "sender_name":  stored["sender_name"],
+      "timestamp":    stored["timestamp"],
+      "message_type": stored["message_type"],
+      "is_from_me":   stored["is_from_me"],
+      "text_content": stored["text_content"],
+    }
+    if mediaType, ok := stored["media_type"]; ok {
+      quoted["media_type"] = mediaType
+    }
+    if transcript, ok := stored["transcript"]; ok {
+      quoted["transcript"] = transcript
+    }
+    return quoted
+  }
+
+  raw, _ := event["raw_message"].(string)
+  var message waE2E.Message
+  if raw == "" || json.Unmarshal([]byte(raw), &message) != nil {
+    return nil
+  }
+  contextInfo := message.GetExtendedTextMessage().GetContextInfo()
+  if contextInfo.GetQuotedMessage() == nil {
+    return nil
+  }
+
+  embedded := contextInfo.GetQuotedMessage()
+  text := embedded.GetConversation()
+  if text == "" {
+    text = embedded.GetExtendedTextMessage().GetText()
+  }
+  return map[string]interface{}{
+    "message_id":   quotedID,
+    "from":         contextInfo.GetParticipant(),
+    "text_content": text,
+    "not_stored":   true,
+  }
+}
+
+// maxContextMessages caps include_context_messages
+const maxContextMessages = 50
+
+// contextMessages returns up to count messages from chat preceding the triggering message,
+// oldest first
+func (ae *ActionExecutor) contextMessages(chat string, triggerID interface{}, count int) []map[string]interface{} {
+  if count > maxContextMessages {
+    count = maxContextMessages
+  }
+
+  messages, err := ae.database.GetMessages(count+1, nil, &chat, nil)
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "handler_execution", "Failed to load context messages", err.Error())
+    return []map[string]interface{}{}
+  }
+
+  recent := make([]map[string]interface{}, 0, count)
+  for i := len(messages) - 1; i >= 0; i-- {
+    if messages[i]["message_id"] == triggerID {
+      continue
+    }
+    recent = append(recent, messages[i])
+  }
+  if len(recent) > count {
+    recent = recent[len(recent)-count:]
+  }
+
+  return recent
+}
+
 // downloadMedia downloads media from an event
 func (ae *ActionExecutor) downloadMedia(event map[string]interface{}) (string, error) {
   // Check if we have a message ID
@@ -162,8 +659,10 @@ func (ae *ActionExecutor) downloadMedia(event map[string]interface{}) (string, e
     ext = ".bin"
   }
   
-  filename := fmt.Sprintf("%s_%s%s", messageID, mediaType, ext)
-  filePath := filepath.Join(tempDir, filename)
+  filePath, err := mediaFilePath(tempDir, fmt.Sprintf("%s_%s", messageID, mediaType), ext)
+  if err != nil {
+    return "", err
+  }
 
   // Check if already downloaded
   if _, err := os.Stat(filePath); err == nil {
@@ -171,7 +670,7 @@ func (ae *ActionExecutor) downloadMedia(event map[string]interface{}) (string, e
   }
 
   // Use WhatsApp client to download
-  if global_whatsapp_client == nil || global_whatsapp_client.client == nil {
+  if global_whatsapp_client == nil || global_whatsapp_client.Client() == nil {
     return "", fmt.Errorf("WhatsApp client not available")
   }
 
@@ -187,14 +686,14 @@ func (ae *ActionExecutor) downloadMedia(event map[string]interface{}) (string, e
     if result != nil && result.Error != "" {
       errMsg = result.Error
     }
-    return "", fmt.Errorf(errMsg)
+    return "", fmt.Errorf("%s", errMsg)
   }
 
   return filePath, nil
 }
 
 // executePythonAction executes a Python action
-func (ae *ActionExecutor) executePythonAction(action map[string]interface{}, eventData map[string]interface{}, timeout int) (map[string]interface{}, error) {
+func (ae *ActionExecutor) executePythonAction(parent context.Context, action map[string]interface{}, eventData map[string]interface{}, timeout int) (map[string]interface{}, error) {
   code, ok := action["code"].(string)
   if !ok || code == "" {
     return nil, fmt.Errorf("missing Python code")
@@ -212,6 +711,18 @@ func (ae *ActionExecutor) executePythonAction(action map[string]interface{}, eve
     }
   }
 
+  // Keep the generated source small: large fields go by file, raw_message is cut short
+  includeRaw, _ := action["include_raw_message"].(bool)
+  eventJSON, fieldFiles, err := handlerEventJSON(eventData, includeRaw)
+  defer func() {
+    for _, path := range fieldFiles {
+      os.Remove(path)
+    }
+  }()
+  if err != nil {
+    return nil, err
+  }
+
   // Build Python code with event data
   pythonCode := fmt.Sprintf(`
 import json
@@ -220,15 +731,21 @@ import sys
 # Event data
 event = %s
 
+# Fields too large to inline were written to files
+for _field, _path in event.pop('_field_files', {}).items():
+    with open(_path, encoding='utf-8') as _f:
+        event[_field] = json.load(_f)
+
 # User code
 %s
-`, toJSON(eventData), code)
+`, eventJSON, code)
 
-  // Call Python MCP tool
+  // Call Python MCP tool, passing the handler timeout so the tool can stop the script too
   pythonInput := map[string]interface{}{
     "input": map[string]interface{}{
       "operation":         "execute",
       "code":              pythonCode,
+      "timeout":           timeout,
       "tool_unlock_token": "d2e9e014",
     },
   }
@@ -237,8 +754,25 @@ event = %s
     return nil, fmt.Errorf("MCP connection not available")
   }
 
-  rawResult, err := callMCPTool(global_sse_connection, "python", pythonInput)
+  ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Second)
+  defer cancel()
+
+  // Fail fast rather than wait out the timeout when there is no python tool to answer
+  if registered, known := global_mcp_tools.has(ctx, global_sse_connection, "python"); known && !registered {
+    return nil, fmt.Errorf("python %w", errToolNotRegistered)
+  }
+
+  rawResult, err := callMCPToolContext(ctx, global_sse_connection, "python", pythonInput)
   if err != nil {
+    if errors.Is(err, errToolNotRegistered) {
+      return nil, fmt.Errorf("python %w", errToolNotRegistered)
+    }
+    if parent.Err() != nil {
+      return nil, fmt.Errorf("handler execution cancelled")
+    }
+    if ctx.Err() == context.DeadlineExceeded {
+      return nil, fmt.Errorf("handler timed out after %ds", timeout)
+    }
     return nil, fmt.Errorf("Python tool call failed: %w", err)
   }
 
@@ -271,25 +805,38 @@ event = %s
 }
 
 // executeDirectActions executes direct actions (no Python)
-func (ae *ActionExecutor) executeDirectActions(action map[string]interface{}, eventData map[string]interface{}) (map[string]interface{}, error) {
+func (ae *ActionExecutor) executeDirectActions(ctx context.Context, action map[string]interface{}, eventData map[string]interface{}) (map[string]interface{}, error) {
   actions, ok := action["actions"].([]interface{})
   if !ok {
     return nil, fmt.Errorf("missing actions array")
   }
 
-  executed := ae.executeReturnedActions(actions, eventData)
+  executed := ae.executeReturnedActions(ctx, actions, eventData)
+  halt, _ := action["halt"].(bool)
+  stop, _ := action["stop_propagation"].(bool)
 
   return map[string]interface{}{
     "success":          true,
     "actions_executed": executed,
+    "halt":             halt || stop,
   }, nil
 }
 
-// executeReturnedActions executes the actions returned by a handler
-func (ae *ActionExecutor) executeReturnedActions(actions []interface{}, eventData map[string]interface{}) int {
+// executeReturnedActions executes the actions returned by a handler, stopping early if ctx
+// is cancelled
+func (ae *ActionExecutor) executeReturnedActions(ctx context.Context, actions []interface{}, eventData map[string]interface{}) int {
   executed := 0
 
+  if global_config.GetPresenceOnSend() && containsSendAction(actions) {
+    if restore := ae.ensureAvailable(); restore != nil {
+      defer restore()
+    }
+  }
+
   for _, action := range actions {
+    if ctx.Err() != nil {
+      break
+    }
     actionMap, ok := action.(map[string]interface{})
     if !ok {
       continue
@@ -299,55 +846,218 @@ func (ae *ActionExecutor) executeReturnedActions(actions []interface{}, eventDat
     actionMap = ae.substituteVariables(actionMap, eventData)
 
     actionType, _ := actionMap["type"].(string)
-    
-    switch actionType {
-    case "send_message":
-      if ae.executeSendMessage(actionMap) {
-        executed++
-      }
-    case "send_reaction":
-      if ae.executeSendReaction(actionMap) {
-        executed++
-      }
-    case "mark_read":
-      if ae.executeMarkRead(actionMap) {
-        executed++
-      }
-    case "send_presence":
-      if ae.executeSendPresence(actionMap) {
-        executed++
-      }
-    case "send_chat_presence":
-      if ae.executeSendChatPresence(actionMap) {
-        executed++
-      }
-    case "delay":
-      if ae.executeDelay(actionMap) {
-        executed++
-      }
-    case "call_method":
-      if ae.executeCallMethod(actionMap) {
-        executed++
-      }
+    if definition := lookupAction(actionType); definition != nil {
+      executed += definition.run(ctx, ae, actionMap, eventData)
     }
   }
 
   return executed
 }
 
-// substituteVariables replaces variables in action with event data
+// recordDeadLetter logs a failed send action and, unless dead_letter_actions is off, stores it
+// with its triggering event for get_dead_letters and retry_dead_letter
+func (ae *ActionExecutor) recordDeadLetter(ctx context.Context, action map[string]interface{}, eventData map[string]interface{}, err error) {
+  actionType, _ := action["type"].(string)
+  handlerID, _ := ctx.Value(handlerIDKey{}).(string)
+  ae.errorState.LogError(ErrorSeverityWarning, "handler_action", fmt.Sprintf("%s action failed", actionType), fmt.Sprintf("Handler: %s: %v", handlerID, err))
+  if !global_config.GetDeadLetterActions() {
+    return
+  }
+
+  event := make(map[string]interface{}, len(eventData))
+  for key, value := range eventData {
+    if !slices.Contains(deadLetterOmittedFields, key) {
+      event[key] = value
+    }
+  }
+  if _, dbErr := ae.database.SaveDeadLetter(handlerID, actionType, action, event, err.Error()); dbErr != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "handler_action", "Failed to save dead letter", dbErr.Error())
+  }
+}
+
+// Typing speed used by humanize_sends
+const (
+  humanizeDelayPerChar = 50 * time.Millisecond
+  humanizeMinDelay     = 500 * time.Millisecond
+)
+
+// humanizeSend shows "typing..." in the recipient's chat and waits roughly as long as typing
+// the message would take (capped and jittered by +/-20%), when humanize_sends is enabled
+func (ae *ActionExecutor) humanizeSend(action map[string]interface{}) {
+  enabled, maxDelay := global_config.GetHumanizeSends()
+  if !enabled || global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return
+  }
+
+  to, _ := action["to"].(string)
+  message, _ := action["message"].(map[string]interface{})
+  if to == "" || message == nil {
+    return
+  }
+
+  delay := time.Duration(len([]rune(messageText(message)))) * humanizeDelayPerChar
+  if delay < humanizeMinDelay {
+    delay = humanizeMinDelay
+  }
+  if delay > maxDelay {
+    delay = maxDelay
+  }
+  delay = time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+
+  CallWhatsmeowMethod("SendChatPresence", map[string]interface{}{
+    "jid":   to,
+    "state": "composing",
+  })
+  time.Sleep(delay)
+}
+
+// messageText returns the text or caption of a message map, or "" if it has none
+func messageText(message map[string]interface{}) string {
+  if conversation, ok := message["conversation"].(string); ok {
+    return conversation
+  }
+  if ext, ok := message["extendedTextMessage"].(map[string]interface{}); ok {
+    text, _ := ext["text"].(string)
+    return text
+  }
+  for _, field := range contextInfoFields {
+    if content, ok := message[field].(map[string]interface{}); ok {
+      caption, _ := content["caption"].(string)
+      return caption
+    }
+  }
+  return ""
+}
+
+// containsSendAction reports whether any returned action sends a message
+func containsSendAction(actions []interface{}) bool {
+  for _, action := range actions {
+    if actionMap, ok := action.(map[string]interface{}); ok {
+      if actionType, _ := actionMap["type"].(string); sendActionTypes[actionType] {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// ensureAvailable marks us available if we aren't already, so delivery receipts
+// come back for the messages we send. It returns a func that restores the prior
+// presence, or nil if nothing was changed.
+func (ae *ActionExecutor) ensureAvailable() func() {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return nil
+  }
+
+  ae.presenceMutex.Lock()
+  prior := ae.presence
+  ae.presenceMutex.Unlock()
+  if prior == "available" {
+    return nil
+  }
+
+  if !ae.setPresence("available") {
+    return nil
+  }
+
+  return func() {
+    if prior == "" {
+      prior = "unavailable"
+    }
+    ae.setPresence(prior)
+  }
+}
+
+// setPresence sends our presence and remembers it on success
+func (ae *ActionExecutor) setPresence(state string) bool {
+  result := CallWhatsmeowMethod("SendPresence", map[string]interface{}{
+    "state": state,
+  })
+  if result == nil || !result.Success {
+    return false
+  }
+
+  ae.presenceMutex.Lock()
+  ae.presence = state
+  ae.presenceMutex.Unlock()
+  return true
+}
+
+// typingTracker remembers chats we've sent a composing presence to, and sends paused if
+// nothing (a send or another presence) follows within composing_timeout, so a handler that
+// fails mid-way can't leave the recipient looking at a permanent "typing..."
+type typingTracker struct {
+  mu     sync.Mutex
+  timers map[string]*time.Timer
+}
+
+// global_typing_tracker tracks composing presences from actions and call_whatsmeow alike
+var global_typing_tracker = &typingTracker{timers: make(map[string]*time.Timer)}
+
+// composing (re)starts the auto-clear timer for a chat
+func (tt *typingTracker) composing(chat types.JID) {
+  timeout := global_config.GetComposingTimeout()
+  if timeout <= 0 || chat.IsEmpty() {
+    return
+  }
+
+  key := chat.String()
+  tt.mu.Lock()
+  defer tt.mu.Unlock()
+
+  if timer, ok := tt.timers[key]; ok {
+    timer.Stop()
+  }
+  var timer *time.Timer
+  timer = time.AfterFunc(timeout, func() {
+    tt.mu.Lock()
+    if tt.timers[key] != timer {
+      tt.mu.Unlock()
+      return
+    }
+    delete(tt.timers, key)
+    tt.mu.Unlock()
+
+    if global_whatsapp_client != nil && global_whatsapp_client.IsConnected() {
+      if err := global_whatsapp_client.Client().SendChatPresence(context.Background(), chat, types.ChatPresencePaused, ""); err != nil {
+        global_error_state.LogError(ErrorSeverityWarning, "chat_presence", "Failed to clear stale typing indicator", err.Error())
+      }
+    }
+  })
+  tt.timers[key] = timer
+}
+
+// clear forgets a chat's composing state once something else has replaced it
+func (tt *typingTracker) clear(chat types.JID) {
+  key := chat.String()
+  tt.mu.Lock()
+  defer tt.mu.Unlock()
+
+  if timer, ok := tt.timers[key]; ok {
+    timer.Stop()
+    delete(tt.timers, key)
+  }
+}
+
+// substituteVariables replaces variables in action with event data. Placeholders inside
+// longer strings are only filled for actions that set inline_placeholders, so text that
+// happens to contain "{event.x}" is otherwise sent as written.
 func (ae *ActionExecutor) substituteVariables(action map[string]interface{}, eventData map[string]interface{}) map[string]interface{} {
   result := make(map[string]interface{})
+  inline, _ := action["inline_placeholders"].(bool)
 
   for key, value := range action {
-    result[key] = ae.substituteValue(value, eventData)
+    result[key] = ae.substituteValue(value, eventData, inline)
   }
 
   return result
 }
 
+// eventPlaceholder matches an {event.field} placeholder inside a longer string
+var eventPlaceholder = regexp.MustCompile(`\{event\.([a-zA-Z0-9_]+)\}`)
+
 // substituteValue recursively substitutes variables in a value
-func (ae *ActionExecutor) substituteValue(value interface{}, eventData map[string]interface{}) interface{} {
+func (ae *ActionExecutor) substituteValue(value interface{}, eventData map[string]interface{}, inline bool) interface{} {
   switch v := value.(type) {
   case string:
     // Replace {event.field} with actual values
@@ -357,17 +1067,27 @@ func (ae *ActionExecutor) substituteValue(value interface{}, eventData map[strin
         return fieldValue
       }
     }
-    return v
+    if !inline {
+      return v
+    }
+    // Placeholders inside text are replaced with the field formatted as text
+    return eventPlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+      fieldValue, ok := eventData[placeholder[7:len(placeholder)-1]]
+      if !ok || fieldValue == nil {
+        return placeholder
+      }
+      return fmt.Sprint(fieldValue)
+    })
   case map[string]interface{}:
     result := make(map[string]interface{})
     for k, val := range v {
-      result[k] = ae.substituteValue(val, eventData)
+      result[k] = ae.substituteValue(val, eventData, inline)
     }
     return result
   case []interface{}:
     result := make([]interface{}, len(v))
     for i, val := range v {
-      result[i] = ae.substituteValue(val, eventData)
+      result[i] = ae.substituteValue(val, eventData, inline)
     }
     return result
   default:
@@ -377,24 +1097,553 @@ func (ae *ActionExecutor) substituteValue(value interface{}, eventData map[strin
 
 // Action execution methods
 
-func (ae *ActionExecutor) executeSendMessage(action map[string]interface{}) bool {
+func (ae *ActionExecutor) executeSendMessage(action map[string]interface{}) error {
   to, ok := action["to"].(string)
   if !ok {
-    return false
+    return fmt.Errorf("to required")
   }
 
   message, ok := action["message"].(map[string]interface{})
   if !ok {
-    return false
+    name, _ := action["template"].(string)
+    if name == "" {
+      return fmt.Errorf("message or template required")
+    }
+    rendered, err := renderActionTemplate(name, action["values"])
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_message", "Failed to render template", err.Error())
+      return err
+    }
+    message = rendered
   }
 
-  params := map[string]interface{}{
-    "to":      to,
-    "message": message,
+  if mentions, ok := action["mentions"].([]interface{}); ok && len(mentions) > 0 {
+    appendMentions, _ := action["append_mentions"].(bool)
+    message, ok = applyMentions(message, mentions, appendMentions)
+    if !ok {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_message", "Mentions require a text or media message", "")
+      return fmt.Errorf("mentions require a text or media message")
+    }
   }
 
-  result := CallWhatsmeowMethod("SendMessage", params)
-  return result != nil && result.Success
+  // Reply to a stored message, quoting it inline
+  if quotedID, ok := action["quoted_message_id"].(string); ok && quotedID != "" {
+    quotedMessage, err := applyQuote(message, quotedID)
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_message", "Failed to quote message", err.Error())
+      return fmt.Errorf("failed to quote message: %w", err)
+    }
+    message = quotedMessage
+  }
+
+  return ae.sendOnce("send_message", to, message, func() error {
+    // Queue the send if we're offline so it can be delivered on reconnect
+    if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+      return ae.enqueueSendMessage(to, message)
+    }
+
+    params := map[string]interface{}{
+      "to":      to,
+      "message": message,
+    }
+
+    result := CallWhatsmeowMethod("SendMessage", params)
+    if result == nil {
+      return fmt.Errorf("SendMessage returned no result")
+    }
+    if !result.Success {
+      return fmt.Errorf("%s", result.Error)
+    }
+    return nil
+  })
+}
+
+// renderActionTemplate renders a saved or registry message template for a send_message action
+func renderActionTemplate(name string, rawValues interface{}) (map[string]interface{}, error) {
+  template, _, ok := lookupMessageTemplate(name)
+  if !ok {
+    return nil, fmt.Errorf("unknown template '%s'", name)
+  }
+  values, _ := rawValues.(map[string]interface{})
+  message, missing, err := renderMessageTemplate(template, values)
+  if len(missing) > 0 {
+    return nil, fmt.Errorf("missing values for template '%s': %s", name, strings.Join(missing, ", "))
+  }
+  if err != nil {
+    return nil, fmt.Errorf("template '%s' %w", name, err)
+  }
+  return message, nil
+}
+
+// contextInfoFields are the message types that can carry a ContextInfo
+var contextInfoFields = []string{"extendedTextMessage", "imageMessage", "videoMessage", "documentMessage", "audioMessage", "stickerMessage"}
+
+// withContextInfo copies a message so its ContextInfo can be edited, returning the copy, the
+// content map holding the ContextInfo and the ContextInfo itself. A plain conversation is
+// upgraded to an extendedTextMessage, since conversations can't carry a ContextInfo.
+func withContextInfo(message map[string]interface{}) (map[string]interface{}, map[string]interface{}, map[string]interface{}, bool) {
+  result := make(map[string]interface{}, len(message))
+  for k, v := range message {
+    result[k] = v
+  }
+
+  field := ""
+  var content map[string]interface{}
+  if conversation, ok := message["conversation"].(string); ok {
+    delete(result, "conversation")
+    field = "extendedTextMessage"
+    content = map[string]interface{}{"text": conversation}
+  } else {
+    for _, f := range contextInfoFields {
+      if existing, ok := message[f].(map[string]interface{}); ok {
+        field = f
+        content = make(map[string]interface{}, len(existing))
+        for k, v := range existing {
+          content[k] = v
+        }
+        break
+      }
+    }
+  }
+  if field == "" {
+    return nil, nil, nil, false
+  }
+
+  contextInfo := map[string]interface{}{}
+  if existing, ok := content["contextInfo"].(map[string]interface{}); ok {
+    for k, v := range existing {
+      contextInfo[k] = v
+    }
+  }
+  content["contextInfo"] = contextInfo
+  result[field] = content
+  return result, content, contextInfo, true
+}
+
+// applyMentions @-tags the given JIDs in a message's text or caption via ContextInfo.mentionedJID.
+// With appendPlaceholders, an "@number" is added for each mention the text doesn't already
+// contain, since WhatsApp only highlights mentions that appear in the text.
+func applyMentions(message map[string]interface{}, mentions []interface{}, appendPlaceholders bool) (map[string]interface{}, bool) {
+  result, content, contextInfo, ok := withContextInfo(message)
+  if !ok {
+    return nil, false
+  }
+
+  textKey := "caption"
+  if _, isText := result["extendedTextMessage"]; isText {
+    textKey = "text"
+  }
+  text, _ := content[textKey].(string)
+  mentioned, _ := contextInfo["mentionedJID"].([]interface{})
+
+  for _, m := range mentions {
+    jidStr, _ := m.(string)
+    jid, err := parseJID(jidStr)
+    if err != nil {
+      continue
+    }
+
+    mentioned = append(mentioned, jid.String())
+    if placeholder := "@" + jid.User; appendPlaceholders && !strings.Contains(text, placeholder) {
+      text = strings.TrimSpace(text + " " + placeholder)
+    }
+  }
+
+  contextInfo["mentionedJID"] = mentioned
+  if text != "" {
+    content[textKey] = text
+  }
+  return result, true
+}
+
+// applyQuote makes a message a reply to a stored message. Media messages are quoted with
+// their metadata and thumbnail, rebuilt from the stored raw message, so the reply shows them
+// inline; if that fails the quote falls back to the stored text.
+func applyQuote(message map[string]interface{}, quotedID string) (map[string]interface{}, error) {
+  _, stored, err := global_database.GetRawMessage(quotedID)
+  if err != nil {
+    return nil, fmt.Errorf("quoted message %s not found: %w", quotedID, err)
+  }
+
+  var storedMsg map[string]interface{}
+  if err := json.Unmarshal([]byte(stored), &storedMsg); err != nil {
+    return nil, fmt.Errorf("failed to parse stored message %s: %w", quotedID, err)
+  }
+
+  result, _, contextInfo, ok := withContextInfo(message)
+  if !ok {
+    return nil, fmt.Errorf("message type can't quote another message")
+  }
+
+  contextInfo["stanzaID"] = quotedID
+  if from, _ := storedMsg["from"].(string); from != "" {
+    contextInfo["participant"] = from
+  }
+
+  quoted, err := quotedMessageFromRaw(storedMsg)
+  if err != nil {
+    text, _ := storedMsg["text_content"].(string)
+    quoted = map[string]interface{}{"conversation": text}
+  }
+  contextInfo["quotedMessage"] = quoted
+
+  return result, nil
+}
+
+// quotedMessageFromRaw rebuilds the protobuf of a stored message for use as a QuotedMessage,
+// dropping its own ContextInfo so quotes don't nest, and returns it in protojson form
+func quotedMessageFromRaw(storedMsg map[string]interface{}) (map[string]interface{}, error) {
+  raw, _ := storedMsg["raw_message"].(string)
+  if raw == "" {
+    return nil, fmt.Errorf("no raw message stored")
+  }
+
+  var quoted waE2E.Message
+  if err := json.Unmarshal([]byte(raw), &quoted); err != nil {
+    return nil, err
+  }
+
+  switch {
+  case quoted.ImageMessage != nil:
+    quoted.ImageMessage.ContextInfo = nil
+  case quoted.VideoMessage != nil:
+    quoted.VideoMessage.ContextInfo = nil
+  case quoted.DocumentMessage != nil:
+    quoted.DocumentMessage.ContextInfo = nil
+  case quoted.AudioMessage != nil:
+    quoted.AudioMessage.ContextInfo = nil
+  case quoted.StickerMessage != nil:
+    quoted.StickerMessage.ContextInfo = nil
+  case quoted.ExtendedTextMessage != nil:
+    quoted.ExtendedTextMessage.ContextInfo = nil
+  case quoted.Conversation != nil:
+  default:
+    return nil, fmt.Errorf("unsupported quoted message type")
+  }
+
+  quotedJSON, err := protojson.Marshal(&quoted)
+  if err != nil {
+    return nil, err
+  }
+
+  var result map[string]interface{}
+  if err := json.Unmarshal(quotedJSON, &result); err != nil {
+    return nil, err
+  }
+  return result, nil
+}
+
+// enqueueSendMessage stores a send request in the outbound queue
+func (ae *ActionExecutor) enqueueSendMessage(to string, message map[string]interface{}) error {
+  id, err := ae.database.EnqueueOutbound(to, message, global_config.GetOutboundQueueTTL())
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "outbound_queue", "Failed to queue message while disconnected", err.Error())
+    return fmt.Errorf("failed to queue message while disconnected: %w", err)
+  }
+
+  ae.errorState.LogError(ErrorSeverityInfo, "outbound_queue",
+    fmt.Sprintf("Queued message #%d to %s until reconnect", id, to), "")
+  return nil
+}
+
+// FlushOutboundQueue delivers queued send requests in order after reconnecting
+func (ae *ActionExecutor) FlushOutboundQueue() {
+  ae.flushMutex.Lock()
+  defer ae.flushMutex.Unlock()
+
+  if expired, err := ae.database.ExpireOutbound(); err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "outbound_queue", "Failed to expire queued messages", err.Error())
+  } else if expired > 0 {
+    ae.errorState.LogError(ErrorSeverityWarning, "outbound_queue",
+      fmt.Sprintf("Dropped %d queued message(s) past their TTL", expired), "")
+  }
+
+  pending, err := ae.database.GetPendingOutbound()
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "outbound_queue", "Failed to read outbound queue", err.Error())
+    return
+  }
+
+  sent := 0
+  for _, item := range pending {
+    // Stop if the connection dropped again; remaining items stay queued in order
+    if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+      break
+    }
+
+    id := item["id"].(int64)
+    params := map[string]interface{}{
+      "to":      item["to"],
+      "message": item["message"],
+    }
+
+    result := CallWhatsmeowMethod("SendMessage", params)
+    if result == nil || !result.Success {
+      errMsg := "failed to send queued message"
+      if result != nil && result.Error != "" {
+        errMsg = result.Error
+      }
+      ae.database.MarkOutboundAttempt(id, errMsg)
+      ae.errorState.LogError(ErrorSeverityWarning, "outbound_queue",
+        fmt.Sprintf("Failed to deliver queued message #%d", id), errMsg)
+      break
+    }
+
+    ae.database.DeleteOutbound(id)
+    sent++
+  }
+
+  if sent > 0 {
+    ae.errorState.LogError(ErrorSeverityInfo, "outbound_queue",
+      fmt.Sprintf("Delivered %d queued message(s)", sent), "")
+  }
+}
+
+// executeSendVoice uploads an OGG/Opus file and sends it as a voice note (PTT)
+func (ae *ActionExecutor) executeSendVoice(action map[string]interface{}) error {
+  to, ok := action["to"].(string)
+  if !ok {
+    return fmt.Errorf("to required")
+  }
+
+  path, ok := action["path"].(string)
+  if !ok || path == "" {
+    return fmt.Errorf("path required")
+  }
+
+  return ae.sendOnce("send_voice", to, action, func() error {
+    message, err := buildVoiceMessage(context.Background(), path)
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_voice", "Failed to prepare voice note", err.Error())
+      return fmt.Errorf("failed to prepare voice note: %w", err)
+    }
+    return ae.sendBuiltMessage("send_voice", to, message)
+  })
+}
+
+// executeSendMedia uploads an image, video or document and sends it, optionally as view-once
+func (ae *ActionExecutor) executeSendMedia(action map[string]interface{}) error {
+  to, ok := action["to"].(string)
+  if !ok {
+    return fmt.Errorf("to required")
+  }
+
+  path, ok := action["path"].(string)
+  if !ok || path == "" {
+    return fmt.Errorf("path required")
+  }
+
+  mediaType, _ := action["media_type"].(string)
+  caption, _ := action["caption"].(string)
+  mimetype, _ := action["mimetype"].(string)
+  viewOnce, _ := action["view_once"].(bool)
+
+  return ae.sendOnce("send_media", to, action, func() error {
+    message, err := buildMediaMessage(context.Background(), path, mediaType, caption, mimetype, viewOnce)
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_media", "Failed to prepare media", err.Error())
+      return fmt.Errorf("failed to prepare media: %w", err)
+    }
+    return ae.sendBuiltMessage("send_media", to, message)
+  })
+}
+
+// executeSendSticker uploads a 512x512 WebP file and sends it as a sticker
+func (ae *ActionExecutor) executeSendSticker(action map[string]interface{}) error {
+  to, ok := action["to"].(string)
+  if !ok {
+    return fmt.Errorf("to required")
+  }
+
+  path, ok := action["path"].(string)
+  if !ok || path == "" {
+    return fmt.Errorf("path required")
+  }
+
+  return ae.sendOnce("send_sticker", to, action, func() error {
+    message, err := buildStickerMessage(context.Background(), path)
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_sticker", "Failed to prepare sticker", err.Error())
+      return fmt.Errorf("failed to prepare sticker: %w", err)
+    }
+    return ae.sendBuiltMessage("send_sticker", to, message)
+  })
+}
+
+// sendDedupKey hashes a send's operation, recipient and content for outbound dedup
+func sendDedupKey(operation string, to string, content interface{}) (string, bool) {
+  encoded, err := json.Marshal(content)
+  if err != nil {
+    return "", false
+  }
+  sum := sha256.Sum256(append([]byte(operation+"\x00"+to+"\x00"), encoded...))
+  return hex.EncodeToString(sum[:]), true
+}
+
+func (ae *ActionExecutor) executeSendLink(action map[string]interface{}) error {
+  to, ok := action["to"].(string)
+  if !ok {
+    return fmt.Errorf("to required")
+  }
+
+  url, _ := action["url"].(string)
+  text, _ := action["text"].(string)
+  title, _ := action["title"].(string)
+  description, _ := action["description"].(string)
+  imageURL, _ := action["image_url"].(string)
+  imageBase64, _ := action["image_base64"].(string)
+
+  return ae.sendOnce("send_link", to, action, func() error {
+    message, err := buildLinkMessage(context.Background(), text, url, title, description, imageURL, imageBase64)
+    if err != nil {
+      ae.errorState.LogError(ErrorSeverityWarning, "send_link", "Failed to prepare link preview", err.Error())
+      return fmt.Errorf("failed to prepare link preview: %w", err)
+    }
+    return ae.sendBuiltMessage("send_link", to, message)
+  })
+}
+
+// sendOnce runs send unless the same content was sent to the same recipient within
+// outbound_dedup_window, logging the suppression. It protects the account from a runaway
+// handler repeatedly sending the same thing. The content is claimed before sending, so
+// concurrent handlers can't both send it, and released if the send fails so it can be
+// retried straight away.
+func (ae *ActionExecutor) sendOnce(operation string, to string, content interface{}, send func() error) error {
+  window := global_config.GetOutboundDedupWindow()
+  if window <= 0 {
+    return send()
+  }
+  key, ok := sendDedupKey(operation, to, content)
+  if !ok {
+    return send()
+  }
+
+  ae.recentMutex.Lock()
+  now := time.Now()
+  for k, sentAt := range ae.recentSends {
+    if now.Sub(sentAt) >= window {
+      delete(ae.recentSends, k)
+    }
+  }
+  if _, ok := ae.recentSends[key]; ok {
+    ae.recentMutex.Unlock()
+    ae.errorState.LogError(ErrorSeverityWarning, operation, "Suppressed duplicate send within outbound_dedup_window", to)
+    return errDuplicateSend
+  }
+  ae.recentSends[key] = now
+  ae.recentMutex.Unlock()
+
+  err := send()
+  if err != nil {
+    ae.recentMutex.Lock()
+    if ae.recentSends[key].Equal(now) {
+      delete(ae.recentSends, key)
+    }
+    ae.recentMutex.Unlock()
+  }
+  return err
+}
+
+// sendBuiltMessage sends an already-constructed protobuf message
+func (ae *ActionExecutor) sendBuiltMessage(operation string, to string, message *waE2E.Message) error {
+  jid, err := parseJID(to)
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, operation, "Invalid recipient", err.Error())
+    return fmt.Errorf("invalid recipient: %w", err)
+  }
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return fmt.Errorf("WhatsApp client not connected")
+  }
+
+  // Choose the ID up front so the message can be stored as pending before it is sent
+  id := global_whatsapp_client.Client().GenerateMessageID()
+  global_whatsapp_client.storePendingMessage(jid, message, id)
+
+  resp, err := global_whatsapp_client.Client().SendMessage(context.Background(), jid, message, whatsmeow.SendRequestExtra{ID: id})
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, operation, "Failed to send message", err.Error())
+    global_whatsapp_client.advanceMessageStatus([]string{id}, MessageStatusFailed)
+    return fmt.Errorf("failed to send message: %w", err)
+  }
+  global_typing_tracker.clear(jid)
+  global_whatsapp_client.storeSentMessage(jid, message, resp)
+
+  return nil
+}
+
+// executeWelcome greets each member who joined in a group_update event.
+// The template may use {member.name}, {member.mention}, {member.jid}, {group.name} and {group.jid}.
+func (ae *ActionExecutor) executeWelcome(action map[string]interface{}, eventData map[string]interface{}) int {
+  if groupAction, _ := eventData["action"].(string); groupAction != "join" {
+    return 0
+  }
+
+  groupJIDStr, _ := eventData["chat"].(string)
+  groupJID, err := parseJID(groupJIDStr)
+  if err != nil {
+    ae.errorState.LogError(ErrorSeverityWarning, "welcome", "Invalid group", err.Error())
+    return 0
+  }
+
+  template, _ := action["template"].(string)
+  if template == "" {
+    template = "Welcome to {group.name}, {member.mention}!"
+  }
+
+  to, _ := action["to"].(string)
+  if to == "" {
+    to = groupJIDStr
+  }
+
+  groupName := groupJID.User
+  if global_whatsapp_client != nil {
+    if info, err := global_whatsapp_client.Client().GetGroupInfo(context.Background(), groupJID); err == nil && info.Name != "" {
+      groupName = info.Name
+    }
+  }
+
+  participants, _ := eventData["participants"].([]string)
+  sent := 0
+  for _, participant := range participants {
+    memberJID, err := parseJID(participant)
+    if err != nil {
+      continue
+    }
+
+    memberName := memberJID.User
+    if global_whatsapp_client != nil {
+      if contact, err := global_whatsapp_client.Client().Store.Contacts.GetContact(context.Background(), memberJID); err == nil && contact.Found {
+        if contact.FullName != "" {
+          memberName = contact.FullName
+        } else if contact.PushName != "" {
+          memberName = contact.PushName
+        }
+      }
+    }
+
+    text := strings.NewReplacer(
+      "{member.name}", memberName,
+      "{member.mention}", "@"+memberJID.User,
+      "{member.jid}", memberJID.String(),
+      "{group.name}", groupName,
+      "{group.jid}", groupJID.String(),
+    ).Replace(template)
+
+    message := map[string]interface{}{
+      "extendedTextMessage": map[string]interface{}{
+        "text": text,
+        "contextInfo": map[string]interface{}{
+          "mentionedJID": []interface{}{memberJID.String()},
+        },
+      },
+    }
+
+    if ae.executeSendMessage(map[string]interface{}{"to": to, "message": message}) == nil {
+      sent++
+    }
+  }
+
+  return sent
 }
 
 func (ae *ActionExecutor) executeSendReaction(action map[string]interface{}) bool {
@@ -427,12 +1676,7 @@ func (ae *ActionExecutor) executeSendPresence(action map[string]interface{}) boo
     return false
   }
 
-  params := map[string]interface{}{
-    "state": state,
-  }
-
-  result := CallWhatsmeowMethod("SendPresence", params)
-  return result != nil && result.Success
+  return ae.setPresence(state)
 }
 
 func (ae *ActionExecutor) executeSendChatPresence(action map[string]interface{}) bool {
@@ -459,14 +1703,20 @@ func (ae *ActionExecutor) executeSendChatPresence(action map[string]interface{})
   return result != nil && result.Success
 }
 
-func (ae *ActionExecutor) executeDelay(action map[string]interface{}) bool {
+func (ae *ActionExecutor) executeDelay(ctx context.Context, action map[string]interface{}) bool {
   seconds, ok := action["seconds"].(float64)
   if !ok {
     return false
   }
 
-  time.Sleep(time.Duration(seconds * float64(time.Second)))
-  return true
+  timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+  defer timer.Stop()
+  select {
+  case <-timer.C:
+    return true
+  case <-ctx.Done():
+    return false
+  }
 }
 
 func (ae *ActionExecutor) executeCallMethod(action map[string]interface{}) bool {
@@ -475,6 +1725,11 @@ func (ae *ActionExecutor) executeCallMethod(action map[string]interface{}) bool
     return false
   }
 
+  if !global_config.IsActionMethodAllowed(method) {
+    ae.errorState.LogError(ErrorSeverityWarning, "call_method", "Method not in action_method_allowlist", method)
+    return false
+  }
+
   params, ok := action["params"].(map[string]interface{})
   if !ok {
     params = make(map[string]interface{})
@@ -486,7 +1741,7 @@ func (ae *ActionExecutor) executeCallMethod(action map[string]interface{}) bool
 
 // Logging methods
 
-func (ae *ActionExecutor) logExecutionSuccess(handlerID string, event map[string]interface{}, startTime time.Time, durationMs int64, actionsExecuted int) {
+func (ae *ActionExecutor) logExecutionSuccess(handlerID string, event map[string]interface{}, startTime time.Time, durationMs int64, actionsExecuted int, stoppedPropagation bool) {
   eventID, _ := event["message_id"].(string)
   eventType, _ := event["event_type"].(string)
   fromJID, _ := event["from"].(string)
@@ -495,12 +1750,13 @@ func (ae *ActionExecutor) logExecutionSuccess(handlerID string, event map[string
     "handler_id":       handlerID,
     "event_id":         eventID,
     "event_type":       eventType,
-    "from_jid":         fromJID,
+    "from_jid":         sanitizeJID(fromJID),
     "started_at":       startTime,
     "completed_at":     time.Now(),
     "duration_ms":      durationMs,
     "success":          true,
     "actions_executed": actionsExecuted,
+    "stopped_propagation": stoppedPropagation,
   }
 
   ae.database.LogHandlerExecution(execution)
@@ -519,12 +1775,12 @@ func (ae *ActionExecutor) logExecutionError(handlerID string, event map[string]i
     "handler_id":   handlerID,
     "event_id":     eventID,
     "event_type":   eventType,
-    "from_jid":     fromJID,
+    "from_jid":     sanitizeJID(fromJID),
     "started_at":   startTime,
     "completed_at": time.Now(),
     "duration_ms":  duration,
     "success":      false,
-    "error":        errorMsg,
+    "error":        sanitizeJID(errorMsg),
   }
 
   ae.database.LogHandlerExecution(execution)
@@ -534,6 +1790,60 @@ func (ae *ActionExecutor) logExecutionError(handlerID string, event map[string]i
 
 // Helper functions
 
+// Limits on what a python handler gets inline
+const (
+  handlerInlineFieldBytes  = 16 * 1024 // larger event fields are passed by file
+  handlerRawMessagePreview = 512       // raw_message is cut to this unless include_raw_message is set
+)
+
+// handlerEventJSON encodes the event for embedding in python handler source. Fields over
+// handlerInlineFieldBytes are written to temp files and listed under _field_files for the
+// generated code to load back; the caller removes the returned files. raw_message is
+// truncated unless includeRaw is set. Fails if the result still exceeds max_handler_input_bytes.
+func handlerEventJSON(eventData map[string]interface{}, includeRaw bool) (string, []string, error) {
+  event := make(map[string]interface{}, len(eventData))
+  for key, value := range eventData {
+    event[key] = value
+  }
+
+  if raw, ok := event["raw_message"].(string); ok && !includeRaw && len(raw) > handlerRawMessagePreview {
+    event["raw_message"] = raw[:handlerRawMessagePreview]
+    event["raw_message_truncated"] = true
+  }
+
+  var files []string
+  fieldFiles := make(map[string]string)
+  for key, value := range event {
+    encoded, err := json.Marshal(value)
+    if err != nil || len(encoded) <= handlerInlineFieldBytes {
+      continue
+    }
+
+    file, err := os.CreateTemp("", "whatsapp_handler_"+key+"_*.json")
+    if err != nil {
+      return "", files, fmt.Errorf("failed to write event field %s to file: %w", key, err)
+    }
+    files = append(files, file.Name())
+    _, err = file.Write(encoded)
+    file.Close()
+    if err != nil {
+      return "", files, fmt.Errorf("failed to write event field %s to file: %w", key, err)
+    }
+
+    fieldFiles[key] = file.Name()
+    delete(event, key)
+  }
+  if len(fieldFiles) > 0 {
+    event["_field_files"] = fieldFiles
+  }
+
+  eventJSON := toJSON(event)
+  if maxBytes := global_config.GetMaxHandlerInputBytes(); maxBytes > 0 && len(eventJSON) > maxBytes {
+    return "", files, fmt.Errorf("event data is %d bytes, over max_handler_input_bytes (%d)", len(eventJSON), maxBytes)
+  }
+  return eventJSON, files, nil
+}
+
 func toJSON(data interface{}) string {
   jsonBytes, err := json.Marshal(data)
   if err != nil {
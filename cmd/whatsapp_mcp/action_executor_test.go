@@ -0,0 +1,148 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "path/filepath"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// TestHandlerPanicIsolated runs a handler whose action panics alongside a normal one, in both
+// execution modes, and checks the panic is recorded as a failed execution while the other
+// handler still runs
+func TestHandlerPanicIsolated(t *testing.T) {
+  actionRegistryIndex["test_panic"] = &actionDefinition{
+    Type: "test_panic",
+    run: func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int {
+      panic("boom")
+    },
+  }
+  t.Cleanup(func() { delete(actionRegistryIndex, "test_panic") })
+
+  for _, mode := range []string{HandlerExecutionSequential, HandlerExecutionParallel} {
+    t.Run(mode, func(t *testing.T) {
+      global_config = NewConfig()
+      global_config.UpdateFromMap(map[string]interface{}{"handler_execution_mode": mode})
+
+      database, err := NewDatabase(filepath.Join(t.TempDir(), "handlers.db"))
+      if err != nil {
+        t.Fatalf("NewDatabase: %v", err)
+      }
+      defer database.Close()
+
+      // The panicking handler has the higher priority, so sequential mode runs it first
+      handlers := map[string]string{"panics": "test_panic", "survives": "delay"}
+      for handlerID, actionType := range handlers {
+        priority := 0
+        if handlerID == "panics" {
+          priority = 10
+        }
+        err := database.SaveHandler(map[string]interface{}{
+          "handler_id":   handlerID,
+          "event_filter": map[string]interface{}{"event_types": []interface{}{"message"}},
+          "action": map[string]interface{}{
+            "type":    "actions",
+            "actions": []interface{}{map[string]interface{}{"type": actionType, "seconds": 0}},
+          },
+          "enabled":         true,
+          "priority":        priority,
+          "timeout_seconds": 5,
+        })
+        if err != nil {
+          t.Fatalf("SaveHandler %s: %v", handlerID, err)
+        }
+      }
+
+      matcher := NewEventMatcher(database)
+      if err := matcher.LoadHandlers(); err != nil {
+        t.Fatalf("LoadHandlers: %v", err)
+      }
+      errorState := NewErrorState(100)
+      executor := NewActionExecutor(database, errorState, matcher)
+
+      executor.ExecuteHandlersForEvent(map[string]interface{}{
+        "event_type": "message",
+        "message_id": "test_message",
+        "chat":       "123@s.whatsapp.net",
+        "from":       "123@s.whatsapp.net",
+        "text":       "hello",
+        "timestamp":  time.Now(),
+      })
+
+      // Parallel mode runs handlers on their own goroutines
+      deadline := time.Now().Add(5 * time.Second)
+      var panicked, survived map[string]interface{}
+      for {
+        panicked, _ = database.GetHandler("panics")
+        survived, _ = database.GetHandler("survives")
+        if fmt.Sprint(panicked["execution_count"], survived["execution_count"]) == "1 1" || time.Now().After(deadline) {
+          break
+        }
+        time.Sleep(10 * time.Millisecond)
+      }
+
+      if fmt.Sprint(panicked["total_errors"]) != "1" {
+        t.Errorf("panicking handler total_errors = %v, want 1", panicked["total_errors"])
+      }
+      if lastError, _ := panicked["last_error"].(string); !strings.Contains(lastError, "handler panicked: boom") {
+        t.Errorf("panicking handler last_error = %q", lastError)
+      }
+      if fmt.Sprint(survived["execution_count"], survived["total_errors"]) != "1 0" {
+        t.Errorf("other handler execution_count = %v, total_errors = %v, want 1 and 0", survived["execution_count"], survived["total_errors"])
+      }
+
+      logged := false
+      for _, entry := range errorState.GetRecentErrors(nil, 100) {
+        if strings.Contains(entry.Message, "handler panicked") && strings.Contains(entry.Details, "panics") {
+          logged = true
+        }
+      }
+      if !logged {
+        t.Error("panic was not logged to the error state")
+      }
+    })
+  }
+}
+
+// TestSendOnceDedup sends the same content concurrently and checks only one send goes out,
+// and that a failed send doesn't hold back a retry
+func TestSendOnceDedup(t *testing.T) {
+  global_config = NewConfig()
+  global_config.UpdateFromMap(map[string]interface{}{"outbound_dedup": true})
+  executor := NewActionExecutor(nil, NewErrorState(100), nil)
+  content := map[string]interface{}{"conversation": "hello"}
+
+  var sent atomic.Int32
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      executor.sendOnce("send_message", "123@s.whatsapp.net", content, func() error {
+        sent.Add(1)
+        time.Sleep(10 * time.Millisecond)
+        return nil
+      })
+    }()
+  }
+  wg.Wait()
+  if n := sent.Load(); n != 1 {
+    t.Errorf("%d identical sends went out, want 1", n)
+  }
+
+  failing := map[string]interface{}{"conversation": "retry me"}
+  executor.sendOnce("send_message", "123@s.whatsapp.net", failing, func() error { return errors.New("offline") })
+  retried := false
+  err := executor.sendOnce("send_message", "123@s.whatsapp.net", failing, func() error {
+    retried = true
+    return nil
+  })
+  if err != nil || !retried {
+    t.Errorf("retry after a failed send: err %v, sent %v; want it sent", err, retried)
+  }
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+  "context"
+  "errors"
+)
+
+// actionDefinition documents one action type a handler may return and how to execute it.
+// executeReturnedActions dispatches through actionRegistry, so an action type listed here is
+// always both documented by get_action_registry and executable.
+type actionDefinition struct {
+  Type        string                 `json:"type"`
+  Description string                 `json:"description"`
+  Required    []string               `json:"required"`
+  Optional    []string               `json:"optional"`
+  Example     map[string]interface{} `json:"example"`
+
+  // run executes the action and returns how many actions it counts as. ctx is cancelled
+  // when the handler execution is cancelled.
+  run func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int
+
+  // send delivers a message for send actions, which leave run unset: their run is derived
+  // from send so failures are dead-lettered, and retry_dead_letter calls send directly
+  send func(ae *ActionExecutor, action map[string]interface{}) error
+}
+
+// countIf adapts a single-send executor to the run signature
+func countIf(execute func(ae *ActionExecutor, action map[string]interface{}) bool) func(context.Context, *ActionExecutor, map[string]interface{}, map[string]interface{}) int {
+  return func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int {
+    if execute(ae, action) {
+      return 1
+    }
+    return 0
+  }
+}
+
+// deadLettered adapts a send executor to the run signature, recording failed sends in the
+// dead_letters table so they can be inspected and retried
+func deadLettered(send func(ae *ActionExecutor, action map[string]interface{}) error) func(context.Context, *ActionExecutor, map[string]interface{}, map[string]interface{}) int {
+  return func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int {
+    err := send(ae, action)
+    if err == nil {
+      return 1
+    }
+    if !errors.Is(err, errDuplicateSend) {
+      ae.recordDeadLetter(ctx, action, eventData, err)
+    }
+    return 0
+  }
+}
+
+// actionRegistry lists every action type, in the order get_action_registry returns them
+var actionRegistry = []actionDefinition{
+  {
+    Type:        "send_message",
+    Description: "Send a message (protojson waE2E.Message), or a saved or registry message template filled with values (one of message or template is required). Queued while offline; shows typing first if humanize_sends is set.",
+    Required:    []string{"to"},
+    Optional:    []string{"message", "template", "values", "mentions", "append_mentions", "quoted_message_id", "inline_placeholders"},
+    Example: map[string]interface{}{
+      "type":    "send_message",
+      "to":      "{event.chat}",
+      "message": map[string]interface{}{"conversation": "Thanks, got it!"},
+    },
+    send: func(ae *ActionExecutor, action map[string]interface{}) error {
+      ae.humanizeSend(action)
+      return ae.executeSendMessage(action)
+    },
+  },
+  {
+    Type:        "send_voice",
+    Description: "Upload an OGG/Opus file and send it as a voice note",
+    Required:    []string{"to", "path"},
+    Optional:    []string{},
+    Example: map[string]interface{}{
+      "type": "send_voice",
+      "to":   "{event.chat}",
+      "path": "/path/to/reply.ogg",
+    },
+    send: (*ActionExecutor).executeSendVoice,
+  },
+  {
+    Type:        "send_media",
+    Description: "Upload an image, video or document and send it",
+    Required:    []string{"to", "path"},
+    Optional:    []string{"media_type", "caption", "mimetype", "view_once"},
+    Example: map[string]interface{}{
+      "type":       "send_media",
+      "to":         "{event.chat}",
+      "path":       "/path/to/photo.jpg",
+      "media_type": "image",
+      "caption":    "Here you go",
+    },
+    send: (*ActionExecutor).executeSendMedia,
+  },
+  {
+    Type:        "send_sticker",
+    Description: "Upload a 512x512 WebP file and send it as a sticker",
+    Required:    []string{"to", "path"},
+    Optional:    []string{},
+    Example: map[string]interface{}{
+      "type": "send_sticker",
+      "to":   "{event.chat}",
+      "path": "/path/to/sticker.webp",
+    },
+    send: (*ActionExecutor).executeSendSticker,
+  },
+  {
+    Type:        "send_link",
+    Description: "Send a URL with an explicit link preview card instead of relying on WhatsApp to generate one. The preview image is fetched from image_url or decoded from image_base64.",
+    Required:    []string{"to", "url"},
+    Optional:    []string{"text", "title", "description", "image_url", "image_base64"},
+    Example: map[string]interface{}{
+      "type":        "send_link",
+      "to":          "{event.chat}",
+      "url":         "https://example.com/menu",
+      "text":        "Here's today's menu",
+      "title":       "Today's menu",
+      "description": "Lunch specials, served 12-3pm",
+      "image_url":   "https://example.com/menu.jpg",
+    },
+    send: (*ActionExecutor).executeSendLink,
+  },
+  {
+    Type:        "send_reaction",
+    Description: "Not implemented yet; use send_message with a reactionMessage message (see the reaction message template) instead",
+    Required:    []string{},
+    Optional:    []string{},
+    Example:     map[string]interface{}{"type": "send_reaction"},
+    run:         countIf((*ActionExecutor).executeSendReaction),
+  },
+  {
+    Type:        "mark_read",
+    Description: "Mark messages as read",
+    Required:    []string{"message_ids"},
+    Optional:    []string{"chat", "sender"},
+    Example: map[string]interface{}{
+      "type":        "mark_read",
+      "message_ids": []interface{}{"{event.message_id}"},
+      "chat":        "{event.chat}",
+      "sender":      "{event.from}",
+    },
+    run: countIf((*ActionExecutor).executeMarkRead),
+  },
+  {
+    Type:        "send_presence",
+    Description: "Set global presence (available or unavailable)",
+    Required:    []string{"state"},
+    Optional:    []string{},
+    Example:     map[string]interface{}{"type": "send_presence", "state": "available"},
+    run:         countIf((*ActionExecutor).executeSendPresence),
+  },
+  {
+    Type:        "send_chat_presence",
+    Description: "Show typing or recording in a chat (state composing or paused, media audio for recording)",
+    Required:    []string{"jid", "state"},
+    Optional:    []string{"media"},
+    Example:     map[string]interface{}{"type": "send_chat_presence", "jid": "{event.chat}", "state": "composing"},
+    run:         countIf((*ActionExecutor).executeSendChatPresence),
+  },
+  {
+    Type:        "welcome",
+    Description: "Greet each member who joined, on group_update events. Template placeholders: {member.name}, {member.mention}, {member.jid}, {group.name}, {group.jid}",
+    Required:    []string{},
+    Optional:    []string{"template", "to"},
+    Example: map[string]interface{}{
+      "type":     "welcome",
+      "template": "Welcome to {group.name}, {member.mention}!",
+    },
+    run: func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int {
+      return ae.executeWelcome(action, eventData)
+    },
+  },
+  {
+    Type:        "delay",
+    Description: "Pause before the next action",
+    Required:    []string{"seconds"},
+    Optional:    []string{},
+    Example:     map[string]interface{}{"type": "delay", "seconds": 2},
+    run: func(ctx context.Context, ae *ActionExecutor, action map[string]interface{}, eventData map[string]interface{}) int {
+      if ae.executeDelay(ctx, action) {
+        return 1
+      }
+      return 0
+    },
+  },
+  {
+    Type:        "call_method",
+    Description: "Call a whatsmeow method from action_method_allowlist (see get_method_registry)",
+    Required:    []string{"method"},
+    Optional:    []string{"params"},
+    Example: map[string]interface{}{
+      "type":   "call_method",
+      "method": "SendChatPresence",
+      "params": map[string]interface{}{"jid": "{event.chat}", "state": "paused"},
+    },
+    run: countIf((*ActionExecutor).executeCallMethod),
+  },
+}
+
+// actionRegistryIndex maps action types to their definitions
+var actionRegistryIndex = func() map[string]*actionDefinition {
+  index := make(map[string]*actionDefinition, len(actionRegistry))
+  for i := range actionRegistry {
+    if actionRegistry[i].send != nil {
+      actionRegistry[i].run = deadLettered(actionRegistry[i].send)
+    }
+    index[actionRegistry[i].Type] = &actionRegistry[i]
+  }
+  return index
+}()
+
+// lookupAction returns the definition for an action type, or nil if it is unknown
+func lookupAction(actionType string) *actionDefinition {
+  return actionRegistryIndex[actionType]
+}
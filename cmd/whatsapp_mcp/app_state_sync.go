@@ -0,0 +1,140 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "time"
+
+  "go.mau.fi/whatsmeow/appstate"
+)
+
+// App-state types that operations read from. Contacts come from critical_unblock_low; pin,
+// mute and archive settings from the regular types.
+var (
+  appStateContacts     = []appstate.WAPatchName{appstate.WAPatchCriticalUnblockLow}
+  appStateChatSettings = []appstate.WAPatchName{appstate.WAPatchRegularHigh, appstate.WAPatchRegularLow}
+)
+
+// appStateSync records when one app-state type finished syncing
+type appStateSync struct {
+  completed_at time.Time // zero when synced by an earlier session
+}
+
+// MarkAppStateSynced records that an app-state type finished a full sync and wakes anyone
+// waiting for it
+func (ws *WhatsAppState) MarkAppStateSynced(name appstate.WAPatchName, completedAt time.Time) {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  if ws.app_state_synced == nil {
+    ws.app_state_synced = make(map[appstate.WAPatchName]appStateSync)
+  }
+  ws.app_state_synced[name] = appStateSync{completed_at: completedAt}
+  ws.notifyAppStateSync()
+}
+
+// ResetAppStateSync forgets all sync progress, for a new or replaced session
+func (ws *WhatsAppState) ResetAppStateSync() {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  ws.app_state_synced = nil
+  ws.notifyAppStateSync()
+}
+
+// notifyAppStateSync wakes waiters so they recheck sync progress. Callers hold ws.mu.
+func (ws *WhatsAppState) notifyAppStateSync() {
+  if ws.app_state_changed != nil {
+    close(ws.app_state_changed)
+  }
+  ws.app_state_changed = make(chan struct{})
+}
+
+// appStateSyncedLocked reports whether every named type has synced. Callers hold ws.mu.
+func (ws *WhatsAppState) appStateSyncedLocked(names []appstate.WAPatchName) bool {
+  for _, name := range names {
+    if _, ok := ws.app_state_synced[name]; !ok {
+      return false
+    }
+  }
+  return true
+}
+
+// IsAppStateSynced reports whether every named type has synced
+func (ws *WhatsAppState) IsAppStateSynced(names []appstate.WAPatchName) bool {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+  return ws.appStateSyncedLocked(names)
+}
+
+// WaitForAppStateSync blocks until every named type has synced or ctx is done, and reports
+// whether they synced
+func (ws *WhatsAppState) WaitForAppStateSync(ctx context.Context, names []appstate.WAPatchName) bool {
+  for {
+    ws.mu.Lock()
+    if ws.appStateSyncedLocked(names) {
+      ws.mu.Unlock()
+      return true
+    }
+    if ws.app_state_changed == nil {
+      ws.app_state_changed = make(chan struct{})
+    }
+    changed := ws.app_state_changed
+    ws.mu.Unlock()
+
+    select {
+    case <-changed:
+    case <-ctx.Done():
+      return false
+    }
+  }
+}
+
+// GetAppStateSyncStatus returns whether every app-state type has synced, with each type's
+// progress
+func (ws *WhatsAppState) GetAppStateSyncStatus() (bool, map[string]interface{}) {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+
+  progress := make(map[string]interface{}, len(appstate.AllPatchNames))
+  for _, name := range appstate.AllPatchNames {
+    status := map[string]interface{}{"synced": false}
+    if synced, ok := ws.app_state_synced[name]; ok {
+      status["synced"] = true
+      if synced.completed_at.IsZero() {
+        status["from_previous_session"] = true
+      } else {
+        status["completed_at"] = synced.completed_at.Format(time.RFC3339)
+      }
+    }
+    progress[string(name)] = status
+  }
+  return ws.appStateSyncedLocked(appstate.AllPatchNames[:]), progress
+}
+
+// seedAppStateSync marks the app-state types this session already synced in an earlier run.
+// whatsmeow only reports completion of full syncs, which happen once after pairing, so a
+// reconnecting session would otherwise never look synced.
+func (wac *WhatsAppClient) seedAppStateSync(ctx context.Context) {
+  for _, name := range appstate.AllPatchNames {
+    version, _, err := wac.Client().Store.AppState.GetAppStateVersion(ctx, string(name))
+    if err != nil {
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to read app state version", fmt.Sprintf("%s: %v", name, err))
+      continue
+    }
+    if version > 0 {
+      global_whatsapp_state.MarkAppStateSynced(name, time.Time{})
+    }
+  }
+}
+
+// awaitAppStateSync reports whether the named app-state types have synced, first waiting up
+// to the operation's wait_for_sync seconds for them if it asked to
+func (oh *OperationHandler) awaitAppStateSync(input *OperationInput, names []appstate.WAPatchName) bool {
+  wait, _ := input.Data["wait_for_sync"].(float64)
+  if wait <= 0 {
+    return oh.whatsapp_state.IsAppStateSynced(names)
+  }
+
+  ctx, cancel := context.WithTimeout(input.Context(), time.Duration(wait*float64(time.Second)))
+  defer cancel()
+  return oh.whatsapp_state.WaitForAppStateSync(ctx, names)
+}
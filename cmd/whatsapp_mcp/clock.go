@@ -0,0 +1,60 @@
+package main
+
+import (
+  "math"
+  "sync"
+  "time"
+)
+
+// clockSkewSamples is how many recent server timestamps the skew estimate considers
+const clockSkewSamples = 20
+
+// clockSkewEstimator estimates how far the local clock is from WhatsApp's server clock by
+// comparing server timestamps (of received messages and send receipts) with the local time
+// they arrived. Each offset also includes delivery delay, and messages queued while offline
+// arrive long after their timestamp, so the smallest recent offset is the best estimate.
+type clockSkewEstimator struct {
+  mu         sync.Mutex
+  offsets    []time.Duration // local minus server, newest last
+  lastServer time.Time
+  lastLocal  time.Time
+}
+
+var global_clock_skew = &clockSkewEstimator{}
+
+// observe records a server timestamp seen at the current local time. Server timestamps
+// only have second precision.
+func (c *clockSkewEstimator) observe(serverTime time.Time) {
+  if serverTime.IsZero() {
+    return
+  }
+  now := time.Now()
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.offsets = append(c.offsets, now.Sub(serverTime))
+  if len(c.offsets) > clockSkewSamples {
+    c.offsets = c.offsets[len(c.offsets)-clockSkewSamples:]
+  }
+  if serverTime.After(c.lastServer) {
+    c.lastServer = serverTime
+    c.lastLocal = now
+  }
+}
+
+// estimate returns the estimated skew (positive when the local clock is ahead), the latest
+// server timestamp with the local time it was seen, and how many samples were used.
+// ok is false until a server timestamp has been observed.
+func (c *clockSkewEstimator) estimate() (skew time.Duration, lastServer time.Time, lastLocal time.Time, samples int, ok bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if len(c.offsets) == 0 {
+    return 0, time.Time{}, time.Time{}, 0, false
+  }
+
+  skew = time.Duration(math.MaxInt64)
+  for _, offset := range c.offsets {
+    skew = min(skew, offset)
+  }
+  return skew, c.lastServer, c.lastLocal, len(c.offsets), true
+}
@@ -2,7 +2,10 @@ package main
 
 import (
   "os"
+  "path"
   "path/filepath"
+  "slices"
+  "time"
 )
 
 // NewConfig creates a new configuration with default values
@@ -21,6 +24,44 @@ func NewConfig() *Config {
     auto_presence:         true,
     handler_timeout:       30,
     max_parallel_handlers: 10,
+    outbound_queue_ttl:    3600,
+    capture_stack_traces:  StackTracesCriticalOnly,
+    operation_timeout:     120,
+    ignore_own_messages:   true,
+    qr_auto_refresh:       true,
+    hash_jids_in_logs:     false,
+    max_handler_event_age_seconds: 0,
+    mcp_tls_insecure:      false,
+    mcp_retry_attempts:    3,
+    mcp_retry_backoff_ms:  500,
+    presence_on_send:      false,
+    action_method_allowlist: append([]string(nil), defaultActionMethodAllowlist...),
+    reverse_backlog_limit: 1000,
+    humanize_sends:        false,
+    humanize_max_delay_ms: 5000,
+    outbound_dedup:        false,
+    outbound_dedup_window: 30,
+    max_concurrent_downloads: 3,
+    qr_display_mode:       QRDisplayAuto,
+    log_format:            LogFormatConsole,
+    composing_timeout:     25,
+    handler_execution_mode: HandlerExecutionParallel,
+    clock_skew_warning:    30,
+    max_handlers:          200,
+    serialized_method_categories: []string{"app_state"},
+    transcription_tool:    "",
+    transcription_operation: "transcribe",
+    max_handler_input_bytes: 256 * 1024,
+    track_message_status:  true,
+    auto_download_media:   false,
+    auto_download_media_types: []string{},
+    auto_download_max_bytes: 50 * 1024 * 1024,
+    enrich_message_names:  false,
+    db_log_min_severity:   ErrorSeverityWarning,
+    register_retry_attempts: 5,
+    register_retry_backoff_ms: 2000,
+    dead_letter_actions:   true,
+    missing_tool_attention: true,
   }
 }
 
@@ -94,7 +135,335 @@ func (c *Config) SetAutoReconnect(enabled bool) {
   c.auto_reconnect = enabled
 }
 
-// ToMap converts the config to a map for JSON serialization
+// GetOutboundQueueTTL returns how long queued outbound messages are kept before expiring
+func (c *Config) GetOutboundQueueTTL() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return time.Duration(c.outbound_queue_ttl) * time.Second
+}
+
+// GetCaptureStackTraces returns which error severities get a stack trace attached
+func (c *Config) GetCaptureStackTraces() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.capture_stack_traces
+}
+
+// GetMessageWebhook returns the message webhook URL and its signing secret
+func (c *Config) GetMessageWebhook() (string, string) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.message_webhook_url, c.message_webhook_secret
+}
+
+// GetOperationTimeout returns the maximum time an operation may run (0 disables the limit)
+func (c *Config) GetOperationTimeout() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return time.Duration(c.operation_timeout) * time.Second
+}
+
+// GetIgnoreOwnMessages returns whether is_from_me events skip handlers that don't opt in
+func (c *Config) GetIgnoreOwnMessages() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.ignore_own_messages
+}
+
+// GetQRAutoRefresh returns whether rotated QR codes are re-displayed until pairing finishes
+func (c *Config) GetQRAutoRefresh() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.qr_auto_refresh
+}
+
+// GetQRDisplayMode returns where pairing QR codes are shown (see the QRDisplay constants)
+func (c *Config) GetQRDisplayMode() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.qr_display_mode
+}
+
+// GetLogFormat returns whether zerolog writes human-readable console output or JSON
+func (c *Config) GetLogFormat() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.log_format
+}
+
+// GetComposingTimeout returns how long a "typing..." chat presence may stay up before it is
+// automatically cleared (0 = never)
+func (c *Config) GetComposingTimeout() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return time.Duration(c.composing_timeout) * time.Second
+}
+
+// GetHandlerExecutionMode returns whether matched handlers run in parallel or one at a time
+// (see the HandlerExecution constants)
+func (c *Config) GetHandlerExecutionMode() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.handler_execution_mode
+}
+
+// GetClockSkewWarning returns the estimated clock skew beyond which get_health_status warns (0 = never)
+func (c *Config) GetClockSkewWarning() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return time.Duration(c.clock_skew_warning) * time.Second
+}
+
+// GetMaxHandlers returns how many handlers may be registered (0 = unlimited)
+func (c *Config) GetMaxHandlers() int {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.max_handlers
+}
+
+// GetSerializedMethodCategories returns the registry categories call_whatsmeow runs one call at a time
+func (c *Config) GetSerializedMethodCategories() []string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return slices.Clone(c.serialized_method_categories)
+}
+
+// IsMethodCategorySerialized reports whether call_whatsmeow runs methods of a registry
+// category one at a time, for methods that mutate shared client state such as app state
+func (c *Config) IsMethodCategorySerialized(category string) bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return slices.Contains(c.serialized_method_categories, category)
+}
+
+// GetTranscriptionTool returns the MCP tool transcribe_voice sends audio to, and the
+// operation it calls on it. An empty tool name means transcription isn't set up.
+func (c *Config) GetTranscriptionTool() (string, string) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.transcription_tool, c.transcription_operation
+}
+
+// GetMaxHandlerInputBytes returns the largest event a python handler is sent inline (0 = unlimited)
+func (c *Config) GetMaxHandlerInputBytes() int {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.max_handler_input_bytes
+}
+
+// GetTrackMessageStatus returns whether sent messages record their delivery status from receipts
+func (c *Config) GetTrackMessageStatus() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.track_message_status
+}
+
+// GetAutoDownloadMedia returns whether incoming media is downloaded as it arrives, which media
+// types qualify (empty means all) and the largest file to fetch in bytes (0 means no limit)
+func (c *Config) GetAutoDownloadMedia() (bool, []string, int) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.auto_download_media, append([]string(nil), c.auto_download_media_types...), c.auto_download_max_bytes
+}
+
+// GetEnrichMessageNames returns whether get_messages adds current contact and group names by default
+func (c *Config) GetEnrichMessageNames() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.enrich_message_names
+}
+
+// GetDBLogMinSeverity returns the lowest severity written to the error_log table
+func (c *Config) GetDBLogMinSeverity() ErrorSeverity {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.db_log_min_severity
+}
+
+// GetRegisterRetry returns how many times tool registration is attempted at startup and the
+// initial backoff between attempts
+func (c *Config) GetRegisterRetry() (int, time.Duration) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.register_retry_attempts, time.Duration(c.register_retry_backoff_ms) * time.Millisecond
+}
+
+// GetDeadLetterActions returns whether failed handler send actions are kept in dead_letters
+func (c *Config) GetDeadLetterActions() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.dead_letter_actions
+}
+
+// GetMissingToolAttention returns whether a handler whose MCP tool isn't registered is marked
+// as needing attention instead of counting toward its circuit breaker
+func (c *Config) GetMissingToolAttention() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.missing_tool_attention
+}
+
+// GetHashJIDsInLogs returns whether JID user portions are hashed in log and error messages
+func (c *Config) GetHashJIDsInLogs() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.hash_jids_in_logs
+}
+
+// GetMaxHandlerEventAge returns the maximum event age for handler dispatch (0 disables the check)
+func (c *Config) GetMaxHandlerEventAge() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return time.Duration(c.max_handler_event_age_seconds) * time.Second
+}
+
+// GetMCPTLS returns whether MCP server certificate verification is skipped and an optional CA cert path
+func (c *Config) GetMCPTLS() (bool, string) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.mcp_tls_insecure, c.mcp_tls_ca_cert
+}
+
+// GetMCPRetry returns how many times MCP requests are attempted and the initial backoff between attempts
+func (c *Config) GetMCPRetry() (int, time.Duration) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.mcp_retry_attempts, time.Duration(c.mcp_retry_backoff_ms) * time.Millisecond
+}
+
+// GetMethodRegistryPath returns the path of an external method registry merged over the embedded one
+func (c *Config) GetMethodRegistryPath() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.method_registry_path
+}
+
+// IsStorageExcluded reports whether a message in chat from sender matches store_exclude_chats
+// or store_exclude_senders. Patterns support wildcards, e.g. "*@g.us" for all groups.
+func (c *Config) IsStorageExcluded(chat string, sender string) bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return matchesAnyPattern(c.store_exclude_chats, chat) || matchesAnyPattern(c.store_exclude_senders, sender)
+}
+
+// GetStoreExcludeSkipHandlers returns whether excluded messages also skip handler dispatch
+func (c *Config) GetStoreExcludeSkipHandlers() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.store_exclude_skip_handlers
+}
+
+// GetDefaultChatScope returns the chats handlers without their own chat filter are limited to
+func (c *Config) GetDefaultChatScope() []string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return append([]string(nil), c.default_chat_scope...)
+}
+
+// GetReverseBacklogLimit returns how many reverse calls may queue beyond the ReverseChannel buffer
+// before further calls are rejected. 0 rejects as soon as the buffer is full.
+func (c *Config) GetReverseBacklogLimit() int {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.reverse_backlog_limit
+}
+
+// GetHandlersFile returns the path of the JSON file handlers are loaded from at startup
+func (c *Config) GetHandlersFile() string {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.handlers_file
+}
+
+// GetHumanizeSends returns whether handler sends show typing first, and the longest typing delay
+func (c *Config) GetHumanizeSends() (bool, time.Duration) {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.humanize_sends, time.Duration(c.humanize_max_delay_ms) * time.Millisecond
+}
+
+// GetOutboundDedupWindow returns how long an identical handler send is suppressed for, or 0 if dedup is off
+func (c *Config) GetOutboundDedupWindow() time.Duration {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  if !c.outbound_dedup {
+    return 0
+  }
+  return time.Duration(c.outbound_dedup_window) * time.Second
+}
+
+// GetMaxConcurrentDownloads returns how many media downloads may run at once (0 = unlimited)
+func (c *Config) GetMaxConcurrentDownloads() int {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.max_concurrent_downloads
+}
+
+// defaultActionMethodAllowlist is the read and send methods handler call_method actions may use.
+// Session-level methods such as Logout are deliberately left out.
+var defaultActionMethodAllowlist = []string{
+  "SendMessage",
+  "SendPresence",
+  "SendChatPresence",
+  "MarkRead",
+  "GetUserInfo",
+  "GetProfilePictureInfo",
+  "DownloadMediaWithPath",
+  "BuildEdit",
+  "BuildRevoke",
+}
+
+// IsActionMethodAllowed reports whether handler actions may call method through call_method.
+// Entries in action_method_allowlist support wildcards; "*" allows everything.
+func (c *Config) IsActionMethodAllowed(method string) bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return matchesAnyPattern(c.action_method_allowlist, method)
+}
+
+// matchesAnyPattern checks value against a list of exact JIDs or wildcard patterns
+func matchesAnyPattern(patterns []string, value string) bool {
+  for _, pattern := range patterns {
+    if pattern == value {
+      return true
+    }
+    if matched, err := path.Match(pattern, value); err == nil && matched {
+      return true
+    }
+  }
+  return false
+}
+
+// toStringSlice converts a JSON array to a string slice, skipping non-string items
+func toStringSlice(values []interface{}) []string {
+  result := make([]string, 0, len(values))
+  for _, v := range values {
+    if str, ok := v.(string); ok && str != "" {
+      result = append(result, str)
+    }
+  }
+  return result
+}
+
+// GetPresenceOnSend returns whether handler sends should go out while marked available
+func (c *Config) GetPresenceOnSend() bool {
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  return c.presence_on_send
+}
+
+// PublicMap is ToMap for get_config and set_config responses. Secrets are write-only: each is
+// replaced by a flag saying whether it is set.
+func (c *Config) PublicMap() map[string]interface{} {
+  config := c.ToMap()
+  secret, _ := config["message_webhook_secret"].(string)
+  delete(config, "message_webhook_secret")
+  config["message_webhook_secret_set"] = secret != ""
+  return config
+}
+
+// ToMap converts the config to a map for saving to the database. It includes secrets, so
+// responses use PublicMap.
 func (c *Config) ToMap() map[string]interface{} {
   c.mu.RLock()
   defer c.mu.RUnlock()
@@ -110,6 +479,53 @@ func (c *Config) ToMap() map[string]interface{} {
     "auto_presence":         c.auto_presence,
     "handler_timeout":       c.handler_timeout,
     "max_parallel_handlers": c.max_parallel_handlers,
+    "outbound_queue_ttl":    c.outbound_queue_ttl,
+    "capture_stack_traces":  c.capture_stack_traces,
+    "message_webhook_url":   c.message_webhook_url,
+    "message_webhook_secret": c.message_webhook_secret,
+    "operation_timeout":     c.operation_timeout,
+    "ignore_own_messages":   c.ignore_own_messages,
+    "qr_auto_refresh":       c.qr_auto_refresh,
+    "hash_jids_in_logs":     c.hash_jids_in_logs,
+    "max_handler_event_age_seconds": c.max_handler_event_age_seconds,
+    "mcp_tls_insecure":      c.mcp_tls_insecure,
+    "mcp_tls_ca_cert":       c.mcp_tls_ca_cert,
+    "mcp_retry_attempts":    c.mcp_retry_attempts,
+    "mcp_retry_backoff_ms":  c.mcp_retry_backoff_ms,
+    "method_registry_path":  c.method_registry_path,
+    "store_exclude_chats":   c.store_exclude_chats,
+    "store_exclude_senders": c.store_exclude_senders,
+    "store_exclude_skip_handlers": c.store_exclude_skip_handlers,
+    "presence_on_send":    c.presence_on_send,
+    "action_method_allowlist": c.action_method_allowlist,
+    "default_chat_scope":  c.default_chat_scope,
+    "reverse_backlog_limit": c.reverse_backlog_limit,
+    "handlers_file":       c.handlers_file,
+    "humanize_sends":      c.humanize_sends,
+    "humanize_max_delay_ms": c.humanize_max_delay_ms,
+    "outbound_dedup":      c.outbound_dedup,
+    "outbound_dedup_window": c.outbound_dedup_window,
+    "max_concurrent_downloads": c.max_concurrent_downloads,
+    "qr_display_mode":     c.qr_display_mode,
+    "log_format":          c.log_format,
+    "composing_timeout":   c.composing_timeout,
+    "handler_execution_mode": c.handler_execution_mode,
+    "clock_skew_warning":  c.clock_skew_warning,
+    "max_handlers":        c.max_handlers,
+    "serialized_method_categories": c.serialized_method_categories,
+    "transcription_tool":  c.transcription_tool,
+    "transcription_operation": c.transcription_operation,
+    "max_handler_input_bytes": c.max_handler_input_bytes,
+    "track_message_status": c.track_message_status,
+    "auto_download_media": c.auto_download_media,
+    "auto_download_media_types": c.auto_download_media_types,
+    "auto_download_max_bytes": c.auto_download_max_bytes,
+    "enrich_message_names": c.enrich_message_names,
+    "db_log_min_severity": c.db_log_min_severity,
+    "register_retry_attempts": c.register_retry_attempts,
+    "register_retry_backoff_ms": c.register_retry_backoff_ms,
+    "dead_letter_actions": c.dead_letter_actions,
+    "missing_tool_attention": c.missing_tool_attention,
   }
 }
 
@@ -148,5 +564,164 @@ func (c *Config) UpdateFromMap(data map[string]interface{}) {
   if val, ok := data["max_parallel_handlers"].(float64); ok {
     c.max_parallel_handlers = int(val)
   }
+  if val, ok := data["outbound_queue_ttl"].(float64); ok {
+    c.outbound_queue_ttl = int(val)
+  }
+  if val, ok := data["capture_stack_traces"].(string); ok {
+    switch val {
+    case StackTracesAll, StackTracesCriticalOnly, StackTracesNone:
+      c.capture_stack_traces = val
+    }
+  }
+  if val, ok := data["message_webhook_url"].(string); ok {
+    c.message_webhook_url = val
+  }
+  if val, ok := data["message_webhook_secret"].(string); ok {
+    c.message_webhook_secret = val
+  }
+  if val, ok := data["operation_timeout"].(float64); ok {
+    c.operation_timeout = int(val)
+  }
+  if val, ok := data["ignore_own_messages"].(bool); ok {
+    c.ignore_own_messages = val
+  }
+  if val, ok := data["qr_auto_refresh"].(bool); ok {
+    c.qr_auto_refresh = val
+  }
+  if val, ok := data["hash_jids_in_logs"].(bool); ok {
+    c.hash_jids_in_logs = val
+  }
+  if val, ok := data["max_handler_event_age_seconds"].(float64); ok {
+    c.max_handler_event_age_seconds = int(val)
+  }
+  if val, ok := data["mcp_tls_insecure"].(bool); ok {
+    c.mcp_tls_insecure = val
+  }
+  if val, ok := data["mcp_tls_ca_cert"].(string); ok {
+    c.mcp_tls_ca_cert = val
+  }
+  if val, ok := data["mcp_retry_attempts"].(float64); ok {
+    c.mcp_retry_attempts = int(val)
+  }
+  if val, ok := data["mcp_retry_backoff_ms"].(float64); ok {
+    c.mcp_retry_backoff_ms = int(val)
+  }
+  if val, ok := data["method_registry_path"].(string); ok {
+    c.method_registry_path = val
+  }
+  if val, ok := data["store_exclude_chats"].([]interface{}); ok {
+    c.store_exclude_chats = toStringSlice(val)
+  }
+  if val, ok := data["store_exclude_senders"].([]interface{}); ok {
+    c.store_exclude_senders = toStringSlice(val)
+  }
+  if val, ok := data["store_exclude_skip_handlers"].(bool); ok {
+    c.store_exclude_skip_handlers = val
+  }
+  if val, ok := data["presence_on_send"].(bool); ok {
+    c.presence_on_send = val
+  }
+  if val, ok := data["action_method_allowlist"].([]interface{}); ok {
+    c.action_method_allowlist = toStringSlice(val)
+  }
+  if val, ok := data["humanize_sends"].(bool); ok {
+    c.humanize_sends = val
+  }
+  if val, ok := data["humanize_max_delay_ms"].(float64); ok && val >= 0 {
+    c.humanize_max_delay_ms = int(val)
+  }
+  if val, ok := data["outbound_dedup"].(bool); ok {
+    c.outbound_dedup = val
+  }
+  if val, ok := data["outbound_dedup_window"].(float64); ok && val >= 0 {
+    c.outbound_dedup_window = int(val)
+  }
+  if val, ok := data["max_concurrent_downloads"].(float64); ok && val >= 0 {
+    c.max_concurrent_downloads = int(val)
+  }
+  if val, ok := data["qr_display_mode"].(string); ok {
+    switch val {
+    case QRDisplayAuto, QRDisplayPopup, QRDisplayASCII, QRDisplayBoth, QRDisplayNone:
+      c.qr_display_mode = val
+    }
+  }
+  if val, ok := data["log_format"].(string); ok {
+    switch val {
+    case LogFormatConsole, LogFormatJSON:
+      c.log_format = val
+    }
+  }
+  if val, ok := data["composing_timeout"].(float64); ok && val >= 0 {
+    c.composing_timeout = int(val)
+  }
+  if val, ok := data["handler_execution_mode"].(string); ok {
+    switch val {
+    case HandlerExecutionParallel, HandlerExecutionSequential:
+      c.handler_execution_mode = val
+    }
+  }
+  if val, ok := data["clock_skew_warning"].(float64); ok && val >= 0 {
+    c.clock_skew_warning = int(val)
+  }
+  if val, ok := data["max_handlers"].(float64); ok && val >= 0 {
+    c.max_handlers = int(val)
+  }
+  if val, ok := data["serialized_method_categories"].([]interface{}); ok {
+    c.serialized_method_categories = toStringSlice(val)
+  }
+  if val, ok := data["transcription_tool"].(string); ok {
+    c.transcription_tool = val
+  }
+  if val, ok := data["transcription_operation"].(string); ok && val != "" {
+    c.transcription_operation = val
+  }
+  if val, ok := data["max_handler_input_bytes"].(float64); ok && val >= 0 {
+    c.max_handler_input_bytes = int(val)
+  }
+  if val, ok := data["track_message_status"].(bool); ok {
+    c.track_message_status = val
+  }
+  if val, ok := data["auto_download_media"].(bool); ok {
+    c.auto_download_media = val
+  }
+  if val, ok := data["auto_download_media_types"].([]interface{}); ok {
+    c.auto_download_media_types = toStringSlice(val)
+  }
+  if val, ok := data["auto_download_max_bytes"].(float64); ok && val >= 0 {
+    c.auto_download_max_bytes = int(val)
+  }
+  if val, ok := data["enrich_message_names"].(bool); ok {
+    c.enrich_message_names = val
+  }
+  if val, ok := data["db_log_min_severity"].(string); ok {
+    if _, known := errorSeverityRank[ErrorSeverity(val)]; known {
+      c.db_log_min_severity = ErrorSeverity(val)
+    }
+  }
+  if val, ok := data["register_retry_attempts"].(float64); ok && val >= 1 {
+    c.register_retry_attempts = int(val)
+  }
+  if val, ok := data["register_retry_backoff_ms"].(float64); ok && val >= 0 {
+    c.register_retry_backoff_ms = int(val)
+  }
+  if val, ok := data["dead_letter_actions"].(bool); ok {
+    c.dead_letter_actions = val
+  }
+  if val, ok := data["missing_tool_attention"].(bool); ok {
+    c.missing_tool_attention = val
+  }
+  if val, ok := data["handlers_file"].(string); ok {
+    c.handlers_file = val
+  }
+  if val, ok := data["reverse_backlog_limit"].(float64); ok && val >= 0 {
+    c.reverse_backlog_limit = int(val)
+  }
+  // default_chat_scope accepts a single JID or a list
+  switch val := data["default_chat_scope"].(type) {
+  case string:
+    c.default_chat_scope = toStringSlice([]interface{}{val})
+  case []interface{}:
+    c.default_chat_scope = toStringSlice(val)
+  }
 }
 
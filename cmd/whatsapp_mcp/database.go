@@ -6,6 +6,9 @@ import (
   "fmt"
   "os"
   "path/filepath"
+  "slices"
+  "strings"
+  "sync"
   "time"
 
   _ "github.com/mattn/go-sqlite3"
@@ -14,6 +17,9 @@ import (
 // Database represents the error logging database
 type Database struct {
   db *sql.DB
+
+  connStatsMu sync.Mutex
+  connReplay  connectionReplay // GetConnectionStats' progress through connection_log
 }
 
 // NewDatabase creates a new database connection
@@ -70,6 +76,18 @@ func (d *Database) initSchema() error {
 
   CREATE INDEX IF NOT EXISTS idx_connection_log_timestamp ON connection_log(timestamp DESC);
 
+  CREATE TABLE IF NOT EXISTS pairing_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    started_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP NOT NULL,
+    outcome TEXT NOT NULL,
+    reason TEXT,
+    waited_ms INTEGER NOT NULL,
+    popup_shown INTEGER DEFAULT 0
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_pairing_attempts_started ON pairing_attempts(started_at DESC);
+
   CREATE TABLE IF NOT EXISTS messages (
     message_id TEXT PRIMARY KEY,
     timestamp TIMESTAMP NOT NULL,
@@ -84,7 +102,15 @@ func (d *Database) initSchema() error {
     media_mime_type TEXT,
     media_size INTEGER,
     quoted_message_id TEXT,
-    raw_message TEXT
+    raw_message TEXT,
+    link_preview TEXT,
+    participant_jid TEXT,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP,
+    mentioned_jids TEXT,
+    content_json TEXT,
+    edited_at TIMESTAMP,
+    sequence INTEGER
   );
 
   CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp DESC);
@@ -114,7 +140,16 @@ func (d *Database) initSchema() error {
     last_error TEXT,
     last_error_time TIMESTAMP,
     total_errors INTEGER DEFAULT 0,
-    circuit_breaker_state TEXT DEFAULT 'closed'
+    circuit_breaker_state TEXT DEFAULT 'closed',
+    batch_enabled INTEGER DEFAULT 0,
+    batch_window_seconds INTEGER,
+    batch_max_size INTEGER,
+    file_managed INTEGER DEFAULT 0,
+    include_context_messages INTEGER,
+    sender_cooldown_seconds INTEGER,
+    coalesce_window_seconds INTEGER,
+    attention_reason TEXT,
+    attention_since TIMESTAMP
   );
 
   CREATE INDEX IF NOT EXISTS idx_handlers_enabled ON event_handlers(enabled);
@@ -132,15 +167,206 @@ func (d *Database) initSchema() error {
     success INTEGER,
     error TEXT,
     actions_executed INTEGER,
+    stopped_propagation INTEGER DEFAULT 0,
     FOREIGN KEY (handler_id) REFERENCES event_handlers(handler_id)
   );
 
   CREATE INDEX IF NOT EXISTS idx_executions_handler ON handler_executions(handler_id);
   CREATE INDEX IF NOT EXISTS idx_executions_from ON handler_executions(from_jid);
   CREATE INDEX IF NOT EXISTS idx_executions_time ON handler_executions(started_at DESC);
+
+  CREATE TABLE IF NOT EXISTS outbound_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    to_jid TEXT NOT NULL,
+    message TEXT NOT NULL,
+    queued_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_outbound_queue_expires ON outbound_queue(expires_at);
+
+  CREATE TABLE IF NOT EXISTS paused_chats (
+    chat_jid TEXT PRIMARY KEY,
+    paused_at TIMESTAMP NOT NULL,
+    resume_at TIMESTAMP,
+    reason TEXT
+  );
+
+  CREATE TABLE IF NOT EXISTS reactions (
+    message_id TEXT NOT NULL,
+    reactor_jid TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    PRIMARY KEY (message_id, reactor_jid)
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_reactions_chat ON reactions(chat_jid);
+
+  CREATE TABLE IF NOT EXISTS poll_votes (
+    poll_message_id TEXT NOT NULL,
+    voter_jid TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    selected_options TEXT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    PRIMARY KEY (poll_message_id, voter_jid)
+  );
+
+  CREATE TABLE IF NOT EXISTS contacts (
+    jid TEXT PRIMARY KEY,
+    full_name TEXT,
+    first_name TEXT,
+    push_name TEXT,
+    business_name TEXT,
+    updated_at TIMESTAMP NOT NULL
+  );
+
+  CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp TIMESTAMP NOT NULL,
+    operation TEXT NOT NULL,
+    arguments TEXT,
+    success INTEGER NOT NULL,
+    error TEXT,
+    duration_ms INTEGER
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log(timestamp DESC);
+  CREATE INDEX IF NOT EXISTS idx_audit_log_operation ON audit_log(operation);
+
+  CREATE TABLE IF NOT EXISTS group_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    group_jid TEXT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    actor_jid TEXT,
+    action TEXT NOT NULL,
+    participants TEXT,
+    details TEXT
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_group_events_group ON group_events(group_jid);
+  CREATE INDEX IF NOT EXISTS idx_group_events_time ON group_events(timestamp DESC);
+
+  CREATE TABLE IF NOT EXISTS media_files (
+    message_id TEXT PRIMARY KEY,
+    chat_jid TEXT NOT NULL,
+    sender_jid TEXT,
+    media_type TEXT NOT NULL,
+    mime_type TEXT,
+    size INTEGER NOT NULL,
+    path TEXT NOT NULL,
+    downloaded_at TIMESTAMP NOT NULL
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_media_files_chat ON media_files(chat_jid);
+  CREATE INDEX IF NOT EXISTS idx_media_files_time ON media_files(downloaded_at DESC);
+
+  CREATE TABLE IF NOT EXISTS dead_letters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    handler_id TEXT,
+    action_type TEXT NOT NULL,
+    action TEXT NOT NULL,
+    event TEXT,
+    error TEXT NOT NULL,
+    failed_at TIMESTAMP NOT NULL,
+    retries INTEGER NOT NULL DEFAULT 0,
+    last_retry_at TIMESTAMP,
+    resolved_at TIMESTAMP
+  );
+
+  CREATE INDEX IF NOT EXISTS idx_dead_letters_handler ON dead_letters(handler_id);
+  CREATE INDEX IF NOT EXISTS idx_dead_letters_time ON dead_letters(failed_at DESC);
+
+  CREATE TABLE IF NOT EXISTS templates (
+    name TEXT PRIMARY KEY,
+    description TEXT,
+    template TEXT NOT NULL,
+    defaults TEXT,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+  );
   `
 
-  _, err := d.db.Exec(schema)
+  if _, err := d.db.Exec(schema); err != nil {
+    return err
+  }
+
+  return d.migrateSchema()
+}
+
+// migrateSchema adds columns introduced after a table was first created
+func (d *Database) migrateSchema() error {
+  migrations := []struct {
+    table      string
+    column     string
+    definition string
+  }{
+    {"messages", "link_preview", "TEXT"},
+    {"messages", "participant_jid", "TEXT"},
+    {"messages", "revoked", "INTEGER NOT NULL DEFAULT 0"},
+    {"messages", "revoked_at", "TIMESTAMP"},
+    {"messages", "mentioned_jids", "TEXT"},
+    {"messages", "content_json", "TEXT"},
+    {"messages", "edited_at", "TIMESTAMP"},
+    {"messages", "sequence", "INTEGER"},
+    {"messages", "transcript", "TEXT"},
+    {"messages", "status", "TEXT"},
+    {"messages", "selected_id", "TEXT"},
+    {"event_handlers", "batch_enabled", "INTEGER DEFAULT 0"},
+    {"event_handlers", "batch_window_seconds", "INTEGER"},
+    {"event_handlers", "batch_max_size", "INTEGER"},
+    {"event_handlers", "file_managed", "INTEGER DEFAULT 0"},
+    {"event_handlers", "include_context_messages", "INTEGER"},
+    {"event_handlers", "sender_cooldown_seconds", "INTEGER"},
+    {"event_handlers", "coalesce_window_seconds", "INTEGER"},
+    {"event_handlers", "attention_reason", "TEXT"},
+    {"event_handlers", "attention_since", "TIMESTAMP"},
+    {"handler_executions", "stopped_propagation", "INTEGER DEFAULT 0"},
+  }
+
+  for _, m := range migrations {
+    if err := d.addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+      return fmt.Errorf("failed to add %s.%s: %w", m.table, m.column, err)
+    }
+  }
+
+  // Messages stored before sequence existed are numbered in rowid (insertion) order
+  if _, err := d.db.Exec(`UPDATE messages SET sequence = rowid WHERE sequence IS NULL`); err != nil {
+    return fmt.Errorf("failed to backfill messages.sequence: %w", err)
+  }
+  if _, err := d.db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_sequence ON messages(sequence)`); err != nil {
+    return fmt.Errorf("failed to index messages.sequence: %w", err)
+  }
+
+  return nil
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists
+func (d *Database) addColumnIfMissing(table string, column string, definition string) error {
+  rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var cid, notNull, pk int
+    var name, colType string
+    var defaultValue sql.NullString
+    if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+      return err
+    }
+    if name == column {
+      return nil
+    }
+  }
+  if err := rows.Err(); err != nil {
+    return err
+  }
+
+  _, err = d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
   return err
 }
 
@@ -277,18 +503,267 @@ func (d *Database) LogConnectionEvent(eventType string, details string) error {
   return err
 }
 
+// disconnectEventTypes are the connection_log event types that mean the connection dropped
+var disconnectEventTypes = map[string]bool{
+  "disconnected":    true,
+  "logged_out":      true,
+  "temporary_ban":   true,
+  "stream_replaced": true,
+  "client_outdated": true,
+  "connect_failure": true,
+  "stream_error":    true,
+}
+
+// ConnectionStats summarises connection stability from connection_log
+type ConnectionStats struct {
+  TotalReconnects  int
+  TotalDisconnects int
+  ConnectedSince   time.Time // zero if the log ends disconnected
+}
+
+// connectionReplay is the state of replaying connection_log, kept between calls so each
+// GetConnectionStats only reads the events logged since the last one
+type connectionReplay struct {
+  lastID int64
+  stats  ConnectionStats
+  up     bool
+  fresh  bool
+}
+
+// freshStartEvents are the connection_log event types after which the next connect is a new
+// session rather than a reconnect
+var freshStartEvents = map[string]bool{
+  "startup":         true,
+  "relink":          true,
+  "restore_session": true,
+}
+
+// GetConnectionStats replays connection_log to count drops and reconnects. Several events
+// logged for one drop (e.g. stream_error then disconnected) count once, and the first
+// connect after a startup, relink or restore_session is not a reconnect. Only events logged
+// since the previous call are read.
+func (d *Database) GetConnectionStats() (*ConnectionStats, error) {
+  d.connStatsMu.Lock()
+  defer d.connStatsMu.Unlock()
+
+  replay := d.connReplay
+  if replay.lastID == 0 {
+    replay.fresh = true
+  }
+
+  rows, err := d.db.Query(`SELECT id, timestamp, event_type FROM connection_log WHERE id > ? ORDER BY id ASC`, replay.lastID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var id int64
+    var timestamp time.Time
+    var eventType string
+    if err := rows.Scan(&id, &timestamp, &eventType); err != nil {
+      return nil, err
+    }
+    replay.lastID = id
+
+    switch {
+    case freshStartEvents[eventType]:
+      replay.up = false
+      replay.fresh = true
+      replay.stats.ConnectedSince = time.Time{}
+    case eventType == "connected":
+      if !replay.up {
+        if !replay.fresh {
+          replay.stats.TotalReconnects++
+        }
+        replay.stats.ConnectedSince = timestamp
+      }
+      replay.up = true
+      replay.fresh = false
+    case disconnectEventTypes[eventType]:
+      if replay.up {
+        replay.stats.TotalDisconnects++
+        replay.stats.ConnectedSince = time.Time{}
+      }
+      replay.up = false
+    }
+  }
+  if err := rows.Err(); err != nil {
+    return nil, err
+  }
+
+  d.connReplay = replay
+  stats := replay.stats
+  return &stats, nil
+}
+
+// GetConnectionLog retrieves connection events, optionally filtered by type and time
+func (d *Database) GetConnectionLog(limit int, eventType *string, sinceTime *time.Time) ([]map[string]interface{}, error) {
+  query := `
+  SELECT id, timestamp, event_type, details
+  FROM connection_log
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if eventType != nil {
+    query += ` AND event_type = ?`
+    args = append(args, *eventType)
+  }
+
+  if sinceTime != nil {
+    query += ` AND timestamp > ?`
+    args = append(args, *sinceTime)
+  }
+
+  query += ` ORDER BY timestamp DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var entries []map[string]interface{}
+  for rows.Next() {
+    var id int
+    var timestamp time.Time
+    var eventType string
+    var details sql.NullString
+
+    if err := rows.Scan(&id, &timestamp, &eventType, &details); err != nil {
+      return nil, err
+    }
+
+    entry := map[string]interface{}{
+      "id":         id,
+      "timestamp":  timestamp.Format(time.RFC3339),
+      "event_type": eventType,
+    }
+    if details.Valid {
+      entry["details"] = details.String
+    }
+
+    entries = append(entries, entry)
+  }
+
+  return entries, rows.Err()
+}
+
+// LogPairingAttempt records how a QR pairing attempt ended
+func (d *Database) LogPairingAttempt(startedAt time.Time, endedAt time.Time, outcome string, reason string, popupShown bool) error {
+  query := `
+  INSERT INTO pairing_attempts (started_at, ended_at, outcome, reason, waited_ms, popup_shown)
+  VALUES (?, ?, ?, ?, ?, ?)
+  `
+
+  var reasonValue interface{}
+  if reason != "" {
+    reasonValue = reason
+  }
+  popup := 0
+  if popupShown {
+    popup = 1
+  }
+
+  _, err := d.db.Exec(query, startedAt, endedAt, outcome, reasonValue, endedAt.Sub(startedAt).Milliseconds(), popup)
+  return err
+}
+
+// GetPairingAttempts retrieves recent pairing attempts, optionally filtered by outcome
+func (d *Database) GetPairingAttempts(limit int, outcome *string) ([]map[string]interface{}, error) {
+  query := `
+  SELECT id, started_at, ended_at, outcome, reason, waited_ms, popup_shown
+  FROM pairing_attempts
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if outcome != nil {
+    query += ` AND outcome = ?`
+    args = append(args, *outcome)
+  }
+
+  query += ` ORDER BY started_at DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var attempts []map[string]interface{}
+  for rows.Next() {
+    var id int
+    var startedAt, endedAt time.Time
+    var outcome string
+    var reason sql.NullString
+    var waitedMs int64
+    var popupShown int
+
+    if err := rows.Scan(&id, &startedAt, &endedAt, &outcome, &reason, &waitedMs, &popupShown); err != nil {
+      return nil, err
+    }
+
+    attempt := map[string]interface{}{
+      "id":          id,
+      "started_at":  startedAt.Format(time.RFC3339),
+      "ended_at":    endedAt.Format(time.RFC3339),
+      "outcome":     outcome,
+      "waited_ms":   waitedMs,
+      "popup_shown": popupShown == 1,
+    }
+    if reason.Valid {
+      attempt["reason"] = reason.String
+    }
+
+    attempts = append(attempts, attempt)
+  }
+
+  return attempts, rows.Err()
+}
+
 // SaveMessage saves a received message to the database
 func (d *Database) SaveMessage(msg map[string]interface{}) error {
   query := `
   INSERT OR REPLACE INTO messages (
     message_id, timestamp, from_jid, chat_jid, sender_name,
     is_group, is_from_me, message_type, text_content,
-    media_type, media_mime_type, media_size, quoted_message_id, raw_message
-  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    media_type, media_mime_type, media_size, quoted_message_id, raw_message,
+    link_preview, participant_jid, mentioned_jids, content_json, selected_id, sequence, status
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+    -- Arrival order: a re-saved message keeps its number, a new one takes the next
+    COALESCE(
+      (SELECT sequence FROM messages WHERE message_id = ?),
+      (SELECT COALESCE(MAX(sequence), 0) + 1 FROM messages)
+    ),
+    -- Receipts may arrive before the send is stored; AdvanceMessageStatus moves it on
+    COALESCE((SELECT status FROM messages WHERE message_id = ?), ?)
+  )
   `
 
   rawJSON, _ := json.Marshal(msg)
 
+  var linkPreview interface{}
+  if preview, ok := msg["link_preview"]; ok && preview != nil {
+    previewJSON, _ := json.Marshal(preview)
+    linkPreview = string(previewJSON)
+  }
+
+  var mentionedJIDs interface{}
+  if mentioned, ok := msg["mentioned_jids"]; ok && mentioned != nil {
+    mentionedJSON, _ := json.Marshal(mentioned)
+    mentionedJIDs = string(mentionedJSON)
+  }
+
+  var contentJSON interface{}
+  if content, ok := msg["content"]; ok && content != nil {
+    contentBytes, _ := json.Marshal(content)
+    contentJSON = string(contentBytes)
+  }
+
   _, err := d.db.Exec(query,
     msg["message_id"],
     msg["timestamp"],
@@ -304,20 +779,64 @@ func (d *Database) SaveMessage(msg map[string]interface{}) error {
     msg["media_size"],
     msg["quoted_message_id"],
     string(rawJSON),
+    linkPreview,
+    msg["participant_jid"],
+    mentionedJIDs,
+    contentJSON,
+    msg["selected_id"],
+    msg["message_id"],
+    msg["message_id"],
+    msg["status"],
   )
 
   return err
 }
 
+// AdvanceMessageStatus sets the delivery status of messages we sent, unless they are
+// already at that status or a later one. Returns how many messages changed.
+func (d *Database) AdvanceMessageStatus(messageIDs []string, status string) (int64, error) {
+  rank := slices.Index(messageStatusOrder, status)
+  if rank < 0 {
+    return 0, fmt.Errorf("unknown message status: %s", status)
+  }
+  if len(messageIDs) == 0 {
+    return 0, nil
+  }
+
+  rankExpr := "CASE status"
+  for i, s := range messageStatusOrder {
+    rankExpr += fmt.Sprintf(" WHEN '%s' THEN %d", s, i)
+  }
+  rankExpr += " ELSE -1 END"
+
+  query := `UPDATE messages SET status = ? WHERE is_from_me = 1 AND ` + rankExpr + ` < ? AND message_id IN (?` + strings.Repeat(", ?", len(messageIDs)-1) + `)`
+  args := []interface{}{status, rank}
+  for _, id := range messageIDs {
+    args = append(args, id)
+  }
+
+  result, err := d.db.Exec(query, args...)
+  if err != nil {
+    return 0, err
+  }
+  return result.RowsAffected()
+}
+
+// GetMessage retrieves a single stored message. Returns sql.ErrNoRows if it is unknown.
+func (d *Database) GetMessage(messageID string) (map[string]interface{}, error) {
+  messages, err := d.queryMessages(`SELECT `+messageColumns+` FROM messages WHERE message_id = ?`, messageID)
+  if err != nil {
+    return nil, err
+  }
+  if len(messages) == 0 {
+    return nil, sql.ErrNoRows
+  }
+  return messages[0], nil
+}
+
 // GetMessages retrieves messages from the database
 func (d *Database) GetMessages(limit int, fromJID *string, chatJID *string, sinceTime *time.Time) ([]map[string]interface{}, error) {
-  query := `
-  SELECT message_id, timestamp, from_jid, chat_jid, sender_name,
-         is_group, is_from_me, message_type, text_content,
-         media_type, media_mime_type, media_size, quoted_message_id
-  FROM messages
-  WHERE 1=1
-  `
+  query := `SELECT ` + messageColumns + ` FROM messages WHERE 1=1`
   args := []interface{}{}
 
   if fromJID != nil {
@@ -335,7 +854,709 @@ func (d *Database) GetMessages(limit int, fromJID *string, chatJID *string, sinc
     args = append(args, *sinceTime)
   }
 
-  query += ` ORDER BY timestamp DESC LIMIT ?`
+  query += ` ORDER BY timestamp DESC, sequence DESC LIMIT ?`
+  args = append(args, limit)
+
+  return d.queryMessages(query, args...)
+}
+
+// SearchMessages finds messages whose text or voice transcript contains every
+// whitespace-separated term of query (case-insensitive), newest first
+func (d *Database) SearchMessages(query string, limit int, fromJID *string, chatJID *string) ([]map[string]interface{}, error) {
+  sqlQuery := `SELECT ` + messageColumns + ` FROM messages WHERE (text_content IS NOT NULL OR transcript IS NOT NULL)`
+  args := []interface{}{}
+
+  for _, term := range strings.Fields(query) {
+    sqlQuery += ` AND (COALESCE(text_content, '') || ' ' || COALESCE(transcript, '')) LIKE ? ESCAPE '\'`
+    args = append(args, "%"+likeEscaper.Replace(term)+"%")
+  }
+
+  if fromJID != nil {
+    sqlQuery += ` AND from_jid = ?`
+    args = append(args, *fromJID)
+  }
+
+  if chatJID != nil {
+    sqlQuery += ` AND chat_jid = ?`
+    args = append(args, *chatJID)
+  }
+
+  sqlQuery += ` ORDER BY timestamp DESC, sequence DESC LIMIT ?`
+  args = append(args, limit)
+
+  return d.queryMessages(sqlQuery, args...)
+}
+
+// likeEscaper escapes LIKE wildcards so search terms match literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CountMessagesByChat returns how many messages each chat received since the given time
+func (d *Database) CountMessagesByChat(since time.Time) (map[string]int, error) {
+  rows, err := d.db.Query(`SELECT chat_jid, COUNT(*) FROM messages WHERE timestamp > ? GROUP BY chat_jid`, since)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  counts := make(map[string]int)
+  for rows.Next() {
+    var chatJID string
+    var count int
+    if err := rows.Scan(&chatJID, &count); err != nil {
+      return nil, err
+    }
+    counts[chatJID] = count
+  }
+
+  return counts, rows.Err()
+}
+
+// histogramBuckets maps a histogram bucket size to the SQL expression giving the UTC start of
+// a message's bucket. Weeks start on Monday.
+var histogramBuckets = map[string]string{
+  "hour": `strftime('%Y-%m-%dT%H:00:00Z', timestamp)`,
+  "day":  `strftime('%Y-%m-%dT00:00:00Z', timestamp)`,
+  "week": `strftime('%Y-%m-%dT00:00:00Z', timestamp, '-6 days', 'weekday 1')`,
+}
+
+// CountMessagesByBucket counts the messages from since up to until in each hour, day or week,
+// keyed by the bucket's UTC start (RFC3339). Buckets without messages are absent.
+func (d *Database) CountMessagesByBucket(bucket string, since time.Time, until time.Time, chatJID *string, fromJID *string) (map[string]int, error) {
+  bucketExpr, ok := histogramBuckets[bucket]
+  if !ok {
+    return nil, fmt.Errorf("unknown bucket: %s", bucket)
+  }
+
+  // Timestamps are stored in local time and compared as text, so the bounds must be local too
+  query := `SELECT ` + bucketExpr + ` AS bucket_start, COUNT(*) FROM messages WHERE timestamp >= ? AND timestamp < ?`
+  args := []interface{}{since.Local(), until.Local()}
+
+  if chatJID != nil {
+    query += ` AND chat_jid = ?`
+    args = append(args, *chatJID)
+  }
+  if fromJID != nil {
+    query += ` AND from_jid = ?`
+    args = append(args, *fromJID)
+  }
+
+  query += ` GROUP BY bucket_start`
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  counts := make(map[string]int)
+  for rows.Next() {
+    var bucketStart string
+    var count int
+    if err := rows.Scan(&bucketStart, &count); err != nil {
+      return nil, err
+    }
+    counts[bucketStart] = count
+  }
+
+  return counts, rows.Err()
+}
+
+// messageColumns are the messages columns read by queryMessages, in scan order
+const messageColumns = `message_id, timestamp, from_jid, chat_jid, sender_name,
+  is_group, is_from_me, message_type, text_content,
+  media_type, media_mime_type, media_size, quoted_message_id, link_preview,
+  participant_jid, revoked, revoked_at, mentioned_jids, content_json, edited_at, sequence, transcript, status, selected_id`
+
+// messageFields are the keys queryMessages may set on a message map, the fields get_messages
+// can project to. Optional ones are only present when set on the message.
+var messageFields = []string{
+  "message_id", "timestamp", "from", "chat", "sender_name", "is_group", "is_from_me",
+  "message_type", "text_content", "media_type", "media_mime_type", "media_size",
+  "quoted_message_id", "link_preview", "participant_jid", "mentioned_jids", "content",
+  "revoked", "revoked_at", "edited_at", "sequence", "transcript", "status", "selected_id",
+}
+
+// mediaMessageFields are the media metadata keys dropped by get_messages' exclude_media
+var mediaMessageFields = []string{"media_type", "media_mime_type", "media_size"}
+
+// queryMessages runs a query selecting messageColumns and converts each row to a message map
+func (d *Database) queryMessages(query string, args ...interface{}) ([]map[string]interface{}, error) {
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var messages []map[string]interface{}
+  for rows.Next() {
+    var messageID, fromJID, chatJID, senderName, messageType string
+    var textContent, mediaType, mediaMimeType, quotedMessageID, linkPreview, participantJID, mentionedJIDs, contentJSON, transcript, status, selectedID sql.NullString
+    var mediaSize, sequence sql.NullInt64
+    var timestamp time.Time
+    var revokedAt, editedAt sql.NullTime
+    var isGroup, isFromMe, revoked bool
+
+    err := rows.Scan(
+      &messageID, &timestamp, &fromJID, &chatJID, &senderName,
+      &isGroup, &isFromMe, &messageType, &textContent,
+      &mediaType, &mediaMimeType, &mediaSize, &quotedMessageID, &linkPreview,
+      &participantJID, &revoked, &revokedAt, &mentionedJIDs, &contentJSON, &editedAt, &sequence, &transcript, &status, &selectedID,
+    )
+    if err != nil {
+      return nil, err
+    }
+
+    msg := map[string]interface{}{
+      "message_id":  messageID,
+      "timestamp":   timestamp.Format(time.RFC3339),
+      "from":        fromJID,
+      "chat":        chatJID,
+      "sender_name": senderName,
+      "is_group":    isGroup,
+      "is_from_me":  isFromMe,
+      "message_type": messageType,
+    }
+
+    if textContent.Valid {
+      msg["text_content"] = textContent.String
+    }
+    if mediaType.Valid {
+      msg["media_type"] = mediaType.String
+    }
+    if mediaMimeType.Valid {
+      msg["media_mime_type"] = mediaMimeType.String
+    }
+    if mediaSize.Valid {
+      msg["media_size"] = mediaSize.Int64
+    }
+    if quotedMessageID.Valid {
+      msg["quoted_message_id"] = quotedMessageID.String
+    }
+    if linkPreview.Valid {
+      var preview map[string]interface{}
+      if err := json.Unmarshal([]byte(linkPreview.String), &preview); err == nil {
+        msg["link_preview"] = preview
+      }
+    }
+    if participantJID.Valid {
+      msg["participant_jid"] = participantJID.String
+    }
+    if mentionedJIDs.Valid {
+      var mentioned []string
+      if err := json.Unmarshal([]byte(mentionedJIDs.String), &mentioned); err == nil {
+        msg["mentioned_jids"] = mentioned
+      }
+    }
+    if contentJSON.Valid {
+      var content map[string]interface{}
+      if err := json.Unmarshal([]byte(contentJSON.String), &content); err == nil {
+        msg["content"] = content
+      }
+    }
+    if revoked {
+      msg["revoked"] = true
+      if revokedAt.Valid {
+        msg["revoked_at"] = revokedAt.Time.Format(time.RFC3339)
+      }
+    }
+    if editedAt.Valid {
+      msg["edited_at"] = editedAt.Time.Format(time.RFC3339)
+    }
+    if sequence.Valid {
+      msg["sequence"] = sequence.Int64
+    }
+    if transcript.Valid {
+      msg["transcript"] = transcript.String
+    }
+    if status.Valid {
+      msg["status"] = status.String
+    }
+    if selectedID.Valid {
+      msg["selected_id"] = selectedID.String
+    }
+
+    messages = append(messages, msg)
+  }
+
+  return messages, rows.Err()
+}
+
+// MarkMessageRevoked flags a stored message as deleted by its sender, keeping its content.
+// Returns false if the message isn't stored.
+func (d *Database) MarkMessageRevoked(messageID string, revokedAt time.Time) (bool, error) {
+  result, err := d.db.Exec(`UPDATE messages SET revoked = 1, revoked_at = ? WHERE message_id = ?`, revokedAt, messageID)
+  if err != nil {
+    return false, err
+  }
+
+  affected, err := result.RowsAffected()
+  return affected > 0, err
+}
+
+// UpdateEditedMessage replaces the text and structured content of a stored message after its
+// sender edited it, returning the previous text. A text edit carries the whole new message, so
+// its content replaces the stored one; a caption edit only changes the stored caption.
+// Returns sql.ErrNoRows if the message isn't stored.
+func (d *Database) UpdateEditedMessage(messageID string, newText string, editedContent map[string]interface{}, editedAt time.Time) (string, error) {
+  var oldText, contentJSON sql.NullString
+  err := d.db.QueryRow(`SELECT text_content, content_json FROM messages WHERE message_id = ?`, messageID).Scan(&oldText, &contentJSON)
+  if err != nil {
+    return "", err
+  }
+
+  var content map[string]interface{}
+  if contentJSON.Valid {
+    json.Unmarshal([]byte(contentJSON.String), &content)
+  }
+  if _, isText := editedContent["body"]; isText || len(content) == 0 {
+    content = editedContent
+  } else if caption, ok := editedContent["caption"]; ok {
+    content["caption"] = caption
+  }
+
+  var newContentJSON interface{}
+  if content != nil {
+    contentBytes, _ := json.Marshal(content)
+    newContentJSON = string(contentBytes)
+  }
+
+  _, err = d.db.Exec(`UPDATE messages SET text_content = ?, content_json = ?, edited_at = ? WHERE message_id = ?`, newText, newContentJSON, editedAt, messageID)
+  if err != nil {
+    return "", err
+  }
+
+  return oldText.String, nil
+}
+
+// SaveTranscript stores the transcript of a voice message
+func (d *Database) SaveTranscript(messageID string, transcript string) error {
+  _, err := d.db.Exec(`UPDATE messages SET transcript = ? WHERE message_id = ?`, transcript, messageID)
+  return err
+}
+
+// GetTranscript returns the stored transcript of a message, or "" if it has none
+func (d *Database) GetTranscript(messageID string) (string, error) {
+  var transcript sql.NullString
+  err := d.db.QueryRow(`SELECT transcript FROM messages WHERE message_id = ?`, messageID).Scan(&transcript)
+  return transcript.String, err
+}
+
+// GetRawMessage retrieves the stored raw message JSON for a message.
+// Returns sql.ErrNoRows if the message is unknown.
+func (d *Database) GetRawMessage(messageID string) (string, string, error) {
+  query := `SELECT chat_jid, raw_message FROM messages WHERE message_id = ?`
+
+  var chatJID string
+  var rawMessage sql.NullString
+  err := d.db.QueryRow(query, messageID).Scan(&chatJID, &rawMessage)
+  if err != nil {
+    return "", "", err
+  }
+
+  return chatJID, rawMessage.String, nil
+}
+
+// SavePollVote stores a voter's current selection in a poll, replacing their previous vote.
+// An empty selection removes the vote.
+func (d *Database) SavePollVote(pollMessageID string, voterJID string, chatJID string, selected []string, timestamp time.Time) error {
+  if len(selected) == 0 {
+    _, err := d.db.Exec(`DELETE FROM poll_votes WHERE poll_message_id = ? AND voter_jid = ?`, pollMessageID, voterJID)
+    return err
+  }
+
+  selectedJSON, _ := json.Marshal(selected)
+  query := `
+  INSERT OR REPLACE INTO poll_votes (poll_message_id, voter_jid, chat_jid, selected_options, timestamp)
+  VALUES (?, ?, ?, ?, ?)
+  `
+  _, err := d.db.Exec(query, pollMessageID, voterJID, chatJID, string(selectedJSON), timestamp)
+  return err
+}
+
+// GetPollVotes returns each voter's current selection in a poll, oldest vote first
+func (d *Database) GetPollVotes(pollMessageID string) ([]map[string]interface{}, error) {
+  query := `
+  SELECT voter_jid, selected_options, timestamp
+  FROM poll_votes
+  WHERE poll_message_id = ?
+  ORDER BY timestamp ASC
+  `
+
+  rows, err := d.db.Query(query, pollMessageID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var votes []map[string]interface{}
+  for rows.Next() {
+    var voterJID, selectedJSON string
+    var timestamp time.Time
+
+    if err := rows.Scan(&voterJID, &selectedJSON, &timestamp); err != nil {
+      return nil, err
+    }
+
+    var selected []string
+    json.Unmarshal([]byte(selectedJSON), &selected)
+    votes = append(votes, map[string]interface{}{
+      "voter":            voterJID,
+      "selected_options": selected,
+      "timestamp":        timestamp.Format(time.RFC3339),
+    })
+  }
+
+  return votes, rows.Err()
+}
+
+// GetHistoryAnchor finds the stored message that on-demand history should be requested before.
+// If beforeMessageID is nil, the oldest stored message in the chat is used.
+func (d *Database) GetHistoryAnchor(chatJID string, beforeMessageID *string) (string, time.Time, bool, error) {
+  var query string
+  var args []interface{}
+
+  if beforeMessageID != nil {
+    query = `SELECT message_id, timestamp, is_from_me FROM messages WHERE chat_jid = ? AND message_id = ?`
+    args = []interface{}{chatJID, *beforeMessageID}
+  } else {
+    query = `SELECT message_id, timestamp, is_from_me FROM messages WHERE chat_jid = ? ORDER BY timestamp ASC, sequence ASC LIMIT 1`
+    args = []interface{}{chatJID}
+  }
+
+  var messageID string
+  var timestamp time.Time
+  var isFromMe bool
+  err := d.db.QueryRow(query, args...).Scan(&messageID, &timestamp, &isFromMe)
+  return messageID, timestamp, isFromMe, err
+}
+
+// SaveReaction stores a reaction, replacing any previous reaction by the same reactor.
+// An empty emoji means the reaction was removed, so the row is deleted instead.
+func (d *Database) SaveReaction(messageID string, reactorJID string, chatJID string, emoji string, timestamp time.Time) error {
+  if emoji == "" {
+    query := `DELETE FROM reactions WHERE message_id = ? AND reactor_jid = ?`
+    _, err := d.db.Exec(query, messageID, reactorJID)
+    return err
+  }
+
+  query := `
+  INSERT OR REPLACE INTO reactions (message_id, reactor_jid, chat_jid, emoji, timestamp)
+  VALUES (?, ?, ?, ?, ?)
+  `
+
+  _, err := d.db.Exec(query, messageID, reactorJID, chatJID, emoji, timestamp)
+  return err
+}
+
+// GetReactions retrieves reactions for a message and/or chat
+func (d *Database) GetReactions(messageID *string, chatJID *string, limit int) ([]map[string]interface{}, error) {
+  query := `
+  SELECT message_id, reactor_jid, chat_jid, emoji, timestamp
+  FROM reactions
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if messageID != nil {
+    query += ` AND message_id = ?`
+    args = append(args, *messageID)
+  }
+
+  if chatJID != nil {
+    query += ` AND chat_jid = ?`
+    args = append(args, *chatJID)
+  }
+
+  query += ` ORDER BY timestamp DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var reactions []map[string]interface{}
+  for rows.Next() {
+    var messageID, reactorJID, chatJID, emoji string
+    var timestamp time.Time
+
+    if err := rows.Scan(&messageID, &reactorJID, &chatJID, &emoji, &timestamp); err != nil {
+      return nil, err
+    }
+
+    reactions = append(reactions, map[string]interface{}{
+      "message_id":  messageID,
+      "reactor_jid": reactorJID,
+      "chat":        chatJID,
+      "emoji":       emoji,
+      "timestamp":   timestamp.Format(time.RFC3339),
+    })
+  }
+
+  return reactions, rows.Err()
+}
+
+// contactNameFields are the contacts columns that SaveContact may update
+var contactNameFields = []string{"full_name", "first_name", "push_name", "business_name"}
+
+// SaveContact upserts name fields for a contact. Only the fields present in names are changed.
+func (d *Database) SaveContact(jid string, names map[string]string) error {
+  columns := []string{"jid", "updated_at"}
+  placeholders := []string{"?", "?"}
+  updates := []string{"updated_at = excluded.updated_at"}
+  args := []interface{}{jid, time.Now()}
+
+  for _, field := range contactNameFields {
+    value, ok := names[field]
+    if !ok {
+      continue
+    }
+    columns = append(columns, field)
+    placeholders = append(placeholders, "?")
+    updates = append(updates, fmt.Sprintf("%s = excluded.%s", field, field))
+    args = append(args, value)
+  }
+
+  query := fmt.Sprintf(`
+  INSERT INTO contacts (%s) VALUES (%s)
+  ON CONFLICT(jid) DO UPDATE SET %s
+  `, strings.Join(columns, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "))
+
+  _, err := d.db.Exec(query, args...)
+  return err
+}
+
+// GetContact retrieves the stored names for a contact
+func (d *Database) GetContact(jid string) (map[string]interface{}, error) {
+  query := `
+  SELECT jid, full_name, first_name, push_name, business_name, updated_at
+  FROM contacts
+  WHERE jid = ?
+  `
+
+  var contactJID string
+  var fullName, firstName, pushName, businessName sql.NullString
+  var updatedAt time.Time
+  err := d.db.QueryRow(query, jid).Scan(&contactJID, &fullName, &firstName, &pushName, &businessName, &updatedAt)
+  if err != nil {
+    return nil, err
+  }
+
+  contact := map[string]interface{}{
+    "jid":        contactJID,
+    "updated_at": updatedAt.Format(time.RFC3339),
+  }
+  if fullName.Valid && fullName.String != "" {
+    contact["full_name"] = fullName.String
+  }
+  if firstName.Valid && firstName.String != "" {
+    contact["first_name"] = firstName.String
+  }
+  if pushName.Valid && pushName.String != "" {
+    contact["push_name"] = pushName.String
+  }
+  if businessName.Valid && businessName.String != "" {
+    contact["business_name"] = businessName.String
+  }
+
+  return contact, nil
+}
+
+// LogAudit appends an operation invocation to the audit log
+func (d *Database) LogAudit(operation string, arguments string, success bool, errorMsg string, durationMs int64) error {
+  query := `
+  INSERT INTO audit_log (timestamp, operation, arguments, success, error, duration_ms)
+  VALUES (?, ?, ?, ?, ?, ?)
+  `
+
+  _, err := d.db.Exec(query, time.Now(), operation, arguments, success, errorMsg, durationMs)
+  return err
+}
+
+// GetAuditLog retrieves audit log entries, optionally filtered by operation, outcome and time
+func (d *Database) GetAuditLog(limit int, operation *string, success *bool, sinceTime *time.Time) ([]map[string]interface{}, error) {
+  query := `
+  SELECT id, timestamp, operation, arguments, success, error, duration_ms
+  FROM audit_log
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if operation != nil {
+    query += ` AND operation = ?`
+    args = append(args, *operation)
+  }
+
+  if success != nil {
+    query += ` AND success = ?`
+    args = append(args, *success)
+  }
+
+  if sinceTime != nil {
+    query += ` AND timestamp > ?`
+    args = append(args, *sinceTime)
+  }
+
+  query += ` ORDER BY timestamp DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var entries []map[string]interface{}
+  for rows.Next() {
+    var id int64
+    var timestamp time.Time
+    var operation string
+    var arguments, errorMsg sql.NullString
+    var success bool
+    var durationMs sql.NullInt64
+
+    if err := rows.Scan(&id, &timestamp, &operation, &arguments, &success, &errorMsg, &durationMs); err != nil {
+      return nil, err
+    }
+
+    entry := map[string]interface{}{
+      "id":        id,
+      "timestamp": timestamp.Format(time.RFC3339),
+      "operation": operation,
+      "success":   success,
+    }
+    if arguments.Valid && arguments.String != "" {
+      var argsMap map[string]interface{}
+      if err := json.Unmarshal([]byte(arguments.String), &argsMap); err == nil {
+        entry["arguments"] = argsMap
+      } else {
+        entry["arguments"] = arguments.String
+      }
+    }
+    if errorMsg.Valid && errorMsg.String != "" {
+      entry["error"] = errorMsg.String
+    }
+    if durationMs.Valid {
+      entry["duration_ms"] = durationMs.Int64
+    }
+
+    entries = append(entries, entry)
+  }
+
+  return entries, rows.Err()
+}
+
+// SaveGroupEvent stores a group membership or settings change
+func (d *Database) SaveGroupEvent(groupJID string, timestamp time.Time, actorJID string, action string, participants []string, details string) error {
+  participantsJSON, err := json.Marshal(participants)
+  if err != nil {
+    return err
+  }
+
+  query := `
+  INSERT INTO group_events (group_jid, timestamp, actor_jid, action, participants, details)
+  VALUES (?, ?, ?, ?, ?, ?)
+  `
+
+  _, err = d.db.Exec(query, groupJID, timestamp, actorJID, action, string(participantsJSON), details)
+  return err
+}
+
+// GetGroupEvents retrieves group events, optionally filtered by group and action
+func (d *Database) GetGroupEvents(groupJID *string, action *string, limit int) ([]map[string]interface{}, error) {
+  query := `
+  SELECT id, group_jid, timestamp, actor_jid, action, participants, details
+  FROM group_events
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if groupJID != nil {
+    query += ` AND group_jid = ?`
+    args = append(args, *groupJID)
+  }
+
+  if action != nil {
+    query += ` AND action = ?`
+    args = append(args, *action)
+  }
+
+  query += ` ORDER BY timestamp DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var groupEvents []map[string]interface{}
+  for rows.Next() {
+    var id int64
+    var groupJID, action string
+    var timestamp time.Time
+    var actorJID, participantsJSON, details sql.NullString
+
+    if err := rows.Scan(&id, &groupJID, &timestamp, &actorJID, &action, &participantsJSON, &details); err != nil {
+      return nil, err
+    }
+
+    groupEvent := map[string]interface{}{
+      "id":        id,
+      "group":     groupJID,
+      "timestamp": timestamp.Format(time.RFC3339),
+      "action":    action,
+    }
+    if actorJID.Valid && actorJID.String != "" {
+      groupEvent["actor"] = actorJID.String
+    }
+    if participantsJSON.Valid {
+      var participants []string
+      if err := json.Unmarshal([]byte(participantsJSON.String), &participants); err == nil {
+        groupEvent["participants"] = participants
+      }
+    }
+    if details.Valid && details.String != "" {
+      groupEvent["details"] = details.String
+    }
+
+    groupEvents = append(groupEvents, groupEvent)
+  }
+
+  return groupEvents, rows.Err()
+}
+
+// SaveMediaFile indexes a downloaded media file against the message it came from
+func (d *Database) SaveMediaFile(messageID string, chatJID string, senderJID string, mediaType string, mimeType string, size int, path string) error {
+  query := `
+  INSERT OR REPLACE INTO media_files (message_id, chat_jid, sender_jid, media_type, mime_type, size, path, downloaded_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+  `
+  _, err := d.db.Exec(query, messageID, chatJID, senderJID, mediaType, mimeType, size, path, time.Now())
+  return err
+}
+
+// GetMediaFiles retrieves indexed media files with optional filtering, newest first
+func (d *Database) GetMediaFiles(chatJID *string, mediaType *string, limit int) ([]map[string]interface{}, error) {
+  query := `
+  SELECT message_id, chat_jid, sender_jid, media_type, mime_type, size, path, downloaded_at
+  FROM media_files
+  WHERE 1=1
+  `
+  args := []interface{}{}
+
+  if chatJID != nil {
+    query += ` AND chat_jid = ?`
+    args = append(args, *chatJID)
+  }
+
+  if mediaType != nil {
+    query += ` AND media_type = ?`
+    args = append(args, *mediaType)
+  }
+
+  query += ` ORDER BY downloaded_at DESC LIMIT ?`
   args = append(args, limit)
 
   rows, err := d.db.Query(query, args...)
@@ -344,66 +1565,66 @@ func (d *Database) GetMessages(limit int, fromJID *string, chatJID *string, sinc
   }
   defer rows.Close()
 
-  var messages []map[string]interface{}
+  var files []map[string]interface{}
   for rows.Next() {
-    var messageID, fromJID, chatJID, senderName, messageType string
-    var textContent, mediaType, mediaMimeType, quotedMessageID sql.NullString
-    var mediaSize sql.NullInt64
-    var timestamp time.Time
-    var isGroup, isFromMe bool
+    var messageID, chatJID, mediaType, path string
+    var senderJID, mimeType sql.NullString
+    var size int64
+    var downloadedAt time.Time
 
-    err := rows.Scan(
-      &messageID, &timestamp, &fromJID, &chatJID, &senderName,
-      &isGroup, &isFromMe, &messageType, &textContent,
-      &mediaType, &mediaMimeType, &mediaSize, &quotedMessageID,
-    )
-    if err != nil {
+    if err := rows.Scan(&messageID, &chatJID, &senderJID, &mediaType, &mimeType, &size, &path, &downloadedAt); err != nil {
       return nil, err
     }
 
-    msg := map[string]interface{}{
-      "message_id":  messageID,
-      "timestamp":   timestamp.Format(time.RFC3339),
-      "from":        fromJID,
-      "chat":        chatJID,
-      "sender_name": senderName,
-      "is_group":    isGroup,
-      "is_from_me":  isFromMe,
-      "message_type": messageType,
-    }
-
-    if textContent.Valid {
-      msg["text_content"] = textContent.String
-    }
-    if mediaType.Valid {
-      msg["media_type"] = mediaType.String
-    }
-    if mediaMimeType.Valid {
-      msg["media_mime_type"] = mediaMimeType.String
-    }
-    if mediaSize.Valid {
-      msg["media_size"] = mediaSize.Int64
-    }
-    if quotedMessageID.Valid {
-      msg["quoted_message_id"] = quotedMessageID.String
-    }
-
-    messages = append(messages, msg)
+    files = append(files, map[string]interface{}{
+      "message_id":    messageID,
+      "chat":          chatJID,
+      "from":          senderJID.String,
+      "media_type":    mediaType,
+      "mime_type":     mimeType.String,
+      "size":          size,
+      "path":          path,
+      "downloaded_at": downloadedAt.Format(time.RFC3339),
+    })
   }
 
-  return messages, rows.Err()
+  return files, rows.Err()
 }
 
-// SaveHandler saves an event handler to the database
+// SaveHandler saves an event handler to the database. Re-saving an existing handler only
+// updates its definition, so execution counts, errors and circuit breaker state are kept.
 func (d *Database) SaveHandler(handler map[string]interface{}) error {
   query := `
-  INSERT OR REPLACE INTO event_handlers (
+  INSERT INTO event_handlers (
     handler_id, description, event_filter, action, enabled, priority,
     max_executions_per_minute, max_executions_per_hour, max_executions_per_sender_per_hour,
     cooldown_seconds, timeout_seconds,
     circuit_breaker_enabled, circuit_breaker_threshold, circuit_breaker_reset_seconds,
-    updated_at
-  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    batch_enabled, batch_window_seconds, batch_max_size, file_managed,
+    include_context_messages, sender_cooldown_seconds, coalesce_window_seconds, updated_at
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+  ON CONFLICT(handler_id) DO UPDATE SET
+    description = excluded.description,
+    event_filter = excluded.event_filter,
+    action = excluded.action,
+    enabled = excluded.enabled,
+    priority = excluded.priority,
+    max_executions_per_minute = excluded.max_executions_per_minute,
+    max_executions_per_hour = excluded.max_executions_per_hour,
+    max_executions_per_sender_per_hour = excluded.max_executions_per_sender_per_hour,
+    cooldown_seconds = excluded.cooldown_seconds,
+    timeout_seconds = excluded.timeout_seconds,
+    circuit_breaker_enabled = excluded.circuit_breaker_enabled,
+    circuit_breaker_threshold = excluded.circuit_breaker_threshold,
+    circuit_breaker_reset_seconds = excluded.circuit_breaker_reset_seconds,
+    batch_enabled = excluded.batch_enabled,
+    batch_window_seconds = excluded.batch_window_seconds,
+    batch_max_size = excluded.batch_max_size,
+    file_managed = excluded.file_managed,
+    include_context_messages = excluded.include_context_messages,
+    sender_cooldown_seconds = excluded.sender_cooldown_seconds,
+    coalesce_window_seconds = excluded.coalesce_window_seconds,
+    updated_at = excluded.updated_at
   `
 
   filterJSON, _ := json.Marshal(handler["event_filter"])
@@ -444,6 +1665,16 @@ func (d *Database) SaveHandler(handler map[string]interface{}) error {
     cbReset = int(r)
   }
 
+  batchEnabled := 0
+  if b, ok := handler["batch"].(bool); ok && b {
+    batchEnabled = 1
+  }
+
+  fileManaged := 0
+  if f, ok := handler["file_managed"].(bool); ok && f {
+    fileManaged = 1
+  }
+
   _, err := d.db.Exec(query,
     handler["handler_id"],
     handler["description"],
@@ -459,6 +1690,13 @@ func (d *Database) SaveHandler(handler map[string]interface{}) error {
     cbEnabled,
     cbThreshold,
     cbReset,
+    batchEnabled,
+    handler["batch_window_seconds"],
+    handler["batch_max_size"],
+    fileManaged,
+    handler["include_context_messages"],
+    handler["sender_cooldown_seconds"],
+    handler["coalesce_window_seconds"],
     time.Now(),
   )
 
@@ -473,7 +1711,10 @@ func (d *Database) GetHandler(handlerID string) (map[string]interface{}, error)
          cooldown_seconds, timeout_seconds,
          circuit_breaker_enabled, circuit_breaker_threshold, circuit_breaker_reset_seconds,
          created_at, updated_at, execution_count, last_executed,
-         last_error, last_error_time, total_errors, circuit_breaker_state
+         last_error, last_error_time, total_errors, circuit_breaker_state,
+         batch_enabled, batch_window_seconds, batch_max_size, file_managed,
+         include_context_messages, sender_cooldown_seconds, coalesce_window_seconds,
+         attention_reason, attention_since
   FROM event_handlers
   WHERE handler_id = ?
   `
@@ -487,6 +1728,12 @@ func (d *Database) GetHandler(handlerID string) (map[string]interface{}, error)
   var lastExecuted, lastErrorTime sql.NullTime
   var lastError, cbState sql.NullString
   var description sql.NullString
+  var batchEnabled sql.NullInt64
+  var batchWindow, batchMaxSize sql.NullInt64
+  var fileManaged sql.NullInt64
+  var contextMessages, senderCooldown, coalesceWindow sql.NullInt64
+  var attentionReason sql.NullString
+  var attentionSince sql.NullTime
 
   err := d.db.QueryRow(query, handlerID).Scan(
     &handlerID, &description, &filterJSON, &actionJSON, &enabled, &priority,
@@ -494,6 +1741,9 @@ func (d *Database) GetHandler(handlerID string) (map[string]interface{}, error)
     &cbEnabled, &cbThreshold, &cbReset,
     &createdAt, &updatedAt, &executionCount, &lastExecuted,
     &lastError, &lastErrorTime, &totalErrors, &cbState,
+    &batchEnabled, &batchWindow, &batchMaxSize, &fileManaged,
+    &contextMessages, &senderCooldown, &coalesceWindow,
+    &attentionReason, &attentionSince,
   )
 
   if err != nil {
@@ -557,14 +1807,74 @@ func (d *Database) GetHandler(handlerID string) (map[string]interface{}, error)
   if cbState.Valid {
     handler["circuit_breaker_state"] = cbState.String
   }
+  if batchEnabled.Valid && batchEnabled.Int64 == 1 {
+    handler["batch"] = true
+    if batchWindow.Valid {
+      handler["batch_window_seconds"] = batchWindow.Int64
+    }
+    if batchMaxSize.Valid {
+      handler["batch_max_size"] = batchMaxSize.Int64
+    }
+  }
+  if fileManaged.Valid && fileManaged.Int64 == 1 {
+    handler["file_managed"] = true
+  }
+  if contextMessages.Valid && contextMessages.Int64 > 0 {
+    handler["include_context_messages"] = contextMessages.Int64
+  }
+  if senderCooldown.Valid && senderCooldown.Int64 > 0 {
+    handler["sender_cooldown_seconds"] = senderCooldown.Int64
+  }
+  if coalesceWindow.Valid && coalesceWindow.Int64 > 0 {
+    handler["coalesce_window_seconds"] = coalesceWindow.Int64
+  }
+  addHandlerAttention(handler, attentionReason, attentionSince)
 
   return handler, nil
 }
 
+// addHandlerAttention adds needs_attention to a handler map when a problem outside the
+// handler, such as a missing MCP tool, has been recorded against it
+func addHandlerAttention(handler map[string]interface{}, reason sql.NullString, since sql.NullTime) {
+  if !reason.Valid || reason.String == "" {
+    return
+  }
+  attention := map[string]interface{}{"reason": reason.String}
+  if since.Valid {
+    attention["since"] = since.Time.Format(time.RFC3339)
+  }
+  handler["needs_attention"] = attention
+}
+
+// SetHandlerAttention records why a handler needs attention, keeping when it first did, or
+// clears it when reason is empty
+func (d *Database) SetHandlerAttention(handlerID string, reason string) error {
+  if reason == "" {
+    _, err := d.db.Exec(`UPDATE event_handlers SET attention_reason = NULL, attention_since = NULL WHERE handler_id = ? AND attention_reason IS NOT NULL`, handlerID)
+    return err
+  }
+  query := `
+  UPDATE event_handlers
+  SET attention_reason = ?,
+      attention_since = COALESCE(attention_since, ?)
+  WHERE handler_id = ?
+  `
+  _, err := d.db.Exec(query, reason, time.Now(), handlerID)
+  return err
+}
+
+// CountHandlers returns how many handlers are registered, enabled or not
+func (d *Database) CountHandlers() (int, error) {
+  var count int
+  err := d.db.QueryRow(`SELECT COUNT(*) FROM event_handlers`).Scan(&count)
+  return count, err
+}
+
 // ListHandlers retrieves all event handlers
 func (d *Database) ListHandlers(enabledOnly bool) ([]map[string]interface{}, error) {
   query := `
-  SELECT handler_id, description, enabled, priority, execution_count, last_executed, circuit_breaker_state
+  SELECT handler_id, description, enabled, priority, execution_count, last_executed, circuit_breaker_state, file_managed,
+         attention_reason, attention_since
   FROM event_handlers
   `
   args := []interface{}{}
@@ -588,8 +1898,11 @@ func (d *Database) ListHandlers(enabledOnly bool) ([]map[string]interface{}, err
     var enabled, priority, executionCount int
     var lastExecuted sql.NullTime
     var cbState sql.NullString
+    var fileManaged sql.NullInt64
+    var attentionReason sql.NullString
+    var attentionSince sql.NullTime
 
-    err := rows.Scan(&handlerID, &description, &enabled, &priority, &executionCount, &lastExecuted, &cbState)
+    err := rows.Scan(&handlerID, &description, &enabled, &priority, &executionCount, &lastExecuted, &cbState, &fileManaged, &attentionReason, &attentionSince)
     if err != nil {
       return nil, err
     }
@@ -610,6 +1923,10 @@ func (d *Database) ListHandlers(enabledOnly bool) ([]map[string]interface{}, err
     if cbState.Valid {
       handler["circuit_breaker_state"] = cbState.String
     }
+    if fileManaged.Valid && fileManaged.Int64 == 1 {
+      handler["file_managed"] = true
+    }
+    addHandlerAttention(handler, attentionReason, attentionSince)
 
     handlers = append(handlers, handler)
   }
@@ -624,6 +1941,35 @@ func (d *Database) DeleteHandler(handlerID string) error {
   return err
 }
 
+// IsHandlerFileManaged reports whether a handler was loaded from handlers_file
+func (d *Database) IsHandlerFileManaged(handlerID string) (bool, error) {
+  var fileManaged sql.NullInt64
+  err := d.db.QueryRow(`SELECT file_managed FROM event_handlers WHERE handler_id = ?`, handlerID).Scan(&fileManaged)
+  if err == sql.ErrNoRows {
+    return false, nil
+  }
+  return fileManaged.Valid && fileManaged.Int64 == 1, err
+}
+
+// ListFileManagedHandlerIDs returns the IDs of all handlers loaded from handlers_file
+func (d *Database) ListFileManagedHandlerIDs() ([]string, error) {
+  rows, err := d.db.Query(`SELECT handler_id FROM event_handlers WHERE file_managed = 1`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var ids []string
+  for rows.Next() {
+    var id string
+    if err := rows.Scan(&id); err != nil {
+      return nil, err
+    }
+    ids = append(ids, id)
+  }
+  return ids, rows.Err()
+}
+
 // UpdateHandlerEnabled enables or disables a handler
 func (d *Database) UpdateHandlerEnabled(handlerID string, enabled bool) error {
   enabledInt := 0
@@ -670,14 +2016,19 @@ func (d *Database) LogHandlerExecution(execution map[string]interface{}) error {
   query := `
   INSERT INTO handler_executions (
     handler_id, event_id, event_type, from_jid,
-    started_at, completed_at, duration_ms, success, error, actions_executed
-  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    started_at, completed_at, duration_ms, success, error, actions_executed,
+    stopped_propagation
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
   `
 
   success := 0
   if s, ok := execution["success"].(bool); ok && s {
     success = 1
   }
+  stoppedPropagation := 0
+  if s, ok := execution["stopped_propagation"].(bool); ok && s {
+    stoppedPropagation = 1
+  }
 
   _, err := d.db.Exec(query,
     execution["handler_id"],
@@ -690,16 +2041,18 @@ func (d *Database) LogHandlerExecution(execution map[string]interface{}) error {
     success,
     execution["error"],
     execution["actions_executed"],
+    stoppedPropagation,
   )
 
   return err
 }
 
 // GetHandlerExecutions retrieves recent handler executions
-func (d *Database) GetHandlerExecutions(handlerID *string, limit int) ([]map[string]interface{}, error) {
+func (d *Database) GetHandlerExecutions(handlerID *string, limit int, sinceTime *time.Time) ([]map[string]interface{}, error) {
   query := `
   SELECT id, handler_id, event_id, event_type, from_jid,
-         started_at, completed_at, duration_ms, success, error, actions_executed
+         started_at, completed_at, duration_ms, success, error, actions_executed,
+         stopped_propagation
   FROM handler_executions
   WHERE 1=1
   `
@@ -710,6 +2063,11 @@ func (d *Database) GetHandlerExecutions(handlerID *string, limit int) ([]map[str
     args = append(args, *handlerID)
   }
 
+  if sinceTime != nil {
+    query += ` AND started_at > ?`
+    args = append(args, *sinceTime)
+  }
+
   query += ` ORDER BY started_at DESC LIMIT ?`
   args = append(args, limit)
 
@@ -729,9 +2087,10 @@ func (d *Database) GetHandlerExecutions(handlerID *string, limit int) ([]map[str
     var success int
     var errorMsg sql.NullString
     var actionsExecuted sql.NullInt64
+    var stoppedPropagation sql.NullInt64
 
     err := rows.Scan(&id, &handlerID, &eventID, &eventType, &fromJID,
-      &startedAt, &completedAt, &durationMs, &success, &errorMsg, &actionsExecuted)
+      &startedAt, &completedAt, &durationMs, &success, &errorMsg, &actionsExecuted, &stoppedPropagation)
     if err != nil {
       return nil, err
     }
@@ -756,6 +2115,9 @@ func (d *Database) GetHandlerExecutions(handlerID *string, limit int) ([]map[str
     if actionsExecuted.Valid {
       exec["actions_executed"] = actionsExecuted.Int64
     }
+    if stoppedPropagation.Int64 == 1 {
+      exec["stopped_propagation"] = true
+    }
 
     executions = append(executions, exec)
   }
@@ -763,6 +2125,388 @@ func (d *Database) GetHandlerExecutions(handlerID *string, limit int) ([]map[str
   return executions, rows.Err()
 }
 
+// EnqueueOutbound stores a send request to be delivered once the client reconnects
+func (d *Database) EnqueueOutbound(to string, message map[string]interface{}, ttl time.Duration) (int64, error) {
+  query := `
+  INSERT INTO outbound_queue (to_jid, message, queued_at, expires_at)
+  VALUES (?, ?, ?, ?)
+  `
+
+  messageJSON, err := json.Marshal(message)
+  if err != nil {
+    return 0, err
+  }
+
+  now := time.Now()
+  result, err := d.db.Exec(query, to, string(messageJSON), now, now.Add(ttl))
+  if err != nil {
+    return 0, err
+  }
+
+  return result.LastInsertId()
+}
+
+// GetPendingOutbound retrieves queued send requests that have not expired, oldest first
+func (d *Database) GetPendingOutbound() ([]map[string]interface{}, error) {
+  query := `
+  SELECT id, to_jid, message, queued_at, attempts
+  FROM outbound_queue
+  WHERE expires_at > ?
+  ORDER BY id ASC
+  `
+
+  rows, err := d.db.Query(query, time.Now())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var pending []map[string]interface{}
+  for rows.Next() {
+    var id int64
+    var to, messageJSON string
+    var queuedAt time.Time
+    var attempts int
+
+    if err := rows.Scan(&id, &to, &messageJSON, &queuedAt, &attempts); err != nil {
+      return nil, err
+    }
+
+    var message map[string]interface{}
+    json.Unmarshal([]byte(messageJSON), &message)
+
+    pending = append(pending, map[string]interface{}{
+      "id":        id,
+      "to":        to,
+      "message":   message,
+      "queued_at": queuedAt.Format(time.RFC3339),
+      "attempts":  attempts,
+    })
+  }
+
+  return pending, rows.Err()
+}
+
+// DeleteOutbound removes a queued send request once it has been delivered
+func (d *Database) DeleteOutbound(id int64) error {
+  query := `DELETE FROM outbound_queue WHERE id = ?`
+  _, err := d.db.Exec(query, id)
+  return err
+}
+
+// MarkOutboundAttempt records a failed delivery attempt for a queued send request
+func (d *Database) MarkOutboundAttempt(id int64, errorMsg string) error {
+  query := `UPDATE outbound_queue SET attempts = attempts + 1, last_error = ? WHERE id = ?`
+  _, err := d.db.Exec(query, errorMsg, id)
+  return err
+}
+
+// ExpireOutbound deletes queued send requests whose TTL has passed and returns how many were dropped
+func (d *Database) ExpireOutbound() (int64, error) {
+  query := `DELETE FROM outbound_queue WHERE expires_at <= ?`
+  result, err := d.db.Exec(query, time.Now())
+  if err != nil {
+    return 0, err
+  }
+  return result.RowsAffected()
+}
+
+// CountOutbound returns the number of send requests waiting in the outbound queue
+func (d *Database) CountOutbound() (int, error) {
+  query := `SELECT COUNT(*) FROM outbound_queue WHERE expires_at > ?`
+  var count int
+  err := d.db.QueryRow(query, time.Now()).Scan(&count)
+  return count, err
+}
+
+// PauseChat stops handlers running for a chat until ResumeChat, or until resumeAt if set
+func (d *Database) PauseChat(chatJID string, resumeAt *time.Time, reason string) error {
+  query := `INSERT OR REPLACE INTO paused_chats (chat_jid, paused_at, resume_at, reason) VALUES (?, ?, ?, ?)`
+
+  var reasonValue interface{}
+  if reason != "" {
+    reasonValue = reason
+  }
+  _, err := d.db.Exec(query, chatJID, time.Now(), resumeAt, reasonValue)
+  return err
+}
+
+// ResumeChat lets handlers run for a chat again. Returns false if it wasn't paused.
+func (d *Database) ResumeChat(chatJID string) (bool, error) {
+  result, err := d.db.Exec(`DELETE FROM paused_chats WHERE chat_jid = ?`, chatJID)
+  if err != nil {
+    return false, err
+  }
+  affected, err := result.RowsAffected()
+  return affected > 0, err
+}
+
+// GetPausedChats returns the paused chats, dropping pauses whose resume_at has passed
+func (d *Database) GetPausedChats() ([]map[string]interface{}, error) {
+  if _, err := d.db.Exec(`DELETE FROM paused_chats WHERE resume_at IS NOT NULL AND resume_at <= ?`, time.Now()); err != nil {
+    return nil, err
+  }
+
+  rows, err := d.db.Query(`SELECT chat_jid, paused_at, resume_at, reason FROM paused_chats ORDER BY paused_at DESC`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var chats []map[string]interface{}
+  for rows.Next() {
+    var chatJID string
+    var pausedAt time.Time
+    var resumeAt sql.NullTime
+    var reason sql.NullString
+
+    if err := rows.Scan(&chatJID, &pausedAt, &resumeAt, &reason); err != nil {
+      return nil, err
+    }
+
+    chat := map[string]interface{}{
+      "chat":      chatJID,
+      "paused_at": pausedAt.Format(time.RFC3339),
+    }
+    if resumeAt.Valid {
+      chat["resume_at"] = resumeAt.Time.Format(time.RFC3339)
+    }
+    if reason.Valid {
+      chat["reason"] = reason.String
+    }
+    chats = append(chats, chat)
+  }
+
+  return chats, rows.Err()
+}
+
+// SaveDeadLetter records a handler action that failed permanently, with the event that
+// triggered it, and returns its ID
+func (d *Database) SaveDeadLetter(handlerID string, actionType string, action map[string]interface{}, event map[string]interface{}, errorMsg string) (int64, error) {
+  query := `
+  INSERT INTO dead_letters (handler_id, action_type, action, event, error, failed_at)
+  VALUES (?, ?, ?, ?, ?, ?)
+  `
+
+  actionJSON, err := json.Marshal(action)
+  if err != nil {
+    return 0, err
+  }
+  eventJSON, err := json.Marshal(event)
+  if err != nil {
+    return 0, err
+  }
+
+  result, err := d.db.Exec(query, handlerID, actionType, string(actionJSON), string(eventJSON), errorMsg, time.Now())
+  if err != nil {
+    return 0, err
+  }
+  return result.LastInsertId()
+}
+
+// deadLetterColumns are the columns scanDeadLetter reads
+const deadLetterColumns = `id, handler_id, action_type, action, event, error, failed_at, retries, last_retry_at, resolved_at`
+
+// scanDeadLetter reads one dead_letters row selected with deadLetterColumns
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+  var id int64
+  var handlerID, eventJSON sql.NullString
+  var actionType, actionJSON, errorMsg string
+  var failedAt time.Time
+  var retries int
+  var lastRetryAt, resolvedAt sql.NullTime
+
+  if err := row.Scan(&id, &handlerID, &actionType, &actionJSON, &eventJSON, &errorMsg, &failedAt, &retries, &lastRetryAt, &resolvedAt); err != nil {
+    return nil, err
+  }
+
+  var action, event map[string]interface{}
+  json.Unmarshal([]byte(actionJSON), &action)
+  json.Unmarshal([]byte(eventJSON.String), &event)
+
+  letter := map[string]interface{}{
+    "id":          id,
+    "handler_id":  handlerID.String,
+    "action_type": actionType,
+    "action":      action,
+    "event":       event,
+    "error":       errorMsg,
+    "failed_at":   failedAt.Format(time.RFC3339),
+    "retries":     retries,
+    "resolved":    resolvedAt.Valid,
+  }
+  if lastRetryAt.Valid {
+    letter["last_retry_at"] = lastRetryAt.Time.Format(time.RFC3339)
+  }
+  if resolvedAt.Valid {
+    letter["resolved_at"] = resolvedAt.Time.Format(time.RFC3339)
+  }
+  return letter, nil
+}
+
+// GetDeadLetters retrieves failed actions, newest first. Resolved ones (retried successfully)
+// are only included when asked for.
+func (d *Database) GetDeadLetters(limit int, handlerID *string, includeResolved bool) ([]map[string]interface{}, error) {
+  query := `SELECT ` + deadLetterColumns + ` FROM dead_letters WHERE 1=1`
+  args := []interface{}{}
+
+  if handlerID != nil {
+    query += ` AND handler_id = ?`
+    args = append(args, *handlerID)
+  }
+  if !includeResolved {
+    query += ` AND resolved_at IS NULL`
+  }
+
+  query += ` ORDER BY failed_at DESC, id DESC LIMIT ?`
+  args = append(args, limit)
+
+  rows, err := d.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  letters := []map[string]interface{}{}
+  for rows.Next() {
+    letter, err := scanDeadLetter(rows)
+    if err != nil {
+      return nil, err
+    }
+    letters = append(letters, letter)
+  }
+  return letters, rows.Err()
+}
+
+// GetDeadLetter retrieves one failed action by ID
+func (d *Database) GetDeadLetter(id int64) (map[string]interface{}, error) {
+  row := d.db.QueryRow(`SELECT `+deadLetterColumns+` FROM dead_letters WHERE id = ?`, id)
+  letter, err := scanDeadLetter(row)
+  if err == sql.ErrNoRows {
+    return nil, fmt.Errorf("dead letter not found: %d", id)
+  }
+  return letter, err
+}
+
+// MarkDeadLetterRetry records a retry of a failed action: resolved when errorMsg is empty,
+// otherwise the new error replaces the old one
+func (d *Database) MarkDeadLetterRetry(id int64, errorMsg string) error {
+  now := time.Now()
+  if errorMsg == "" {
+    _, err := d.db.Exec(`UPDATE dead_letters SET retries = retries + 1, last_retry_at = ?, resolved_at = ? WHERE id = ?`, now, now, id)
+    return err
+  }
+  _, err := d.db.Exec(`UPDATE dead_letters SET retries = retries + 1, last_retry_at = ?, error = ? WHERE id = ?`, now, errorMsg, id)
+  return err
+}
+
+// SaveTemplate creates or replaces a message template, keeping its created_at
+func (d *Database) SaveTemplate(name string, description string, template interface{}, defaults map[string]interface{}) error {
+  query := `
+  INSERT INTO templates (name, description, template, defaults, created_at, updated_at)
+  VALUES (?, ?, ?, ?, ?, ?)
+  ON CONFLICT(name) DO UPDATE SET
+    description = excluded.description,
+    template = excluded.template,
+    defaults = excluded.defaults,
+    updated_at = excluded.updated_at
+  `
+
+  templateJSON, err := json.Marshal(template)
+  if err != nil {
+    return err
+  }
+  var defaultsValue interface{}
+  if len(defaults) > 0 {
+    defaultsJSON, err := json.Marshal(defaults)
+    if err != nil {
+      return err
+    }
+    defaultsValue = string(defaultsJSON)
+  }
+  var descriptionValue interface{}
+  if description != "" {
+    descriptionValue = description
+  }
+
+  now := time.Now()
+  _, err = d.db.Exec(query, name, descriptionValue, string(templateJSON), defaultsValue, now, now)
+  return err
+}
+
+// templateColumns are the columns scanTemplate reads
+const templateColumns = `name, description, template, defaults, created_at, updated_at`
+
+// scanTemplate reads one templates row selected with templateColumns, in the same shape as
+// a method registry message_templates entry
+func scanTemplate(row interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+  var name, templateJSON string
+  var description, defaultsJSON sql.NullString
+  var createdAt, updatedAt time.Time
+
+  if err := row.Scan(&name, &description, &templateJSON, &defaultsJSON, &createdAt, &updatedAt); err != nil {
+    return nil, err
+  }
+
+  var body interface{}
+  json.Unmarshal([]byte(templateJSON), &body)
+
+  template := map[string]interface{}{
+    "name":       name,
+    "template":   body,
+    "created_at": createdAt.Format(time.RFC3339),
+    "updated_at": updatedAt.Format(time.RFC3339),
+  }
+  if description.Valid {
+    template["description"] = description.String
+  }
+  if defaultsJSON.Valid {
+    var defaults map[string]interface{}
+    json.Unmarshal([]byte(defaultsJSON.String), &defaults)
+    template["defaults"] = defaults
+  }
+  return template, nil
+}
+
+// GetTemplate retrieves a saved message template by name
+func (d *Database) GetTemplate(name string) (map[string]interface{}, error) {
+  row := d.db.QueryRow(`SELECT `+templateColumns+` FROM templates WHERE name = ?`, name)
+  template, err := scanTemplate(row)
+  if err == sql.ErrNoRows {
+    return nil, fmt.Errorf("template not found: %s", name)
+  }
+  return template, err
+}
+
+// ListTemplates retrieves every saved message template, by name
+func (d *Database) ListTemplates() ([]map[string]interface{}, error) {
+  rows, err := d.db.Query(`SELECT ` + templateColumns + ` FROM templates ORDER BY name`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  templates := []map[string]interface{}{}
+  for rows.Next() {
+    template, err := scanTemplate(rows)
+    if err != nil {
+      return nil, err
+    }
+    templates = append(templates, template)
+  }
+  return templates, rows.Err()
+}
+
+// DeleteTemplate removes a saved message template. Returns false if there was none.
+func (d *Database) DeleteTemplate(name string) (bool, error) {
+  result, err := d.db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+  if err != nil {
+    return false, err
+  }
+  affected, err := result.RowsAffected()
+  return affected > 0, err
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
   return d.db.Close()
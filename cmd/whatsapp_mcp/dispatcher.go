@@ -9,8 +9,11 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
 	"go.mau.fi/whatsmeow/proto/waE2E"
 	"go.mau.fi/whatsmeow/types"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -24,6 +27,17 @@ type MethodRegistry struct {
 	Methods          map[string]MethodSpec `json:"methods"`
 	MessageTemplates map[string]interface{} `json:"message_templates"`
 	TypeNotes        map[string]string      `json:"type_notes"`
+
+	// Invalid lists method entries skipped while loading, with the reason
+	Invalid map[string]string `json:"-"`
+}
+
+// rawMethodRegistry is a registry file with its methods left undecoded, so that one
+// malformed entry can be skipped without rejecting the whole file
+type rawMethodRegistry struct {
+	Methods          map[string]json.RawMessage `json:"methods"`
+	MessageTemplates map[string]interface{}     `json:"message_templates"`
+	TypeNotes        map[string]string          `json:"type_notes"`
 }
 
 // MethodSpec defines a callable method
@@ -49,16 +63,177 @@ type ParamSpec struct {
 }
 
 var globalMethodRegistry *MethodRegistry
+var methodRegistryMutex sync.RWMutex
+
+// categoryLocks serializes calls to methods in the serialized_method_categories config,
+// one lock per category so unrelated categories still run in parallel
+var categoryLocks = make(map[string]*sync.Mutex)
+var categoryLocksMutex sync.Mutex
+
+// lockMethodCategory takes the lock for a method category and returns its unlock function
+func lockMethodCategory(category string) func() {
+	categoryLocksMutex.Lock()
+	lock, ok := categoryLocks[category]
+	if !ok {
+		lock = &sync.Mutex{}
+		categoryLocks[category] = lock
+	}
+	categoryLocksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
 
-// LoadMethodRegistry loads the method registry from embedded JSON
+// getMethodRegistry returns the currently loaded method registry
+func getMethodRegistry() *MethodRegistry {
+	methodRegistryMutex.RLock()
+	defer methodRegistryMutex.RUnlock()
+	return globalMethodRegistry
+}
+
+// LoadMethodRegistry loads the method registry from embedded JSON, then merges the
+// external registry file from method_registry_path (if configured) over it by name.
+// Invalid method entries are skipped and listed in the registry's Invalid map.
+// On error the previously loaded registry is kept.
 func LoadMethodRegistry() error {
-	globalMethodRegistry = &MethodRegistry{}
-	if err := json.Unmarshal(methodRegistryJSON, globalMethodRegistry); err != nil {
+	registry := &MethodRegistry{
+		Methods: make(map[string]MethodSpec),
+		Invalid: make(map[string]string),
+	}
+	if err := mergeMethodRegistry(registry, methodRegistryJSON); err != nil {
 		return fmt.Errorf("failed to load method registry: %w", err)
 	}
+
+	if global_config != nil {
+		if path := global_config.GetMethodRegistryPath(); path != "" {
+			if err := mergeMethodRegistryFile(registry, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	methodRegistryMutex.Lock()
+	globalMethodRegistry = registry
+	methodRegistryMutex.Unlock()
+	return nil
+}
+
+// unmatchedMethodCategories returns the serialized_method_categories that no method in the
+// loaded registry has, since serializing them protects nothing
+func unmatchedMethodCategories() []string {
+	registry := getMethodRegistry()
+	if registry == nil || global_config == nil {
+		return nil
+	}
+
+	used := make(map[string]bool)
+	for _, spec := range registry.Methods {
+		used[spec.Category] = true
+	}
+	var unmatched []string
+	for _, category := range global_config.GetSerializedMethodCategories() {
+		if !used[category] {
+			unmatched = append(unmatched, category)
+		}
+	}
+	return unmatched
+}
+
+// warnUnmatchedMethodCategories logs a warning listing serialized_method_categories that
+// match no registry method (usually a typo), and returns them
+func warnUnmatchedMethodCategories() []string {
+	unmatched := unmatchedMethodCategories()
+	if len(unmatched) > 0 && global_error_state != nil {
+		global_error_state.LogError(ErrorSeverityWarning, "method_registry",
+			"serialized_method_categories match no registry method",
+			fmt.Sprintf("Unmatched categories: %s", strings.Join(unmatched, ", ")))
+	}
+	return unmatched
+}
+
+// mergeMethodRegistryFile reads an external registry and merges its entries over registry
+func mergeMethodRegistryFile(registry *MethodRegistry, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read external method registry: %w", err)
+	}
+
+	if err := mergeMethodRegistry(registry, data); err != nil {
+		return fmt.Errorf("failed to parse external method registry %s: %w", path, err)
+	}
 	return nil
 }
 
+// mergeMethodRegistry parses registry JSON and merges its entries over registry by name.
+// Only a malformed file is an error; invalid method entries are recorded in registry.Invalid.
+func mergeMethodRegistry(registry *MethodRegistry, data []byte) error {
+	external := &rawMethodRegistry{}
+	if err := json.Unmarshal(data, external); err != nil {
+		return err
+	}
+
+	for name, raw := range external.Methods {
+		var spec MethodSpec
+		if err := json.Unmarshal(raw, &spec); err != nil {
+			registry.Invalid[name] = err.Error()
+			continue
+		}
+		if spec.Name == "" {
+			spec.Name = name
+		}
+		if err := validateMethodSpec(spec); err != nil {
+			registry.Invalid[name] = err.Error()
+			continue
+		}
+		registry.Methods[name] = spec
+		delete(registry.Invalid, name)
+	}
+
+	if registry.MessageTemplates == nil {
+		registry.MessageTemplates = make(map[string]interface{})
+	}
+	for name, template := range external.MessageTemplates {
+		registry.MessageTemplates[name] = template
+	}
+
+	if registry.TypeNotes == nil {
+		registry.TypeNotes = make(map[string]string)
+	}
+	for name, note := range external.TypeNotes {
+		registry.TypeNotes[name] = note
+	}
+
+	return nil
+}
+
+// validateMethodSpec checks that a registry entry has what CallWhatsmeowMethod needs:
+// a name and parameters with names and supported types
+func validateMethodSpec(spec MethodSpec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	for i, param := range spec.Params {
+		if param.Name == "" {
+			return fmt.Errorf("parameter %d has no name", i)
+		}
+		if !isSupportedParamType(param.Type) {
+			return fmt.Errorf("parameter '%s' has unsupported type %q", param.Name, param.Type)
+		}
+	}
+	return nil
+}
+
+// isSupportedParamType reports whether convertParam can convert values of a registry type
+func isSupportedParamType(paramType string) bool {
+	switch paramType {
+	case "context", "jid", "string", "int", "bool", "time", "duration",
+		"chatpresence", "chatpresencemedia", "presence", "patchname", "interface", "object",
+		"[]jid", "[]string", "proto:waE2E.Message":
+		return true
+	}
+	return false
+}
+
 // Type converters
 
 func convertToContext(v interface{}) (reflect.Value, error) {
@@ -73,13 +248,22 @@ func convertToJID(v interface{}) (reflect.Value, error) {
 		return reflect.Value{}, fmt.Errorf("JID must be string, got %T", v)
 	}
 
+	jid, err := parseJID(str)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(jid), nil
+}
+
+// parseJID parses a full JID or a bare phone number (which gets @s.whatsapp.net added)
+func parseJID(str string) (types.JID, error) {
 	// If already contains @, parse as-is
 	if strings.Contains(str, "@") {
 		jid, err := types.ParseJID(str)
 		if err != nil {
-			return reflect.Value{}, fmt.Errorf("invalid JID: %w", err)
+			return types.EmptyJID, fmt.Errorf("invalid JID: %w", err)
 		}
-		return reflect.ValueOf(jid), nil
+		return jid, nil
 	}
 
 	// Otherwise, assume phone number and add @s.whatsapp.net
@@ -87,14 +271,13 @@ func convertToJID(v interface{}) (reflect.Value, error) {
 	phone := regexp.MustCompile(`[^\d+]`).ReplaceAllString(str, "")
 	
 	if len(phone) < 7 {
-		return reflect.Value{}, fmt.Errorf("invalid phone number: too short (%s)", phone)
+		return types.EmptyJID, fmt.Errorf("invalid phone number: too short (%s)", phone)
 	}
 
 	// Remove leading + if present
 	phone = strings.TrimPrefix(phone, "+")
 
-	jid := types.NewJID(phone, types.DefaultUserServer)
-	return reflect.ValueOf(jid), nil
+	return types.NewJID(phone, types.DefaultUserServer), nil
 }
 
 func convertToJIDSlice(v interface{}) (reflect.Value, error) {
@@ -229,6 +412,22 @@ func convertToPresence(v interface{}) (reflect.Value, error) {
 	return reflect.ValueOf(presence), nil
 }
 
+func convertToPatchName(v interface{}) (reflect.Value, error) {
+	str, ok := v.(string)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("app state name must be string, got %T", v)
+	}
+
+	names := make([]string, 0, len(appstate.AllPatchNames))
+	for _, name := range appstate.AllPatchNames {
+		if string(name) == str {
+			return reflect.ValueOf(name), nil
+		}
+		names = append(names, string(name))
+	}
+	return reflect.Value{}, fmt.Errorf("invalid app state name: %s (must be one of %s)", str, strings.Join(names, ", "))
+}
+
 func convertToInt(v interface{}) (reflect.Value, error) {
 	switch val := v.(type) {
 	case float64:
@@ -310,6 +509,8 @@ func convertParam(paramSpec ParamSpec, value interface{}) (reflect.Value, error)
 		return convertToChatPresenceMedia(value)
 	case "presence":
 		return convertToPresence(value)
+	case "patchname":
+		return convertToPatchName(value)
 	case "interface", "object":
 		// Pass through as-is (for complex types we don't yet support)
 		return reflect.ValueOf(value), nil
@@ -320,17 +521,36 @@ func convertParam(paramSpec ParamSpec, value interface{}) (reflect.Value, error)
 
 // CallWhatsmeowMethod calls a whatsmeow client method via reflection
 func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *OperationResult {
+	return CallWhatsmeowMethodContext(context.Background(), methodName, params)
+}
+
+// CallWhatsmeowMethodContext calls a whatsmeow client method via reflection,
+// passing ctx to methods that accept a context so the call can be cancelled
+func CallWhatsmeowMethodContext(ctx context.Context, methodName string, params map[string]interface{}) *OperationResult {
 	// Panic recovery - catch any panics during reflection/execution
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Panic in CallWhatsmeowMethod: %v\n", r)
+			fmt.Fprintf(logStderr, "[ERROR] Panic in CallWhatsmeowMethod: %v\n", r)
 			// Note: We can't modify the return value here, but the panic won't crash the server
 		}
 	}()
 
 	// Check if method exists in registry
-	methodSpec, exists := globalMethodRegistry.Methods[methodName]
+	registry := getMethodRegistry()
+	if registry == nil {
+		return &OperationResult{
+			Success: false,
+			Error:   "method registry not loaded (check the startup log for registry errors)",
+		}
+	}
+	methodSpec, exists := registry.Methods[methodName]
 	if !exists {
+		if reason, invalid := registry.Invalid[methodName]; invalid {
+			return &OperationResult{
+				Success: false,
+				Error:   fmt.Sprintf("method %s was skipped because its registry entry is invalid: %s", methodName, reason),
+			}
+		}
 		return &OperationResult{
 			Success: false,
 			Error:   fmt.Sprintf("unknown method: %s", methodName),
@@ -338,7 +558,7 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 	}
 
 	// Check if client is available
-	if global_whatsapp_client == nil || global_whatsapp_client.client == nil {
+	if global_whatsapp_client == nil || global_whatsapp_client.Client() == nil {
 		return &OperationResult{
 			Success: false,
 			Error:   "WhatsApp client not initialized or not connected",
@@ -346,7 +566,7 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 	}
 
 	// Get method via reflection
-	client := global_whatsapp_client.client
+	client := global_whatsapp_client.Client()
 	method := reflect.ValueOf(client).MethodByName(methodName)
 	if !method.IsValid() {
 		return &OperationResult{
@@ -362,7 +582,7 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 	// We'll add it automatically if needed
 	methodType := method.Type()
 	if methodType.NumIn() > 0 && methodType.In(0).String() == "context.Context" {
-		args = append(args, reflect.ValueOf(context.Background()))
+		args = append(args, reflect.ValueOf(ctx))
 	}
 
 	// Convert remaining parameters based on spec
@@ -379,7 +599,11 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 					Error:   fmt.Sprintf("required parameter '%s' missing", paramSpec.Name),
 				}
 			}
-			// Use zero value for optional params
+			// Use zero value for optional params that precede others; trailing
+			// optional (and variadic) params can simply be left out
+			if len(args) < fixedParamCount(methodType) {
+				args = append(args, reflect.Zero(methodType.In(len(args))))
+			}
 			continue
 		}
 
@@ -394,6 +618,37 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 		args = append(args, arg)
 	}
 
+	// Variadic methods get their trailing arguments packed into a single slice
+	callSlice := false
+	if methodType.IsVariadic() && len(args) > fixedParamCount(methodType) {
+		variadicArgs, err := buildVariadicArgs(methodType, args[fixedParamCount(methodType):])
+		if err != nil {
+			return &OperationResult{
+				Success: false,
+				Error:   fmt.Sprintf("parameter '%s': %v", methodSpec.Params[len(methodSpec.Params)-1].Name, err),
+			}
+		}
+		args = append(args[:fixedParamCount(methodType)], variadicArgs)
+		callSlice = true
+	}
+
+	// Media downloads share one concurrency limit
+	if strings.HasPrefix(methodName, "Download") {
+		if err := global_download_limiter.acquire(ctx); err != nil {
+			return &OperationResult{
+				Success: false,
+				Error:   fmt.Sprintf("%s cancelled while waiting for a download slot: %v", methodName, err),
+			}
+		}
+		defer global_download_limiter.release()
+	}
+
+	// Methods that mutate shared client state (e.g. app-state sync) can race inside
+	// whatsmeow, so their categories run one call at a time
+	if methodSpec.Category != "" && global_config != nil && global_config.IsMethodCategorySerialized(methodSpec.Category) {
+		defer lockMethodCategory(methodSpec.Category)()
+	}
+
 	// Call the method with panic recovery
 	var results []reflect.Value
 	var callPanic interface{}
@@ -404,6 +659,10 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 				callPanic = r
 			}
 		}()
+		if callSlice {
+			results = method.CallSlice(args)
+			return
+		}
 		results = method.Call(args)
 	}()
 	
@@ -442,6 +701,45 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 		}
 	}
 
+	// Track "typing..." so it can't get stuck if nothing follows it
+	if methodName == "SendChatPresence" {
+		var chat types.JID
+		var state types.ChatPresence
+		for _, arg := range args {
+			switch v := arg.Interface().(type) {
+			case types.JID:
+				chat = v
+			case types.ChatPresence:
+				state = v
+			}
+		}
+		if state == types.ChatPresenceComposing {
+			global_typing_tracker.composing(chat)
+		} else {
+			global_typing_tracker.clear(chat)
+		}
+	}
+
+	// Keep our own sent messages in the local history
+	if methodName == "SendMessage" && len(results) > 1 {
+		if resp, ok := results[0].Interface().(whatsmeow.SendResponse); ok {
+			var to types.JID
+			var message *waE2E.Message
+			for _, arg := range args {
+				switch v := arg.Interface().(type) {
+				case types.JID:
+					to = v
+				case *waE2E.Message:
+					message = v
+				}
+			}
+			if message != nil && !to.IsEmpty() {
+				global_typing_tracker.clear(to)
+				global_whatsapp_client.storeSentMessage(to, message, resp)
+			}
+		}
+	}
+
 	// Convert first return value to map (if not error-only)
 	if len(results) > 1 {
 		firstResult := results[0].Interface()
@@ -460,6 +758,58 @@ func CallWhatsmeowMethod(methodName string, params map[string]interface{}) *Oper
 	}
 }
 
+// fixedParamCount returns the number of non-variadic parameters of a method
+func fixedParamCount(methodType reflect.Type) int {
+	if methodType.IsVariadic() {
+		return methodType.NumIn() - 1
+	}
+	return methodType.NumIn()
+}
+
+// buildVariadicArgs assembles the trailing arguments of a variadic method into the
+// slice passed to CallSlice. Each value may already be the whole slice, a single
+// element, or a JSON-like value (map/array) that is decoded into the element type.
+func buildVariadicArgs(methodType reflect.Type, values []reflect.Value) (reflect.Value, error) {
+	sliceType := methodType.In(methodType.NumIn() - 1)
+	elemType := sliceType.Elem()
+
+	if len(values) == 1 && values[0].IsValid() && values[0].Type().AssignableTo(sliceType) {
+		return values[0], nil
+	}
+
+	slice := reflect.MakeSlice(sliceType, 0, len(values))
+	for _, value := range values {
+		if value.IsValid() && value.Type().AssignableTo(elemType) {
+			slice = reflect.Append(slice, value)
+			continue
+		}
+
+		// A JSON array supplies several variadic values at once
+		var items []interface{}
+		if value.IsValid() {
+			if arr, ok := value.Interface().([]interface{}); ok {
+				items = arr
+			} else {
+				items = []interface{}{value.Interface()}
+			}
+		}
+
+		for _, item := range items {
+			elem := reflect.New(elemType)
+			jsonBytes, err := json.Marshal(item)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("variadic argument: %w", err)
+			}
+			if err := json.Unmarshal(jsonBytes, elem.Interface()); err != nil {
+				return reflect.Value{}, fmt.Errorf("variadic argument must be %s: %w", elemType, err)
+			}
+			slice = reflect.Append(slice, elem.Elem())
+		}
+	}
+
+	return slice, nil
+}
+
 // convertToMap converts a value to a map for JSON serialization
 func convertToMap(v interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// variadicOption is a struct element type for variadic test methods
+type variadicOption struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// variadicTarget has methods shaped like the whatsmeow client's fixed and variadic ones
+type variadicTarget struct{}
+
+func (variadicTarget) Fixed(ctx context.Context, jid string, count int) int { return count }
+
+func (variadicTarget) Tags(ctx context.Context, prefix string, tags ...string) []string { return tags }
+
+func (variadicTarget) Options(ctx context.Context, opts ...variadicOption) []variadicOption {
+	return opts
+}
+
+func variadicMethodType(t *testing.T, name string) reflect.Type {
+	t.Helper()
+	method := reflect.ValueOf(variadicTarget{}).MethodByName(name)
+	if !method.IsValid() {
+		t.Fatalf("no method %s", name)
+	}
+	return method.Type()
+}
+
+func TestFixedParamCount(t *testing.T) {
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{"Fixed", 3},
+		{"Tags", 2},
+		{"Options", 1},
+	}
+	for _, test := range tests {
+		if got := fixedParamCount(variadicMethodType(t, test.method)); got != test.want {
+			t.Errorf("fixedParamCount(%s) = %d, want %d", test.method, got, test.want)
+		}
+	}
+}
+
+func TestBuildVariadicArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		values  []interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"empty", "Tags", nil, []string{}, false},
+		{"single element", "Tags", []interface{}{"a"}, []string{"a"}, false},
+		{"many elements", "Tags", []interface{}{"a", "b", "c"}, []string{"a", "b", "c"}, false},
+		{"whole slice", "Tags", []interface{}{[]string{"a", "b"}}, []string{"a", "b"}, false},
+		{"json array", "Tags", []interface{}{[]interface{}{"a", "b"}}, []string{"a", "b"}, false},
+		{"struct element", "Options", []interface{}{variadicOption{Name: "x", Value: 1}}, []variadicOption{{Name: "x", Value: 1}}, false},
+		{"json objects", "Options", []interface{}{
+			map[string]interface{}{"name": "x", "value": 1},
+			map[string]interface{}{"name": "y", "value": 2},
+		}, []variadicOption{{Name: "x", Value: 1}, {Name: "y", Value: 2}}, false},
+		{"json array of objects", "Options", []interface{}{[]interface{}{
+			map[string]interface{}{"name": "x"},
+			map[string]interface{}{"name": "y"},
+		}}, []variadicOption{{Name: "x"}, {Name: "y"}}, false},
+		{"wrong type for string", "Tags", []interface{}{map[string]interface{}{"name": "x"}}, nil, true},
+		{"wrong type for struct", "Options", []interface{}{"x"}, nil, true},
+		{"wrong field type", "Options", []interface{}{map[string]interface{}{"value": "one"}}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mt := variadicMethodType(t, test.method)
+			values := make([]reflect.Value, len(test.values))
+			for i, value := range test.values {
+				values[i] = reflect.ValueOf(value)
+			}
+
+			got, err := buildVariadicArgs(mt, values)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("buildVariadicArgs = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildVariadicArgs: %v", err)
+			}
+			if !reflect.DeepEqual(got.Interface(), test.want) {
+				t.Fatalf("buildVariadicArgs = %#v, want %#v", got.Interface(), test.want)
+			}
+
+			// The result must be callable the way the dispatcher calls it
+			args := []reflect.Value{reflect.ValueOf(context.Background())}
+			if test.method == "Tags" {
+				args = append(args, reflect.ValueOf("prefix"))
+			}
+			args = append(args, got)
+			result := reflect.ValueOf(variadicTarget{}).MethodByName(test.method).CallSlice(args)
+			if !reflect.DeepEqual(result[0].Interface(), test.want) {
+				t.Errorf("method received %#v, want %#v", result[0].Interface(), test.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+  "crypto/sha256"
+  "encoding/hex"
   "fmt"
+  "io"
+  "os"
+  "regexp"
   "runtime/debug"
   "time"
 
@@ -17,8 +22,29 @@ func NewErrorState(max_recent_errors int) *ErrorState {
   }
 }
 
-// LogError logs an error to the error state
+// LogError logs an error to the error state, and to the error_log table if it is at least
+// db_log_min_severity. Lower severities stay in memory, so routine info events such as each
+// received message don't grow the table.
 func (es *ErrorState) LogError(severity ErrorSeverity, operation string, message string, details string) *ErrorEntry {
+  entry := es.record(severity, operation, message, details)
+
+  if global_database != nil && shouldPersistError(severity) {
+    global_database.LogError(entry)
+  }
+  return entry
+}
+
+// shouldPersistError checks a severity against the db_log_min_severity config
+func shouldPersistError(severity ErrorSeverity) bool {
+  minSeverity := ErrorSeverityWarning
+  if global_config != nil {
+    minSeverity = global_config.GetDBLogMinSeverity()
+  }
+  return errorSeverityRank[severity] >= errorSeverityRank[minSeverity]
+}
+
+// record adds an entry to the in-memory error state
+func (es *ErrorState) record(severity ErrorSeverity, operation string, message string, details string) *ErrorEntry {
   es.mu.Lock()
   defer es.mu.Unlock()
 
@@ -27,12 +53,12 @@ func (es *ErrorState) LogError(severity ErrorSeverity, operation string, message
     Timestamp: time.Now(),
     Severity:  severity,
     Operation: operation,
-    Message:   message,
-    Details:   details,
+    Message:   sanitizeJID(message),
+    Details:   sanitizeJID(details),
   }
 
-  // Capture stack trace for errors and critical errors
-  if severity == ErrorSeverityError || severity == ErrorSeverityCritical {
+  // Capture stack trace according to the configured level
+  if shouldCaptureStackTrace(severity) {
     entry.StackTrace = string(debug.Stack())
   }
 
@@ -52,6 +78,56 @@ func (es *ErrorState) LogError(severity ErrorSeverity, operation string, message
   return entry
 }
 
+// shouldCaptureStackTrace checks the capture_stack_traces config for the given severity
+func shouldCaptureStackTrace(severity ErrorSeverity) bool {
+  level := StackTracesCriticalOnly
+  if global_config != nil {
+    level = global_config.GetCaptureStackTraces()
+  }
+
+  switch level {
+  case StackTracesAll:
+    return true
+  case StackTracesNone:
+    return false
+  default:
+    return severity == ErrorSeverityCritical
+  }
+}
+
+// jidPattern matches the user (and optional device) portion of a JID in free text
+var jidPattern = regexp.MustCompile(`([0-9A-Za-z.\-_]+)((?::\d+)?@(?:s\.whatsapp\.net|c\.us|g\.us|lid|broadcast|newsletter|bot|hosted|hosted\.lid))`)
+
+// sanitizeJID replaces the user portion of every JID in text with a stable truncated hash
+// when hash_jids_in_logs is enabled, so logs stay correlatable without exposing phone numbers
+func sanitizeJID(text string) string {
+  if global_config == nil || !global_config.GetHashJIDsInLogs() || text == "" {
+    return text
+  }
+
+  return jidPattern.ReplaceAllStringFunc(text, func(jid string) string {
+    parts := jidPattern.FindStringSubmatch(jid)
+    sum := sha256.Sum256([]byte(parts[1]))
+    return "h" + hex.EncodeToString(sum[:])[:10] + parts[2]
+  })
+}
+
+// logStderr is where log lines go: stderr, with JIDs hashed when hash_jids_in_logs is enabled.
+// zerolog writes through it too.
+var logStderr io.Writer = sanitizingWriter{out: os.Stderr}
+
+// sanitizingWriter passes everything written to it through sanitizeJID
+type sanitizingWriter struct {
+  out io.Writer
+}
+
+func (w sanitizingWriter) Write(p []byte) (int, error) {
+  if _, err := io.WriteString(w.out, sanitizeJID(string(p))); err != nil {
+    return 0, err
+  }
+  return len(p), nil
+}
+
 // GetCriticalError returns the current critical error, if any
 func (es *ErrorState) GetCriticalError() *ErrorEntry {
   es.mu.RLock()
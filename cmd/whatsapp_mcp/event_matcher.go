@@ -1,10 +1,16 @@
 package main
 
 import (
+  "fmt"
   "regexp"
   "strings"
   "sync"
   "time"
+  "unicode"
+
+  "golang.org/x/text/runes"
+  "golang.org/x/text/transform"
+  "golang.org/x/text/unicode/norm"
 )
 
 // EventMatcher handles matching events against handler filters
@@ -12,6 +18,10 @@ type EventMatcher struct {
   database      *Database
   handlers      []map[string]interface{}
   handlersMutex sync.RWMutex
+  // Indexes into handlers by filter event_types, so an event is only checked against
+  // handlers that can match its type. untyped holds handlers without event_types.
+  handlersByType map[string][]int
+  untyped        []int
   rateLimits    map[string]*RateLimiter
   limitsMutex   sync.RWMutex
 }
@@ -21,6 +31,7 @@ type RateLimiter struct {
   perMinuteCounts map[int64]int
   perHourCounts   map[int64]int
   perSenderCounts map[string]map[int64]int
+  perSenderLast   map[string]time.Time
   lastExecution   time.Time
   mutex           sync.Mutex
 }
@@ -50,23 +61,69 @@ func (em *EventMatcher) LoadHandlers() error {
     handlerID := h["handler_id"].(string)
     fullHandler, err := em.database.GetHandler(handlerID)
     if err != nil {
-      continue // skip invalid handlers
+      // skip invalid handlers, but say so rather than have them silently stop running
+      global_error_state.LogError(ErrorSeverityWarning, "load_handlers", fmt.Sprintf("Skipped handler '%s' that failed to load", handlerID), err.Error())
+      continue
     }
     fullHandlers = append(fullHandlers, fullHandler)
   }
 
   em.handlers = fullHandlers
+  em.indexHandlers()
   return nil
 }
 
-// MatchEvent finds all handlers that match the given event
+// indexHandlers rebuilds the event type index. Called with handlersMutex held.
+func (em *EventMatcher) indexHandlers() {
+  em.handlersByType = make(map[string][]int)
+  em.untyped = nil
+  for i, handler := range em.handlers {
+    filter, _ := handler["event_filter"].(map[string]interface{})
+    eventTypes, _ := filter["event_types"].([]interface{})
+    indexed := false
+    for _, t := range eventTypes {
+      if eventType, ok := t.(string); ok {
+        em.handlersByType[eventType] = append(em.handlersByType[eventType], i)
+        indexed = true
+      }
+    }
+    if !indexed {
+      em.untyped = append(em.untyped, i)
+    }
+  }
+}
+
+// candidateHandlers returns the handlers that could match an event of the given type, in
+// load order. Called with handlersMutex held.
+func (em *EventMatcher) candidateHandlers(eventType string) []map[string]interface{} {
+  typed := em.handlersByType[eventType]
+  candidates := make([]map[string]interface{}, 0, len(typed)+len(em.untyped))
+
+  // Merge the two sorted index lists, keeping load order for equal priorities
+  i, j := 0, 0
+  for i < len(typed) || j < len(em.untyped) {
+    if j == len(em.untyped) || (i < len(typed) && typed[i] < em.untyped[j]) {
+      candidates = append(candidates, em.handlers[typed[i]])
+      i++
+    } else {
+      candidates = append(candidates, em.handlers[em.untyped[j]])
+      j++
+    }
+  }
+  return candidates
+}
+
+// MatchEvent finds all handlers that match the given event. It returns deep copies, so the
+// executor goroutines own their handler maps and a concurrent LoadHandlers can't change a
+// handler while it runs.
 func (em *EventMatcher) MatchEvent(event map[string]interface{}) []map[string]interface{} {
   em.handlersMutex.RLock()
   defer em.handlersMutex.RUnlock()
 
   var matches []map[string]interface{}
 
-  for _, handler := range em.handlers {
+  eventType, _ := event["event_type"].(string)
+  for _, handler := range em.candidateHandlers(eventType) {
     // Check if handler is enabled
     if enabled, ok := handler["enabled"].(bool); !ok || !enabled {
       continue
@@ -82,14 +139,9 @@ func (em *EventMatcher) MatchEvent(event map[string]interface{}) []map[string]in
       continue
     }
 
-    // Check cooldown
-    if !em.checkCooldown(handler) {
-      continue
-    }
-
-    // Check event filter
-    if em.matchesFilter(handler, event) {
-      matches = append(matches, handler)
+    // Check event filter, then claim the cooldown so a concurrent event can't also pass it
+    if em.matchesFilter(handler, event) && em.reserveCooldown(handler, event) {
+      matches = append(matches, deepCopyValue(handler).(map[string]interface{}))
     }
   }
 
@@ -106,6 +158,15 @@ func (em *EventMatcher) matchesFilter(handler map[string]interface{}, event map[
     return false
   }
 
+  // Skip our own messages unless the handler opts in, to avoid reply loops
+  if eventIsFromMe, _ := event["is_from_me"].(bool); eventIsFromMe && global_config != nil && global_config.GetIgnoreOwnMessages() {
+    includeFromMe, _ := filter["include_from_me"].(bool)
+    wantsFromMe, _ := filter["is_from_me"].(bool)
+    if !includeFromMe && !wantsFromMe {
+      return false
+    }
+  }
+
   // Check event_types
   if eventTypes, ok := filter["event_types"].([]interface{}); ok && len(eventTypes) > 0 {
     eventType, _ := event["event_type"].(string)
@@ -130,6 +191,14 @@ func (em *EventMatcher) matchesFilter(handler map[string]interface{}, event map[
     }
   }
 
+  // Check selected_ids (the option tapped in a button_reply or list_reply)
+  if selectedIDs, ok := filter["selected_ids"].([]interface{}); ok && len(selectedIDs) > 0 {
+    selectedID, _ := event["selected_id"].(string)
+    if !containsString(selectedIDs, selectedID) {
+      return false
+    }
+  }
+
   // Check from_jids
   if fromJIDs, ok := filter["from_jids"].([]interface{}); ok && len(fromJIDs) > 0 {
     fromJID, _ := event["from"].(string)
@@ -146,6 +215,18 @@ func (em *EventMatcher) matchesFilter(handler map[string]interface{}, event map[
     }
   }
 
+  // Handlers without their own chat filter are limited to default_chat_scope, unless they opt out
+  if !hasChatFilter(filter) && global_config != nil {
+    if ignoreScope, _ := filter["ignore_default_scope"].(bool); !ignoreScope {
+      if scope := global_config.GetDefaultChatScope(); len(scope) > 0 {
+        chatJID, _ := event["chat"].(string)
+        if !matchesAnyPattern(scope, chatJID) {
+          return false
+        }
+      }
+    }
+  }
+
   // Check is_group
   if isGroup, ok := filter["is_group"].(bool); ok {
     eventIsGroup, _ := event["is_group"].(bool)
@@ -185,14 +266,23 @@ func (em *EventMatcher) matchesFilter(handler map[string]interface{}, event map[
     }
   }
 
+  // Check has_link_preview
+  if hasLink, ok := filter["has_link_preview"].(bool); ok {
+    _, eventHasLink := event["link_preview"].(map[string]interface{})
+    if hasLink != eventHasLink {
+      return false
+    }
+  }
+
   // Check text_contains
   if textContains, ok := filter["text_contains"].([]interface{}); ok && len(textContains) > 0 {
+    normalize, _ := filter["normalize_text"].(bool)
     textContent, _ := event["text_content"].(string)
-    textContent = strings.ToLower(textContent)
+    textContent = foldText(textContent, normalize)
     matched := false
     for _, keyword := range textContains {
       if keywordStr, ok := keyword.(string); ok {
-        if strings.Contains(textContent, strings.ToLower(keywordStr)) {
+        if strings.Contains(textContent, foldText(keywordStr, normalize)) {
           matched = true
           break
         }
@@ -212,9 +302,131 @@ func (em *EventMatcher) matchesFilter(handler map[string]interface{}, event map[
     }
   }
 
+  // Check active_hours
+  if activeHours, ok := filter["active_hours"].(map[string]interface{}); ok {
+    if !matchesActiveHours(activeHours, time.Now()) {
+      return false
+    }
+  }
+
   return true
 }
 
+// weekdayNames maps active_hours day names to weekdays
+var weekdayNames = map[string]time.Weekday{
+  "sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+  "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// lookupWeekday finds the weekday for an abbreviated or full day name, in any case
+func lookupWeekday(name string) (time.Weekday, bool) {
+  name = strings.ToLower(name)
+  if weekday, ok := weekdayNames[name]; ok {
+    return weekday, true
+  }
+  for _, weekday := range weekdayNames {
+    if name == strings.ToLower(weekday.String()) {
+      return weekday, true
+    }
+  }
+  return 0, false
+}
+
+// parseActiveDays reads an active_hours days list. A missing or empty list means every day.
+func parseActiveDays(value interface{}) (map[time.Weekday]bool, error) {
+  days := map[time.Weekday]bool{}
+  dayList, ok := value.([]interface{})
+  if value != nil && !ok {
+    return nil, fmt.Errorf("days must be a list of day names")
+  }
+  if len(dayList) == 0 {
+    for _, weekday := range weekdayNames {
+      days[weekday] = true
+    }
+    return days, nil
+  }
+
+  for _, d := range dayList {
+    name, _ := d.(string)
+    weekday, ok := lookupWeekday(name)
+    if !ok {
+      return nil, fmt.Errorf("days has unknown day %q (use mon, tue, ... or monday, tuesday, ...)", name)
+    }
+    days[weekday] = true
+  }
+  return days, nil
+}
+
+// validateActiveHours checks an active_hours spec, so one that would never match (or, with
+// outside:true, always match) is rejected when it is saved
+func validateActiveHours(spec map[string]interface{}) error {
+  if _, err := parseClockMinutes(spec["start"]); err != nil {
+    return fmt.Errorf("start must be HH:MM")
+  }
+  if _, err := parseClockMinutes(spec["end"]); err != nil {
+    return fmt.Errorf("end must be HH:MM")
+  }
+  if tz, _ := spec["timezone"].(string); tz != "" {
+    if _, err := time.LoadLocation(tz); err != nil {
+      return fmt.Errorf("timezone is invalid: %v", err)
+    }
+  }
+  _, err := parseActiveDays(spec["days"])
+  return err
+}
+
+// matchesActiveHours checks now against an active_hours filter: {"days": ["mon", ...],
+// "start": "09:00", "end": "17:00", "timezone": "Europe/London", "outside": false}.
+// days defaults to every day, timezone to local time, and a window whose end is before its
+// start runs overnight (belonging to the day it starts). outside:true matches whenever the
+// window is not active. An invalid spec never matches.
+func matchesActiveHours(spec map[string]interface{}, now time.Time) bool {
+  location := time.Local
+  if tz, _ := spec["timezone"].(string); tz != "" {
+    loc, err := time.LoadLocation(tz)
+    if err != nil {
+      return false
+    }
+    location = loc
+  }
+  now = now.In(location)
+
+  start, err1 := parseClockMinutes(spec["start"])
+  end, err2 := parseClockMinutes(spec["end"])
+  if err1 != nil || err2 != nil {
+    return false
+  }
+
+  days, err := parseActiveDays(spec["days"])
+  if err != nil {
+    return false
+  }
+
+  minute := now.Hour()*60 + now.Minute()
+  yesterday := (now.Weekday() + 6) % 7
+  var active bool
+  if start <= end {
+    active = days[now.Weekday()] && minute >= start && minute < end
+  } else {
+    active = (days[now.Weekday()] && minute >= start) || (days[yesterday] && minute < end)
+  }
+
+  if outside, _ := spec["outside"].(bool); outside {
+    return !active
+  }
+  return active
+}
+
+// parseClockMinutes parses an "HH:MM" time of day into minutes past midnight
+func parseClockMinutes(value interface{}) (int, error) {
+  text, _ := value.(string)
+  clock, err := time.Parse("15:04", text)
+  if err != nil {
+    return 0, err
+  }
+  return clock.Hour()*60 + clock.Minute(), nil
+}
+
 // checkRateLimits checks if handler's rate limits allow execution
 func (em *EventMatcher) checkRateLimits(handler map[string]interface{}, event map[string]interface{}) bool {
   handlerID := handler["handler_id"].(string)
@@ -226,6 +438,7 @@ func (em *EventMatcher) checkRateLimits(handler map[string]interface{}, event ma
       perMinuteCounts: make(map[int64]int),
       perHourCounts:   make(map[int64]int),
       perSenderCounts: make(map[string]map[int64]int),
+      perSenderLast:   make(map[string]time.Time),
     }
     em.rateLimits[handlerID] = limiter
   }
@@ -268,19 +481,27 @@ func (em *EventMatcher) checkRateLimits(handler map[string]interface{}, event ma
   return true
 }
 
-// RecordExecution records an execution for rate limiting
-func (em *EventMatcher) RecordExecution(handlerID string, event map[string]interface{}) {
+// limiterFor returns the handler's rate limiter, creating it on first use
+func (em *EventMatcher) limiterFor(handlerID string) *RateLimiter {
   em.limitsMutex.Lock()
+  defer em.limitsMutex.Unlock()
+
   limiter, exists := em.rateLimits[handlerID]
   if !exists {
     limiter = &RateLimiter{
       perMinuteCounts: make(map[int64]int),
       perHourCounts:   make(map[int64]int),
       perSenderCounts: make(map[string]map[int64]int),
+      perSenderLast:   make(map[string]time.Time),
     }
     em.rateLimits[handlerID] = limiter
   }
-  em.limitsMutex.Unlock()
+  return limiter
+}
+
+// RecordExecution records an execution for rate limiting
+func (em *EventMatcher) RecordExecution(handlerID string, event map[string]interface{}) {
+  limiter := em.limiterFor(handlerID)
 
   limiter.mutex.Lock()
   defer limiter.mutex.Unlock()
@@ -299,6 +520,7 @@ func (em *EventMatcher) RecordExecution(handlerID string, event map[string]inter
       limiter.perSenderCounts[fromJID] = make(map[int64]int)
     }
     limiter.perSenderCounts[fromJID][currentHour]++
+    limiter.perSenderLast[fromJID] = now
   }
 
   limiter.lastExecution = now
@@ -329,35 +551,53 @@ func (em *EventMatcher) RecordExecution(handlerID string, event map[string]inter
       delete(limiter.perSenderCounts, sender)
     }
   }
-}
 
-// checkCooldown checks if enough time has passed since last execution
-func (em *EventMatcher) checkCooldown(handler map[string]interface{}) bool {
-  cooldownSeconds, ok := handler["cooldown_seconds"].(int64)
-  if !ok || cooldownSeconds <= 0 {
-    return true
+  for sender, last := range limiter.perSenderLast {
+    if now.Sub(last) > maxSenderCooldown {
+      delete(limiter.perSenderLast, sender)
+    }
   }
+}
 
-  handlerID := handler["handler_id"].(string)
-
-  em.limitsMutex.RLock()
-  limiter, exists := em.rateLimits[handlerID]
-  em.limitsMutex.RUnlock()
-
-  if !exists {
+// maxSenderCooldown is how long per-sender execution times are remembered, and so the
+// longest sender_cooldown_seconds that takes effect
+const maxSenderCooldown = 7 * 24 * time.Hour
+
+// reserveCooldown checks if enough time has passed since the last execution, and since the
+// last execution for the event's sender when sender_cooldown_seconds is set. If so it marks
+// the handler (and sender) as executed now, under the same lock, so two events arriving
+// together can't both get through before RecordExecution runs.
+func (em *EventMatcher) reserveCooldown(handler map[string]interface{}, event map[string]interface{}) bool {
+  cooldownSeconds, _ := handler["cooldown_seconds"].(int64)
+  senderCooldownSeconds, _ := handler["sender_cooldown_seconds"].(int64)
+  if cooldownSeconds <= 0 && senderCooldownSeconds <= 0 {
     return true
   }
 
+  limiter := em.limiterFor(handler["handler_id"].(string))
+  fromJID, _ := event["from"].(string)
+
   limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+
+  now := time.Now()
   lastExec := limiter.lastExecution
-  limiter.mutex.Unlock()
+  lastSenderExec := limiter.perSenderLast[fromJID]
 
-  if lastExec.IsZero() {
-    return true
+  if cooldownSeconds > 0 && !lastExec.IsZero() && now.Sub(lastExec).Seconds() < float64(cooldownSeconds) {
+    return false
+  }
+  if senderCooldownSeconds > 0 && fromJID != "" && !lastSenderExec.IsZero() && now.Sub(lastSenderExec).Seconds() < float64(senderCooldownSeconds) {
+    return false
   }
 
-  elapsed := time.Since(lastExec)
-  return elapsed.Seconds() >= float64(cooldownSeconds)
+  if cooldownSeconds > 0 {
+    limiter.lastExecution = now
+  }
+  if senderCooldownSeconds > 0 && fromJID != "" {
+    limiter.perSenderLast[fromJID] = now
+  }
+  return true
 }
 
 // isCircuitBreakerOpen checks if handler's circuit breaker is open
@@ -435,6 +675,48 @@ func (em *EventMatcher) UpdateCircuitBreaker(handlerID string, success bool) err
 
 // Helper functions
 
+// deepCopyValue copies the maps and slices of a decoded JSON value, leaving scalars shared
+func deepCopyValue(value interface{}) interface{} {
+  switch v := value.(type) {
+  case map[string]interface{}:
+    copied := make(map[string]interface{}, len(v))
+    for key, val := range v {
+      copied[key] = deepCopyValue(val)
+    }
+    return copied
+  case []interface{}:
+    copied := make([]interface{}, len(v))
+    for i, val := range v {
+      copied[i] = deepCopyValue(val)
+    }
+    return copied
+  default:
+    return v
+  }
+}
+
+// hasChatFilter reports whether a filter already restricts which chats it matches
+func hasChatFilter(filter map[string]interface{}) bool {
+  for _, key := range []string{"chat_jids", "group_jids"} {
+    if jids, ok := filter[key].([]interface{}); ok && len(jids) > 0 {
+      return true
+    }
+  }
+  return false
+}
+
+// foldText lowercases text for keyword matching. With normalize it also applies NFKD and
+// strips combining marks, so "café" matches "cafe" and full-width "ＡＢＣ" matches "abc".
+func foldText(text string, normalize bool) string {
+  if normalize {
+    t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+    if folded, _, err := transform.String(t, text); err == nil {
+      text = folded
+    }
+  }
+  return strings.ToLower(text)
+}
+
 func containsString(slice []interface{}, str string) bool {
   for _, item := range slice {
     if itemStr, ok := item.(string); ok && itemStr == str {
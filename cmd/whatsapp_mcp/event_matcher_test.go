@@ -0,0 +1,168 @@
+package main
+
+import (
+  "fmt"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+// TestReloadHandlersDuringMatching reloads handlers while events are matched and the
+// matched handlers are read and modified, as executor goroutines do. Run with -race.
+func TestReloadHandlersDuringMatching(t *testing.T) {
+  database, err := NewDatabase(filepath.Join(t.TempDir(), "handlers.db"))
+  if err != nil {
+    t.Fatalf("NewDatabase: %v", err)
+  }
+  defer database.Close()
+
+  for i := 0; i < 5; i++ {
+    err := database.SaveHandler(map[string]interface{}{
+      "handler_id": fmt.Sprintf("handler_%d", i),
+      "event_filter": map[string]interface{}{
+        "event_types": []interface{}{"message"},
+        "is_from_me":  false,
+      },
+      "action": map[string]interface{}{
+        "type":    "actions",
+        "actions": []interface{}{map[string]interface{}{"type": "delay", "seconds": 0}},
+      },
+      "enabled":  true,
+      "priority": i,
+    })
+    if err != nil {
+      t.Fatalf("SaveHandler: %v", err)
+    }
+  }
+
+  matcher := NewEventMatcher(database)
+  if err := matcher.LoadHandlers(); err != nil {
+    t.Fatalf("LoadHandlers: %v", err)
+  }
+
+  event := map[string]interface{}{
+    "event_type": "message",
+    "from":       "123@s.whatsapp.net",
+    "chat":       "123@s.whatsapp.net",
+    "is_from_me": false,
+  }
+
+  var wg sync.WaitGroup
+  stop := make(chan struct{})
+
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 50; i++ {
+      if err := matcher.LoadHandlers(); err != nil {
+        t.Errorf("LoadHandlers: %v", err)
+      }
+    }
+    close(stop)
+  }()
+
+  for w := 0; w < 4; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for {
+        select {
+        case <-stop:
+          return
+        default:
+        }
+        matches := matcher.MatchEvent(event)
+        if len(matches) != 5 {
+          t.Errorf("matched %d handlers, want 5", len(matches))
+          return
+        }
+        for _, handler := range matches {
+          handlerID, _ := handler["handler_id"].(string)
+          matcher.RecordExecution(handlerID, event)
+          action := handler["action"].(map[string]interface{})
+          action["seen"] = true
+          handler["circuit_breaker_state"] = "closed"
+        }
+      }
+    }()
+  }
+
+  wg.Wait()
+
+  for _, handler := range matcher.MatchEvent(event) {
+    if _, ok := handler["action"].(map[string]interface{})["seen"]; ok {
+      t.Fatalf("handler %v was modified through a matched copy", handler["handler_id"])
+    }
+  }
+}
+
+// TestMatchesActiveHoursDays checks day names are matched whole, so names that change byte
+// length when lowercased can't panic, and that a spec with unknown days never matches, even
+// with outside:true
+func TestMatchesActiveHoursDays(t *testing.T) {
+  monday := time.Date(2026, time.October, 12, 10, 0, 0, 0, time.UTC)
+  tests := []struct {
+    name    string
+    days    []interface{}
+    outside bool
+    want    bool
+  }{
+    {"abbreviation", []interface{}{"mon"}, false, true},
+    {"full name", []interface{}{"Monday"}, false, true},
+    {"other day", []interface{}{"tue"}, false, false},
+    {"other day outside", []interface{}{"tue"}, true, true},
+    {"every day", nil, false, true},
+    {"kelvin sign", []interface{}{"\u212a"}, false, false},
+    {"unknown day outside", []interface{}{"someday"}, true, false},
+    {"prefix only", []interface{}{"mond"}, false, false},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      spec := map[string]interface{}{"start": "09:00", "end": "17:00", "timezone": "UTC", "outside": test.outside}
+      if test.days != nil {
+        spec["days"] = test.days
+      }
+      if got := matchesActiveHours(spec, monday); got != test.want {
+        t.Errorf("matchesActiveHours(days %v, outside %v) = %v, want %v", test.days, test.outside, got, test.want)
+      }
+    })
+  }
+
+  if err := validateActiveHours(map[string]interface{}{"start": "09:00", "end": "17:00", "days": []interface{}{"\u212a"}}); err == nil {
+    t.Error("validateActiveHours accepted an unknown day")
+  }
+}
+
+// TestReserveCooldownConcurrent checks that of many simultaneous events from one sender,
+// only one gets through a sender cooldown
+func TestReserveCooldownConcurrent(t *testing.T) {
+  matcher := NewEventMatcher(nil)
+  handler := map[string]interface{}{"handler_id": "autoreply", "sender_cooldown_seconds": int64(3600)}
+  event := map[string]interface{}{"from": "447700900000@s.whatsapp.net"}
+
+  var passed int
+  var mu sync.Mutex
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if matcher.reserveCooldown(handler, event) {
+        mu.Lock()
+        passed++
+        mu.Unlock()
+      }
+    }()
+  }
+  wg.Wait()
+
+  if passed != 1 {
+    t.Errorf("%d events passed the sender cooldown, want 1", passed)
+  }
+  other := map[string]interface{}{"from": "447700900001@s.whatsapp.net"}
+  if !matcher.reserveCooldown(handler, other) {
+    t.Error("a different sender was held back by the first sender's cooldown")
+  }
+}
@@ -11,13 +11,17 @@ Phase 1: Basic authentication and message sending/receiving.
 import (
   "bufio"
   "bytes"
+  "context"
   "crypto/tls"
+  "crypto/x509"
   "encoding/binary"
   "encoding/json"
+  "errors"
   "flag"
   "fmt"
   "io"
   "io/ioutil"
+  "net"
   "net/http"
   "net/url"
   "os"
@@ -26,6 +30,8 @@ import (
   "path/filepath"
   "runtime"
   "strings"
+  "sync"
+  "sync/atomic"
   "syscall"
   "time"
 
@@ -100,8 +106,20 @@ type SSEConnection struct {
   Client          *http.Client
   ReverseChannel  chan ReverseMessage
   ResponseChannel map[string]chan JSONRPCResponse
+  responseMutex   sync.Mutex // guards ResponseChannel (SSE reader vs request senders)
+  endpointMutex   sync.Mutex // guards SessionID and MessageEndpoint, set by the SSE reader
   StopChannel     chan bool
   IsAlive         *bool
+
+  // Reverse calls that arrive while ReverseChannel is full wait here, so the SSE
+  // reader never blocks and responses keep flowing while the main loop is busy
+  backlogMutex    sync.Mutex
+  backlog         []ReverseMessage
+  pumping         bool
+  reverseReceived int64
+  reverseQueued   int64
+  reverseDropped  int64
+  reverseMaxDepth int
 }
 
 // Find native messaging manifest (same as reverse_mcp.go)
@@ -163,7 +181,7 @@ func discoverMCPServerEndpoint(manifest *Manifest) (*MCPConfig, error) {
     return nil, fmt.Errorf("binary not found: %s", binaryPath)
   }
 
-  fmt.Fprintf(os.Stderr, "Running native binary: %s\n", binaryPath)
+  fmt.Fprintf(logStderr, "Running native binary: %s\n", binaryPath)
 
   cmd := exec.Command(binaryPath)
   stdout, err := cmd.StdoutPipe()
@@ -180,14 +198,14 @@ func discoverMCPServerEndpoint(manifest *Manifest) (*MCPConfig, error) {
     lengthBytes := make([]byte, 4)
     n, err := io.ReadFull(stdout, lengthBytes)
     if err != nil || n != 4 {
-      fmt.Fprintf(os.Stderr, "ERROR: Failed to read length prefix: %v\n", err)
+      fmt.Fprintf(logStderr, "ERROR: Failed to read length prefix: %v\n", err)
       done <- nil
       return
     }
 
     messageLength := binary.LittleEndian.Uint32(lengthBytes)
     if messageLength <= 0 || messageLength > 10000000 {
-      fmt.Fprintf(os.Stderr, "ERROR: Invalid message length: %d\n", messageLength)
+      fmt.Fprintf(logStderr, "ERROR: Invalid message length: %d\n", messageLength)
       done <- nil
       return
     }
@@ -195,14 +213,14 @@ func discoverMCPServerEndpoint(manifest *Manifest) (*MCPConfig, error) {
     jsonBytes := make([]byte, messageLength)
     n, err = io.ReadFull(stdout, jsonBytes)
     if err != nil || n != int(messageLength) {
-      fmt.Fprintf(os.Stderr, "ERROR: Failed to read JSON: %v\n", err)
+      fmt.Fprintf(logStderr, "ERROR: Failed to read JSON: %v\n", err)
       done <- nil
       return
     }
 
     var config MCPConfig
     if err := json.Unmarshal(jsonBytes, &config); err != nil {
-      fmt.Fprintf(os.Stderr, "ERROR: Failed to parse JSON: %v\n", err)
+      fmt.Fprintf(logStderr, "ERROR: Failed to parse JSON: %v\n", err)
       done <- nil
       return
     }
@@ -223,8 +241,42 @@ func discoverMCPServerEndpoint(manifest *Manifest) (*MCPConfig, error) {
   }
 }
 
+// buildMCPTLSConfig returns the TLS config for talking to the MCP server. Certificates are
+// verified against the system pool (plus mcp_tls_ca_cert if set) unless mcp_tls_insecure is enabled.
+func buildMCPTLSConfig() (*tls.Config, error) {
+  insecure, caCertPath := global_config.GetMCPTLS()
+  if insecure {
+    fmt.Fprintln(logStderr, "[WARN] mcp_tls_insecure is enabled - MCP server certificate will not be verified")
+    return &tls.Config{InsecureSkipVerify: true}, nil
+  }
+
+  if caCertPath == "" {
+    return &tls.Config{}, nil
+  }
+
+  pool, err := x509.SystemCertPool()
+  if err != nil || pool == nil {
+    pool = x509.NewCertPool()
+  }
+
+  caCert, err := os.ReadFile(caCertPath)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read mcp_tls_ca_cert: %w", err)
+  }
+  if !pool.AppendCertsFromPEM(caCert) {
+    return nil, fmt.Errorf("no PEM certificates found in mcp_tls_ca_cert: %s", caCertPath)
+  }
+
+  return &tls.Config{RootCAs: pool}, nil
+}
+
 // Connect to SSE endpoint (same as reverse_mcp.go)
 func connectSSE(serverURL, authHeader string) (*SSEConnection, error) {
+  tlsConfig, err := buildMCPTLSConfig()
+  if err != nil {
+    return nil, err
+  }
+
   isAlive := true
   conn := &SSEConnection{
     ServerURL:       serverURL,
@@ -235,7 +287,7 @@ func connectSSE(serverURL, authHeader string) (*SSEConnection, error) {
     IsAlive:         &isAlive,
     Client: &http.Client{
       Transport: &http.Transport{
-        TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        TLSClientConfig: tlsConfig,
       },
     },
   }
@@ -302,26 +354,19 @@ func connectSSE(serverURL, authHeader string) (*SSEConnection, error) {
         eventType = value
       case "data":
         if eventType == "endpoint" {
-          conn.MessageEndpoint = value
-          if strings.Contains(value, "session_id=") {
-            parts := strings.Split(value, "session_id=")
-            if len(parts) > 1 {
-              conn.SessionID = strings.Split(parts[1], "&")[0]
-            }
-          }
+          conn.setEndpoint(value)
         } else {
           var msg map[string]interface{}
           if err := json.Unmarshal([]byte(value), &msg); err == nil {
             if _, ok := msg["reverse"]; ok {
               var revMsg ReverseMessage
               json.Unmarshal([]byte(value), &revMsg)
-              conn.ReverseChannel <- revMsg
+              conn.deliverReverse(revMsg)
             } else if id, ok := msg["id"].(string); ok {
-              if ch, exists := conn.ResponseChannel[id]; exists {
+              if ch, exists := conn.takeResponseChannel(id); exists {
                 var response JSONRPCResponse
                 json.Unmarshal([]byte(value), &response)
                 ch <- response
-                delete(conn.ResponseChannel, id)
               }
             }
           }
@@ -332,22 +377,183 @@ func connectSSE(serverURL, authHeader string) (*SSEConnection, error) {
 
   // Wait for session ID
   for i := 0; i < 50; i++ {
-    if conn.SessionID != "" {
+    if conn.sessionID() != "" {
       break
     }
     time.Sleep(100 * time.Millisecond)
   }
 
-  if conn.SessionID == "" {
+  if conn.sessionID() == "" {
     return nil, fmt.Errorf("no session ID received")
   }
 
   return conn, nil
 }
 
-// Send JSON-RPC request
-func (conn *SSEConnection) sendRequest(method string, params interface{}) (json.RawMessage, error) {
-  requestID := fmt.Sprintf("%d", time.Now().UnixNano())
+// deliverReverse hands a reverse call to the main loop without blocking the SSE reader.
+// When ReverseChannel is full the call is queued in the backlog (up to reverse_backlog_limit)
+// and a pump goroutine feeds it through in order; beyond the limit it is rejected with an error reply.
+func (conn *SSEConnection) deliverReverse(msg ReverseMessage) {
+  conn.backlogMutex.Lock()
+  defer conn.backlogMutex.Unlock()
+
+  conn.reverseReceived++
+  if !conn.pumping {
+    select {
+    case conn.ReverseChannel <- msg:
+      if depth := len(conn.ReverseChannel); depth > conn.reverseMaxDepth {
+        conn.reverseMaxDepth = depth
+      }
+      return
+    default:
+    }
+  }
+
+  if len(conn.backlog) >= global_config.GetReverseBacklogLimit() {
+    conn.reverseDropped++
+    fmt.Fprintf(logStderr, "[WARN] Reverse call backlog full, rejecting call %s\n", msg.Reverse.CallID)
+    global_error_state.LogError(ErrorSeverityWarning, "reverse_channel", "Reverse call dropped, backlog full", msg.Reverse.CallID)
+    go conn.sendToolReply(msg.Reverse.CallID, formatOperationResponse(&OperationResult{
+      Success: false,
+      Error:   "WhatsApp tool is overloaded, try again shortly",
+    }))
+    return
+  }
+
+  conn.backlog = append(conn.backlog, msg)
+  conn.reverseQueued++
+  if depth := len(conn.ReverseChannel) + len(conn.backlog); depth > conn.reverseMaxDepth {
+    conn.reverseMaxDepth = depth
+  }
+  if !conn.pumping {
+    conn.pumping = true
+    go conn.pumpBacklog()
+  }
+}
+
+// pumpBacklog feeds queued reverse calls into ReverseChannel until the backlog is empty
+func (conn *SSEConnection) pumpBacklog() {
+  for {
+    conn.backlogMutex.Lock()
+    if len(conn.backlog) == 0 {
+      conn.pumping = false
+      conn.backlogMutex.Unlock()
+      return
+    }
+    msg := conn.backlog[0]
+    conn.backlog = conn.backlog[1:]
+    conn.backlogMutex.Unlock()
+
+    conn.ReverseChannel <- msg
+  }
+}
+
+// ReverseChannelStats reports the reverse call queue depth and overflow counters
+func (conn *SSEConnection) ReverseChannelStats() map[string]interface{} {
+  conn.backlogMutex.Lock()
+  defer conn.backlogMutex.Unlock()
+
+  return map[string]interface{}{
+    "depth":     len(conn.ReverseChannel),
+    "capacity":  cap(conn.ReverseChannel),
+    "backlog":   len(conn.backlog),
+    "max_depth": conn.reverseMaxDepth,
+    "received":  conn.reverseReceived,
+    "queued":    conn.reverseQueued,
+    "dropped":   conn.reverseDropped,
+  }
+}
+
+// setEndpoint records the message endpoint announced on the SSE stream and its session ID
+func (conn *SSEConnection) setEndpoint(endpoint string) {
+  conn.endpointMutex.Lock()
+  defer conn.endpointMutex.Unlock()
+  conn.MessageEndpoint = endpoint
+  if strings.Contains(endpoint, "session_id=") {
+    parts := strings.Split(endpoint, "session_id=")
+    if len(parts) > 1 {
+      conn.SessionID = strings.Split(parts[1], "&")[0]
+    }
+  }
+}
+
+// sessionID returns the session ID announced on the SSE stream, or "" before it arrives
+func (conn *SSEConnection) sessionID() string {
+  conn.endpointMutex.Lock()
+  defer conn.endpointMutex.Unlock()
+  return conn.SessionID
+}
+
+// messageURL returns the full URL requests and replies are posted to
+func (conn *SSEConnection) messageURL() string {
+  conn.endpointMutex.Lock()
+  defer conn.endpointMutex.Unlock()
+  u, _ := url.Parse(conn.ServerURL)
+  return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, conn.MessageEndpoint)
+}
+
+// setResponseChannel registers the channel that will receive the response for requestID
+func (conn *SSEConnection) setResponseChannel(requestID string, ch chan JSONRPCResponse) {
+  conn.responseMutex.Lock()
+  defer conn.responseMutex.Unlock()
+  conn.ResponseChannel[requestID] = ch
+}
+
+// takeResponseChannel removes and returns the response channel for requestID, if registered
+func (conn *SSEConnection) takeResponseChannel(requestID string) (chan JSONRPCResponse, bool) {
+  conn.responseMutex.Lock()
+  defer conn.responseMutex.Unlock()
+  ch, exists := conn.ResponseChannel[requestID]
+  delete(conn.ResponseChannel, requestID)
+  return ch, exists
+}
+
+// roundTrip posts a JSON-RPC request and waits for its response on the SSE stream.
+// Failures are retried with exponential backoff according to mcp_retry_attempts and
+// mcp_retry_backoff_ms. An idempotent request is retried after network errors, 5xx
+// responses and timeouts; any other request only when it never reached the server,
+// since a timed out tool call may still run. Once ctx is done no further attempts are made.
+func (conn *SSEConnection) roundTrip(ctx context.Context, method string, params interface{}, idempotent bool, timeout time.Duration, timeoutMsg string) (JSONRPCResponse, error) {
+  attempts, backoff := global_config.GetMCPRetry()
+  if attempts < 1 {
+    attempts = 1
+  }
+
+  var lastErr error
+  for attempt := 1; attempt <= attempts; attempt++ {
+    if attempt > 1 {
+      select {
+      case <-time.After(backoff):
+      case <-ctx.Done():
+        return JSONRPCResponse{}, ctx.Err()
+      }
+      backoff *= 2
+    }
+
+    response, retryable, err := conn.roundTripOnce(ctx, method, params, idempotent, timeout, timeoutMsg)
+    if err == nil {
+      return response, nil
+    }
+
+    lastErr = err
+    if !retryable {
+      break
+    }
+    if attempt < attempts {
+      fmt.Fprintf(logStderr, "[WARN] %s attempt %d/%d failed, retrying: %v\n", method, attempt, attempts, err)
+    }
+  }
+
+  return JSONRPCResponse{}, lastErr
+}
+
+// requestCounter numbers JSON-RPC requests so their IDs never collide
+var requestCounter uint64
+
+// roundTripOnce makes a single request attempt. The bool result reports whether the failure is worth retrying.
+func (conn *SSEConnection) roundTripOnce(ctx context.Context, method string, params interface{}, idempotent bool, timeout time.Duration, timeoutMsg string) (JSONRPCResponse, bool, error) {
+  // The counter keeps IDs unique when concurrent requests start in the same nanosecond
+  requestID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&requestCounter, 1))
 
   request := JSONRPCRequest{
     JSONRPC: "2.0",
@@ -358,19 +564,18 @@ func (conn *SSEConnection) sendRequest(method string, params interface{}) (json.
 
   body, err := json.Marshal(request)
   if err != nil {
-    return nil, err
+    return JSONRPCResponse{}, false, err
   }
 
   respChan := make(chan JSONRPCResponse, 1)
-  conn.ResponseChannel[requestID] = respChan
+  conn.setResponseChannel(requestID, respChan)
 
-  u, _ := url.Parse(conn.ServerURL)
-  fullURL := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, conn.MessageEndpoint)
+  fullURL := conn.messageURL()
 
-  req, err := http.NewRequest("POST", fullURL, bytes.NewReader(body))
+  req, err := http.NewRequestWithContext(ctx, "POST", fullURL, bytes.NewReader(body))
   if err != nil {
-    delete(conn.ResponseChannel, requestID)
-    return nil, err
+    conn.takeResponseChannel(requestID)
+    return JSONRPCResponse{}, false, err
   }
 
   req.Header.Set("Content-Type", "application/json")
@@ -378,22 +583,106 @@ func (conn *SSEConnection) sendRequest(method string, params interface{}) (json.
 
   resp, err := conn.Client.Do(req)
   if err != nil {
-    delete(conn.ResponseChannel, requestID)
-    return nil, err
+    conn.takeResponseChannel(requestID)
+    return JSONRPCResponse{}, ctx.Err() == nil && (idempotent || requestNotSent(err)), err
   }
   defer resp.Body.Close()
 
   if resp.StatusCode != 202 {
-    delete(conn.ResponseChannel, requestID)
-    return nil, fmt.Errorf("POST failed: %d", resp.StatusCode)
+    conn.takeResponseChannel(requestID)
+    return JSONRPCResponse{}, idempotent && resp.StatusCode >= 500, &postStatusError{StatusCode: resp.StatusCode}
   }
 
   select {
   case response := <-respChan:
-    return response.Result, nil
-  case <-time.After(10 * time.Second):
-    delete(conn.ResponseChannel, requestID)
-    return nil, fmt.Errorf("timeout")
+    return response, false, nil
+  case <-time.After(timeout):
+    conn.takeResponseChannel(requestID)
+    return JSONRPCResponse{}, idempotent, fmt.Errorf("%s", timeoutMsg)
+  case <-ctx.Done():
+    conn.takeResponseChannel(requestID)
+    return JSONRPCResponse{}, false, ctx.Err()
+  }
+}
+
+// requestNotSent reports whether a POST failed before the connection was made, so the
+// server cannot have seen the request
+func requestNotSent(err error) bool {
+  var opErr *net.OpError
+  return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// postStatusError is a request the MCP server answered with an unexpected HTTP status
+type postStatusError struct {
+  StatusCode int
+}
+
+func (e *postStatusError) Error() string {
+  return fmt.Sprintf("POST failed: %d", e.StatusCode)
+}
+
+// sendNotification posts a JSON-RPC notification (no response is expected)
+func (conn *SSEConnection) sendNotification(method string, params interface{}) error {
+  body, err := json.Marshal(map[string]interface{}{
+    "jsonrpc": "2.0",
+    "method":  method,
+    "params":  params,
+  })
+  if err != nil {
+    return err
+  }
+
+  fullURL := conn.messageURL()
+
+  req, err := http.NewRequest("POST", fullURL, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("Authorization", conn.AuthHeader)
+
+  resp, err := conn.Client.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != 202 && resp.StatusCode != 200 {
+    return fmt.Errorf("POST failed: %d", resp.StatusCode)
+  }
+  return nil
+}
+
+// progressNotifier returns a ProgressFunc that sends notifications/progress for a tool call.
+// The caller's progressToken is used when given, otherwise the reverse call ID.
+func progressNotifier(conn *SSEConnection, callID string, params map[string]interface{}) ProgressFunc {
+  if conn == nil {
+    return nil
+  }
+
+  var token interface{} = callID
+  if meta, ok := params["_meta"].(map[string]interface{}); ok {
+    if t, ok := meta["progressToken"]; ok && t != nil {
+      token = t
+    }
+  }
+
+  return func(current int, total int, message string) {
+    notification := map[string]interface{}{
+      "progressToken": token,
+      "progress":      current,
+    }
+    if total > 0 {
+      notification["total"] = total
+    }
+    if message != "" {
+      notification["message"] = message
+    }
+
+    if err := conn.sendNotification("notifications/progress", notification); err != nil {
+      log.Debug().Err(err).Str("call_id", callID).Msg("Failed to send progress notification")
+    }
   }
 }
 
@@ -415,8 +704,7 @@ func (conn *SSEConnection) sendToolReply(callID string, result interface{}) erro
     return err
   }
 
-  u, _ := url.Parse(conn.ServerURL)
-  fullURL := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, conn.MessageEndpoint)
+  fullURL := conn.messageURL()
 
   req, err := http.NewRequest("POST", fullURL, bytes.NewReader(body))
   if err != nil {
@@ -433,25 +721,47 @@ func (conn *SSEConnection) sendToolReply(callID string, result interface{}) erro
   defer resp.Body.Close()
 
   if resp.StatusCode == 202 {
-    fmt.Fprintf(os.Stderr, "[OK] Sent tools/reply for call_id %s\n", callID)
+    fmt.Fprintf(logStderr, "[OK] Sent tools/reply for call_id %s\n", callID)
     return nil
   }
 
   return fmt.Errorf("POST failed: %d", resp.StatusCode)
 }
 
+// configureLogging points the global zerolog logger at stderr, as human-readable console
+// output or as one JSON object per line for log aggregation (Loki, ELK, ...)
+func configureLogging(format string) {
+  if format == LogFormatJSON {
+    log.Logger = zerolog.New(logStderr).With().Timestamp().Logger()
+    return
+  }
+  log.Logger = log.Output(zerolog.ConsoleWriter{Out: logStderr})
+}
+
+// reportMethodRegistry prints how many methods the registry holds and which entries were skipped
+func reportMethodRegistry(action string) {
+  registry := getMethodRegistry()
+  fmt.Fprintf(logStderr, "[OK] %s method registry (%d methods)\n", action, len(registry.Methods))
+  if len(registry.Invalid) > 0 {
+    fmt.Fprintf(logStderr, "[WARN] Skipped %d invalid method registry entries:\n", len(registry.Invalid))
+    for name, reason := range registry.Invalid {
+      fmt.Fprintf(logStderr, "  %s: %s\n", name, reason)
+    }
+  }
+}
+
 // Initialize system components
 func initializeSystem() error {
-  // Initialize logging
   zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-  log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
   // Load method registry
-  fmt.Fprintln(os.Stderr, "[INFO] Loading method registry...")
+  fmt.Fprintln(logStderr, "[INFO] Loading method registry...")
+  // A broken registry only disables call_whatsmeow, so keep starting without one
   if err := LoadMethodRegistry(); err != nil {
-    return fmt.Errorf("failed to load method registry: %w", err)
+    fmt.Fprintf(logStderr, "[WARN] %v; call_whatsmeow is unavailable\n", err)
+  } else {
+    reportMethodRegistry("Loaded")
   }
-  fmt.Fprintf(os.Stderr, "[OK] Loaded %d methods from registry\n", len(globalMethodRegistry.Methods))
 
   // Initialize configuration
   global_config = NewConfig()
@@ -478,6 +788,19 @@ func initializeSystem() error {
     global_config.UpdateFromMap(savedConfig)
   }
 
+  // Initialize logging now that log_format is known, before anything logs through zerolog
+  configureLogging(global_config.GetLogFormat())
+
+  // Merge the external method registry now that its path is known
+  if global_config.GetMethodRegistryPath() != "" {
+    if err := LoadMethodRegistry(); err != nil {
+      fmt.Fprintf(logStderr, "[WARN] Using embedded method registry: %v\n", err)
+    } else {
+      reportMethodRegistry("Merged external")
+    }
+  }
+  warnUnmatchedMethodCategories()
+
   // Initialize operation handler
   global_operation_handler = NewOperationHandler(
     global_error_state,
@@ -486,18 +809,31 @@ func initializeSystem() error {
     global_database,
   )
 
+  // Refresh declaratively managed handlers before they are loaded
+  if handlersFile := global_config.GetHandlersFile(); handlersFile != "" {
+    if loaded, err := global_operation_handler.SyncHandlersFile(handlersFile); err != nil {
+      fmt.Fprintf(logStderr, "[WARN] Failed to load handlers file: %v\n", err)
+      global_error_state.LogError(ErrorSeverityWarning, "handlers_file", "Failed to load handlers file", err.Error())
+    } else {
+      fmt.Fprintf(logStderr, "[OK] Loaded %d handlers from %s\n", loaded, handlersFile)
+    }
+  }
+
   // Initialize event matcher
   global_event_matcher = NewEventMatcher(global_database)
-  fmt.Fprintln(os.Stderr, "[INFO] Loading event handlers...")
+  fmt.Fprintln(logStderr, "[INFO] Loading event handlers...")
   if err := global_event_matcher.LoadHandlers(); err != nil {
-    fmt.Fprintf(os.Stderr, "[WARN] Failed to load handlers: %v\n", err)
+    fmt.Fprintf(logStderr, "[WARN] Failed to load handlers: %v\n", err)
   } else {
-    fmt.Fprintf(os.Stderr, "[OK] Loaded %d event handlers\n", len(global_event_matcher.handlers))
+    fmt.Fprintf(logStderr, "[OK] Loaded %d event handlers\n", len(global_event_matcher.handlers))
   }
 
   // Initialize action executor
   global_action_executor = NewActionExecutor(global_database, global_error_state, global_event_matcher)
-  fmt.Fprintln(os.Stderr, "[OK] Action executor initialized\n")
+  if err := global_action_executor.LoadPausedChats(); err != nil {
+    fmt.Fprintf(logStderr, "[WARN] Failed to load paused chats: %v\n", err)
+  }
+  fmt.Fprint(logStderr, "[OK] Action executor initialized\n\n")
 
   // Initialize WhatsApp client
   whatsappClient, err := NewWhatsAppClient(global_config.GetDatabasePath())
@@ -556,71 +892,102 @@ func shutdownSystem() {
 
 // callMCPTool calls another MCP tool (e.g., user, sqlite, etc.)
 func callMCPTool(conn *SSEConnection, toolName string, arguments interface{}) (json.RawMessage, error) {
+  return callMCPToolContext(context.Background(), conn, toolName, arguments)
+}
+
+// callMCPToolContext calls another MCP tool, giving up when ctx is done. If ctx has a
+// deadline it replaces the default 30 second wait for the tool's response.
+func callMCPToolContext(ctx context.Context, conn *SSEConnection, toolName string, arguments interface{}) (json.RawMessage, error) {
   toolCallParams := map[string]interface{}{
     "name":      toolName,
     "arguments": arguments,
   }
 
   // Use longer timeout for tool calls (30 seconds)
-  requestID := fmt.Sprintf("%d", time.Now().UnixNano())
-
-  request := JSONRPCRequest{
-    JSONRPC: "2.0",
-    ID:      requestID,
-    Method:  "tools/call",
-    Params:  toolCallParams,
+  timeout := 30 * time.Second
+  if deadline, ok := ctx.Deadline(); ok {
+    timeout = time.Until(deadline)
   }
 
-  body, err := json.Marshal(request)
+  response, err := conn.roundTrip(ctx, "tools/call", toolCallParams, false, timeout, "timeout waiting for tool response")
   if err != nil {
     return nil, err
   }
+  if response.Error != nil {
+    if isUnknownToolError(fmt.Sprint(response.Error)) {
+      global_mcp_tools.forget(toolName)
+      return nil, fmt.Errorf("%w: %s", errToolNotRegistered, toolName)
+    }
+    return nil, fmt.Errorf("tool call error: %v", response.Error)
+  }
+  return response.Result, nil
+}
 
-  // Create response channel
-  respChan := make(chan JSONRPCResponse, 1)
-  conn.ResponseChannel[requestID] = respChan
-
-  // Parse URL
-  u, _ := url.Parse(conn.ServerURL)
-  fullURL := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, conn.MessageEndpoint)
+// errToolNotRegistered is returned when the MCP server has no tool by the name called
+var errToolNotRegistered = errors.New("tool not registered with the MCP server")
 
-  req, err := http.NewRequest("POST", fullURL, bytes.NewReader(body))
-  if err != nil {
-    delete(conn.ResponseChannel, requestID)
-    return nil, err
+// isUnknownToolError reports whether an MCP error says the called tool doesn't exist
+func isUnknownToolError(text string) bool {
+  text = strings.ToLower(text)
+  for _, marker := range []string{"unknown tool", "tool not found", "no such tool", "not registered"} {
+    if strings.Contains(text, marker) {
+      return true
+    }
   }
+  return false
+}
 
-  req.Header.Set("Content-Type", "application/json")
-  req.Header.Set("Authorization", conn.AuthHeader)
+// mcpToolListTTL is how long the MCP server's tool list is trusted before it is fetched again
+const mcpToolListTTL = time.Minute
 
-  resp, err := conn.Client.Do(req)
-  if err != nil {
-    delete(conn.ResponseChannel, requestID)
-    return nil, err
-  }
-  defer resp.Body.Close()
+// mcpToolList caches the names of the tools registered with the MCP server, so a call to a
+// missing tool can fail at once instead of waiting out its timeout
+type mcpToolList struct {
+  mu      sync.Mutex
+  names   map[string]bool
+  fetched time.Time
+}
 
-  if resp.StatusCode != 202 {
-    delete(conn.ResponseChannel, requestID)
-    return nil, fmt.Errorf("POST failed: %d", resp.StatusCode)
-  }
+var global_mcp_tools = &mcpToolList{}
 
-  // Wait for response with 30 second timeout
-  select {
-  case response := <-respChan:
-    if response.Error != nil {
-      return nil, fmt.Errorf("tool call error: %v", response.Error)
+// has reports whether the MCP server has a tool registered. known is false if the tool list
+// couldn't be fetched, in which case callers should just make the call.
+func (tl *mcpToolList) has(ctx context.Context, conn *SSEConnection, name string) (registered bool, known bool) {
+  tl.mu.Lock()
+  defer tl.mu.Unlock()
+
+  if tl.names == nil || time.Since(tl.fetched) > mcpToolListTTL {
+    response, err := conn.roundTrip(ctx, "tools/list", map[string]interface{}{}, true, 5*time.Second, "timeout waiting for tool list")
+    if err != nil || response.Error != nil {
+      return false, false
+    }
+    var list struct {
+      Tools []struct {
+        Name string `json:"name"`
+      } `json:"tools"`
     }
-    return response.Result, nil
-  case <-time.After(30 * time.Second):
-    delete(conn.ResponseChannel, requestID)
-    return nil, fmt.Errorf("timeout waiting for tool response")
+    if err := json.Unmarshal(response.Result, &list); err != nil || len(list.Tools) == 0 {
+      return false, false
+    }
+    tl.names = make(map[string]bool, len(list.Tools))
+    for _, tool := range list.Tools {
+      tl.names[tool.Name] = true
+    }
+    tl.fetched = time.Now()
   }
+  return tl.names[name], true
+}
+
+// forget drops a tool the server turned out not to have from the cached list
+func (tl *mcpToolList) forget(name string) {
+  tl.mu.Lock()
+  defer tl.mu.Unlock()
+  delete(tl.names, name)
 }
 
 // Register WhatsApp tool
 func registerWhatsAppTool(conn *SSEConnection) error {
-  fmt.Fprintln(os.Stderr, "Registering whatsapp tool with MCP server...")
+  fmt.Fprintln(logStderr, "Registering whatsapp tool with MCP server...")
 
   params := map[string]interface{}{
     "name": "remote",
@@ -632,12 +999,49 @@ func registerWhatsAppTool(conn *SSEConnection) error {
 
 ## Operations
 - check_login_status, get_qr_code, logout - Authentication
+- relink - Clear only the local session keys and return a fresh QR code; keeps messages, handlers and settings (use when the device link was invalidated)
+- backup_session - Copy the session database (device credentials) to path, briefly disconnecting
+- restore_session - Replace the session with a backup from path and reconnect to verify it (path, timeout)
+- get_pairing_status - Poll pairing progress after get_qr_code (waiting_for_scan, scanned, paired, failed)
+- get_pairing_history - Past pairing attempts with outcome, reason, time waited and whether a popup was shown (limit, outcome)
 - call_whatsmeow - Generic dispatcher (call ANY whatsmeow method)
-- get_messages - Query message history (limit, from, chat, since)
+- get_messages - Query message history (limit, from, chat, since, fields, exclude_media, enrich_names, wait_for_sync)
+- get_message_histogram - Message counts per hour/day/week in UTC for charting (bucket, since, until, chat, from)
+- search_messages - Find stored messages containing all words of query (chat, from, limit; ranked=true to sort by relevance)
+- get_raw_message - Stored raw message JSON exactly as whatsmeow delivered it (message_id)
+- send_link - Send a URL with an explicit preview card (to, url, text, title, description, image_url or image_base64)
+- post_status - Post a status update: text (background_color, text_color, font) or path (media_type image/video, caption); viewers follow status privacy
+- send_poll - Send a poll (to, question, options, max_selections: 1 single choice, N up to N, 0 any number)
+- vote_poll - Vote in a stored poll by option names (message_id, options; empty options withdraws the vote)
+- get_poll_results - Per-option vote counts and voters plus each voter's selections (message_id); votes also reach handlers as event_type "poll_vote"
+- get_reactions - Who reacted to a message or chat with what (message_id, chat)
+- get_group_events - Group joins, leaves, subject changes (group, action); also dispatched to handlers as event_type "group_update"
+- request_chat_history - Backfill older messages for a chat from the phone (chat, count, before_message_id)
+- check_numbers_on_whatsapp - Check which phone numbers are registered and get their JIDs (numbers)
+- get_users_info - Profile info (status, picture ID, verified name, devices) for many JIDs at once (jids)
+- set_disappearing_timer - Set disappearing messages for a chat (chat, duration: off/24h/7d/90d)
+- get_chat_settings - Pinned/archived/muted state and disappearing timer for a chat (wait_for_sync seconds to wait for app state)
+- set_profile_picture - Set (or remove) our profile picture, or a group's with group=JID, from image_base64 or path
+- transcribe_voice - Download a voice message and transcribe it with the transcription_tool MCP tool (message_id, language, force)
+- get_media_files - Media saved by auto_download_media, newest first (chat, media_type, limit)
+- get_my_groups - Groups this account is in, with participant counts and admin status (cached 5 min; refresh=true to bypass)
 - get_method_registry - Get full method list with examples
+- get_action_registry - List handler action types with their fields and examples
+- get_message_types - List sendable waE2E.Message content types with required fields, examples and how to send each
+- render_template - Fill a message template's {placeholders} and validate the waE2E.Message (template, values)
+- save_template - Save a reusable message template with {placeholders}, usable by send_message actions (name, template, description, defaults)
+- get_template, list_templates, delete_template - Inspect and remove saved message templates (name)
+- reload_method_registry - Re-read the external registry at config method_registry_path
 - get_version, get_health_status, get_error_log - System ops
+- get_time_info - Local time vs. the latest server message timestamp and estimated clock skew
+- get_connection_log - Connect/disconnect history (limit, event_type, since)
+- get_activity - Messages, connection events and handler executions in one timeline, each tagged with kind (limit, since)
+- get_operation_metrics - Per-operation call counts and latency histograms
+- get_audit_log - Every operation invoked, with redacted arguments (limit, filter_operation, success, since)
 - shutdown - Graceful exit
 
+Long operations (request_chat_history, check_numbers_on_whatsapp, get_users_info) send notifications/progress while they run
+
 ## Send Message
 {
   "operation": "call_whatsmeow",
@@ -667,6 +1071,12 @@ Handlers return actions, don't execute directly:
 ✅ return {'actions': [{'type': 'send_message', 'to': '...', 'message': {...}}]}
 ❌ Don't call mcp.call('whatsapp', ...) for writes
 ✅ Research queries (GetUserInfo, etc.) are OK
+- pause_chat_handlers / resume_chat_handlers - Stop all handlers for one chat while you take over, then resume (chat, minutes, reason; both return paused_chats)
+- list_running_handlers - Handler executions in progress with execution_id, handler_id, event, started_at and elapsed_ms
+- cancel_handler_execution - Stop a running handler execution (execution_id); it is logged as failed
+- get_dead_letters - Handler send actions that failed, with their event and error (limit, handler_id, include_resolved)
+- retry_dead_letter - Send a failed action again (id); marked resolved on success
+- set_autoreply / get_autoreply - Out-of-office reply to direct messages outside office_hours (message, office_hours {days, start, end, timezone}, cooldown_hours, include_groups, enabled)
 
 See TOOL_DOCUMENTATION_FOR_LLMS.md for complete guide.`, ToolName, ToolVersion),
         "description": fmt.Sprintf("%s v%s - Send/receive WhatsApp messages, query history, call ANY whatsmeow method via generic dispatcher. Auto-login, panic recovery, message templates.", ToolName, ToolVersion),
@@ -678,18 +1088,55 @@ See TOOL_DOCUMENTATION_FOR_LLMS.md for complete guide.`, ToolName, ToolVersion),
               "enum": []string{
                 "get_version",
                 "get_health_status",
+                "get_time_info",
                 "get_error_log",
                 "clear_error_state",
                 "get_config",
                 "set_config",
                 "get_connection_info",
+                "get_connection_log",
+                "get_activity",
+                "get_operation_metrics",
+                "get_audit_log",
                 "get_qr_code",
                 "check_login_status",
+                "get_pairing_status",
+                "get_pairing_history",
                 "logout",
+                "relink",
+                "backup_session",
+                "restore_session",
                 "shutdown",
                 "call_whatsmeow",
                 "get_method_registry",
+                "get_action_registry",
+                "get_message_types",
+                "render_template",
+                "save_template",
+                "get_template",
+                "list_templates",
+                "delete_template",
+                "reload_method_registry",
                 "get_messages",
+                "get_raw_message",
+                "search_messages",
+                "get_message_histogram",
+                "get_reactions",
+                "send_link",
+                "post_status",
+                "send_poll",
+                "vote_poll",
+                "get_poll_results",
+                "get_group_events",
+                "request_chat_history",
+                "check_numbers_on_whatsapp",
+                "get_users_info",
+                "set_disappearing_timer",
+                "get_chat_settings",
+                "get_my_groups",
+                "set_profile_picture",
+                "transcribe_voice",
+                "get_media_files",
                 "register_handler",
                 "list_handlers",
                 "get_handler",
@@ -699,6 +1146,14 @@ See TOOL_DOCUMENTATION_FOR_LLMS.md for complete guide.`, ToolName, ToolVersion),
                 "disable_handler",
                 "get_handler_executions",
                 "reload_handlers",
+                "pause_chat_handlers",
+                "resume_chat_handlers",
+                "list_running_handlers",
+                "cancel_handler_execution",
+                "get_dead_letters",
+                "retry_dead_letter",
+                "set_autoreply",
+                "get_autoreply",
               },
               "description": "Operation to perform",
             },
@@ -715,18 +1170,32 @@ See TOOL_DOCUMENTATION_FOR_LLMS.md for complete guide.`, ToolName, ToolVersion),
     },
   }
 
-  result, err := conn.sendRequest("tools/call", params)
+  // Registering the same tool again is harmless, so a timed out attempt can be retried
+  rpcResponse, err := conn.roundTrip(context.Background(), "tools/call", params, true, 10*time.Second, "timeout")
   if err != nil {
+    var statusErr *postStatusError
+    if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+      return fmt.Errorf("%w: %v", errRegistrationRejected, err)
+    }
     return err
   }
+  if rpcResponse.Error != nil {
+    return fmt.Errorf("registration error: %v", rpcResponse.Error)
+  }
 
   var response map[string]interface{}
-  if err := json.Unmarshal(result, &response); err == nil {
+  if err := json.Unmarshal(rpcResponse.Result, &response); err == nil {
     if content, ok := response["content"].([]interface{}); ok && len(content) > 0 {
       if item, ok := content[0].(map[string]interface{}); ok {
-        if text, ok := item["text"].(string); ok && strings.Contains(text, "Successfully registered tool") {
-          fmt.Fprintf(os.Stderr, "[OK] %s\n", text)
-          return nil
+        if text, ok := item["text"].(string); ok {
+          if strings.Contains(text, "Successfully registered tool") {
+            fmt.Fprintf(logStderr, "[OK] %s\n", text)
+            return nil
+          }
+          if isAuthFailure(text) {
+            return fmt.Errorf("%w: %s", errRegistrationRejected, text)
+          }
+          return fmt.Errorf("unexpected registration response: %s", text)
         }
       }
     }
@@ -735,8 +1204,53 @@ See TOOL_DOCUMENTATION_FOR_LLMS.md for complete guide.`, ToolName, ToolVersion),
   return fmt.Errorf("unexpected registration response")
 }
 
+// errRegistrationRejected marks a registration failure that retrying can't fix, such as
+// bad credentials
+var errRegistrationRejected = errors.New("registration rejected")
+
+// isAuthFailure reports whether a server message says the request wasn't authorized
+func isAuthFailure(text string) bool {
+  text = strings.ToLower(text)
+  for _, marker := range []string{"unauthorized", "forbidden", "authentication", "invalid api key", "invalid tool_api_key"} {
+    if strings.Contains(text, marker) {
+      return true
+    }
+  }
+  return false
+}
+
+// registerWithRetry registers the whatsapp tool, retrying transient failures (such as an MCP
+// server that is still starting up) with exponential backoff according to
+// register_retry_attempts and register_retry_backoff_ms. A rejected registration fails at
+// once. Returns false without an error if a signal arrived while waiting to retry.
+func registerWithRetry(conn *SSEConnection, sigChan <-chan os.Signal) (bool, error) {
+  attempts, backoff := global_config.GetRegisterRetry()
+  if attempts < 1 {
+    attempts = 1
+  }
+
+  var err error
+  for attempt := 1; attempt <= attempts; attempt++ {
+    if attempt > 1 {
+      fmt.Fprintf(logStderr, "[WARN] Registration attempt %d/%d failed, retrying in %s: %v\n", attempt-1, attempts, backoff, err)
+      select {
+      case <-time.After(backoff):
+      case <-sigChan:
+        return false, nil
+      }
+      backoff *= 2
+    }
+
+    err = registerWhatsAppTool(conn)
+    if err == nil || errors.Is(err, errRegistrationRejected) {
+      return err == nil, err
+    }
+  }
+  return false, fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+}
+
 // Handle WhatsApp operations
-func handleWhatsAppOperation(inputData json.RawMessage, conn *SSEConnection) map[string]interface{} {
+func handleWhatsAppOperation(inputData json.RawMessage, callID string, conn *SSEConnection) map[string]interface{} {
   var callData map[string]interface{}
   if err := json.Unmarshal(inputData, &callData); err != nil {
     log.Error().Err(err).Msg("Failed to unmarshal call data")
@@ -762,42 +1276,24 @@ func handleWhatsAppOperation(inputData json.RawMessage, conn *SSEConnection) map
   input := &OperationInput{
     Operation: operation,
     Data:      data,
+    progress:  progressNotifier(conn, callID, params),
   }
 
   // Handle operation
   result := global_operation_handler.HandleOperation(input)
 
-  // Log to database if error
+  // Record failures; LogError persists them unless db_log_min_severity is above error
   if !result.Success {
     global_error_state.LogError(ErrorSeverityError, operation, result.Error, "")
-    global_database.LogError(global_error_state.GetRecentErrors(nil, 1)[0])
-  }
-
-  // Special handling for get_qr_code - return image
-  if operation == "get_qr_code" && result.Success {
-    if qrBase64, ok := result.Data["qr_code_base64"].(string); ok && qrBase64 != "" {
-      // Return as image using proper MCP image content type
-      return map[string]interface{}{
-        "content": []map[string]interface{}{
-          {
-            "type": "image",
-            "mimeType": "image/png",
-            "data": qrBase64,
-          },
-          {
-            "type": "text",
-            "text": fmt.Sprintf("QR Code generated successfully!\n\nInstructions: %s\n\nQR Code Text: %s\n\nTimeout: %d seconds",
-              result.Data["instructions"],
-              result.Data["qr_code_text"],
-              result.Data["timeout"]),
-          },
-        },
-        "isError": false,
-      }
-    }
   }
 
-  // Format result as MCP response (standard text response)
+  return formatOperationResponse(result)
+}
+
+// formatOperationResponse converts an operation result into MCP content items.
+// Results carrying BinaryData are emitted as image (for image/* types) or
+// resource content, followed by the JSON result as text.
+func formatOperationResponse(result *OperationResult) map[string]interface{} {
   resultJSON, err := json.Marshal(result)
   if err != nil {
     log.Error().Err(err).Msg("Failed to marshal result")
@@ -812,59 +1308,85 @@ func handleWhatsAppOperation(inputData json.RawMessage, conn *SSEConnection) map
     }
   }
 
+  content := []map[string]interface{}{}
+
+  if result.BinaryData != "" {
+    contentType := result.ContentType
+    if contentType == "" {
+      contentType = "application/octet-stream"
+    }
+
+    if strings.HasPrefix(contentType, "image/") {
+      content = append(content, map[string]interface{}{
+        "type":     "image",
+        "mimeType": contentType,
+        "data":     result.BinaryData,
+      })
+    } else {
+      content = append(content, map[string]interface{}{
+        "type": "resource",
+        "resource": map[string]interface{}{
+          "uri":      "whatsapp://binary",
+          "mimeType": contentType,
+          "blob":     result.BinaryData,
+        },
+      })
+    }
+  }
+
+  content = append(content, map[string]interface{}{
+    "type": "text",
+    "text": string(resultJSON),
+  })
+
   return map[string]interface{}{
-    "content": []map[string]interface{}{
-      {
-        "type": "text",
-        "text": string(resultJSON),
-      },
-    },
+    "content": content,
     "isError": !result.Success,
   }
 }
 
 // Main worker
 func mainWorker() int {
-	fmt.Fprintf(os.Stderr, "=== %s v%s ===\n", ToolName, ToolVersion)
-	fmt.Fprintf(os.Stderr, "PID: %d\n", os.Getpid())
-	fmt.Fprintln(os.Stderr, "Initializing system...\n")
+	fmt.Fprintf(logStderr, "=== %s v%s ===\n", ToolName, ToolVersion)
+	fmt.Fprintf(logStderr, "PID: %d\n", os.Getpid())
+	fmt.Fprint(logStderr, "Initializing system...\n\n")
 
   // Initialize system components
   if err := initializeSystem(); err != nil {
-    fmt.Fprintf(os.Stderr, "ERROR: Failed to initialize system: %v\n", err)
+    fmt.Fprintf(logStderr, "ERROR: Failed to initialize system: %v\n", err)
     return 1
   }
   defer shutdownSystem()
 
-  fmt.Fprintln(os.Stderr, "Connecting to MCP server...\n")
+  fmt.Fprint(logStderr, "Connecting to MCP server...\n\n")
 
   // Setup signal handling
   sigChan := make(chan os.Signal, 1)
   signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
   // Step 1: Find manifest
-  fmt.Fprintln(os.Stderr, "Step 1: Finding native messaging manifest...")
+  fmt.Fprintln(logStderr, "Step 1: Finding native messaging manifest...")
   manifestPath, err := findNativeMessagingManifest()
   if err != nil {
-    fmt.Fprintln(os.Stderr, "ERROR: Could not find native messaging manifest")
+    fmt.Fprintln(logStderr, "ERROR: Could not find native messaging manifest")
     return 1
   }
-  fmt.Fprintf(os.Stderr, "[OK] Found manifest: %s\n\n", manifestPath)
+  fmt.Fprintf(logStderr, "[OK] Found manifest: %s\n\n", manifestPath)
 
   // Step 2: Read manifest
-  fmt.Fprintln(os.Stderr, "Step 2: Reading manifest...")
+  fmt.Fprintln(logStderr, "Step 2: Reading manifest...")
   manifest, err := readManifest(manifestPath)
   if err != nil {
-    fmt.Fprintln(os.Stderr, "ERROR: Could not read manifest")
+    fmt.Fprintln(logStderr, "ERROR: Could not read manifest")
     return 1
   }
-  fmt.Fprintln(os.Stderr, "[OK] Manifest loaded\n")
+  fmt.Fprint(logStderr, "[OK] Manifest loaded\n\n")
 
   // Step 3: Discover endpoint
-  fmt.Fprintln(os.Stderr, "Step 3: Discovering MCP server endpoint...")
+  fmt.Fprintln(logStderr, "Step 3: Discovering MCP server endpoint...")
   config, err := discoverMCPServerEndpoint(manifest)
   if err != nil {
-    fmt.Fprintln(os.Stderr, "ERROR: Could not get configuration")
+    fmt.Fprintln(logStderr, "ERROR: Could not get configuration")
     return 1
   }
 
@@ -876,54 +1398,60 @@ func mainWorker() int {
   }
 
   if serverURL == "" {
-    fmt.Fprintln(os.Stderr, "ERROR: Could not extract server URL")
+    fmt.Fprintln(logStderr, "ERROR: Could not extract server URL")
     return 1
   }
-  fmt.Fprintf(os.Stderr, "[OK] Found server at: %s\n\n", serverURL)
+  fmt.Fprintf(logStderr, "[OK] Found server at: %s\n\n", serverURL)
 
   // Step 4: Connect to SSE
-  fmt.Fprintln(os.Stderr, "Step 4: Connecting to SSE endpoint...")
+  fmt.Fprintln(logStderr, "Step 4: Connecting to SSE endpoint...")
   conn, err := connectSSE(serverURL, authHeader)
   if err != nil {
-    fmt.Fprintf(os.Stderr, "ERROR: Could not connect: %v\n", err)
+    fmt.Fprintf(logStderr, "ERROR: Could not connect: %v\n", err)
     return 1
   }
-  fmt.Fprintf(os.Stderr, "[OK] Connected! Session ID: %s\n\n", conn.SessionID)
+  fmt.Fprintf(logStderr, "[OK] Connected! Session ID: %s\n\n", conn.sessionID())
   
   // Store connection globally for tool calls
   global_sse_connection = conn
 
   // Step 5: Register WhatsApp tool
-  fmt.Fprintln(os.Stderr, "Step 5: Registering whatsapp tool...")
-  if err := registerWhatsAppTool(conn); err != nil {
-    fmt.Fprintf(os.Stderr, "ERROR: Failed to register: %v\n", err)
+  fmt.Fprintln(logStderr, "Step 5: Registering whatsapp tool...")
+  registered, err := registerWithRetry(conn, sigChan)
+  if err != nil {
+    fmt.Fprintf(logStderr, "ERROR: Failed to register: %v\n", err)
     return 1
   }
+  if !registered {
+    fmt.Fprintln(logStderr, "Interrupted before registration, shutting down...")
+    conn.StopChannel <- true
+    return 0
+  }
 
-  fmt.Fprintln(os.Stderr, "\n"+strings.Repeat("=", 60))
-  fmt.Fprintln(os.Stderr, "[OK] WhatsApp tool registered successfully!")
-  fmt.Fprintln(os.Stderr, "Listening for tool calls... (Press Ctrl+C to stop)")
-  fmt.Fprintln(os.Stderr, strings.Repeat("=", 60)+"\n")
+  fmt.Fprintln(logStderr, "\n"+strings.Repeat("=", 60))
+  fmt.Fprintln(logStderr, "[OK] WhatsApp tool registered successfully!")
+  fmt.Fprintln(logStderr, "Listening for tool calls... (Press Ctrl+C to stop)")
+  fmt.Fprintln(logStderr, strings.Repeat("=", 60)+"\n")
 
   // Step 6: Listen for reverse calls
   for {
     select {
     case msg := <-conn.ReverseChannel:
-      fmt.Fprintln(os.Stderr, "\n[CALL] Reverse call received:")
-      fmt.Fprintf(os.Stderr, "       Tool: %s\n", msg.Reverse.Tool)
-      fmt.Fprintf(os.Stderr, "       Call ID: %s\n", msg.Reverse.CallID)
+      fmt.Fprintln(logStderr, "\n[CALL] Reverse call received:")
+      fmt.Fprintf(logStderr, "       Tool: %s\n", msg.Reverse.Tool)
+      fmt.Fprintf(logStderr, "       Call ID: %s\n", msg.Reverse.CallID)
 
       if msg.Reverse.Tool == "whatsapp" {
-        result := handleWhatsAppOperation(msg.Reverse.Input, conn)
+        result := handleWhatsAppOperation(msg.Reverse.Input, msg.Reverse.CallID, conn)
         conn.sendToolReply(msg.Reverse.CallID, result)
       } else {
-        fmt.Fprintf(os.Stderr, "[WARN] Unknown tool: %s\n", msg.Reverse.Tool)
+        fmt.Fprintf(logStderr, "[WARN] Unknown tool: %s\n", msg.Reverse.Tool)
       }
 
     case <-sigChan:
-      fmt.Fprintln(os.Stderr, "\n\n"+strings.Repeat("=", 60))
-      fmt.Fprintln(os.Stderr, "Shutting down...")
-      fmt.Fprintln(os.Stderr, strings.Repeat("=", 60))
+      fmt.Fprintln(logStderr, "\n\n"+strings.Repeat("=", 60))
+      fmt.Fprintln(logStderr, "Shutting down...")
+      fmt.Fprintln(logStderr, strings.Repeat("=", 60))
       conn.StopChannel <- true
       return 0
     }
@@ -942,7 +1470,7 @@ func main() {
   }
 
   if *background {
-    fmt.Fprintf(os.Stderr, "Starting in background mode (PID: %d)...\n", os.Getpid())
+    fmt.Fprintf(logStderr, "Starting in background mode (PID: %d)...\n", os.Getpid())
   }
 
   os.Exit(mainWorker())
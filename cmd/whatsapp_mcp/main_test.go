@@ -0,0 +1,109 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "math/rand"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+)
+
+// newTestMCPServer starts an SSE endpoint that answers each POSTed request on the stream,
+// echoing its params, after a random delay so responses arrive out of order
+func newTestMCPServer(t *testing.T) *httptest.Server {
+  events := make(chan string, 100)
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/event-stream")
+    fmt.Fprint(w, "event: endpoint\ndata: /messages?session_id=test\n\n")
+    w.(http.Flusher).Flush()
+    for {
+      select {
+      case event := <-events:
+        fmt.Fprintf(w, "data: %s\n\n", event)
+        w.(http.Flusher).Flush()
+      case <-r.Context().Done():
+        return
+      }
+    }
+  })
+  mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(r.Body)
+    var request JSONRPCRequest
+    if err := json.Unmarshal(body, &request); err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+    w.WriteHeader(http.StatusAccepted)
+
+    go func() {
+      time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+      response, _ := json.Marshal(map[string]interface{}{
+        "jsonrpc": "2.0",
+        "id":      request.ID,
+        "result":  request.Params,
+      })
+      events <- string(response)
+    }()
+  })
+
+  server := httptest.NewServer(mux)
+  t.Cleanup(func() {
+    // The SSE stream stays open until the client goes away
+    server.CloseClientConnections()
+    server.Close()
+  })
+  return server
+}
+
+// TestConcurrentRoundTrips sends requests from many goroutines at once and checks each gets
+// its own response back, exercising ResponseChannel from the SSE reader and the senders
+// together. Run with -race.
+func TestConcurrentRoundTrips(t *testing.T) {
+  global_config = NewConfig()
+  server := newTestMCPServer(t)
+
+  conn, err := connectSSE(server.URL+"/sse", "Bearer test")
+  if err != nil {
+    t.Fatalf("connectSSE: %v", err)
+  }
+  defer func() { conn.StopChannel <- true }()
+
+  const callers = 20
+  const callsEach = 10
+
+  var wg sync.WaitGroup
+  for caller := 0; caller < callers; caller++ {
+    wg.Add(1)
+    go func(caller int) {
+      defer wg.Done()
+      for call := 0; call < callsEach; call++ {
+        sent := fmt.Sprintf("%d/%d", caller, call)
+        response, err := conn.roundTrip(t.Context(), "tools/call", map[string]interface{}{"call": sent}, false, 5*time.Second, "timeout")
+        if err != nil {
+          t.Errorf("roundTrip %s: %v", sent, err)
+          return
+        }
+        var result map[string]string
+        if err := json.Unmarshal(response.Result, &result); err != nil || result["call"] != sent {
+          t.Errorf("roundTrip %s got response %s", sent, response.Result)
+        }
+      }
+    }(caller)
+  }
+  wg.Wait()
+
+  if pending, _ := conn.takeResponseChannel(""); pending != nil {
+    t.Error("unexpected response channel for empty request ID")
+  }
+  conn.responseMutex.Lock()
+  defer conn.responseMutex.Unlock()
+  if len(conn.ResponseChannel) != 0 {
+    t.Errorf("%d response channels left registered", len(conn.ResponseChannel))
+  }
+}
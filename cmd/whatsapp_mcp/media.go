@@ -0,0 +1,724 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/base64"
+  "encoding/binary"
+  "fmt"
+  "image"
+  "image/draw"
+  _ "image/gif"
+  "image/jpeg"
+  _ "image/png"
+  "io"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+  "time"
+
+  "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/types/events"
+  "google.golang.org/protobuf/proto"
+)
+
+// downloadLimiter caps concurrent media downloads at max_concurrent_downloads so a burst of
+// media can't starve the websocket of bandwidth. The limit is re-read on every acquire, so
+// set_config takes effect for queued downloads too.
+type downloadLimiter struct {
+  mu      sync.Mutex
+  active  int
+  waiting int
+  wake    chan struct{} // closed and replaced whenever a slot is released
+}
+
+// global_download_limiter is shared by handler-triggered and on-demand downloads
+var global_download_limiter = &downloadLimiter{wake: make(chan struct{})}
+
+// acquire waits for a free download slot, or returns ctx's error if it is cancelled first
+func (dl *downloadLimiter) acquire(ctx context.Context) error {
+  dl.mu.Lock()
+  dl.waiting++
+  defer func() {
+    dl.mu.Lock()
+    dl.waiting--
+    dl.mu.Unlock()
+  }()
+
+  for {
+    limit := global_config.GetMaxConcurrentDownloads()
+    if limit <= 0 || dl.active < limit {
+      dl.active++
+      dl.mu.Unlock()
+      return nil
+    }
+    wake := dl.wake
+    dl.mu.Unlock()
+
+    select {
+    case <-wake:
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+    dl.mu.Lock()
+  }
+}
+
+// release frees a slot taken by acquire and wakes queued downloads
+func (dl *downloadLimiter) release() {
+  dl.mu.Lock()
+  defer dl.mu.Unlock()
+  dl.active--
+  close(dl.wake)
+  dl.wake = make(chan struct{})
+}
+
+// Stats reports how many downloads are running and queued
+func (dl *downloadLimiter) Stats() map[string]interface{} {
+  dl.mu.Lock()
+  defer dl.mu.Unlock()
+  return map[string]interface{}{
+    "active":  dl.active,
+    "waiting": dl.waiting,
+    "limit":   global_config.GetMaxConcurrentDownloads(),
+  }
+}
+
+// incomingMedia returns the downloadable media in a message with its type, MIME type and size.
+// ok is false if the message carries no media.
+func incomingMedia(message *waE2E.Message) (media whatsmeow.DownloadableMessage, mediaType string, mimeType string, size uint64, ok bool) {
+  switch {
+  case message.GetImageMessage() != nil:
+    image := message.GetImageMessage()
+    return image, "image", image.GetMimetype(), image.GetFileLength(), true
+  case message.GetVideoMessage() != nil:
+    video := message.GetVideoMessage()
+    return video, "video", video.GetMimetype(), video.GetFileLength(), true
+  case message.GetDocumentMessage() != nil:
+    doc := message.GetDocumentMessage()
+    return doc, "document", doc.GetMimetype(), doc.GetFileLength(), true
+  case message.GetAudioMessage() != nil:
+    audio := message.GetAudioMessage()
+    return audio, "audio", audio.GetMimetype(), audio.GetFileLength(), true
+  case message.GetStickerMessage() != nil:
+    sticker := message.GetStickerMessage()
+    return sticker, "sticker", sticker.GetMimetype(), sticker.GetFileLength(), true
+  }
+  return nil, "", "", 0, false
+}
+
+// mediaExtensions maps the MIME types we save media as to their file extensions. Anything
+// else falls back to a default for the media type, so the sender can't choose the extension.
+var mediaExtensions = map[string]string{
+  "image/jpeg":                    ".jpg",
+  "image/png":                     ".png",
+  "image/gif":                     ".gif",
+  "image/webp":                    ".webp",
+  "video/mp4":                     ".mp4",
+  "video/3gpp":                    ".3gp",
+  "audio/ogg":                     ".ogg",
+  "audio/mpeg":                    ".mp3",
+  "audio/mp4":                     ".m4a",
+  "audio/aac":                     ".aac",
+  "application/pdf":               ".pdf",
+  "application/zip":               ".zip",
+  "text/plain":                    ".txt",
+  "text/csv":                      ".csv",
+  "application/msword":            ".doc",
+  "application/vnd.ms-excel":      ".xls",
+  "application/vnd.ms-powerpoint": ".ppt",
+  "application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+  "application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+}
+
+// mediaFileExtension picks a file extension for downloaded media from its MIME type, then a
+// default for the media type
+func mediaFileExtension(mediaType string, mimeType string) string {
+  if ext, ok := mediaExtensions[strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))]; ok {
+    return ext
+  }
+  switch mediaType {
+  case "image":
+    return ".jpg"
+  case "video":
+    return ".mp4"
+  case "audio":
+    return ".ogg"
+  case "sticker":
+    return ".webp"
+  }
+  return ".bin"
+}
+
+// mediaFilePath returns where to save a message's media under dir. The message ID comes from
+// the sender, so one that could name a path outside dir is rejected.
+func mediaFilePath(dir string, messageID string, ext string) (string, error) {
+  if messageID == "" || messageID == "." || messageID == ".." || strings.ContainsAny(messageID, "/\\\x00") {
+    return "", fmt.Errorf("unsafe message ID %q", messageID)
+  }
+  return filepath.Join(dir, messageID+ext), nil
+}
+
+// autoDownloadMedia saves an incoming message's media to media_download_path and indexes it
+// in media_files, when auto_download_media is on and the media passes the type and size
+// filters. It runs independently of handlers and shares the max_concurrent_downloads limit.
+func autoDownloadMedia(v *events.Message) {
+  enabled, types, maxBytes := global_config.GetAutoDownloadMedia()
+  if !enabled || global_whatsapp_client == nil {
+    return
+  }
+
+  media, mediaType, mimeType, size, ok := incomingMedia(v.Message)
+  if !ok {
+    return
+  }
+  if len(types) > 0 && !slices.Contains(types, mediaType) {
+    return
+  }
+  if maxBytes > 0 && size > uint64(maxBytes) {
+    global_error_state.LogError(ErrorSeverityInfo, "media_download", "Skipped auto-download of oversized media", fmt.Sprintf("Message: %s, Size: %d bytes, Limit: %d bytes", v.Info.ID, size, maxBytes))
+    return
+  }
+
+  ctx := context.Background()
+  if err := global_download_limiter.acquire(ctx); err != nil {
+    return
+  }
+  data, err := global_whatsapp_client.Client().Download(ctx, media)
+  global_download_limiter.release()
+  if err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "media_download", "Failed to auto-download media", fmt.Sprintf("Message: %s: %v", v.Info.ID, err))
+    return
+  }
+
+  dir := global_config.GetMediaDownloadPath()
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "media_download", "Failed to create media directory", err.Error())
+    return
+  }
+  path, err := mediaFilePath(dir, v.Info.ID, mediaFileExtension(mediaType, mimeType))
+  if err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "media_download", "Skipped auto-download of media", err.Error())
+    return
+  }
+  if err := os.WriteFile(path, data, 0644); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "media_download", "Failed to save downloaded media", err.Error())
+    return
+  }
+
+  if err := global_database.SaveMediaFile(v.Info.ID, v.Info.Chat.String(), v.Info.Sender.ToNonAD().String(), mediaType, mimeType, len(data), path); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "media_download", "Failed to index downloaded media", err.Error())
+  }
+}
+
+// uploadMediaFile reads a local file and uploads it to WhatsApp's media servers
+func uploadMediaFile(ctx context.Context, path string, mediaType whatsmeow.MediaType) ([]byte, whatsmeow.UploadResponse, error) {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return nil, whatsmeow.UploadResponse{}, fmt.Errorf("WhatsApp client not connected")
+  }
+
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, whatsmeow.UploadResponse{}, fmt.Errorf("failed to read media file: %w", err)
+  }
+
+  uploaded, err := global_whatsapp_client.Client().Upload(ctx, data, mediaType)
+  if err != nil {
+    return nil, whatsmeow.UploadResponse{}, fmt.Errorf("failed to upload media: %w", err)
+  }
+
+  return data, uploaded, nil
+}
+
+// buildVoiceMessage uploads an OGG/Opus file and builds a push-to-talk AudioMessage,
+// which WhatsApp renders as a voice note instead of an audio attachment
+func buildVoiceMessage(ctx context.Context, path string) (*waE2E.Message, error) {
+  data, uploaded, err := uploadMediaFile(ctx, path, whatsmeow.MediaAudio)
+  if err != nil {
+    return nil, err
+  }
+
+  audio := &waE2E.AudioMessage{
+    URL:           proto.String(uploaded.URL),
+    DirectPath:    proto.String(uploaded.DirectPath),
+    MediaKey:      uploaded.MediaKey,
+    Mimetype:      proto.String("audio/ogg; codecs=opus"),
+    FileEncSHA256: uploaded.FileEncSHA256,
+    FileSHA256:    uploaded.FileSHA256,
+    FileLength:    proto.Uint64(uploaded.FileLength),
+    PTT:           proto.Bool(true),
+  }
+
+  if seconds, err := oggOpusDuration(data); err == nil {
+    audio.Seconds = proto.Uint32(seconds)
+  }
+
+  return &waE2E.Message{AudioMessage: audio}, nil
+}
+
+// buildMediaMessage uploads an image, video or document and builds the matching message.
+// View-once media is flagged and wrapped in a ViewOnceMessage so it can only be opened once.
+func buildMediaMessage(ctx context.Context, path string, mediaType string, caption string, mimetype string, viewOnce bool) (*waE2E.Message, error) {
+  var uploadType whatsmeow.MediaType
+  switch mediaType {
+  case "image":
+    uploadType = whatsmeow.MediaImage
+  case "video":
+    uploadType = whatsmeow.MediaVideo
+  case "document":
+    if viewOnce {
+      return nil, fmt.Errorf("view_once is only supported for image and video")
+    }
+    uploadType = whatsmeow.MediaDocument
+  default:
+    return nil, fmt.Errorf("unsupported media_type: %s (must be 'image', 'video' or 'document')", mediaType)
+  }
+
+  data, uploaded, err := uploadMediaFile(ctx, path, uploadType)
+  if err != nil {
+    return nil, err
+  }
+
+  if mimetype == "" {
+    mimetype = http.DetectContentType(data)
+  }
+
+  message := &waE2E.Message{}
+  switch mediaType {
+  case "image":
+    message.ImageMessage = &waE2E.ImageMessage{
+      URL:           proto.String(uploaded.URL),
+      DirectPath:    proto.String(uploaded.DirectPath),
+      MediaKey:      uploaded.MediaKey,
+      Mimetype:      proto.String(mimetype),
+      FileEncSHA256: uploaded.FileEncSHA256,
+      FileSHA256:    uploaded.FileSHA256,
+      FileLength:    proto.Uint64(uploaded.FileLength),
+    }
+    if caption != "" {
+      message.ImageMessage.Caption = proto.String(caption)
+    }
+    if viewOnce {
+      message.ImageMessage.ViewOnce = proto.Bool(true)
+    } else if thumbnail, width, height, err := imageThumbnail(data); err == nil {
+      message.ImageMessage.JPEGThumbnail = thumbnail
+      message.ImageMessage.Width = proto.Uint32(width)
+      message.ImageMessage.Height = proto.Uint32(height)
+    }
+  case "video":
+    message.VideoMessage = &waE2E.VideoMessage{
+      URL:           proto.String(uploaded.URL),
+      DirectPath:    proto.String(uploaded.DirectPath),
+      MediaKey:      uploaded.MediaKey,
+      Mimetype:      proto.String(mimetype),
+      FileEncSHA256: uploaded.FileEncSHA256,
+      FileSHA256:    uploaded.FileSHA256,
+      FileLength:    proto.Uint64(uploaded.FileLength),
+    }
+    if caption != "" {
+      message.VideoMessage.Caption = proto.String(caption)
+    }
+    if viewOnce {
+      message.VideoMessage.ViewOnce = proto.Bool(true)
+    } else if thumbnail, width, height, err := videoThumbnail(ctx, path); err == nil {
+      message.VideoMessage.JPEGThumbnail = thumbnail
+      message.VideoMessage.Width = proto.Uint32(width)
+      message.VideoMessage.Height = proto.Uint32(height)
+    }
+  case "document":
+    message.DocumentMessage = &waE2E.DocumentMessage{
+      URL:           proto.String(uploaded.URL),
+      DirectPath:    proto.String(uploaded.DirectPath),
+      MediaKey:      uploaded.MediaKey,
+      Mimetype:      proto.String(mimetype),
+      FileEncSHA256: uploaded.FileEncSHA256,
+      FileSHA256:    uploaded.FileSHA256,
+      FileLength:    proto.Uint64(uploaded.FileLength),
+      FileName:      proto.String(filepath.Base(path)),
+    }
+    if caption != "" {
+      message.DocumentMessage.Caption = proto.String(caption)
+    }
+  }
+
+  if viewOnce {
+    return &waE2E.Message{
+      ViewOnceMessage: &waE2E.FutureProofMessage{Message: message},
+    }, nil
+  }
+
+  return message, nil
+}
+
+// stickerSize is the dimension WhatsApp requires for stickers
+const stickerSize = 512
+
+// buildStickerMessage uploads a 512x512 WebP file and builds a StickerMessage
+func buildStickerMessage(ctx context.Context, path string) (*waE2E.Message, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read sticker file: %w", err)
+  }
+
+  width, height, animated, err := webpInfo(data)
+  if err != nil {
+    if contentType := http.DetectContentType(data); contentType != "image/webp" {
+      return nil, fmt.Errorf("sticker must be a WebP image, got %s (convert it to 512x512 WebP first)", contentType)
+    }
+    return nil, fmt.Errorf("invalid WebP sticker: %w", err)
+  }
+  if width != stickerSize || height != stickerSize {
+    return nil, fmt.Errorf("sticker must be %dx%d, got %dx%d", stickerSize, stickerSize, width, height)
+  }
+
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return nil, fmt.Errorf("WhatsApp client not connected")
+  }
+
+  uploaded, err := global_whatsapp_client.Client().Upload(ctx, data, whatsmeow.MediaImage)
+  if err != nil {
+    return nil, fmt.Errorf("failed to upload sticker: %w", err)
+  }
+
+  return &waE2E.Message{
+    StickerMessage: &waE2E.StickerMessage{
+      URL:           proto.String(uploaded.URL),
+      DirectPath:    proto.String(uploaded.DirectPath),
+      MediaKey:      uploaded.MediaKey,
+      Mimetype:      proto.String("image/webp"),
+      FileEncSHA256: uploaded.FileEncSHA256,
+      FileSHA256:    uploaded.FileSHA256,
+      FileLength:    proto.Uint64(uploaded.FileLength),
+      Width:         proto.Uint32(width),
+      Height:        proto.Uint32(height),
+      IsAnimated:    proto.Bool(animated),
+    },
+  }, nil
+}
+
+// Limits for link preview images
+const (
+  linkPreviewImageMaxBytes = 5 * 1024 * 1024
+  linkPreviewThumbnailSize = 300 // longest edge of the card's JPEG thumbnail
+)
+
+// linkPreviewClient fetches preview images given by URL
+var linkPreviewClient = &http.Client{Timeout: 15 * time.Second}
+
+// buildLinkMessage builds a text message with an explicit link preview card, so the card
+// doesn't depend on WhatsApp generating one. The URL is appended to text unless it already
+// appears there. The optional preview image is fetched from imageURL or decoded from
+// imageBase64 and re-encoded as the card's JPEG thumbnail.
+func buildLinkMessage(ctx context.Context, text string, url string, title string, description string, imageURL string, imageBase64 string) (*waE2E.Message, error) {
+  if url == "" {
+    return nil, fmt.Errorf("url required")
+  }
+  if !strings.Contains(text, url) {
+    text = strings.TrimSpace(text + "\n" + url)
+  }
+
+  ext := &waE2E.ExtendedTextMessage{
+    Text:        proto.String(text),
+    MatchedText: proto.String(url),
+    Title:       proto.String(title),
+    Description: proto.String(description),
+    PreviewType: waE2E.ExtendedTextMessage_NONE.Enum(),
+  }
+
+  var data []byte
+  var err error
+  switch {
+  case imageBase64 != "":
+    data, err = base64.StdEncoding.DecodeString(imageBase64)
+  case imageURL != "":
+    data, err = fetchPreviewImage(ctx, imageURL)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("failed to read preview image: %w", err)
+  }
+  if data != nil {
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+      return nil, fmt.Errorf("failed to decode preview image: %w", err)
+    }
+    thumbnail := downscaleImage(img, linkPreviewThumbnailSize)
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+      return nil, fmt.Errorf("failed to encode preview image: %w", err)
+    }
+    ext.JPEGThumbnail = buf.Bytes()
+    ext.ThumbnailWidth = proto.Uint32(uint32(thumbnail.Bounds().Dx()))
+    ext.ThumbnailHeight = proto.Uint32(uint32(thumbnail.Bounds().Dy()))
+  }
+
+  return &waE2E.Message{ExtendedTextMessage: ext}, nil
+}
+
+// fetchPreviewImage downloads a link preview image, refusing anything over linkPreviewImageMaxBytes
+func fetchPreviewImage(ctx context.Context, url string) ([]byte, error) {
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+  if err != nil {
+    return nil, err
+  }
+  resp, err := linkPreviewClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+  }
+
+  data, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewImageMaxBytes+1))
+  if err != nil {
+    return nil, err
+  }
+  if len(data) > linkPreviewImageMaxBytes {
+    return nil, fmt.Errorf("image larger than %d bytes", linkPreviewImageMaxBytes)
+  }
+  return data, nil
+}
+
+// webpInfo reads the canvas size and animation flag from a WebP file's RIFF header
+// (VP8, VP8L or extended VP8X format)
+func webpInfo(data []byte) (uint32, uint32, bool, error) {
+  if len(data) < 30 || !bytes.Equal(data[0:4], []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WEBP")) {
+    return 0, 0, false, fmt.Errorf("not a WebP file")
+  }
+
+  chunk := data[12:]
+  switch string(chunk[0:4]) {
+  case "VP8X":
+    // Flags byte, 3 reserved bytes, then 24-bit canvas width-1 and height-1
+    animated := chunk[8]&0x02 != 0
+    width := uint32(chunk[12]) | uint32(chunk[13])<<8 | uint32(chunk[14])<<16
+    height := uint32(chunk[15]) | uint32(chunk[16])<<8 | uint32(chunk[17])<<16
+    return width + 1, height + 1, animated, nil
+  case "VP8 ":
+    // Lossy: 3-byte frame tag, start code 9d 01 2a, then 14-bit width and height
+    if !bytes.Equal(chunk[11:14], []byte{0x9d, 0x01, 0x2a}) {
+      return 0, 0, false, fmt.Errorf("invalid VP8 frame header")
+    }
+    width := uint32(binary.LittleEndian.Uint16(chunk[14:16]) & 0x3fff)
+    height := uint32(binary.LittleEndian.Uint16(chunk[16:18]) & 0x3fff)
+    return width, height, false, nil
+  case "VP8L":
+    // Lossless: signature 0x2f, then 14-bit width-1 and height-1
+    if chunk[8] != 0x2f {
+      return 0, 0, false, fmt.Errorf("invalid VP8L signature")
+    }
+    bits := binary.LittleEndian.Uint32(chunk[9:13])
+    width := bits&0x3fff + 1
+    height := (bits>>14)&0x3fff + 1
+    return width, height, false, nil
+  default:
+    return 0, 0, false, fmt.Errorf("unknown WebP chunk %q", chunk[0:4])
+  }
+}
+
+// oggOpusDuration computes the length of an OGG/Opus stream in seconds from the
+// final page's granule position (always 48kHz for Opus) minus the OpusHead pre-skip
+func oggOpusDuration(data []byte) (uint32, error) {
+  const headerSize = 27
+
+  var preSkip uint64
+  var lastGranule uint64
+  found := false
+
+  for offset := 0; offset+headerSize <= len(data); {
+    if !bytes.Equal(data[offset:offset+4], []byte("OggS")) {
+      return 0, fmt.Errorf("invalid OGG page at offset %d", offset)
+    }
+
+    granule := binary.LittleEndian.Uint64(data[offset+6 : offset+14])
+    segmentCount := int(data[offset+26])
+    if offset+headerSize+segmentCount > len(data) {
+      break
+    }
+
+    payloadSize := 0
+    for _, segment := range data[offset+headerSize : offset+headerSize+segmentCount] {
+      payloadSize += int(segment)
+    }
+    payloadStart := offset + headerSize + segmentCount
+
+    // The first packet of the stream is the OpusHead identification header
+    if !found {
+      payload := data[payloadStart:]
+      if len(payload) < 12 || !bytes.HasPrefix(payload, []byte("OpusHead")) {
+        return 0, fmt.Errorf("not an Opus stream")
+      }
+      preSkip = uint64(binary.LittleEndian.Uint16(payload[10:12]))
+      found = true
+    }
+
+    // Granule -1 marks pages where no packet finishes
+    if granule != ^uint64(0) {
+      lastGranule = granule
+    }
+
+    offset = payloadStart + payloadSize
+  }
+
+  if !found || lastGranule <= preSkip {
+    return 0, fmt.Errorf("could not determine duration")
+  }
+
+  return uint32((lastGranule - preSkip + 47999) / 48000), nil
+}
+
+// thumbnailMaxSize is the longest edge of generated JPEG thumbnails
+const thumbnailMaxSize = 72
+
+// imageThumbnail decodes a JPEG, PNG or GIF and returns a downscaled JPEG thumbnail
+// along with the original image's dimensions
+func imageThumbnail(data []byte) ([]byte, uint32, uint32, error) {
+  img, _, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return nil, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+  }
+
+  bounds := img.Bounds()
+  thumbnail, err := encodeThumbnail(img)
+  if err != nil {
+    return nil, 0, 0, err
+  }
+  return thumbnail, uint32(bounds.Dx()), uint32(bounds.Dy()), nil
+}
+
+// videoThumbnail grabs a frame with ffmpeg and returns it as a JPEG thumbnail along with
+// the video's dimensions. Fails if ffmpeg isn't installed, in which case the video is sent without one.
+func videoThumbnail(ctx context.Context, path string) ([]byte, uint32, uint32, error) {
+  ffmpeg, err := exec.LookPath("ffmpeg")
+  if err != nil {
+    return nil, 0, 0, fmt.Errorf("ffmpeg not available: %w", err)
+  }
+
+  // The file: prefix stops ffmpeg reading a name as an option ("-...") or a protocol ("http:...")
+  absPath, err := filepath.Abs(path)
+  if err != nil {
+    return nil, 0, 0, err
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+  defer cancel()
+
+  // Take the first frame; seeking further would fail on clips shorter than the offset
+  frame, err := exec.CommandContext(ctx, ffmpeg,
+    "-loglevel", "error",
+    "-i", "file:"+absPath,
+    "-frames:v", "1",
+    "-f", "image2pipe",
+    "-vcodec", "mjpeg",
+    "-",
+  ).Output()
+  if err != nil {
+    return nil, 0, 0, fmt.Errorf("ffmpeg frame extraction failed: %w", err)
+  }
+
+  return imageThumbnail(frame)
+}
+
+// encodeThumbnail box-downscales img so its longest edge is at most thumbnailMaxSize and encodes it as JPEG
+func encodeThumbnail(img image.Image) ([]byte, error) {
+  if img.Bounds().Empty() {
+    return nil, fmt.Errorf("empty image")
+  }
+
+  var buf bytes.Buffer
+  if err := jpeg.Encode(&buf, downscaleImage(img, thumbnailMaxSize), &jpeg.Options{Quality: 70}); err != nil {
+    return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+  }
+  return buf.Bytes(), nil
+}
+
+// downscaleImage box-filters an image so neither side exceeds maxSize, keeping its aspect ratio
+func downscaleImage(img image.Image, maxSize int) *image.RGBA {
+  bounds := img.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+
+  thumbWidth, thumbHeight := width, height
+  if width > maxSize || height > maxSize {
+    if width >= height {
+      thumbWidth = maxSize
+      thumbHeight = max(1, height*maxSize/width)
+    } else {
+      thumbHeight = maxSize
+      thumbWidth = max(1, width*maxSize/height)
+    }
+  }
+
+  thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+  for ty := 0; ty < thumbHeight; ty++ {
+    y0 := bounds.Min.Y + ty*height/thumbHeight
+    y1 := max(y0+1, bounds.Min.Y+(ty+1)*height/thumbHeight)
+    for tx := 0; tx < thumbWidth; tx++ {
+      x0 := bounds.Min.X + tx*width/thumbWidth
+      x1 := max(x0+1, bounds.Min.X+(tx+1)*width/thumbWidth)
+
+      // Average every source pixel that falls in this thumbnail pixel
+      var r, g, b, a, n uint64
+      for y := y0; y < y1; y++ {
+        for x := x0; x < x1; x++ {
+          pr, pg, pb, pa := img.At(x, y).RGBA()
+          r += uint64(pr)
+          g += uint64(pg)
+          b += uint64(pb)
+          a += uint64(pa)
+          n++
+        }
+      }
+      offset := thumb.PixOffset(tx, ty)
+      thumb.Pix[offset] = uint8(r / n >> 8)
+      thumb.Pix[offset+1] = uint8(g / n >> 8)
+      thumb.Pix[offset+2] = uint8(b / n >> 8)
+      thumb.Pix[offset+3] = uint8(a / n >> 8)
+    }
+  }
+
+  return thumb
+}
+
+// Profile picture limits: WhatsApp wants a square JPEG, and rejects very small images
+const (
+  profilePictureMaxSize = 640
+  profilePictureMinSize = 192
+)
+
+// prepareProfilePicture center-crops an image to a square, scales it down to at most
+// profilePictureMaxSize and re-encodes it as JPEG
+func prepareProfilePicture(data []byte) ([]byte, error) {
+  img, format, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return nil, fmt.Errorf("unsupported image (use JPEG, PNG or GIF): %w", err)
+  }
+
+  bounds := img.Bounds()
+  side := min(bounds.Dx(), bounds.Dy())
+  if side < profilePictureMinSize {
+    return nil, fmt.Errorf("image is %dx%d; profile pictures must be at least %dx%d", bounds.Dx(), bounds.Dy(), profilePictureMinSize, profilePictureMinSize)
+  }
+
+  // Already a square JPEG of the right size: send it untouched
+  if format == "jpeg" && bounds.Dx() == bounds.Dy() && side <= profilePictureMaxSize {
+    return data, nil
+  }
+
+  // Center crop to a square
+  x0 := bounds.Min.X + (bounds.Dx()-side)/2
+  y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+  square := image.NewRGBA(image.Rect(0, 0, side, side))
+  draw.Draw(square, square.Bounds(), img, image.Pt(x0, y0), draw.Src)
+
+  var buf bytes.Buffer
+  if err := jpeg.Encode(&buf, downscaleImage(square, profilePictureMaxSize), &jpeg.Options{Quality: 90}); err != nil {
+    return nil, fmt.Errorf("failed to encode profile picture: %w", err)
+  }
+  return buf.Bytes(), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+// messageTypeDefinition documents one waE2E.Message content type: the protojson field that
+// carries it, what it needs and how to send it
+type messageTypeDefinition struct {
+  Type        string                 `json:"type"`
+  Field       string                 `json:"field"`
+  Description string                 `json:"description"`
+  Required    []string               `json:"required"`
+  Optional    []string               `json:"optional"`
+  SendWith    string                 `json:"send_with"`
+  Example     map[string]interface{} `json:"example"`
+}
+
+// mediaUploadNote explains why media content can't be composed by hand
+const mediaUploadNote = "url, directPath, mediaKey, fileSHA256, fileEncSHA256 and fileLength come from uploading the file, so build it with the action rather than by hand"
+
+// messageTypes lists every message content type this tool can build or send, in the order
+// get_message_types returns them. Examples are protojson waE2E.Message values, as taken by
+// SendMessage through call_whatsmeow and by send_message actions.
+var messageTypes = []messageTypeDefinition{
+  {
+    Type:        "conversation",
+    Field:       "conversation",
+    Description: "Plain text",
+    Required:    []string{"conversation"},
+    Optional:    []string{},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow",
+    Example:     map[string]interface{}{"conversation": "Hello!"},
+  },
+  {
+    Type:        "extended_text",
+    Field:       "extendedTextMessage",
+    Description: "Text with a contextInfo for @mentions (mentionedJID) or replies (stanzaID, participant, quotedMessage), or with a link preview (matchedText, title, description)",
+    Required:    []string{"text"},
+    Optional:    []string{"contextInfo", "matchedText", "title", "description", "JPEGThumbnail"},
+    SendWith:    "send_message action (mentions and quoted_message_id fill in contextInfo), send_link for previews",
+    Example: map[string]interface{}{
+      "extendedTextMessage": map[string]interface{}{
+        "text":        "Hello @61487543210",
+        "contextInfo": map[string]interface{}{"mentionedJID": []interface{}{"61487543210@s.whatsapp.net"}},
+      },
+    },
+  },
+  {
+    Type:        "image",
+    Field:       "imageMessage",
+    Description: "Photo with an optional caption; " + mediaUploadNote,
+    Required:    []string{"url", "directPath", "mediaKey", "mimetype", "fileSHA256", "fileEncSHA256", "fileLength"},
+    Optional:    []string{"caption", "width", "height", "JPEGThumbnail", "viewOnce", "contextInfo"},
+    SendWith:    "send_media action (media_type image)",
+    Example: map[string]interface{}{
+      "imageMessage": map[string]interface{}{
+        "caption":  "Here you go",
+        "mimetype": "image/jpeg",
+      },
+    },
+  },
+  {
+    Type:        "video",
+    Field:       "videoMessage",
+    Description: "Video with an optional caption, or a looping GIF with gifPlayback; " + mediaUploadNote,
+    Required:    []string{"url", "directPath", "mediaKey", "mimetype", "fileSHA256", "fileEncSHA256", "fileLength"},
+    Optional:    []string{"caption", "seconds", "width", "height", "gifPlayback", "JPEGThumbnail", "viewOnce", "contextInfo"},
+    SendWith:    "send_media action (media_type video)",
+    Example: map[string]interface{}{
+      "videoMessage": map[string]interface{}{
+        "caption":  "Watch this",
+        "mimetype": "video/mp4",
+      },
+    },
+  },
+  {
+    Type:        "document",
+    Field:       "documentMessage",
+    Description: "File attachment shown with its name; " + mediaUploadNote,
+    Required:    []string{"url", "directPath", "mediaKey", "mimetype", "fileSHA256", "fileEncSHA256", "fileLength"},
+    Optional:    []string{"fileName", "title", "caption", "pageCount", "contextInfo"},
+    SendWith:    "send_media action (media_type document)",
+    Example: map[string]interface{}{
+      "documentMessage": map[string]interface{}{
+        "fileName": "invoice.pdf",
+        "mimetype": "application/pdf",
+      },
+    },
+  },
+  {
+    Type:        "audio",
+    Field:       "audioMessage",
+    Description: "Audio file, or a voice note when PTT is true (OGG/Opus); " + mediaUploadNote,
+    Required:    []string{"url", "directPath", "mediaKey", "mimetype", "fileSHA256", "fileEncSHA256", "fileLength"},
+    Optional:    []string{"PTT", "seconds", "contextInfo"},
+    SendWith:    "send_voice action for voice notes",
+    Example: map[string]interface{}{
+      "audioMessage": map[string]interface{}{
+        "mimetype": "audio/ogg; codecs=opus",
+        "PTT":      true,
+      },
+    },
+  },
+  {
+    Type:        "sticker",
+    Field:       "stickerMessage",
+    Description: "512x512 WebP sticker, optionally animated; " + mediaUploadNote,
+    Required:    []string{"url", "directPath", "mediaKey", "mimetype", "fileSHA256", "fileEncSHA256", "fileLength"},
+    Optional:    []string{"width", "height", "isAnimated"},
+    SendWith:    "send_sticker action",
+    Example: map[string]interface{}{
+      "stickerMessage": map[string]interface{}{
+        "mimetype": "image/webp",
+      },
+    },
+  },
+  {
+    Type:        "location",
+    Field:       "locationMessage",
+    Description: "A pinned location",
+    Required:    []string{"degreesLatitude", "degreesLongitude"},
+    Optional:    []string{"name", "address", "URL"},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow (see the location message template)",
+    Example: map[string]interface{}{
+      "locationMessage": map[string]interface{}{
+        "degreesLatitude":  -33.8688,
+        "degreesLongitude": 151.2093,
+        "name":             "Sydney Opera House",
+      },
+    },
+  },
+  {
+    Type:        "contact",
+    Field:       "contactMessage",
+    Description: "A contact card in vCard format",
+    Required:    []string{"displayName", "vcard"},
+    Optional:    []string{},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow",
+    Example: map[string]interface{}{
+      "contactMessage": map[string]interface{}{
+        "displayName": "Jane Doe",
+        "vcard":       "BEGIN:VCARD\nVERSION:3.0\nFN:Jane Doe\nTEL;type=CELL;waid=61487543210:+61 487 543 210\nEND:VCARD",
+      },
+    },
+  },
+  {
+    Type:        "poll",
+    Field:       "pollCreationMessageV3",
+    Description: "A poll with 2-12 options; selectableOptionsCount 0 allows any number. Votes are encrypted with the poll's messageSecret, which send_poll generates",
+    Required:    []string{"name", "options", "selectableOptionsCount"},
+    Optional:    []string{},
+    SendWith:    "send_poll operation",
+    Example: map[string]interface{}{
+      "pollCreationMessageV3": map[string]interface{}{
+        "name":                   "Lunch?",
+        "options":                []interface{}{map[string]interface{}{"optionName": "Pizza"}, map[string]interface{}{"optionName": "Sushi"}},
+        "selectableOptionsCount": 1,
+      },
+    },
+  },
+  {
+    Type:        "buttons",
+    Field:       "buttonsMessage",
+    Description: "Text with up to three quick-reply buttons. Taps arrive as message_type button_reply with the buttonID in selected_id. Not shown by every WhatsApp client",
+    Required:    []string{"contentText", "buttons", "headerType"},
+    Optional:    []string{"footerText"},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow (see the buttons message template)",
+    Example: map[string]interface{}{
+      "buttonsMessage": map[string]interface{}{
+        "contentText": "Did this answer your question?",
+        "headerType":  "EMPTY",
+        "buttons": []interface{}{
+          map[string]interface{}{"buttonID": "yes", "buttonText": map[string]interface{}{"displayText": "Yes"}, "type": "RESPONSE"},
+          map[string]interface{}{"buttonID": "no", "buttonText": map[string]interface{}{"displayText": "No"}, "type": "RESPONSE"},
+        },
+      },
+    },
+  },
+  {
+    Type:        "list",
+    Field:       "listMessage",
+    Description: "A menu opened with buttonText, whose rows are grouped in sections. Picks arrive as message_type list_reply with the rowID in selected_id. Not shown by every WhatsApp client",
+    Required:    []string{"title", "buttonText", "listType", "sections"},
+    Optional:    []string{"description", "footerText"},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow",
+    Example: map[string]interface{}{
+      "listMessage": map[string]interface{}{
+        "title":      "Menu",
+        "buttonText": "View options",
+        "listType":   "SINGLE_SELECT",
+        "sections": []interface{}{
+          map[string]interface{}{
+            "title": "Mains",
+            "rows": []interface{}{
+              map[string]interface{}{"rowID": "pizza", "title": "Pizza", "description": "Margherita"},
+              map[string]interface{}{"rowID": "pasta", "title": "Pasta"},
+            },
+          },
+        },
+      },
+    },
+  },
+  {
+    Type:        "reaction",
+    Field:       "reactionMessage",
+    Description: "An emoji reaction to a message; an empty text removes it",
+    Required:    []string{"key", "text", "senderTimestampMS"},
+    Optional:    []string{},
+    SendWith:    "send_message action, or SendMessage via call_whatsmeow (see the reaction message template)",
+    Example: map[string]interface{}{
+      "reactionMessage": map[string]interface{}{
+        "key":               map[string]interface{}{"remoteJID": "61487543210@s.whatsapp.net", "fromMe": false, "ID": "3EB0ABC123"},
+        "text":              "👍",
+        "senderTimestampMS": 1699999999000,
+      },
+    },
+  },
+}
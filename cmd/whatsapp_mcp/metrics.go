@@ -0,0 +1,120 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+)
+
+// operationLatencyBuckets are the upper bounds of the per-operation latency histogram
+var operationLatencyBuckets = []time.Duration{
+  10 * time.Millisecond,
+  50 * time.Millisecond,
+  100 * time.Millisecond,
+  500 * time.Millisecond,
+  1 * time.Second,
+  5 * time.Second,
+  30 * time.Second,
+}
+
+// OperationMetrics keeps running timing statistics per operation type
+type OperationMetrics struct {
+  mu         sync.Mutex
+  operations map[string]*operationStats
+  started    time.Time
+}
+
+// operationStats holds the counters for a single operation type
+type operationStats struct {
+  count    int64
+  failures int64
+  total    time.Duration
+  min      time.Duration
+  max      time.Duration
+  buckets  []int64 // one per operationLatencyBuckets entry, plus overflow
+}
+
+// NewOperationMetrics creates an empty metrics collector
+func NewOperationMetrics() *OperationMetrics {
+  return &OperationMetrics{
+    operations: make(map[string]*operationStats),
+    started:    time.Now(),
+  }
+}
+
+// Record adds one operation invocation to the statistics
+func (om *OperationMetrics) Record(operation string, duration time.Duration, success bool) {
+  om.mu.Lock()
+  defer om.mu.Unlock()
+
+  stats, ok := om.operations[operation]
+  if !ok {
+    stats = &operationStats{
+      min:     duration,
+      buckets: make([]int64, len(operationLatencyBuckets)+1),
+    }
+    om.operations[operation] = stats
+  }
+
+  stats.count++
+  if !success {
+    stats.failures++
+  }
+  stats.total += duration
+  if duration < stats.min {
+    stats.min = duration
+  }
+  if duration > stats.max {
+    stats.max = duration
+  }
+
+  bucket := len(operationLatencyBuckets)
+  for i, bound := range operationLatencyBuckets {
+    if duration <= bound {
+      bucket = i
+      break
+    }
+  }
+  stats.buckets[bucket]++
+}
+
+// Snapshot returns the statistics for every operation, slowest average first
+func (om *OperationMetrics) Snapshot() []map[string]interface{} {
+  om.mu.Lock()
+  defer om.mu.Unlock()
+
+  snapshot := make([]map[string]interface{}, 0, len(om.operations))
+  for operation, stats := range om.operations {
+    histogram := make(map[string]int64, len(stats.buckets))
+    for i, count := range stats.buckets {
+      label := fmt.Sprintf(">%s", operationLatencyBuckets[len(operationLatencyBuckets)-1])
+      if i < len(operationLatencyBuckets) {
+        label = fmt.Sprintf("<=%s", operationLatencyBuckets[i])
+      }
+      histogram[label] = count
+    }
+
+    snapshot = append(snapshot, map[string]interface{}{
+      "operation": operation,
+      "count":     stats.count,
+      "failures":  stats.failures,
+      "avg_ms":    stats.total.Milliseconds() / stats.count,
+      "min_ms":    stats.min.Milliseconds(),
+      "max_ms":    stats.max.Milliseconds(),
+      "total_ms":  stats.total.Milliseconds(),
+      "histogram": histogram,
+    })
+  }
+
+  sort.Slice(snapshot, func(i, j int) bool {
+    return snapshot[i]["avg_ms"].(int64) > snapshot[j]["avg_ms"].(int64)
+  })
+
+  return snapshot
+}
+
+// Since returns when metrics collection started
+func (om *OperationMetrics) Since() time.Time {
+  return om.started
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+  "bytes"
+  "context"
+  "database/sql"
+  "encoding/base64"
   "encoding/json"
+  "errors"
   "fmt"
+  "math"
   "os"
+  "regexp"
+  "slices"
+  "sort"
   "strings"
+  "sync"
   "time"
+  "unicode"
+
+  "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/types"
+  "google.golang.org/protobuf/encoding/protojson"
 )
 
 // OperationHandler handles all MCP operations
@@ -14,8 +30,17 @@ type OperationHandler struct {
   config       *Config
   whatsapp_state *WhatsAppState
   database     *Database
+  metrics      *OperationMetrics
+
+  // get_my_groups results, reused for joinedGroupsCacheTTL
+  groupsCache    []map[string]interface{}
+  groupsCachedAt time.Time
+  groupsMutex    sync.Mutex
 }
 
+// joinedGroupsCacheTTL is how long get_my_groups reuses the joined group list
+const joinedGroupsCacheTTL = 5 * time.Minute
+
 // NewOperationHandler creates a new operation handler
 func NewOperationHandler(errorState *ErrorState, config *Config, whatsappState *WhatsAppState, database *Database) *OperationHandler {
   return &OperationHandler{
@@ -23,11 +48,84 @@ func NewOperationHandler(errorState *ErrorState, config *Config, whatsappState *
     config:       config,
     whatsapp_state: whatsappState,
     database:     database,
+    metrics:      NewOperationMetrics(),
   }
 }
 
-// HandleOperation handles an operation and returns the result
+// HandleOperation handles an operation and returns the result, timed for get_operation_metrics
 func (oh *OperationHandler) HandleOperation(input *OperationInput) *OperationResult {
+  startTime := time.Now()
+  result := oh.runOperation(input)
+  duration := time.Since(startTime)
+
+  result.DurationMs = duration.Milliseconds()
+  oh.metrics.Record(input.Operation, duration, result.Success)
+
+  // Every invocation is recorded, successes included, for accountability
+  if err := oh.database.LogAudit(input.Operation, auditArguments(input.Data), result.Success, sanitizeJID(result.Error), result.DurationMs); err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "audit_log", "Failed to write audit log entry", err.Error())
+  }
+
+  return result
+}
+
+// auditSecretKeys are argument names whose values are never written to the audit log
+var auditSecretKeys = []string{"secret", "token", "password", "auth"}
+
+// maxAuditArgumentLength caps the stored size of long argument values (e.g. handler code)
+const maxAuditArgumentLength = 1000
+
+// auditArguments serialises operation arguments for the audit log, redacting secrets,
+// truncating long values and hashing JIDs when hash_jids_in_logs is enabled
+func auditArguments(data map[string]interface{}) string {
+  if len(data) == 0 {
+    return ""
+  }
+  return sanitizeJID(toJSON(redactAuditValue(data)))
+}
+
+// redactAuditValue recursively redacts and truncates a value for the audit log
+func redactAuditValue(value interface{}) interface{} {
+  switch v := value.(type) {
+  case map[string]interface{}:
+    result := make(map[string]interface{}, len(v))
+    for key, val := range v {
+      lowerKey := strings.ToLower(key)
+      redacted := false
+      for _, secret := range auditSecretKeys {
+        if strings.Contains(lowerKey, secret) {
+          redacted = true
+          break
+        }
+      }
+      if redacted {
+        result[key] = "[redacted]"
+      } else {
+        result[key] = redactAuditValue(val)
+      }
+    }
+    return result
+  case []interface{}:
+    result := make([]interface{}, len(v))
+    for i, val := range v {
+      result[i] = redactAuditValue(val)
+    }
+    return result
+  case string:
+    if len(v) > maxAuditArgumentLength {
+      return v[:maxAuditArgumentLength] + "...[truncated]"
+    }
+    return v
+  default:
+    return v
+  }
+}
+
+// operationCancelGrace is how long a timed out operation gets to return after its context is cancelled
+const operationCancelGrace = 10 * time.Second
+
+// runOperation checks the error state and dispatches the operation under the configured timeout
+func (oh *OperationHandler) runOperation(input *OperationInput) *OperationResult {
   // Check for critical errors first (except for error management operations)
   if input.Operation != "get_error_log" && 
      input.Operation != "get_health_status" && 
@@ -37,7 +135,59 @@ func (oh *OperationHandler) HandleOperation(input *OperationInput) *OperationRes
     }
   }
 
-  // Route to specific operation handler
+  timeout := oh.config.GetOperationTimeout()
+  if timeout <= 0 {
+    return oh.dispatchOperation(input)
+  }
+
+  // Run the operation under a deadline so a hung call still gets a response
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  input.ctx = ctx
+
+  resultChan := make(chan *OperationResult, 1)
+  go func() {
+    defer func() {
+      if r := recover(); r != nil {
+        resultChan <- &OperationResult{
+          Success: false,
+          Error:   fmt.Sprintf("Operation '%s' panicked: %v", input.Operation, r),
+        }
+      }
+    }()
+    resultChan <- oh.dispatchOperation(input)
+  }()
+
+  select {
+  case result := <-resultChan:
+    return result
+  case <-ctx.Done():
+  }
+
+  // The operation's context is now cancelled; wait for it to unwind so it isn't left running
+  // behind the caller's back. One that finished anyway reports its real result.
+  select {
+  case result := <-resultChan:
+    if result.Success {
+      return result
+    }
+  case <-time.After(operationCancelGrace):
+    oh.error_state.LogError(ErrorSeverityError, input.Operation, "Operation still running after being cancelled",
+      fmt.Sprintf("timeout %s, waited a further %s", timeout, operationCancelGrace))
+  }
+
+  oh.error_state.LogError(ErrorSeverityError, input.Operation, "Operation timed out", timeout.String())
+  return &OperationResult{
+    Success: false,
+    Error:   fmt.Sprintf("Operation '%s' timed out after %s", input.Operation, timeout),
+    Data: map[string]interface{}{
+      "timed_out": true,
+    },
+  }
+}
+
+// dispatchOperation routes an operation to its handler
+func (oh *OperationHandler) dispatchOperation(input *OperationInput) *OperationResult {
   switch input.Operation {
   case "get_error_log":
     return oh.handleGetErrorLog(input)
@@ -51,22 +201,96 @@ func (oh *OperationHandler) HandleOperation(input *OperationInput) *OperationRes
     return oh.handleSetConfig(input)
   case "get_connection_info":
     return oh.handleGetConnectionInfo(input)
+  case "get_connection_log":
+    return oh.handleGetConnectionLog(input)
+  case "get_activity":
+    return oh.handleGetActivity(input)
+  case "get_audit_log":
+    return oh.handleGetAuditLog(input)
+  case "get_operation_metrics":
+    return oh.handleGetOperationMetrics(input)
   case "get_qr_code":
     return oh.handleGetQRCode(input)
   case "check_login_status":
     return oh.handleCheckLoginStatus(input)
+  case "get_pairing_status":
+    return oh.handleGetPairingStatus(input)
+  case "get_pairing_history":
+    return oh.handleGetPairingHistory(input)
+  case "relink":
+    return oh.handleRelink(input)
+  case "backup_session":
+    return oh.handleBackupSession(input)
+  case "restore_session":
+    return oh.handleRestoreSession(input)
   case "logout":
     return oh.handleLogout(input)
   case "shutdown":
     return oh.handleShutdown(input)
   case "call_whatsmeow":
     return oh.handleCallWhatsmeow(input)
+  case "get_action_registry":
+    return oh.handleGetActionRegistry(input)
+  case "get_message_types":
+    return oh.handleGetMessageTypes(input)
   case "get_method_registry":
     return oh.handleGetMethodRegistry(input)
+  case "reload_method_registry":
+    return oh.handleReloadMethodRegistry(input)
+  case "render_template":
+    return oh.handleRenderTemplate(input)
+  case "save_template":
+    return oh.handleSaveTemplate(input)
+  case "get_template":
+    return oh.handleGetTemplate(input)
+  case "list_templates":
+    return oh.handleListTemplates(input)
+  case "delete_template":
+    return oh.handleDeleteTemplate(input)
   case "get_version":
     return oh.handleGetVersion(input)
+  case "get_time_info":
+    return oh.handleGetTimeInfo(input)
   case "get_messages":
     return oh.handleGetMessages(input)
+  case "search_messages":
+    return oh.handleSearchMessages(input)
+  case "get_message_histogram":
+    return oh.handleGetMessageHistogram(input)
+  case "get_raw_message":
+    return oh.handleGetRawMessage(input)
+  case "get_reactions":
+    return oh.handleGetReactions(input)
+  case "send_link":
+    return oh.handleSendLink(input)
+  case "post_status":
+    return oh.handlePostStatus(input)
+  case "send_poll":
+    return oh.handleSendPoll(input)
+  case "vote_poll":
+    return oh.handleVotePoll(input)
+  case "get_poll_results":
+    return oh.handleGetPollResults(input)
+  case "get_group_events":
+    return oh.handleGetGroupEvents(input)
+  case "request_chat_history":
+    return oh.handleRequestChatHistory(input)
+  case "check_numbers_on_whatsapp":
+    return oh.handleCheckNumbersOnWhatsApp(input)
+  case "get_users_info":
+    return oh.handleGetUsersInfo(input)
+  case "set_disappearing_timer":
+    return oh.handleSetDisappearingTimer(input)
+  case "get_chat_settings":
+    return oh.handleGetChatSettings(input)
+  case "get_my_groups":
+    return oh.handleGetMyGroups(input)
+  case "set_profile_picture":
+    return oh.handleSetProfilePicture(input)
+  case "transcribe_voice":
+    return oh.handleTranscribeVoice(input)
+  case "get_media_files":
+    return oh.handleGetMediaFiles(input)
 
   // Handler operations
   case "register_handler":
@@ -85,8 +309,24 @@ func (oh *OperationHandler) HandleOperation(input *OperationInput) *OperationRes
     return oh.handleDisableHandler(input)
   case "get_handler_executions":
     return oh.handleGetHandlerExecutions(input)
+  case "get_dead_letters":
+    return oh.handleGetDeadLetters(input)
+  case "retry_dead_letter":
+    return oh.handleRetryDeadLetter(input)
   case "reload_handlers":
     return oh.handleReloadHandlers(input)
+  case "pause_chat_handlers":
+    return oh.handlePauseChatHandlers(input)
+  case "resume_chat_handlers":
+    return oh.handleResumeChatHandlers(input)
+  case "list_running_handlers":
+    return oh.handleListRunningHandlers(input)
+  case "cancel_handler_execution":
+    return oh.handleCancelHandlerExecution(input)
+  case "set_autoreply":
+    return oh.handleSetAutoreply(input)
+  case "get_autoreply":
+    return oh.handleGetAutoreply(input)
 
   default:
     return &OperationResult{
@@ -201,6 +441,67 @@ func (oh *OperationHandler) handleGetHealthStatus(input *OperationInput) *Operat
       "critical": errorCounts[ErrorSeverityCritical],
     },
     "connection_state": oh.whatsapp_state.GetConnectionState(),
+    "excluded_messages": global_excluded_messages.Load(),
+  }
+
+  if queueDepth, err := oh.database.CountOutbound(); err == nil {
+    data["outbound_queue_depth"] = queueDepth
+  }
+
+  // Connection stability, replayed from connection_log
+  if stats, err := oh.database.GetConnectionStats(); err == nil {
+    stability := map[string]interface{}{
+      "total_reconnects":  stats.TotalReconnects,
+      "total_disconnects": stats.TotalDisconnects,
+      "connected_since":   nil,
+      "uptime_seconds":    0,
+    }
+    if !stats.ConnectedSince.IsZero() && oh.whatsapp_state.GetConnectionState() == string(StateConnected) {
+      stability["connected_since"] = stats.ConnectedSince.Format("2006-01-02T15:04:05Z07:00")
+      stability["uptime_seconds"] = int64(time.Since(stats.ConnectedSince).Seconds())
+    }
+    data["connection_stability"] = stability
+  }
+
+  // A skewed local clock breaks since filters against server timestamps
+  if threshold := oh.config.GetClockSkewWarning(); threshold > 0 {
+    if skew, _, _, _, ok := global_clock_skew.estimate(); ok && skew.Abs() > threshold {
+      data["clock_skew_warning"] = fmt.Sprintf("Local clock is %s off the server clock (see get_time_info)", skew.Abs().Round(time.Second))
+      if health == "healthy" {
+        health = "warning"
+        data["health"] = health
+      }
+    }
+  }
+
+  // Handlers whose MCP tool went missing stay failing until someone restores it
+  if handlers, err := oh.database.ListHandlers(false); err == nil {
+    var attention []map[string]interface{}
+    for _, handler := range handlers {
+      if needs, ok := handler["needs_attention"].(map[string]interface{}); ok {
+        attention = append(attention, map[string]interface{}{
+          "handler_id": handler["handler_id"],
+          "reason":     needs["reason"],
+          "since":      needs["since"],
+        })
+      }
+    }
+    if len(attention) > 0 {
+      data["handlers_needing_attention"] = attention
+      if health == "healthy" {
+        health = "warning"
+        data["health"] = health
+      }
+    }
+  }
+
+  // A terminal disconnect (ban, logout) won't recover by itself
+  if lastDisconnect := oh.whatsapp_state.GetDisconnectReason(); lastDisconnect != nil {
+    data["last_disconnect"] = lastDisconnect
+    if terminal, _ := lastDisconnect["terminal"].(bool); terminal && oh.whatsapp_state.GetConnectionState() != string(StateConnected) {
+      health = "critical"
+      data["health"] = health
+    }
   }
 
   if criticalError != nil {
@@ -246,7 +547,7 @@ func (oh *OperationHandler) handleGetConfig(input *OperationInput) *OperationRes
   return &OperationResult{
     Success: true,
     Message: "Current configuration",
-    Data:    oh.config.ToMap(),
+    Data:    oh.config.PublicMap(),
   }
 }
 
@@ -260,22 +561,33 @@ func (oh *OperationHandler) handleSetConfig(input *OperationInput) *OperationRes
   }
 
   oh.config.UpdateFromMap(input.Data)
+  if _, ok := input.Data["log_format"]; ok {
+    configureLogging(oh.config.GetLogFormat())
+  }
 
   // Save to database
   if err := oh.database.SaveConfig("app_config", oh.config.ToMap()); err != nil {
     oh.error_state.LogError(ErrorSeverityWarning, "set_config", "Failed to save config to database", err.Error())
   }
 
+  message := "Configuration updated"
+  if _, ok := input.Data["serialized_method_categories"]; ok {
+    if unmatched := warnUnmatchedMethodCategories(); len(unmatched) > 0 {
+      message = fmt.Sprintf("Configuration updated; serialized_method_categories %s match no registry method", strings.Join(unmatched, ", "))
+    }
+  }
+
   return &OperationResult{
     Success: true,
-    Message: "Configuration updated",
-    Data:    oh.config.ToMap(),
+    Message: message,
+    Data:    oh.config.PublicMap(),
   }
 }
 
 // handleGetConnectionInfo handles the get_connection_info operation
 func (oh *OperationHandler) handleGetConnectionInfo(input *OperationInput) *OperationResult {
   state := oh.whatsapp_state.GetState()
+  state["sync_complete"], state["app_state_sync"] = oh.whatsapp_state.GetAppStateSyncStatus()
 
   return &OperationResult{
     Success: true,
@@ -284,191 +596,707 @@ func (oh *OperationHandler) handleGetConnectionInfo(input *OperationInput) *Oper
   }
 }
 
-// Helper methods for WhatsAppState
-func (ws *WhatsAppState) GetConnectionState() string {
-  ws.mu.RLock()
-  defer ws.mu.RUnlock()
-  return string(ws.connection_state)
+// handleGetAuditLog handles the get_audit_log operation
+func (oh *OperationHandler) handleGetAuditLog(input *OperationInput) *OperationResult {
+  limit := 50 // default
+  var operation *string
+  var success *bool
+  var sinceTime *time.Time
+
+  if input.Data != nil {
+    if limitVal, ok := input.Data["limit"].(float64); ok {
+      limit = int(limitVal)
+    }
+    if op, ok := input.Data["filter_operation"].(string); ok && op != "" {
+      operation = &op
+    }
+    if s, ok := input.Data["success"].(bool); ok {
+      success = &s
+    }
+    if s, ok := input.Data["since"].(string); ok && s != "" {
+      t, err := time.Parse(time.RFC3339, s)
+      if err != nil {
+        return &OperationResult{
+          Success: false,
+          Error:   fmt.Sprintf("Invalid since (use ISO8601): %v", err),
+        }
+      }
+      sinceTime = &t
+    }
+  }
+
+  entries, err := oh.database.GetAuditLog(limit, operation, success, sinceTime)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve audit log: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d audit log entries", len(entries)),
+    Data: map[string]interface{}{
+      "entries": entries,
+      "count":   len(entries),
+    },
+  }
 }
 
-func (ws *WhatsAppState) GetState() map[string]interface{} {
-  ws.mu.RLock()
-  defer ws.mu.RUnlock()
+// handleGetOperationMetrics handles the get_operation_metrics operation
+func (oh *OperationHandler) handleGetOperationMetrics(input *OperationInput) *OperationResult {
+  operations := oh.metrics.Snapshot()
 
-  return map[string]interface{}{
-    "connection_state":  string(ws.connection_state),
-    "phone_number":      ws.phone_number,
-    "device_id":         ws.device_id,
-    "last_connected":    ws.last_connected.Format("2006-01-02T15:04:05Z07:00"),
-    "last_disconnected": ws.last_disconnected.Format("2006-01-02T15:04:05Z07:00"),
-    "reconnect_attempts": ws.reconnect_attempts,
+  data := map[string]interface{}{
+    "operations": operations,
+    "since":      oh.metrics.Since().Format(time.RFC3339),
+    "media_downloads": global_download_limiter.Stats(),
+  }
+  if global_sse_connection != nil {
+    data["reverse_channel"] = global_sse_connection.ReverseChannelStats()
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Timing for %d operation type(s)", len(operations)),
+    Data:    data,
   }
 }
 
-// handleGetQRCode handles the get_qr_code operation
-func (oh *OperationHandler) handleGetQRCode(input *OperationInput) *OperationResult {
-  if global_whatsapp_client == nil {
-    return &OperationResult{
-      Success: false,
-      Error:   "WhatsApp client not initialized",
+// handleGetActivity handles the get_activity operation: recent messages, connection
+// events and handler executions merged into one timeline, newest first
+func (oh *OperationHandler) handleGetActivity(input *OperationInput) *OperationResult {
+  limit := 50 // default
+  if limitVal, ok := input.Data["limit"].(float64); ok && limitVal > 0 {
+    limit = int(limitVal)
+  }
+
+  var sinceTime *time.Time
+  if s, ok := input.Data["since"].(string); ok && s != "" {
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid since (use ISO8601): %v", err),
+      }
     }
+    sinceTime = &t
   }
 
-  if global_whatsapp_client.IsLoggedIn() {
+  // Each source is capped at limit, which is enough to fill the merged timeline
+  messages, err := oh.database.GetMessages(limit, nil, nil, sinceTime)
+  if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   "Already logged in. Use logout first if you want to pair a new device.",
+      Error:   fmt.Sprintf("Failed to retrieve messages: %v", err),
     }
   }
-
-  // Get timeout from parameters (default 60 seconds)
-  timeout := 60
-  if timeoutVal, ok := input.Data["timeout"].(float64); ok {
-    timeout = int(timeoutVal)
+  connections, err := oh.database.GetConnectionLog(limit, nil, sinceTime)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve connection log: %v", err),
+    }
   }
-
-  // Get QR code
-  qrText, qrBase64, err := global_whatsapp_client.GetQRCode(timeout)
+  executions, err := oh.database.GetHandlerExecutions(nil, limit, sinceTime)
   if err != nil {
-    oh.error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to get QR code", err.Error())
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to get QR code: %v", err),
+      Error:   fmt.Sprintf("Failed to retrieve handler executions: %v", err),
     }
   }
 
-  // Generate ASCII QR for terminal
-  asciiQR := generateASCIIQR(qrText)
-  
-  // Print ASCII QR to console
-  fmt.Fprintln(os.Stderr, "\n"+strings.Repeat("=", 60))
-  fmt.Fprintln(os.Stderr, "QR CODE - Scan with WhatsApp mobile app")
-  fmt.Fprintln(os.Stderr, strings.Repeat("=", 60))
-  fmt.Fprintln(os.Stderr, asciiQR)
-  fmt.Fprintln(os.Stderr, strings.Repeat("=", 60))
-  fmt.Fprintln(os.Stderr, "Instructions: Open WhatsApp > Settings > Linked Devices > Link a Device")
-  fmt.Fprintf(os.Stderr, "Timeout: %d seconds\n", timeout)
-  fmt.Fprintln(os.Stderr, strings.Repeat("=", 60)+"\n")
-  
-  // Show QR code popup using user MCP tool
-  go showQRPopup(qrBase64, timeout)
-  
-  return &OperationResult{
-    Success: true,
-    Message: "QR code generated. Scan with WhatsApp mobile app.",
-    Data: map[string]interface{}{
-      "qr_code_text":   qrText,
-      "qr_code_base64": qrBase64,
-      "qr_code_ascii":  asciiQR,
-      "timeout":        timeout,
-      "instructions":   "Scan this QR code with your WhatsApp mobile app (Settings > Linked Devices > Link a Device)",
-    },
+  type activityEntry struct {
+    at    time.Time
+    entry map[string]interface{}
   }
-}
-
-// handleCheckLoginStatus handles the check_login_status operation
-func (oh *OperationHandler) handleCheckLoginStatus(input *OperationInput) *OperationResult {
-  if global_whatsapp_client == nil {
-    return &OperationResult{
-      Success: false,
-      Error:   "WhatsApp client not initialized",
+  var timeline []activityEntry
+  add := func(kind string, timeKey string, items []map[string]interface{}) {
+    for _, item := range items {
+      timestamp, _ := item[timeKey].(string)
+      at, _ := time.Parse(time.RFC3339, timestamp)
+      item["kind"] = kind
+      item["timestamp"] = timestamp
+      timeline = append(timeline, activityEntry{at: at, entry: item})
     }
   }
+  add("message", "timestamp", messages)
+  add("connection", "timestamp", connections)
+  add("handler_execution", "started_at", executions)
 
-  isLoggedIn := global_whatsapp_client.IsLoggedIn()
-  isConnected := global_whatsapp_client.IsConnected()
+  sort.SliceStable(timeline, func(i, j int) bool {
+    return timeline[i].at.After(timeline[j].at)
+  })
+  if len(timeline) > limit {
+    timeline = timeline[:limit]
+  }
 
-  var phoneNumber, deviceID string
-  if isLoggedIn {
-    jid := global_whatsapp_client.GetJID()
-    phoneNumber = jid.User
-    deviceID = fmt.Sprintf("%d", jid.Device)
+  activity := make([]map[string]interface{}, len(timeline))
+  for i, item := range timeline {
+    activity[i] = item.entry
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Login status: %v, Connected: %v", isLoggedIn, isConnected),
+    Message: fmt.Sprintf("Retrieved %d activity entries", len(activity)),
     Data: map[string]interface{}{
-      "is_logged_in": isLoggedIn,
-      "is_connected": isConnected,
-      "phone_number": phoneNumber,
-      "device_id":    deviceID,
+      "activity": activity,
+      "count":    len(activity),
     },
   }
 }
 
-// handleLogout handles the logout operation
-func (oh *OperationHandler) handleLogout(input *OperationInput) *OperationResult {
-  if global_whatsapp_client == nil {
-    return &OperationResult{
-      Success: false,
-      Error:   "WhatsApp client not initialized",
-    }
+// handleGetConnectionLog handles the get_connection_log operation
+func (oh *OperationHandler) handleGetConnectionLog(input *OperationInput) *OperationResult {
+  // Parse parameters
+  limit := 50 // default
+  if limitVal, ok := input.Data["limit"].(float64); ok {
+    limit = int(limitVal)
   }
 
-  if !global_whatsapp_client.IsLoggedIn() {
-    return &OperationResult{
-      Success: false,
-      Error:   "Not logged in",
+  var eventType *string
+  if typeStr, ok := input.Data["event_type"].(string); ok && typeStr != "" {
+    eventType = &typeStr
+  }
+
+  var sinceTime *time.Time
+  if s, ok := input.Data["since"].(string); ok && s != "" {
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid since (use ISO8601): %v", err),
+      }
     }
+    sinceTime = &t
   }
 
-  err := global_whatsapp_client.Logout()
+  entries, err := oh.database.GetConnectionLog(limit, eventType, sinceTime)
   if err != nil {
-    oh.error_state.LogError(ErrorSeverityError, "logout", "Failed to logout", err.Error())
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to logout: %v", err),
+      Error:   fmt.Sprintf("Failed to retrieve connection log: %v", err),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: "Logged out successfully",
+    Message: fmt.Sprintf("Retrieved %d connection event(s)", len(entries)),
+    Data: map[string]interface{}{
+      "events": entries,
+      "count":  len(entries),
+    },
   }
 }
 
-// handleShutdown handles the shutdown operation - gracefully shuts down the tool
-func (oh *OperationHandler) handleShutdown(input *OperationInput) *OperationResult {
-  fmt.Fprintln(os.Stderr, "[INFO] Shutdown requested by AI agent")
-  
-  // Log the shutdown
-  oh.error_state.LogError(ErrorSeverityInfo, "shutdown", "Graceful shutdown initiated", "")
-  
-  // Disconnect WhatsApp client if connected
-  if global_whatsapp_client != nil && global_whatsapp_client.IsConnected() {
-    fmt.Fprintln(os.Stderr, "[INFO] Disconnecting WhatsApp client...")
-    global_whatsapp_client.client.Disconnect()
-  }
-  
-  // Close database
-  if global_database != nil {
-    fmt.Fprintln(os.Stderr, "[INFO] Closing database...")
-    global_database.Close()
+// Helper methods for WhatsAppState
+func (ws *WhatsAppState) GetConnectionState() string {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+  return string(ws.connection_state)
+}
+
+func (ws *WhatsAppState) GetState() map[string]interface{} {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+
+  return map[string]interface{}{
+    "connection_state":  string(ws.connection_state),
+    "phone_number":      ws.phone_number,
+    "device_id":         ws.device_id,
+    "last_connected":    ws.last_connected.Format("2006-01-02T15:04:05Z07:00"),
+    "last_disconnected": ws.last_disconnected.Format("2006-01-02T15:04:05Z07:00"),
+    "reconnect_attempts": ws.reconnect_attempts,
   }
-  
-  // Exit the process
-  fmt.Fprintln(os.Stderr, "[INFO] Shutdown complete. Exiting.")
-  go func() {
-    time.Sleep(500 * time.Millisecond) // Give time for response to be sent
-    os.Exit(0)
-  }()
-  
-  return &OperationResult{
-    Success: true,
-    Message: "Shutdown initiated. Tool will exit in 500ms.",
+}
+
+// SetPairingState records a pairing progress change
+func (ws *WhatsAppState) SetPairingState(state PairingState, errorMsg string) {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  ws.pairing_state = state
+  ws.pairing_updated = time.Now()
+  ws.pairing_error = errorMsg
+}
+
+// BeginPairingAttempt starts timing a QR pairing attempt
+func (ws *WhatsAppState) BeginPairingAttempt() {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  ws.pairing_started = time.Now()
+  ws.pairing_popup = false
+}
+
+// MarkPairingPopupShown notes that the current attempt's QR code was shown in a popup
+func (ws *WhatsAppState) MarkPairingPopupShown() {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  ws.pairing_popup = true
+}
+
+// FinishPairingAttempt ends the current attempt, returning when it started and whether a
+// popup was shown. ok is false if no attempt was pending, so each attempt ends only once.
+func (ws *WhatsAppState) FinishPairingAttempt() (started time.Time, popupShown bool, ok bool) {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  if ws.pairing_started.IsZero() {
+    return time.Time{}, false, false
   }
+  started, popupShown = ws.pairing_started, ws.pairing_popup
+  ws.pairing_started = time.Time{}
+  return started, popupShown, true
 }
 
-// showQRPopup shows a popup window with the QR code using the user MCP tool
-func showQRPopup(qrBase64 string, timeout int) {
-  if global_sse_connection == nil {
-    fmt.Fprintln(os.Stderr, "[WARN] Cannot show QR popup: no SSE connection")
+// SetDisconnectReason records why the connection last dropped. Terminal reasons
+// (logout, ban, replaced session) need user action, so auto-reconnect is disabled.
+// A recoverable disconnect does not overwrite an earlier terminal reason.
+func (ws *WhatsAppState) SetDisconnectReason(reason string, description string, terminal bool) {
+  ws.mu.Lock()
+  defer ws.mu.Unlock()
+  if ws.disconnect_terminal && !terminal && ws.connection_state != StateConnected {
     return
   }
+  ws.disconnect_reason = reason
+  ws.disconnect_description = description
+  ws.disconnect_terminal = terminal
+}
 
-  html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
+// GetDisconnectReason returns the last disconnect classification, or nil if none was recorded
+func (ws *WhatsAppState) GetDisconnectReason() map[string]interface{} {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+  if ws.disconnect_reason == "" {
+    return nil
+  }
+  return map[string]interface{}{
+    "reason":      ws.disconnect_reason,
+    "description": ws.disconnect_description,
+    "terminal":    ws.disconnect_terminal,
+    "at":          ws.last_disconnected.Format("2006-01-02T15:04:05Z07:00"),
+  }
+}
+
+// GetPairingState returns the current pairing state
+func (ws *WhatsAppState) GetPairingState() PairingState {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+  if ws.pairing_state == "" {
+    return PairingIdle
+  }
+  return ws.pairing_state
+}
+
+// GetPairingStatus returns the current pairing progress
+func (ws *WhatsAppState) GetPairingStatus() map[string]interface{} {
+  ws.mu.RLock()
+  defer ws.mu.RUnlock()
+
+  state := ws.pairing_state
+  if state == "" {
+    state = PairingIdle
+  }
+
+  status := map[string]interface{}{
+    "pairing_state": string(state),
+  }
+  if !ws.pairing_updated.IsZero() {
+    status["updated_at"] = ws.pairing_updated.Format("2006-01-02T15:04:05Z07:00")
+  }
+  if ws.pairing_error != "" {
+    status["error"] = ws.pairing_error
+  }
+  return status
+}
+
+// handleGetPairingStatus handles the get_pairing_status operation
+func (oh *OperationHandler) handleGetPairingStatus(input *OperationInput) *OperationResult {
+  status := oh.whatsapp_state.GetPairingStatus()
+  if global_whatsapp_client != nil {
+    status["is_logged_in"] = global_whatsapp_client.IsLoggedIn()
+    status["is_connected"] = global_whatsapp_client.IsConnected()
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Pairing state: %s", status["pairing_state"]),
+    Data:    status,
+  }
+}
+
+// handleGetPairingHistory handles the get_pairing_history operation
+func (oh *OperationHandler) handleGetPairingHistory(input *OperationInput) *OperationResult {
+  limit := 20 // default
+  if limitVal, ok := input.Data["limit"].(float64); ok && limitVal > 0 {
+    limit = int(limitVal)
+  }
+
+  var outcome *string
+  if outcomeStr, ok := input.Data["outcome"].(string); ok && outcomeStr != "" {
+    switch outcomeStr {
+    case PairingOutcomeSuccess, PairingOutcomeTimeout, PairingOutcomeError:
+      outcome = &outcomeStr
+    default:
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid outcome %q (use success, timeout or error)", outcomeStr),
+      }
+    }
+  }
+
+  attempts, err := oh.database.GetPairingAttempts(limit, outcome)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve pairing history: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d pairing attempt(s)", len(attempts)),
+    Data: map[string]interface{}{
+      "attempts": attempts,
+      "count":    len(attempts),
+    },
+  }
+}
+
+// handleRelink handles the relink operation: clears just the local session keys and starts
+// a fresh QR pairing, for when WhatsApp has invalidated the link but the session wasn't cleared.
+// Unlike logout, the server isn't notified and messages, handlers and settings are kept.
+func (oh *OperationHandler) handleRelink(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+
+  if err := global_whatsapp_client.ResetSession(input.Context()); err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "relink", "Failed to reset session", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to reset session: %v", err),
+    }
+  }
+
+  result := oh.handleGetQRCode(input)
+  if result.Success {
+    result.Message = "Session cleared. Scan the new QR code with WhatsApp to re-link this device."
+  } else {
+    result.Error = fmt.Sprintf("Session cleared, but %s. Call get_qr_code to retry.", result.Error)
+  }
+  return result
+}
+
+// handleBackupSession handles the backup_session operation: copies the session database
+// (device credentials) to path so the link can be restored elsewhere without a QR scan
+func (oh *OperationHandler) handleBackupSession(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+  if !global_whatsapp_client.IsLoggedIn() {
+    return &OperationResult{
+      Success: false,
+      Error:   "Not logged in; there is no session to back up",
+    }
+  }
+
+  path, _ := input.Data["path"].(string)
+  if path == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing path",
+    }
+  }
+
+  size, err := global_whatsapp_client.BackupSession(input.Context(), path)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "backup_session", "Failed to back up session", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to back up session: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Session backed up to %s. It holds this device's credentials: keep it private.", path),
+    Data: map[string]interface{}{
+      "path":  path,
+      "bytes": size,
+      "jid":   global_whatsapp_client.GetJID().String(),
+    },
+  }
+}
+
+// handleRestoreSession handles the restore_session operation: replaces the session database
+// with a backup, then reconnects to confirm WhatsApp still accepts it
+func (oh *OperationHandler) handleRestoreSession(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+
+  path, _ := input.Data["path"].(string)
+  if path == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing path",
+    }
+  }
+  timeout := 30
+  if t, ok := input.Data["timeout"].(float64); ok && t > 0 {
+    timeout = int(t)
+  }
+
+  jid, previous, err := global_whatsapp_client.RestoreSession(input.Context(), path)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "restore_session", "Failed to restore session", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to restore session: %v", err),
+    }
+  }
+
+  data := map[string]interface{}{
+    "jid":              jid.String(),
+    "previous_session": previous,
+  }
+
+  // Drop any stale signal from an earlier connection before waiting for this one
+  select {
+  case <-global_whatsapp_client.connected_channel:
+  default:
+  }
+  err = global_whatsapp_client.Connect()
+  if err == nil {
+    err = global_whatsapp_client.WaitForConnection(timeout)
+  }
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Session restored, but it did not connect: %v. WhatsApp may have unlinked this device; check get_connection_info, relink, or restore previous_session.", err),
+      Data:    data,
+    }
+  }
+
+  data["connected"] = true
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Session restored and connected as %s", jid),
+    Data:    data,
+  }
+}
+
+// handleGetQRCode handles the get_qr_code operation
+func (oh *OperationHandler) handleGetQRCode(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+
+  if global_whatsapp_client.IsLoggedIn() {
+    return &OperationResult{
+      Success: false,
+      Error:   "Already logged in. Use logout first if you want to pair a new device.",
+    }
+  }
+
+  // Get timeout from parameters (default 60 seconds)
+  timeout := 60
+  if timeoutVal, ok := input.Data["timeout"].(float64); ok {
+    timeout = int(timeoutVal)
+  }
+
+  // Keep the popup/console QR current as WhatsApp rotates codes
+  var onRefresh func(string, string)
+  if oh.config.GetQRAutoRefresh() {
+    onRefresh = func(qrText string, qrBase64 string) {
+      if _, popup := displayQRCode(qrText, qrBase64, timeout); popup {
+        oh.whatsapp_state.MarkPairingPopupShown()
+      }
+    }
+  }
+
+  // Get QR code
+  qrText, qrBase64, err := global_whatsapp_client.GetQRCode(timeout, onRefresh)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to get QR code", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to get QR code: %v", err),
+    }
+  }
+
+  asciiQR, popup := displayQRCode(qrText, qrBase64, timeout)
+  if popup {
+    oh.whatsapp_state.MarkPairingPopupShown()
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: "QR code generated. Scan with WhatsApp mobile app.",
+    Data: map[string]interface{}{
+      "qr_code_text":  qrText,
+      "qr_code_ascii": asciiQR,
+      "timeout":       timeout,
+      "instructions":  "Scan this QR code with your WhatsApp mobile app (Settings > Linked Devices > Link a Device)",
+    },
+    ContentType: "image/png",
+    BinaryData:  qrBase64,
+  }
+}
+
+// displayQRCode prints the QR code to the console and/or shows it in a popup, as selected by
+// qr_display_mode, returning the ASCII art and whether a popup was shown
+func displayQRCode(qrText string, qrBase64 string, timeout int) (string, bool) {
+  // Generate ASCII QR for terminal
+  asciiQR := generateASCIIQR(qrText)
+
+  mode := global_config.GetQRDisplayMode()
+  if mode == QRDisplayAuto {
+    mode = QRDisplayASCII
+    if global_sse_connection != nil {
+      mode = QRDisplayBoth
+    }
+  }
+
+  if mode == QRDisplayASCII || mode == QRDisplayBoth {
+    printQRCode(asciiQR, timeout)
+  }
+
+  // Show QR code popup using user MCP tool
+  popup := mode == QRDisplayPopup || mode == QRDisplayBoth
+  if popup {
+    go showQRPopup(qrBase64, timeout)
+  }
+
+  return asciiQR, popup
+}
+
+// printQRCode prints the ASCII QR code and pairing instructions to the console
+func printQRCode(asciiQR string, timeout int) {
+  fmt.Fprintln(logStderr, "\n"+strings.Repeat("=", 60))
+  fmt.Fprintln(logStderr, "QR CODE - Scan with WhatsApp mobile app")
+  fmt.Fprintln(logStderr, strings.Repeat("=", 60))
+  fmt.Fprintln(logStderr, asciiQR)
+  fmt.Fprintln(logStderr, strings.Repeat("=", 60))
+  fmt.Fprintln(logStderr, "Instructions: Open WhatsApp > Settings > Linked Devices > Link a Device")
+  fmt.Fprintf(logStderr, "Timeout: %d seconds\n", timeout)
+  fmt.Fprintln(logStderr, strings.Repeat("=", 60)+"\n")
+}
+
+// handleCheckLoginStatus handles the check_login_status operation
+func (oh *OperationHandler) handleCheckLoginStatus(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+
+  isLoggedIn := global_whatsapp_client.IsLoggedIn()
+  isConnected := global_whatsapp_client.IsConnected()
+
+  var phoneNumber, deviceID string
+  if isLoggedIn {
+    jid := global_whatsapp_client.GetJID()
+    phoneNumber = jid.User
+    deviceID = fmt.Sprintf("%d", jid.Device)
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Login status: %v, Connected: %v", isLoggedIn, isConnected),
+    Data: map[string]interface{}{
+      "is_logged_in": isLoggedIn,
+      "is_connected": isConnected,
+      "phone_number": phoneNumber,
+      "device_id":    deviceID,
+    },
+  }
+}
+
+// handleLogout handles the logout operation
+func (oh *OperationHandler) handleLogout(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not initialized",
+    }
+  }
+
+  if !global_whatsapp_client.IsLoggedIn() {
+    return &OperationResult{
+      Success: false,
+      Error:   "Not logged in",
+    }
+  }
+
+  err := global_whatsapp_client.Logout()
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "logout", "Failed to logout", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to logout: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: "Logged out successfully",
+  }
+}
+
+// handleShutdown handles the shutdown operation - gracefully shuts down the tool
+func (oh *OperationHandler) handleShutdown(input *OperationInput) *OperationResult {
+  fmt.Fprintln(logStderr, "[INFO] Shutdown requested by AI agent")
+  
+  // Log the shutdown
+  oh.error_state.LogError(ErrorSeverityInfo, "shutdown", "Graceful shutdown initiated", "")
+  
+  // Disconnect WhatsApp client if connected
+  if global_whatsapp_client != nil && global_whatsapp_client.IsConnected() {
+    fmt.Fprintln(logStderr, "[INFO] Disconnecting WhatsApp client...")
+    global_whatsapp_client.Client().Disconnect()
+  }
+  
+  // Close database
+  if global_database != nil {
+    fmt.Fprintln(logStderr, "[INFO] Closing database...")
+    global_database.Close()
+  }
+  
+  // Exit the process
+  fmt.Fprintln(logStderr, "[INFO] Shutdown complete. Exiting.")
+  go func() {
+    time.Sleep(500 * time.Millisecond) // Give time for response to be sent
+    os.Exit(0)
+  }()
+  
+  return &OperationResult{
+    Success: true,
+    Message: "Shutdown initiated. Tool will exit in 500ms.",
+  }
+}
+
+// showQRPopup shows a popup window with the QR code using the user MCP tool
+func showQRPopup(qrBase64 string, timeout int) {
+  if global_sse_connection == nil {
+    fmt.Fprintln(logStderr, "[WARN] Cannot show QR popup: no SSE connection")
+    return
+  }
+
+  html := fmt.Sprintf(`<!DOCTYPE html>
+<html>
 <head>
     <title>WhatsApp QR Code</title>
     <style>
@@ -522,540 +1350,3307 @@ func showQRPopup(qrBase64 string, timeout int) {
             text-align: left;
             border-radius: 4px;
         }
-        .instructions h3 {
-            margin-top: 0;
-            color: #128C7E;
-            font-size: 16px;
+        .instructions h3 {
+            margin-top: 0;
+            color: #128C7E;
+            font-size: 16px;
+        }
+        .instructions ol {
+            margin: 10px 0;
+            padding-left: 20px;
+        }
+        .instructions li {
+            margin: 8px 0;
+            color: #333;
+        }
+        .timeout {
+            color: #999;
+            font-size: 12px;
+            margin-top: 20px;
+        }
+        .close-btn {
+            background: #25D366;
+            color: white;
+            border: none;
+            padding: 12px 30px;
+            border-radius: 8px;
+            cursor: pointer;
+            font-size: 16px;
+            margin-top: 20px;
+            transition: background 0.3s;
+        }
+        .close-btn:hover {
+            background: #128C7E;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>📱 WhatsApp Pairing</h1>
+        <p class="subtitle">Scan this QR code with your WhatsApp mobile app</p>
+        
+        <div class="qr-container">
+            <img src="data:image/png;base64,%s" class="qr-code" alt="WhatsApp QR Code">
+        </div>
+        
+        <div class="instructions">
+            <h3>How to scan:</h3>
+            <ol>
+                <li>Open <strong>WhatsApp</strong> on your phone</li>
+                <li>Tap <strong>Menu</strong> or <strong>Settings</strong></li>
+                <li>Tap <strong>Linked Devices</strong></li>
+                <li>Tap <strong>Link a Device</strong></li>
+                <li>Point your phone at this screen to scan the QR code</li>
+            </ol>
+        </div>
+        
+        <p class="timeout">⏱️ This QR code will expire in %d seconds</p>
+        
+        <button class="close-btn" onclick="window.close()">Close</button>
+    </div>
+</body>
+</html>`, qrBase64, timeout)
+
+  arguments := map[string]interface{}{
+    "input": map[string]interface{}{
+      "operation":        "show_popup",
+      "html":             html,
+      "title":            "WhatsApp QR Code - Scan to Connect",
+      "width":            600,
+      "height":           954,
+      "modal":            false,
+      "wait_for_response": false,
+      "center_on_screen": true,
+      "always_on_top":    true,
+      "bring_to_front":   false,
+      "tool_unlock_token": "b3fa8eb3",
+    },
+  }
+
+  fmt.Fprintln(logStderr, "[INFO] Showing QR code popup window...")
+  _, err := callMCPTool(global_sse_connection, "user", arguments)
+  if err != nil {
+    fmt.Fprintf(logStderr, "[WARN] Failed to show QR popup: %v\n", err)
+  } else {
+    fmt.Fprintln(logStderr, "[OK] QR code popup displayed")
+  }
+}
+
+// handleCallWhatsmeow handles the call_whatsmeow operation - generic dispatcher
+func (oh *OperationHandler) handleCallWhatsmeow(input *OperationInput) *OperationResult {
+  // Extract method name
+  methodName, ok := input.Data["method"].(string)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   "method name required (string)",
+    }
+  }
+
+  // Extract params
+  params, ok := input.Data["params"].(map[string]interface{})
+  if !ok {
+    params = make(map[string]interface{})
+  }
+
+  // Call via dispatcher
+  fmt.Fprintf(logStderr, "[INFO] Calling whatsmeow method: %s\n", methodName)
+  result := CallWhatsmeowMethodContext(input.Context(), methodName, params)
+
+  if !result.Success {
+    oh.error_state.LogError(ErrorSeverityError, "call_whatsmeow", fmt.Sprintf("Method %s failed", methodName), result.Error)
+  }
+
+  return result
+}
+
+// handleGetActionRegistry handles the get_action_registry operation
+func (oh *OperationHandler) handleGetActionRegistry(input *OperationInput) *OperationResult {
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("%d action types", len(actionRegistry)),
+    Data: map[string]interface{}{
+      "actions": actionRegistry,
+      "note":    "String values of the form {event.<field>} are replaced with that field of the triggering event",
+    },
+  }
+}
+
+// handleGetMessageTypes handles the get_message_types operation
+func (oh *OperationHandler) handleGetMessageTypes(input *OperationInput) *OperationResult {
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("%d message types", len(messageTypes)),
+    Data: map[string]interface{}{
+      "message_types": messageTypes,
+      "note":          "Examples are protojson waE2E.Message values. Set exactly one content field per message; media examples omit the upload fields that send_media, send_voice and send_sticker fill in",
+    },
+  }
+}
+
+// handleGetMethodRegistry handles the get_method_registry operation
+func (oh *OperationHandler) handleGetMethodRegistry(input *OperationInput) *OperationResult {
+  registry := getMethodRegistry()
+  if registry == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Method registry not loaded",
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: "Method registry retrieved",
+    Data: map[string]interface{}{
+      "methods":           registry.Methods,
+      "message_templates": registry.MessageTemplates,
+      "type_notes":        registry.TypeNotes,
+      "invalid_methods":   registry.Invalid,
+    },
+  }
+}
+
+// handleReloadMethodRegistry handles the reload_method_registry operation
+func (oh *OperationHandler) handleReloadMethodRegistry(input *OperationInput) *OperationResult {
+  if err := LoadMethodRegistry(); err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "reload_method_registry", "Failed to reload method registry", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to reload method registry (previous registry kept): %v", err),
+    }
+  }
+
+  registry := getMethodRegistry()
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Loaded %d methods, skipped %d invalid", len(registry.Methods), len(registry.Invalid)),
+    Data: map[string]interface{}{
+      "method_count":    len(registry.Methods),
+      "invalid_methods": registry.Invalid,
+      "external_path":   oh.config.GetMethodRegistryPath(),
+      "unmatched_serialized_categories": warnUnmatchedMethodCategories(),
+    },
+  }
+}
+
+// templatePlaceholder matches a {name} placeholder in a message template
+var templatePlaceholder = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// handleRenderTemplate handles the render_template operation: it fills a message template's
+// {name} placeholders from values (over the template's defaults) and checks the result parses
+// as a waE2E.Message. Templates without a template body render their example.
+func (oh *OperationHandler) handleRenderTemplate(input *OperationInput) *OperationResult {
+  name, _ := input.Data["template"].(string)
+  if name == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing template name",
+    }
+  }
+
+  template, source, ok := lookupMessageTemplate(name)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Unknown template '%s' (available: %s)", name, strings.Join(messageTemplateNames(), ", ")),
+    }
+  }
+
+  values, _ := input.Data["values"].(map[string]interface{})
+  message, missing, err := renderMessageTemplate(template, values)
+  if len(missing) > 0 {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Missing values for template '%s': %s", name, strings.Join(missing, ", ")),
+      Data: map[string]interface{}{
+        "missing": missing,
+      },
+    }
+  }
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Template '%s' %v", name, err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Rendered template '%s'", name),
+    Data: map[string]interface{}{
+      "template": name,
+      "source":   source,
+      "message":  message,
+    },
+  }
+}
+
+// lookupMessageTemplate finds a message template by name. Templates saved with save_template
+// take precedence over the method registry's message_templates; source says which it came from.
+func lookupMessageTemplate(name string) (template map[string]interface{}, source string, ok bool) {
+  if global_database != nil {
+    if saved, err := global_database.GetTemplate(name); err == nil {
+      return saved, "saved", true
+    }
+  }
+  if registry := getMethodRegistry(); registry != nil {
+    if template, ok := registry.MessageTemplates[name].(map[string]interface{}); ok {
+      return template, "registry", true
+    }
+  }
+  return nil, "", false
+}
+
+// messageTemplateNames lists every saved and registry message template name, sorted
+func messageTemplateNames() []string {
+  seen := map[string]bool{}
+  if global_database != nil {
+    if saved, err := global_database.ListTemplates(); err == nil {
+      for _, template := range saved {
+        seen[template["name"].(string)] = true
+      }
+    }
+  }
+  if registry := getMethodRegistry(); registry != nil {
+    for name := range registry.MessageTemplates {
+      seen[name] = true
+    }
+  }
+
+  names := make([]string, 0, len(seen))
+  for name := range seen {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// renderMessageTemplate fills a template's placeholders from values over its defaults and
+// round-trips the result through waE2E.Message, so it is exactly what SendMessage accepts.
+// Placeholders left without a value are returned in missing, sorted.
+func renderMessageTemplate(template map[string]interface{}, given map[string]interface{}) (message map[string]interface{}, missing []string, err error) {
+  body, ok := template["template"]
+  if !ok {
+    body = template["example"]
+  }
+
+  values := map[string]interface{}{}
+  if defaults, ok := template["defaults"].(map[string]interface{}); ok {
+    for key, value := range defaults {
+      values[key] = value
+    }
+  }
+  for key, value := range given {
+    values[key] = value
+  }
+
+  unfilled := map[string]bool{}
+  rendered := renderTemplateValue(body, values, unfilled)
+  if len(unfilled) > 0 {
+    for placeholder := range unfilled {
+      missing = append(missing, placeholder)
+    }
+    sort.Strings(missing)
+    return nil, missing, nil
+  }
+
+  renderedJSON, err := json.Marshal(rendered)
+  if err != nil {
+    return nil, nil, fmt.Errorf("failed to encode: %w", err)
+  }
+  var msg waE2E.Message
+  if err := protojson.Unmarshal(renderedJSON, &msg); err != nil {
+    return nil, nil, fmt.Errorf("does not render to a valid waE2E.Message: %w", err)
+  }
+  msgJSON, err := protojson.Marshal(&msg)
+  if err != nil {
+    return nil, nil, fmt.Errorf("failed to encode message: %w", err)
+  }
+  json.Unmarshal(msgJSON, &message)
+  return message, nil, nil
+}
+
+// templatePlaceholders lists the {name} placeholders a template body uses, sorted
+func templatePlaceholders(body interface{}) []string {
+  found := map[string]bool{}
+  renderTemplateValue(body, map[string]interface{}{}, found)
+  placeholders := make([]string, 0, len(found))
+  for placeholder := range found {
+    placeholders = append(placeholders, placeholder)
+  }
+  sort.Strings(placeholders)
+  return placeholders
+}
+
+// handleSaveTemplate handles the save_template operation: it stores a message template
+// (a protojson waE2E.Message with {name} placeholders, or plain text) for render_template and
+// send_message actions. A template whose placeholders all have defaults is checked to render.
+func (oh *OperationHandler) handleSaveTemplate(input *OperationInput) *OperationResult {
+  name, _ := input.Data["name"].(string)
+  if name == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing template name",
+    }
+  }
+
+  var body interface{}
+  switch v := input.Data["template"].(type) {
+  case string:
+    if v == "" {
+      return &OperationResult{
+        Success: false,
+        Error:   "Template text is empty",
+      }
+    }
+    body = map[string]interface{}{"conversation": v}
+  case map[string]interface{}:
+    body = v
+  default:
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing template (a waE2E.Message object with {placeholders}, or text)",
+    }
+  }
+
+  description, _ := input.Data["description"].(string)
+  defaults, _ := input.Data["defaults"].(map[string]interface{})
+
+  // Catch typos in field names now rather than when a handler first sends it
+  template := map[string]interface{}{"template": body, "defaults": defaults}
+  if _, missing, err := renderMessageTemplate(template, nil); len(missing) == 0 && err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Template '%s' %v", name, err),
+    }
+  }
+
+  if err := oh.database.SaveTemplate(name, description, body, defaults); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to save template: %v", err),
+    }
+  }
+
+  data := map[string]interface{}{
+    "name":         name,
+    "placeholders": templatePlaceholders(body),
+  }
+  if registry := getMethodRegistry(); registry != nil {
+    if _, ok := registry.MessageTemplates[name]; ok {
+      data["overrides_registry"] = true
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Saved template '%s'", name),
+    Data:    data,
+  }
+}
+
+// handleGetTemplate handles the get_template operation
+func (oh *OperationHandler) handleGetTemplate(input *OperationInput) *OperationResult {
+  name, _ := input.Data["name"].(string)
+  if name == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing template name",
+    }
+  }
+
+  template, source, ok := lookupMessageTemplate(name)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Unknown template '%s' (available: %s)", name, strings.Join(messageTemplateNames(), ", ")),
+    }
+  }
+
+  data := make(map[string]interface{}, len(template)+3)
+  for key, value := range template {
+    data[key] = value
+  }
+  data["name"] = name
+  data["source"] = source
+  body, ok := template["template"]
+  if !ok {
+    body = template["example"]
+  }
+  data["placeholders"] = templatePlaceholders(body)
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Template '%s' (%s)", name, source),
+    Data:    data,
+  }
+}
+
+// handleListTemplates handles the list_templates operation: saved templates in full, plus
+// the names of the method registry's built-in ones
+func (oh *OperationHandler) handleListTemplates(input *OperationInput) *OperationResult {
+  saved, err := oh.database.ListTemplates()
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to list templates: %v", err),
+    }
+  }
+  for _, template := range saved {
+    template["placeholders"] = templatePlaceholders(template["template"])
+  }
+
+  registryNames := []string{}
+  if registry := getMethodRegistry(); registry != nil {
+    for name := range registry.MessageTemplates {
+      registryNames = append(registryNames, name)
+    }
+    sort.Strings(registryNames)
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Found %d saved templates, %d registry templates", len(saved), len(registryNames)),
+    Data: map[string]interface{}{
+      "templates":          saved,
+      "registry_templates": registryNames,
+    },
+  }
+}
+
+// handleDeleteTemplate handles the delete_template operation. Registry templates can't be
+// deleted; deleting a saved template that overrode one brings the registry's back.
+func (oh *OperationHandler) handleDeleteTemplate(input *OperationInput) *OperationResult {
+  name, _ := input.Data["name"].(string)
+  if name == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing template name",
+    }
+  }
+
+  deleted, err := oh.database.DeleteTemplate(name)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to delete template: %v", err),
+    }
+  }
+  if !deleted {
+    if _, source, ok := lookupMessageTemplate(name); ok && source == "registry" {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Template '%s' is built into the method registry and can't be deleted", name),
+      }
+    }
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("No saved template '%s'", name),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Deleted template '%s'", name),
+    Data: map[string]interface{}{
+      "name": name,
+    },
+  }
+}
+
+// renderTemplateValue fills {name} placeholders in a template value. A string that is a
+// single placeholder takes the value as-is (so numbers, booleans and lists keep their type);
+// placeholders inside longer strings are replaced with the value as text. Placeholders
+// without a value are added to missing.
+func renderTemplateValue(value interface{}, values map[string]interface{}, missing map[string]bool) interface{} {
+  switch v := value.(type) {
+  case string:
+    if match := templatePlaceholder.FindStringSubmatch(v); match != nil && match[0] == v {
+      replacement, ok := values[match[1]]
+      if !ok {
+        missing[match[1]] = true
+      }
+      return replacement
+    }
+    return templatePlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+      key := placeholder[1 : len(placeholder)-1]
+      replacement, ok := values[key]
+      if !ok {
+        missing[key] = true
+        return placeholder
+      }
+      return fmt.Sprint(replacement)
+    })
+  case map[string]interface{}:
+    rendered := make(map[string]interface{}, len(v))
+    for key, val := range v {
+      rendered[key] = renderTemplateValue(val, values, missing)
+    }
+    return rendered
+  case []interface{}:
+    rendered := make([]interface{}, len(v))
+    for i, val := range v {
+      rendered[i] = renderTemplateValue(val, values, missing)
+    }
+    return rendered
+  default:
+    return v
+  }
+}
+
+// handleGetVersion handles the get_version operation
+func (oh *OperationHandler) handleGetVersion(input *OperationInput) *OperationResult {
+  return &OperationResult{
+    Success: true,
+    Message: "Version information retrieved",
+    Data:    GetVersionInfo(),
+  }
+}
+
+// handleGetTimeInfo handles the get_time_info operation: the local time against the latest
+// server message timestamp, and the estimated skew between the two clocks
+func (oh *OperationHandler) handleGetTimeInfo(input *OperationInput) *OperationResult {
+  now := time.Now()
+  zone, offset := now.Zone()
+
+  data := map[string]interface{}{
+    "local_time":         now.Format(time.RFC3339Nano),
+    "local_timezone":     zone,
+    "utc_offset_seconds": offset,
+    "skew_known":         false,
+  }
+
+  skew, lastServer, lastLocal, samples, ok := global_clock_skew.estimate()
+  if !ok {
+    return &OperationResult{
+      Success: true,
+      Message: "No server timestamp seen yet; send or receive a message to estimate clock skew",
+      Data:    data,
+    }
+  }
+
+  data["skew_known"] = true
+  data["last_server_message_time"] = lastServer.Format(time.RFC3339)
+  data["last_server_message_received_at"] = lastLocal.Format(time.RFC3339Nano)
+  data["estimated_skew_seconds"] = math.Round(skew.Seconds()*10) / 10
+  data["samples"] = samples
+
+  message := fmt.Sprintf("Local clock is about %s ahead of the server", skew.Round(time.Second))
+  if skew < 0 {
+    message = fmt.Sprintf("Local clock is about %s behind the server", (-skew).Round(time.Second))
+  }
+  if threshold := oh.config.GetClockSkewWarning(); threshold > 0 && skew.Abs() > threshold {
+    data["warning"] = fmt.Sprintf("Clock skew exceeds %s; since filters and scheduling may misbehave", threshold)
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: message,
+    Data:    data,
+  }
+}
+
+// handleGetMessages handles the get_messages operation
+func (oh *OperationHandler) handleGetMessages(input *OperationInput) *OperationResult {
+  // Parse parameters
+  limit := 50 // Default limit
+  if input.Data != nil {
+    if l, ok := input.Data["limit"].(float64); ok {
+      limit = int(l)
+    }
+  }
+
+  var fromJID *string
+  if input.Data != nil {
+    if f, ok := input.Data["from"].(string); ok && f != "" {
+      fromJID = &f
+    }
+  }
+
+  var chatJID *string
+  if input.Data != nil {
+    if c, ok := input.Data["chat"].(string); ok && c != "" {
+      chatJID = &c
+    }
+  }
+
+  var sinceTime *time.Time
+  if input.Data != nil {
+    if s, ok := input.Data["since"].(string); ok && s != "" {
+      t, err := time.Parse(time.RFC3339, s)
+      if err == nil {
+        sinceTime = &t
+      }
+    }
+  }
+
+  // Optional projection, to keep large pulls small
+  var fields []string
+  if rawFields, ok := input.Data["fields"].([]interface{}); ok && len(rawFields) > 0 {
+    for _, f := range rawFields {
+      field, _ := f.(string)
+      if !slices.Contains(messageFields, field) {
+        return &OperationResult{
+          Success: false,
+          Error:   fmt.Sprintf("Unknown field %q (valid: %s)", field, strings.Join(messageFields, ", ")),
+        }
+      }
+      fields = append(fields, field)
+    }
+  }
+  excludeMedia, _ := input.Data["exclude_media"].(bool)
+  enrichNames := oh.config.GetEnrichMessageNames()
+  if enrich, ok := input.Data["enrich_names"].(bool); ok {
+    enrichNames = enrich
+  }
+
+  // Get messages from database
+  messages, err := oh.database.GetMessages(limit, fromJID, chatJID, sinceTime)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve messages: %v", err),
+    }
+  }
+
+  var contactsSynced bool
+  if enrichNames {
+    contactsSynced = oh.awaitAppStateSync(input, appStateContacts)
+    oh.enrichMessageNames(input.Context(), messages)
+  }
+
+  if fields != nil || excludeMedia {
+    for i, msg := range messages {
+      messages[i] = projectMessage(msg, fields, excludeMedia)
+      // Enriched names are added on request, so they survive a projection
+      for _, field := range enrichedNameFields {
+        if value, ok := msg[field]; ok {
+          messages[i][field] = value
         }
-        .instructions ol {
-            margin: 10px 0;
-            padding-left: 20px;
+      }
+    }
+  }
+
+  data := map[string]interface{}{
+    "messages": messages,
+    "count":    len(messages),
+  }
+  if enrichNames {
+    // Until contacts have synced, address-book names may be missing
+    data["sync_complete"] = contactsSynced
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d messages", len(messages)),
+    Data:    data,
+  }
+}
+
+// enrichedNameFields are the keys enrichMessageNames adds to a message
+var enrichedNameFields = []string{"current_sender_name", "chat_name"}
+
+// enrichMessageNames adds current_sender_name, the best name known now for each message's
+// sender, and chat_name for group messages, leaving the stored sender_name as it was saved.
+// Names come from the address book (WhatsApp's contact store, then the contacts table), then
+// push and business names. Group info, fetched once per group while connected, supplies the
+// group name and the phone-number/LID pairs needed to find a LID sender's contact.
+func (oh *OperationHandler) enrichMessageNames(ctx context.Context, messages []map[string]interface{}) {
+  var client *whatsmeow.Client
+  if global_whatsapp_client != nil {
+    client = global_whatsapp_client.Client()
+  }
+  connected := client != nil && global_whatsapp_client.IsConnected()
+
+  groups := map[string]*types.GroupInfo{}
+  names := map[string]string{}
+  for _, msg := range messages {
+    chat, _ := msg["chat"].(string)
+    isGroup, _ := msg["is_group"].(bool)
+
+    var group *types.GroupInfo
+    if isGroup {
+      cached, seen := groups[chat]
+      if !seen && connected {
+        if chatJID, err := types.ParseJID(chat); err == nil {
+          cached, _ = client.GetGroupInfo(ctx, chatJID)
         }
-        .instructions li {
-            margin: 8px 0;
-            color: #333;
+        groups[chat] = cached
+      }
+      group = cached
+      if group != nil && group.Name != "" {
+        msg["chat_name"] = group.Name
+      }
+    }
+
+    from, _ := msg["from"].(string)
+    name, seen := names[chat+"|"+from]
+    if !seen {
+      name = bestContactName(ctx, client, from, group)
+      names[chat+"|"+from] = name
+    }
+    if name == "" {
+      name, _ = msg["sender_name"].(string)
+    }
+    msg["current_sender_name"] = name
+  }
+}
+
+// bestContactName looks up the best current name for a sender, trying its phone number and
+// LID when group info links them, or "" if no name is known
+func bestContactName(ctx context.Context, client *whatsmeow.Client, sender string, group *types.GroupInfo) string {
+  senderJID, err := types.ParseJID(sender)
+  if err != nil {
+    return ""
+  }
+  senderJID = senderJID.ToNonAD()
+
+  candidates := []types.JID{senderJID}
+  displayName := ""
+  if group != nil {
+    for _, participant := range group.Participants {
+      if participant.JID.ToNonAD() != senderJID && participant.PhoneNumber.ToNonAD() != senderJID && participant.LID.ToNonAD() != senderJID {
+        continue
+      }
+      for _, alt := range []types.JID{participant.PhoneNumber, participant.LID} {
+        if !alt.IsEmpty() && alt.ToNonAD() != senderJID {
+          candidates = append(candidates, alt.ToNonAD())
         }
-        .timeout {
-            color: #999;
-            font-size: 12px;
-            margin-top: 20px;
+      }
+      displayName = participant.DisplayName
+      break
+    }
+  }
+
+  // Address book names first, then names the contact chose
+  var fallback []string
+  for _, jid := range candidates {
+    if client != nil {
+      if contact, err := client.Store.Contacts.GetContact(ctx, jid); err == nil && contact.Found {
+        if contact.FullName != "" {
+          return contact.FullName
         }
-        .close-btn {
-            background: #25D366;
-            color: white;
-            border: none;
-            padding: 12px 30px;
-            border-radius: 8px;
-            cursor: pointer;
-            font-size: 16px;
-            margin-top: 20px;
-            transition: background 0.3s;
+        fallback = append(fallback, contact.PushName, contact.BusinessName)
+      }
+    }
+    if contact, err := global_database.GetContact(jid.String()); err == nil {
+      if fullName, _ := contact["full_name"].(string); fullName != "" {
+        return fullName
+      }
+      pushName, _ := contact["push_name"].(string)
+      businessName, _ := contact["business_name"].(string)
+      fallback = append(fallback, pushName, businessName)
+    }
+  }
+  fallback = append(fallback, displayName)
+
+  for _, name := range fallback {
+    if name != "" {
+      return name
+    }
+  }
+  return ""
+}
+
+// projectMessage keeps only the given fields of a message (all of them if fields is nil),
+// dropping media metadata if excludeMedia is set
+func projectMessage(msg map[string]interface{}, fields []string, excludeMedia bool) map[string]interface{} {
+  projected := msg
+  if fields != nil {
+    projected = make(map[string]interface{}, len(fields))
+    for _, field := range fields {
+      if value, ok := msg[field]; ok {
+        projected[field] = value
+      }
+    }
+  }
+  if excludeMedia {
+    for _, field := range mediaMessageFields {
+      delete(projected, field)
+    }
+  }
+  return projected
+}
+
+// Weights of the search_messages ranked score components
+const (
+  searchWeightMatch    = 0.5
+  searchWeightRecency  = 0.3
+  searchWeightActivity = 0.2
+
+  searchRecencyHalfLife = 30 * 24 * time.Hour // a month-old match scores half the recency of a new one
+  searchActivityWindow  = 7 * 24 * time.Hour
+  searchMaxCandidates   = 500
+)
+
+// handleSearchMessages handles the search_messages operation. By default matches are returned
+// newest first; with ranked:true they are scored on match quality, recency and how active the
+// chat has been lately, and returned best first with their score.
+func (oh *OperationHandler) handleSearchMessages(input *OperationInput) *OperationResult {
+  query, _ := input.Data["query"].(string)
+  terms := strings.Fields(query)
+  if len(terms) == 0 {
+    return &OperationResult{
+      Success: false,
+      Error:   "query required (string)",
+    }
+  }
+
+  limit := 20
+  if l, ok := input.Data["limit"].(float64); ok && l > 0 {
+    limit = int(l)
+  }
+
+  var fromJID, chatJID *string
+  if f, ok := input.Data["from"].(string); ok && f != "" {
+    fromJID = &f
+  }
+  if c, ok := input.Data["chat"].(string); ok && c != "" {
+    chatJID = &c
+  }
+
+  ranked, _ := input.Data["ranked"].(bool)
+
+  // Ranking looks at a wider pool of recent matches than it returns
+  fetch := limit
+  if ranked {
+    fetch = min(max(limit*10, 100), searchMaxCandidates)
+  }
+
+  messages, err := oh.database.SearchMessages(query, fetch, fromJID, chatJID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to search messages: %v", err),
+    }
+  }
+
+  if ranked && len(messages) > 0 {
+    activity, err := oh.database.CountMessagesByChat(time.Now().Add(-searchActivityWindow))
+    if err != nil {
+      activity = map[string]int{}
+    }
+    maxActivity := 0
+    for _, count := range activity {
+      maxActivity = max(maxActivity, count)
+    }
+
+    for _, msg := range messages {
+      text, _ := msg["text_content"].(string)
+      if transcript, ok := msg["transcript"].(string); ok {
+        text = strings.TrimSpace(text + " " + transcript)
+      }
+      chat, _ := msg["chat"].(string)
+      timestamp, _ := time.Parse(time.RFC3339, msg["timestamp"].(string))
+
+      match := searchMatchScore(text, query, terms)
+      recency := math.Exp2(-float64(time.Since(timestamp)) / float64(searchRecencyHalfLife))
+      chatActivity := 0.0
+      if maxActivity > 0 {
+        chatActivity = math.Log1p(float64(activity[chat])) / math.Log1p(float64(maxActivity))
+      }
+
+      score := searchWeightMatch*match + searchWeightRecency*recency + searchWeightActivity*chatActivity
+      msg["score"] = math.Round(score*1000) / 1000
+    }
+
+    sort.SliceStable(messages, func(i, j int) bool {
+      return messages[i]["score"].(float64) > messages[j]["score"].(float64)
+    })
+    if len(messages) > limit {
+      messages = messages[:limit]
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Found %d messages", len(messages)),
+    Data: map[string]interface{}{
+      "messages": messages,
+      "count":    len(messages),
+      "ranked":   ranked,
+    },
+  }
+}
+
+// histogramDefaultBuckets is how many buckets get_message_histogram covers when no since is
+// given, and histogramMaxBuckets the most it returns
+const (
+  histogramDefaultBuckets = 30
+  histogramMaxBuckets     = 1000
+)
+
+// histogramBucketStart truncates t to the UTC start of its hour, day or week (from Monday)
+// and returns it with the bucket length
+func histogramBucketStart(bucket string, t time.Time) (time.Time, time.Duration) {
+  t = t.UTC()
+  switch bucket {
+  case "hour":
+    return t.Truncate(time.Hour), time.Hour
+  case "week":
+    day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+    return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)), 7 * 24 * time.Hour
+  default:
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), 24 * time.Hour
+  }
+}
+
+// handleGetMessageHistogram handles the get_message_histogram operation: message counts per
+// hour, day or week (in UTC) for charting, including empty buckets
+func (oh *OperationHandler) handleGetMessageHistogram(input *OperationInput) *OperationResult {
+  bucket := "day"
+  if b, ok := input.Data["bucket"].(string); ok && b != "" {
+    bucket = b
+  }
+  if _, ok := histogramBuckets[bucket]; !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   "bucket must be 'hour', 'day' or 'week'",
+    }
+  }
+
+  until := time.Now()
+  if s, ok := input.Data["until"].(string); ok && s != "" {
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid until (use ISO8601): %v", err),
+      }
+    }
+    until = t
+  }
+
+  first, step := histogramBucketStart(bucket, until)
+  first = first.Add(-step * (histogramDefaultBuckets - 1))
+  if s, ok := input.Data["since"].(string); ok && s != "" {
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid since (use ISO8601): %v", err),
+      }
+    }
+    first, _ = histogramBucketStart(bucket, t)
+  }
+  if !first.Before(until) {
+    return &OperationResult{
+      Success: false,
+      Error:   "since must be before until",
+    }
+  }
+  if until.Sub(first) > step*histogramMaxBuckets {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Range spans more than %d %s buckets; use a larger bucket or a shorter range", histogramMaxBuckets, bucket),
+    }
+  }
+
+  var chatJID, fromJID *string
+  if c, ok := input.Data["chat"].(string); ok && c != "" {
+    chatJID = &c
+  }
+  if f, ok := input.Data["from"].(string); ok && f != "" {
+    fromJID = &f
+  }
+
+  counts, err := oh.database.CountMessagesByBucket(bucket, first, until, chatJID, fromJID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to count messages: %v", err),
+    }
+  }
+
+  buckets := []map[string]interface{}{}
+  total := 0
+  for start := first; start.Before(until); start = start.Add(step) {
+    key := start.Format(time.RFC3339)
+    buckets = append(buckets, map[string]interface{}{
+      "bucket_start": key,
+      "count":        counts[key],
+    })
+    total += counts[key]
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("%d messages in %d %s buckets", total, len(buckets), bucket),
+    Data: map[string]interface{}{
+      "bucket":  bucket,
+      "since":   first.Format(time.RFC3339),
+      "until":   until.UTC().Format(time.RFC3339),
+      "buckets": buckets,
+      "total":   total,
+    },
+  }
+}
+
+// searchMatchScore rates how well text matches a search from 0 to 1: whole-word hits count
+// more than substring hits, and the exact phrase earns a bonus
+func searchMatchScore(text string, query string, terms []string) float64 {
+  lower := strings.ToLower(text)
+  words := make(map[string]bool)
+  for _, word := range strings.FieldsFunc(lower, func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+  }) {
+    words[word] = true
+  }
+
+  score, best := 0.0, float64(len(terms))
+  for _, term := range terms {
+    term = strings.ToLower(term)
+    if words[term] {
+      score += 1
+    } else if strings.Contains(lower, term) {
+      score += 0.5
+    }
+  }
+  if len(terms) > 1 {
+    best++
+    if strings.Contains(lower, strings.ToLower(strings.Join(terms, " "))) {
+      score += 1
+    }
+  }
+
+  return score / best
+}
+
+// handleGetReactions handles the get_reactions operation
+func (oh *OperationHandler) handleGetReactions(input *OperationInput) *OperationResult {
+  limit := 100 // Default limit
+  var messageID, chatJID *string
+
+  if input.Data != nil {
+    if l, ok := input.Data["limit"].(float64); ok {
+      limit = int(l)
+    }
+    if m, ok := input.Data["message_id"].(string); ok && m != "" {
+      messageID = &m
+    }
+    if c, ok := input.Data["chat"].(string); ok && c != "" {
+      chatJID = &c
+    }
+  }
+
+  if messageID == nil && chatJID == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "message_id or chat required",
+    }
+  }
+
+  reactions, err := oh.database.GetReactions(messageID, chatJID, limit)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve reactions: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d reactions", len(reactions)),
+    Data: map[string]interface{}{
+      "reactions": reactions,
+      "count":     len(reactions),
+    },
+  }
+}
+
+// handleSendLink handles the send_link operation: sends a URL with an explicit link preview
+// (title, description and optional image) instead of relying on WhatsApp to generate one
+func (oh *OperationHandler) handleSendLink(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  toStr, _ := input.Data["to"].(string)
+  url, _ := input.Data["url"].(string)
+  if toStr == "" || url == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "to and url required",
+    }
+  }
+  to, err := parseJID(toStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid recipient: %v", err),
+    }
+  }
+
+  text, _ := input.Data["text"].(string)
+  title, _ := input.Data["title"].(string)
+  description, _ := input.Data["description"].(string)
+  imageURL, _ := input.Data["image_url"].(string)
+  imageBase64, _ := input.Data["image_base64"].(string)
+
+  message, err := buildLinkMessage(input.Context(), text, url, title, description, imageURL, imageBase64)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   err.Error(),
+    }
+  }
+
+  resp, err := global_whatsapp_client.Client().SendMessage(input.Context(), to, message)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "send_link", "Failed to send link", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to send link: %v", err),
+    }
+  }
+  global_whatsapp_client.storeSentMessage(to, message, resp)
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Link sent to %s", to),
+    Data: map[string]interface{}{
+      "message_id":    resp.ID,
+      "timestamp":     resp.Timestamp.Format(time.RFC3339),
+      "has_thumbnail": len(message.GetExtendedTextMessage().GetJPEGThumbnail()) > 0,
+    },
+  }
+}
+
+// handlePostStatus handles the post_status operation: a text status (text, with optional
+// background_color, text_color and font) or an image or video status (path, media_type,
+// caption). Who can see it follows the account's status privacy setting.
+func (oh *OperationHandler) handlePostStatus(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  text, _ := input.Data["text"].(string)
+  path, _ := input.Data["path"].(string)
+  if (text == "") == (path == "") {
+    return &OperationResult{
+      Success: false,
+      Error:   "text or path required (not both; use caption with path)",
+    }
+  }
+
+  var message *waE2E.Message
+  var err error
+  if path != "" {
+    mediaType, _ := input.Data["media_type"].(string)
+    if mediaType == "" {
+      mediaType = "image"
+    }
+    if mediaType != "image" && mediaType != "video" {
+      return &OperationResult{
+        Success: false,
+        Error:   "media_type must be 'image' or 'video' for a status",
+      }
+    }
+    caption, _ := input.Data["caption"].(string)
+    mimetype, _ := input.Data["mimetype"].(string)
+    message, err = buildMediaMessage(input.Context(), path, mediaType, caption, mimetype, false)
+  } else {
+    backgroundColor, _ := input.Data["background_color"].(string)
+    textColor, _ := input.Data["text_color"].(string)
+    font, _ := input.Data["font"].(string)
+    message, err = buildTextStatus(text, backgroundColor, textColor, font)
+  }
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   err.Error(),
+    }
+  }
+
+  // whatsmeow sends the status to everyone the privacy setting allows, so check there is
+  // someone before posting a status only our own devices would see
+  client := global_whatsapp_client.Client()
+  privacy, viewers, err := statusAudience(input.Context(), client)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   err.Error(),
+    }
+  }
+  if viewers == 0 {
+    hint := "add contacts to the status allow list"
+    if privacy != types.StatusPrivacyTypeWhitelist {
+      hint = "no address book contacts are known yet; if this device was just linked, wait for app state sync (see sync_complete in get_connection_info)"
+    }
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Nobody would see this status (privacy: %s): %s", privacy, hint),
+    }
+  }
+
+  resp, err := client.SendMessage(input.Context(), types.StatusBroadcastJID, message)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "post_status", "Failed to post status", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to post status: %v", err),
+    }
+  }
+  global_whatsapp_client.storeSentMessage(types.StatusBroadcastJID, message, resp)
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Status posted to %d contact(s)", viewers),
+    Data: map[string]interface{}{
+      "message_id": resp.ID,
+      "timestamp":  resp.Timestamp.Format(time.RFC3339),
+      "privacy":    string(privacy),
+      "viewers":    viewers,
+    },
+  }
+}
+
+// handleSendPoll handles the send_poll operation. max_selections is how many options a voter
+// may pick: 1 (the default) for a single-choice poll, 0 for any number.
+func (oh *OperationHandler) handleSendPoll(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  toStr, _ := input.Data["to"].(string)
+  question, _ := input.Data["question"].(string)
+  if toStr == "" || question == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "to and question required",
+    }
+  }
+  to, err := parseJID(toStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid recipient: %v", err),
+    }
+  }
+
+  rawOptions, _ := input.Data["options"].([]interface{})
+  options := make([]string, 0, len(rawOptions))
+  for _, option := range rawOptions {
+    name, _ := option.(string)
+    if name == "" || slices.Contains(options, name) {
+      return &OperationResult{
+        Success: false,
+        Error:   "Poll options must be distinct, non-empty strings",
+      }
+    }
+    options = append(options, name)
+  }
+  if len(options) < 2 || len(options) > maxPollOptions {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("A poll needs between 2 and %d options", maxPollOptions),
+    }
+  }
+
+  maxSelections := 1
+  if m, ok := input.Data["max_selections"].(float64); ok {
+    maxSelections = int(m)
+  }
+  if maxSelections < 0 || maxSelections > len(options) {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("max_selections must be between 0 (any number) and %d", len(options)),
+    }
+  }
+
+  message := global_whatsapp_client.Client().BuildPollCreation(question, options, maxSelections)
+  resp, err := global_whatsapp_client.Client().SendMessage(input.Context(), to, message)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "send_poll", "Failed to send poll", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to send poll: %v", err),
+    }
+  }
+  global_whatsapp_client.storeSentMessage(to, message, resp)
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Poll sent to %s", to),
+    Data: map[string]interface{}{
+      "message_id":     resp.ID,
+      "timestamp":      resp.Timestamp.Format(time.RFC3339),
+      "question":       question,
+      "options":        options,
+      "max_selections": maxSelections,
+    },
+  }
+}
+
+// handleVotePoll handles the vote_poll operation: it votes in a stored poll by option name,
+// replacing any earlier vote of ours. An empty options list withdraws the vote.
+func (oh *OperationHandler) handleVotePoll(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  messageID, _ := input.Data["message_id"].(string)
+  if messageID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid message_id",
+    }
+  }
+
+  stored, err := oh.database.GetMessage(messageID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Poll not found: %v", err),
+    }
+  }
+  pollOptions, maxSelections, ok := storedPollOptions(stored)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message %s is not a poll", messageID),
+    }
+  }
+
+  rawSelected, _ := input.Data["options"].([]interface{})
+  selected := make([]string, 0, len(rawSelected))
+  for _, option := range rawSelected {
+    name, _ := option.(string)
+    if !slices.Contains(pollOptions, name) {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("'%s' is not an option of this poll (options: %s)", name, strings.Join(pollOptions, ", ")),
+      }
+    }
+    if !slices.Contains(selected, name) {
+      selected = append(selected, name)
+    }
+  }
+  if maxSelections > 0 && len(selected) > maxSelections {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("This poll allows at most %d selection(s)", maxSelections),
+    }
+  }
+
+  chat, err := types.ParseJID(stored["chat"].(string))
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid stored chat: %v", err),
+    }
+  }
+  sender, err := types.ParseJID(stored["from"].(string))
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid stored sender: %v", err),
+    }
+  }
+  isFromMe, _ := stored["is_from_me"].(bool)
+  pollInfo := &types.MessageInfo{
+    MessageSource: types.MessageSource{
+      Chat:     chat,
+      Sender:   sender,
+      IsFromMe: isFromMe,
+      IsGroup:  chat.Server == types.GroupServer,
+    },
+    ID: messageID,
+  }
+
+  message, err := global_whatsapp_client.Client().BuildPollVote(input.Context(), pollInfo, selected)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to build poll vote: %v", err),
+    }
+  }
+  resp, err := global_whatsapp_client.Client().SendMessage(input.Context(), chat, message)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "vote_poll", "Failed to send poll vote", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to send poll vote: %v", err),
+    }
+  }
+
+  own := global_whatsapp_client.GetJID().ToNonAD().String()
+  if err := oh.database.SavePollVote(messageID, own, chat.String(), selected, resp.Timestamp); err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "vote_poll", "Failed to save poll vote", err.Error())
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Voted in poll %s", messageID),
+    Data: map[string]interface{}{
+      "message_id":       messageID,
+      "selected_options": selected,
+    },
+  }
+}
+
+// handleGetPollResults handles the get_poll_results operation: the poll's options with how
+// many voters picked each and who, plus each voter's full selection
+func (oh *OperationHandler) handleGetPollResults(input *OperationInput) *OperationResult {
+  messageID, _ := input.Data["message_id"].(string)
+  if messageID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid message_id",
+    }
+  }
+
+  stored, err := oh.database.GetMessage(messageID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Poll not found: %v", err),
+    }
+  }
+  options, maxSelections, ok := storedPollOptions(stored)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message %s is not a poll", messageID),
+    }
+  }
+
+  votes, err := oh.database.GetPollVotes(messageID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve poll votes: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Poll has %d voters", len(votes)),
+    Data: map[string]interface{}{
+      "message_id":     messageID,
+      "question":       stored["text_content"],
+      "max_selections": maxSelections,
+      "multi_select":   maxSelections != 1,
+      "results":        tallyPoll(options, votes),
+      "votes":          votes,
+      "total_voters":   len(votes),
+    },
+  }
+}
+
+// handleGetRawMessage handles the get_raw_message operation
+func (oh *OperationHandler) handleGetRawMessage(input *OperationInput) *OperationResult {
+  var messageID string
+  if input.Data != nil {
+    messageID, _ = input.Data["message_id"].(string)
+  }
+  if messageID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid message_id",
+    }
+  }
+
+  chatJID, rawMessage, err := oh.database.GetRawMessage(messageID)
+  if err == sql.ErrNoRows {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message '%s' not found", messageID),
+    }
+  } else if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve message: %v", err),
+    }
+  }
+
+  if rawMessage == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message '%s' has no raw message stored", messageID),
+    }
+  }
+
+  var pretty bytes.Buffer
+  if err := json.Indent(&pretty, []byte(rawMessage), "", "  "); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Stored raw message is not valid JSON: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved raw message '%s'", messageID),
+    Data: map[string]interface{}{
+      "message_id":  messageID,
+      "chat":        chatJID,
+      "raw_message": pretty.String(),
+    },
+  }
+}
+
+// handleTranscribeVoice handles the transcribe_voice operation: downloads the audio of a stored
+// voice message and sends it to the transcription_tool MCP tool, the way python handlers are
+// run. The transcript is stored on the message (so search_messages finds it) and reused
+// unless force is set.
+func (oh *OperationHandler) handleTranscribeVoice(input *OperationInput) *OperationResult {
+  messageID, _ := input.Data["message_id"].(string)
+  if messageID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid message_id",
+    }
+  }
+
+  _, rawMessage, err := oh.database.GetRawMessage(messageID)
+  if err == sql.ErrNoRows {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message '%s' not found", messageID),
+    }
+  } else if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve message: %v", err),
+    }
+  }
+
+  // The stored row wraps the message protobuf JSON in its raw_message field
+  var storedMsg map[string]interface{}
+  var message waE2E.Message
+  json.Unmarshal([]byte(rawMessage), &storedMsg)
+  protoJSON, _ := storedMsg["raw_message"].(string)
+  if err := json.Unmarshal([]byte(protoJSON), &message); err != nil || message.GetAudioMessage() == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Message '%s' is not a voice or audio message", messageID),
+    }
+  }
+  audio := message.GetAudioMessage()
+
+  if force, _ := input.Data["force"].(bool); !force {
+    if transcript, err := oh.database.GetTranscript(messageID); err == nil && transcript != "" {
+      return &OperationResult{
+        Success: true,
+        Message: "Transcript retrieved (already transcribed; force=true to redo)",
+        Data: map[string]interface{}{
+          "message_id": messageID,
+          "transcript": transcript,
+          "cached":     true,
+        },
+      }
+    }
+  }
+
+  tool, operation := oh.config.GetTranscriptionTool()
+  if tool == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "No transcription tool configured; set transcription_tool (and transcription_operation) with set_config",
+    }
+  }
+  if global_sse_connection == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "MCP connection not available",
+    }
+  }
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "Not connected to WhatsApp",
+    }
+  }
+
+  // Download the audio, sharing the media download limit
+  ctx := input.Context()
+  if err := global_download_limiter.acquire(ctx); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Cancelled while waiting for a download slot: %v", err),
+    }
+  }
+  data, err := global_whatsapp_client.Client().Download(ctx, audio)
+  global_download_limiter.release()
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to download voice message: %v", err),
+    }
+  }
+
+  dir := oh.config.GetMediaDownloadPath()
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to create media directory: %v", err),
+    }
+  }
+  path, err := mediaFilePath(dir, messageID, ".ogg")
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid message_id: %v", err),
+    }
+  }
+  if err := os.WriteFile(path, data, 0644); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to save voice message: %v", err),
+    }
+  }
+
+  toolInput := map[string]interface{}{
+    "operation": operation,
+    "path":      path,
+    "mime_type": audio.GetMimetype(),
+  }
+  if language, ok := input.Data["language"].(string); ok && language != "" {
+    toolInput["language"] = language
+  }
+
+  rawResult, err := callMCPToolContext(ctx, global_sse_connection, tool, map[string]interface{}{"input": toolInput})
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "transcribe_voice", "Transcription tool call failed", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Transcription tool '%s' failed: %v", tool, err),
+    }
+  }
+
+  transcript, err := transcriptFromToolResult(rawResult)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Transcription tool '%s' returned no transcript: %v", tool, err),
+    }
+  }
+
+  if err := oh.database.SaveTranscript(messageID, transcript); err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "transcribe_voice", "Failed to store transcript", err.Error())
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Transcribed %ds voice message", audio.GetSeconds()),
+    Data: map[string]interface{}{
+      "message_id":       messageID,
+      "transcript":       transcript,
+      "duration_seconds": audio.GetSeconds(),
+      "path":             path,
+      "cached":           false,
+    },
+  }
+}
+
+// transcriptFromToolResult extracts the transcript from an MCP tool result. The tool may
+// answer with plain text content, or with JSON carrying a text or transcript field.
+func transcriptFromToolResult(raw json.RawMessage) (string, error) {
+  var result map[string]interface{}
+  if err := json.Unmarshal(raw, &result); err != nil {
+    return "", err
+  }
+  if isError, _ := result["isError"].(bool); isError {
+    return "", fmt.Errorf("tool reported an error: %s", string(raw))
+  }
+
+  fromFields := func(m map[string]interface{}) string {
+    for _, key := range []string{"transcript", "text"} {
+      if text, ok := m[key].(string); ok && strings.TrimSpace(text) != "" {
+        return strings.TrimSpace(text)
+      }
+    }
+    return ""
+  }
+
+  if text := fromFields(result); text != "" {
+    return text, nil
+  }
+
+  var parts []string
+  content, _ := result["content"].([]interface{})
+  for _, item := range content {
+    entry, _ := item.(map[string]interface{})
+    text, _ := entry["text"].(string)
+    var nested map[string]interface{}
+    if json.Unmarshal([]byte(text), &nested) == nil {
+      text = fromFields(nested)
+    }
+    if text = strings.TrimSpace(text); text != "" {
+      parts = append(parts, text)
+    }
+  }
+  if len(parts) == 0 {
+    return "", fmt.Errorf("empty result")
+  }
+  return strings.Join(parts, "\n"), nil
+}
+
+// handleGetGroupEvents handles the get_group_events operation
+func (oh *OperationHandler) handleGetGroupEvents(input *OperationInput) *OperationResult {
+  limit := 100 // Default limit
+  var groupJID, action *string
+
+  if input.Data != nil {
+    if l, ok := input.Data["limit"].(float64); ok {
+      limit = int(l)
+    }
+    if g, ok := input.Data["group"].(string); ok && g != "" {
+      groupJID = &g
+    }
+    if a, ok := input.Data["action"].(string); ok && a != "" {
+      action = &a
+    }
+  }
+
+  groupEvents, err := oh.database.GetGroupEvents(groupJID, action, limit)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve group events: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d group events", len(groupEvents)),
+    Data: map[string]interface{}{
+      "group_events": groupEvents,
+      "count":        len(groupEvents),
+    },
+  }
+}
+
+// handleGetMediaFiles handles the get_media_files operation: lists media saved by
+// auto_download_media, optionally filtered by chat and media type
+func (oh *OperationHandler) handleGetMediaFiles(input *OperationInput) *OperationResult {
+  limit := 100 // Default limit
+  var chatJID, mediaType *string
+
+  if input.Data != nil {
+    if l, ok := input.Data["limit"].(float64); ok {
+      limit = int(l)
+    }
+    if c, ok := input.Data["chat"].(string); ok && c != "" {
+      chatJID = &c
+    }
+    if t, ok := input.Data["media_type"].(string); ok && t != "" {
+      mediaType = &t
+    }
+  }
+
+  files, err := oh.database.GetMediaFiles(chatJID, mediaType, limit)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve media files: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d media files", len(files)),
+    Data: map[string]interface{}{
+      "media_files": files,
+      "count":       len(files),
+    },
+  }
+}
+
+// checkNumbersBatchSize is how many numbers are sent per IsOnWhatsApp query
+const checkNumbersBatchSize = 50
+
+// handleCheckNumbersOnWhatsApp handles the check_numbers_on_whatsapp operation
+func (oh *OperationHandler) handleCheckNumbersOnWhatsApp(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  numbersRaw, ok := input.Data["numbers"].([]interface{})
+  if !ok || len(numbersRaw) == 0 {
+    return &OperationResult{
+      Success: false,
+      Error:   "numbers required (array of phone numbers)",
+    }
+  }
+
+  // IsOnWhatsApp expects international format with a leading +
+  phones := make([]string, 0, len(numbersRaw))
+  for i, n := range numbersRaw {
+    numStr, ok := n.(string)
+    if !ok {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("numbers[%d] must be a string", i),
+      }
+    }
+    digits := regexp.MustCompile(`\D`).ReplaceAllString(numStr, "")
+    if len(digits) < 7 {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("numbers[%d]: invalid phone number (%s)", i, numStr),
+      }
+    }
+    phones = append(phones, "+"+digits)
+  }
+
+  // Large lists are checked in batches so progress can be reported between them
+  var responses []types.IsOnWhatsAppResponse
+  for start := 0; start < len(phones); start += checkNumbersBatchSize {
+    end := start + checkNumbersBatchSize
+    if end > len(phones) {
+      end = len(phones)
+    }
+
+    batch, err := global_whatsapp_client.Client().IsOnWhatsApp(input.Context(), phones[start:end])
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to check numbers: %v", err),
+      }
+    }
+    responses = append(responses, batch...)
+    input.ReportProgress(end, len(phones), fmt.Sprintf("Checked %d/%d numbers", end, len(phones)))
+  }
+
+  results := make([]map[string]interface{}, 0, len(responses))
+  registered := 0
+  for _, resp := range responses {
+    result := map[string]interface{}{
+      "number":         resp.Query,
+      "is_on_whatsapp": resp.IsIn,
+    }
+    if resp.IsIn {
+      registered++
+      result["jid"] = resp.JID.String()
+    }
+    if resp.VerifiedName != nil && resp.VerifiedName.Details != nil {
+      result["verified_name"] = resp.VerifiedName.Details.GetVerifiedName()
+    }
+    results = append(results, result)
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("%d of %d number(s) are on WhatsApp", registered, len(results)),
+    Data: map[string]interface{}{
+      "results":    results,
+      "count":      len(results),
+      "registered": registered,
+    },
+  }
+}
+
+// usersInfoBatchSize is how many JIDs are sent per GetUserInfo query
+const usersInfoBatchSize = 100
+
+// handleGetUsersInfo handles the get_users_info operation - profile info for many users at
+// once, e.g. a whole group's participant list
+func (oh *OperationHandler) handleGetUsersInfo(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  jidsRaw, ok := input.Data["jids"].([]interface{})
+  if !ok || len(jidsRaw) == 0 {
+    return &OperationResult{
+      Success: false,
+      Error:   "jids required (array of JIDs or phone numbers)",
+    }
+  }
+
+  jids := make([]types.JID, 0, len(jidsRaw))
+  seen := make(map[types.JID]bool, len(jidsRaw))
+  for i, j := range jidsRaw {
+    jidStr, _ := j.(string)
+    jid, err := parseJID(jidStr)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("jids[%d]: %v", i, err),
+      }
+    }
+    jid = jid.ToNonAD()
+    if !seen[jid] {
+      seen[jid] = true
+      jids = append(jids, jid)
+    }
+  }
+
+  users := make(map[string]interface{}, len(jids))
+  for start := 0; start < len(jids); start += usersInfoBatchSize {
+    end := min(start+usersInfoBatchSize, len(jids))
+
+    infos, err := global_whatsapp_client.Client().GetUserInfo(input.Context(), jids[start:end])
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to get user info: %v", err),
+      }
+    }
+
+    for jid, info := range infos {
+      user := map[string]interface{}{
+        "status":     info.Status,
+        "picture_id": info.PictureID,
+      }
+      if !info.LID.IsEmpty() {
+        user["lid"] = info.LID.String()
+      }
+      if info.VerifiedName != nil && info.VerifiedName.Details != nil {
+        user["verified_name"] = info.VerifiedName.Details.GetVerifiedName()
+      }
+      devices := make([]string, 0, len(info.Devices))
+      for _, device := range info.Devices {
+        devices = append(devices, device.String())
+      }
+      user["devices"] = devices
+      users[jid.String()] = user
+    }
+    input.ReportProgress(end, len(jids), fmt.Sprintf("Fetched %d/%d users", end, len(jids)))
+  }
+
+  // JIDs WhatsApp returned nothing for (not registered, or hidden)
+  missing := make([]string, 0)
+  for _, jid := range jids {
+    if _, ok := users[jid.String()]; !ok {
+      missing = append(missing, jid.String())
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Fetched info for %d of %d user(s)", len(users), len(jids)),
+    Data: map[string]interface{}{
+      "users":   users,
+      "count":   len(users),
+      "missing": missing,
+    },
+  }
+}
+
+// handleRequestChatHistory handles the request_chat_history operation - backfills a chat from the phone
+func (oh *OperationHandler) handleRequestChatHistory(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  chatStr, ok := input.Data["chat"].(string)
+  if !ok || chatStr == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "chat required (string)",
+    }
+  }
+
+  chatJID, err := parseJID(chatStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid chat: %v", err),
+    }
+  }
+
+  count := 50 // Recommended batch size
+  if c, ok := input.Data["count"].(float64); ok && c > 0 {
+    count = int(c)
+  }
+
+  waitSeconds := 30
+  if w, ok := input.Data["wait_seconds"].(float64); ok && w > 0 {
+    waitSeconds = int(w)
+  }
+
+  var beforeMessageID *string
+  if b, ok := input.Data["before_message_id"].(string); ok && b != "" {
+    beforeMessageID = &b
+  }
+
+  // The phone needs a known message to page backwards from
+  anchorID, anchorTime, anchorFromMe, err := oh.database.GetHistoryAnchor(chatJID.String(), beforeMessageID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("No stored message to anchor history request in %s: %v", chatJID, err),
+    }
+  }
+
+  anchor := &types.MessageInfo{
+    MessageSource: types.MessageSource{
+      Chat:     chatJID,
+      IsFromMe: anchorFromMe,
+    },
+    ID:        anchorID,
+    Timestamp: anchorTime,
+  }
+
+  imported, err := global_whatsapp_client.RequestChatHistory(input.Context(), anchor, count, time.Duration(waitSeconds)*time.Second, input.ReportProgress)
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "request_chat_history", "History request failed", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to request chat history: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Imported %d messages from phone history", imported),
+    Data: map[string]interface{}{
+      "chat":              chatJID.String(),
+      "imported":          imported,
+      "before_message_id": anchorID,
+    },
+  }
+}
+
+// handleSetDisappearingTimer handles the set_disappearing_timer operation
+func (oh *OperationHandler) handleSetDisappearingTimer(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsConnected() {
+    return &OperationResult{
+      Success: false,
+      Error:   "WhatsApp client not connected",
+    }
+  }
+
+  chatStr, ok := input.Data["chat"].(string)
+  if !ok || chatStr == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "chat required (string)",
+    }
+  }
+
+  chatJID, err := parseJID(chatStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid chat: %v", err),
+    }
+  }
+
+  durationStr, ok := input.Data["duration"].(string)
+  if !ok || durationStr == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "duration required (one of: off, 24h, 7d, 90d)",
+    }
+  }
+
+  // WhatsApp only accepts a fixed set of timers
+  timer, ok := whatsmeow.ParseDisappearingTimerString(durationStr)
+  if !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid duration '%s' (must be one of: off, 24h, 7d, 90d)", durationStr),
+    }
+  }
+
+  err = global_whatsapp_client.Client().SetDisappearingTimer(input.Context(), chatJID, timer, time.Time{})
+  if err != nil {
+    oh.error_state.LogError(ErrorSeverityError, "set_disappearing_timer", "Failed to set disappearing timer", err.Error())
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to set disappearing timer: %v", err),
+    }
+  }
+
+  // Private chat timers can't be queried from the server, so remember what we set
+  timerSeconds := int(timer.Seconds())
+  if err := oh.database.SaveConfig("disappearing_timer:"+chatJID.String(), timerSeconds); err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "set_disappearing_timer", "Failed to save disappearing timer", err.Error())
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Disappearing timer for %s set to %s", chatJID, formatDisappearingTimer(timer)),
+    Data: map[string]interface{}{
+      "chat":                      chatJID.String(),
+      "disappearing_timer":        formatDisappearingTimer(timer),
+      "disappearing_timer_seconds": timerSeconds,
+    },
+  }
+}
+
+// handleGetChatSettings handles the get_chat_settings operation
+func (oh *OperationHandler) handleGetChatSettings(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsLoggedIn() {
+    return &OperationResult{
+      Success: false,
+      Error:   "Not logged in",
+    }
+  }
+
+  chatStr, ok := input.Data["chat"].(string)
+  if !ok || chatStr == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "chat required (string)",
+    }
+  }
+
+  chatJID, err := parseJID(chatStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid chat: %v", err),
+    }
+  }
+
+  data := map[string]interface{}{
+    "chat": chatJID.String(),
+    // Pin, mute and archive are only known once app state has synced
+    "sync_complete": oh.awaitAppStateSync(input, appStateChatSettings),
+  }
+
+  client := global_whatsapp_client.Client()
+  if settings, err := client.Store.ChatSettings.GetChatSettings(input.Context(), chatJID); err == nil && settings.Found {
+    data["pinned"] = settings.Pinned
+    data["archived"] = settings.Archived
+    if !settings.MutedUntil.IsZero() {
+      data["muted_until"] = settings.MutedUntil.Format(time.RFC3339)
+    }
+  }
+
+  // Groups report their timer from the server; private chats use the last value we set
+  var timerSeconds int
+  if chatJID.Server == types.GroupServer {
+    groupInfo, err := client.GetGroupInfo(input.Context(), chatJID)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to get group info: %v", err),
+      }
+    }
+    if groupInfo.IsEphemeral {
+      timerSeconds = int(groupInfo.DisappearingTimer)
+    }
+  } else {
+    oh.database.LoadConfig("disappearing_timer:"+chatJID.String(), &timerSeconds)
+  }
+
+  timer := time.Duration(timerSeconds) * time.Second
+  data["disappearing_timer"] = formatDisappearingTimer(timer)
+  data["disappearing_timer_seconds"] = timerSeconds
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Chat settings for %s", chatJID),
+    Data:    data,
+  }
+}
+
+// formatDisappearingTimer formats a disappearing timer using WhatsApp's labels
+func formatDisappearingTimer(timer time.Duration) string {
+  switch timer {
+  case whatsmeow.DisappearingTimerOff:
+    return "off"
+  case whatsmeow.DisappearingTimer24Hours:
+    return "24h"
+  case whatsmeow.DisappearingTimer7Days:
+    return "7d"
+  case whatsmeow.DisappearingTimer90Days:
+    return "90d"
+  default:
+    return timer.String()
+  }
+}
+
+// handleRegisterHandler handles the register_handler operation
+func (oh *OperationHandler) handleRegisterHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing handler data",
+    }
+  }
+
+  // Only handlers_file can mark a handler file-managed
+  delete(input.Data, "file_managed")
+
+  return oh.saveHandlerDefinition(input.Data)
+}
+
+// handlerIntegerFields are the handler settings stored in INTEGER columns
+var handlerIntegerFields = []string{
+  "priority", "max_executions_per_minute", "max_executions_per_hour", "max_executions_per_sender_per_hour",
+  "cooldown_seconds", "timeout_seconds", "batch_window_seconds", "batch_max_size",
+  "include_context_messages", "sender_cooldown_seconds", "coalesce_window_seconds",
+}
+
+// normalizeHandlerIntegers converts a handler's integer settings from JSON numbers to ints,
+// rejecting fractions. SQLite would otherwise store 2.5 as REAL and the handler would no
+// longer load.
+func normalizeHandlerIntegers(data map[string]interface{}) error {
+  for _, field := range handlerIntegerFields {
+    switch v := data[field].(type) {
+    case nil, int:
+    case int64:
+      data[field] = int(v)
+    case float64:
+      if v != math.Trunc(v) {
+        return fmt.Errorf("%s must be a whole number, got %v", field, v)
+      }
+      data[field] = int(v)
+    default:
+      return fmt.Errorf("%s must be a number", field)
+    }
+  }
+  return nil
+}
+
+// saveHandlerDefinition validates a handler definition, fills in defaults and saves it
+func (oh *OperationHandler) saveHandlerDefinition(data map[string]interface{}) *OperationResult {
+  // Validate required fields
+  handlerID, ok := data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
+  }
+
+  if _, ok := data["event_filter"]; !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing event_filter",
+    }
+  }
+  if filter, ok := data["event_filter"].(map[string]interface{}); ok {
+    if activeHours, ok := filter["active_hours"].(map[string]interface{}); ok {
+      if err := validateActiveHours(activeHours); err != nil {
+        return &OperationResult{
+          Success: false,
+          Error:   fmt.Sprintf("event_filter.active_hours.%v", err),
         }
-        .close-btn:hover {
-            background: #128C7E;
+      }
+    }
+  }
+
+  if _, ok := data["action"]; !ok {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing action",
+    }
+  }
+
+  // Set defaults
+  if _, ok := data["enabled"]; !ok {
+    data["enabled"] = true
+  }
+  if _, ok := data["priority"]; !ok {
+    data["priority"] = 0
+  }
+  if _, ok := data["timeout_seconds"]; !ok {
+    data["timeout_seconds"] = 30
+  }
+  if batch, _ := data["batch"].(bool); batch {
+    if _, ok := data["batch_window_seconds"]; !ok {
+      data["batch_window_seconds"] = 60
+    }
+    if _, ok := data["batch_max_size"]; !ok {
+      data["batch_max_size"] = 10
+    }
+  }
+  if err := normalizeHandlerIntegers(data); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   err.Error(),
+    }
+  }
+
+  // Cap the number of handlers, since every event is matched against each of them.
+  // Re-saving an existing handler is always allowed.
+  if maxHandlers := oh.config.GetMaxHandlers(); maxHandlers > 0 {
+    if _, err := oh.database.GetHandler(handlerID); err == sql.ErrNoRows {
+      count, err := oh.database.CountHandlers()
+      if err == nil && count >= maxHandlers {
+        return &OperationResult{
+          Success: false,
+          Error:   fmt.Sprintf("Handler limit reached (%d of max_handlers %d); delete unused handlers or raise max_handlers", count, maxHandlers),
         }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>📱 WhatsApp Pairing</h1>
-        <p class="subtitle">Scan this QR code with your WhatsApp mobile app</p>
-        
-        <div class="qr-container">
-            <img src="data:image/png;base64,%s" class="qr-code" alt="WhatsApp QR Code">
-        </div>
-        
-        <div class="instructions">
-            <h3>How to scan:</h3>
-            <ol>
-                <li>Open <strong>WhatsApp</strong> on your phone</li>
-                <li>Tap <strong>Menu</strong> or <strong>Settings</strong></li>
-                <li>Tap <strong>Linked Devices</strong></li>
-                <li>Tap <strong>Link a Device</strong></li>
-                <li>Point your phone at this screen to scan the QR code</li>
-            </ol>
-        </div>
-        
-        <p class="timeout">⏱️ This QR code will expire in %d seconds</p>
-        
-        <button class="close-btn" onclick="window.close()">Close</button>
-    </div>
-</body>
-</html>`, qrBase64, timeout)
+      }
+    }
+  }
+
+  // Save to database
+  err := oh.database.SaveHandler(data)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to save handler: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Handler '%s' registered successfully", handlerID),
+    Data: map[string]interface{}{
+      "handler_id": handlerID,
+    },
+  }
+}
+
+// handleListHandlers handles the list_handlers operation
+func (oh *OperationHandler) handleListHandlers(input *OperationInput) *OperationResult {
+  enabledOnly := false
+  if input.Data != nil {
+    if e, ok := input.Data["enabled_only"].(bool); ok {
+      enabledOnly = e
+    }
+  }
+
+  handlers, err := oh.database.ListHandlers(enabledOnly)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve handlers: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d handlers", len(handlers)),
+    Data: map[string]interface{}{
+      "handlers": handlers,
+      "count":    len(handlers),
+    },
+  }
+}
+
+// handleGetHandler handles the get_handler operation
+func (oh *OperationHandler) handleGetHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing handler_id",
+    }
+  }
+
+  handlerID, ok := input.Data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
+  }
+
+  handler, err := oh.database.GetHandler(handlerID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve handler: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved handler '%s'", handlerID),
+    Data:    handler,
+  }
+}
+
+// handleUpdateHandler handles the update_handler operation
+func (oh *OperationHandler) handleUpdateHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing handler data",
+    }
+  }
+
+  handlerID, ok := input.Data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
+  }
 
-  arguments := map[string]interface{}{
-    "input": map[string]interface{}{
-      "operation":        "show_popup",
-      "html":             html,
-      "title":            "WhatsApp QR Code - Scan to Connect",
-      "width":            600,
-      "height":           954,
-      "modal":            false,
-      "wait_for_response": false,
-      "center_on_screen": true,
-      "always_on_top":    true,
-      "bring_to_front":   false,
-      "tool_unlock_token": "b3fa8eb3",
+  // Check if handler exists
+  existing, err := oh.database.GetHandler(handlerID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Handler not found: %v", err),
+    }
+  }
+
+  // Merge updates into existing handler
+  for key, value := range input.Data {
+    existing[key] = value
+  }
+  if err := normalizeHandlerIntegers(existing); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   err.Error(),
+    }
+  }
+
+  // Save updated handler
+  err = oh.database.SaveHandler(existing)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to update handler: %v", err),
+    }
+  }
+
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Handler '%s' updated successfully", handlerID),
+    Data: map[string]interface{}{
+      "handler_id": handlerID,
     },
   }
+}
 
-  fmt.Fprintln(os.Stderr, "[INFO] Showing QR code popup window...")
-  _, err := callMCPTool(global_sse_connection, "user", arguments)
+// SyncHandlersFile upserts the handlers defined in a JSON file (an array of handler
+// definitions, or an object with a "handlers" array) as file-managed handlers, and removes
+// file-managed handlers that are no longer in the file. A definition that fails validation
+// is reported and its handler keeps its previously stored version. Returns how many were loaded.
+func (oh *OperationHandler) SyncHandlersFile(path string) (int, error) {
+  data, err := os.ReadFile(path)
   if err != nil {
-    fmt.Fprintf(os.Stderr, "[WARN] Failed to show QR popup: %v\n", err)
-  } else {
-    fmt.Fprintln(os.Stderr, "[OK] QR code popup displayed")
+    return 0, fmt.Errorf("failed to read handlers file: %w", err)
+  }
+
+  var definitions []map[string]interface{}
+  if err := json.Unmarshal(data, &definitions); err != nil {
+    var wrapped struct {
+      Handlers []map[string]interface{} `json:"handlers"`
+    }
+    if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+      return 0, fmt.Errorf("failed to parse handlers file: %w", err)
+    }
+    definitions = wrapped.Handlers
+  }
+
+  loaded := 0
+  inFile := make(map[string]bool, len(definitions))
+  for i, definition := range definitions {
+    definition["file_managed"] = true
+    result := oh.saveHandlerDefinition(definition)
+    if !result.Success {
+      // Keep what's stored rather than deleting a working handler over a typo in the file
+      if handlerID, ok := definition["handler_id"].(string); ok && handlerID != "" {
+        inFile[handlerID] = true
+        oh.error_state.LogError(ErrorSeverityError, "handlers_file",
+          fmt.Sprintf("Invalid definition for handler '%s' in %s; keeping its previous version", handlerID, path), result.Error)
+        continue
+      }
+      oh.error_state.LogError(ErrorSeverityWarning, "handlers_file", fmt.Sprintf("Skipped handler %d in %s", i, path), result.Error)
+      continue
+    }
+    inFile[definition["handler_id"].(string)] = true
+    loaded++
+  }
+
+  // Handlers dropped from the file go away on the next start
+  existing, err := oh.database.ListFileManagedHandlerIDs()
+  if err != nil {
+    return loaded, fmt.Errorf("failed to list file-managed handlers: %w", err)
   }
+  for _, handlerID := range existing {
+    if !inFile[handlerID] {
+      if err := oh.database.DeleteHandler(handlerID); err != nil {
+        oh.error_state.LogError(ErrorSeverityWarning, "handlers_file", "Failed to remove handler no longer in file", err.Error())
+      }
+    }
+  }
+
+  return loaded, nil
 }
 
-// handleCallWhatsmeow handles the call_whatsmeow operation - generic dispatcher
-func (oh *OperationHandler) handleCallWhatsmeow(input *OperationInput) *OperationResult {
-  // Extract method name
-  methodName, ok := input.Data["method"].(string)
-  if !ok {
+// handleDeleteHandler handles the delete_handler operation
+func (oh *OperationHandler) handleDeleteHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
     return &OperationResult{
       Success: false,
-      Error:   "method name required (string)",
+      Error:   "Missing handler_id",
     }
   }
 
-  // Extract params
-  params, ok := input.Data["params"].(map[string]interface{})
-  if !ok {
-    params = make(map[string]interface{})
+  handlerID, ok := input.Data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
   }
 
-  // Call via dispatcher
-  fmt.Fprintf(os.Stderr, "[INFO] Calling whatsmeow method: %s\n", methodName)
-  result := CallWhatsmeowMethod(methodName, params)
+  if fileManaged, err := oh.database.IsHandlerFileManaged(handlerID); err == nil && fileManaged {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Handler '%s' is managed by handlers_file (%s); remove it from the file instead", handlerID, oh.config.GetHandlersFile()),
+    }
+  }
 
-  if !result.Success {
-    oh.error_state.LogError(ErrorSeverityError, "call_whatsmeow", fmt.Sprintf("Method %s failed", methodName), result.Error)
+  err := oh.database.DeleteHandler(handlerID)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to delete handler: %v", err),
+    }
   }
 
-  return result
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Handler '%s' deleted successfully", handlerID),
+    Data: map[string]interface{}{
+      "handler_id": handlerID,
+    },
+  }
 }
 
-// handleGetMethodRegistry handles the get_method_registry operation
-func (oh *OperationHandler) handleGetMethodRegistry(input *OperationInput) *OperationResult {
-  if globalMethodRegistry == nil {
+// handleEnableHandler handles the enable_handler operation
+func (oh *OperationHandler) handleEnableHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
     return &OperationResult{
       Success: false,
-      Error:   "Method registry not loaded",
+      Error:   "Missing handler_id",
+    }
+  }
+
+  handlerID, ok := input.Data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
+  }
+
+  err := oh.database.UpdateHandlerEnabled(handlerID, true)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to enable handler: %v", err),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: "Method registry retrieved",
+    Message: fmt.Sprintf("Handler '%s' enabled", handlerID),
     Data: map[string]interface{}{
-      "methods":           globalMethodRegistry.Methods,
-      "message_templates": globalMethodRegistry.MessageTemplates,
-      "type_notes":        globalMethodRegistry.TypeNotes,
+      "handler_id": handlerID,
+      "enabled":    true,
     },
   }
 }
 
-// handleGetVersion handles the get_version operation
-func (oh *OperationHandler) handleGetVersion(input *OperationInput) *OperationResult {
+// handleDisableHandler handles the disable_handler operation
+func (oh *OperationHandler) handleDisableHandler(input *OperationInput) *OperationResult {
+  if input.Data == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing handler_id",
+    }
+  }
+
+  handlerID, ok := input.Data["handler_id"].(string)
+  if !ok || handlerID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing or invalid handler_id",
+    }
+  }
+
+  err := oh.database.UpdateHandlerEnabled(handlerID, false)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to disable handler: %v", err),
+    }
+  }
+
   return &OperationResult{
     Success: true,
-    Message: "Version information retrieved",
-    Data:    GetVersionInfo(),
+    Message: fmt.Sprintf("Handler '%s' disabled", handlerID),
+    Data: map[string]interface{}{
+      "handler_id": handlerID,
+      "enabled":    false,
+    },
   }
 }
 
-// handleGetMessages handles the get_messages operation
-func (oh *OperationHandler) handleGetMessages(input *OperationInput) *OperationResult {
-  // Parse parameters
-  limit := 50 // Default limit
+// handleGetHandlerExecutions handles the get_handler_executions operation
+func (oh *OperationHandler) handleGetHandlerExecutions(input *OperationInput) *OperationResult {
+  limit := 50 // default
+  var handlerID *string
+
   if input.Data != nil {
     if l, ok := input.Data["limit"].(float64); ok {
       limit = int(l)
     }
+    if h, ok := input.Data["handler_id"].(string); ok && h != "" {
+      handlerID = &h
+    }
   }
 
-  var fromJID *string
-  if input.Data != nil {
-    if f, ok := input.Data["from"].(string); ok && f != "" {
-      fromJID = &f
+  executions, err := oh.database.GetHandlerExecutions(handlerID, limit, nil)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to retrieve executions: %v", err),
     }
   }
 
-  var chatJID *string
-  if input.Data != nil {
-    if c, ok := input.Data["chat"].(string); ok && c != "" {
-      chatJID = &c
-    }
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("Retrieved %d executions", len(executions)),
+    Data: map[string]interface{}{
+      "executions": executions,
+      "count":      len(executions),
+    },
   }
+}
 
-  var sinceTime *time.Time
-  if input.Data != nil {
-    if s, ok := input.Data["since"].(string); ok && s != "" {
-      t, err := time.Parse(time.RFC3339, s)
-      if err == nil {
-        sinceTime = &t
-      }
+// handleReloadHandlers handles the reload_handlers operation
+func (oh *OperationHandler) handleReloadHandlers(input *OperationInput) *OperationResult {
+  if global_event_matcher == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Event matcher not initialized",
     }
   }
 
-  // Get messages from database
-  messages, err := oh.database.GetMessages(limit, fromJID, chatJID, sinceTime)
+  err := global_event_matcher.LoadHandlers()
   if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to retrieve messages: %v", err),
+      Error:   fmt.Sprintf("Failed to reload handlers: %v", err),
     }
   }
 
+  count := len(global_event_matcher.handlers)
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Retrieved %d messages", len(messages)),
+    Message: fmt.Sprintf("Reloaded %d handlers", count),
     Data: map[string]interface{}{
-      "messages": messages,
-      "count":    len(messages),
+      "count": count,
     },
   }
 }
 
-// handleRegisterHandler handles the register_handler operation
-func (oh *OperationHandler) handleRegisterHandler(input *OperationInput) *OperationResult {
-  if input.Data == nil {
+// handlePauseChatHandlers handles the pause_chat_handlers operation: no handler runs for the
+// chat until resume_chat_handlers, or for minutes if given. The pause survives restarts.
+func (oh *OperationHandler) handlePauseChatHandlers(input *OperationInput) *OperationResult {
+  chatStr, _ := input.Data["chat"].(string)
+  if chatStr == "" {
     return &OperationResult{
       Success: false,
-      Error:   "Missing handler data",
+      Error:   "Missing chat",
+    }
+  }
+  chat, err := parseJID(chatStr)
+  if err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Invalid chat JID: %v", err),
     }
   }
 
-  // Validate required fields
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
+  var resumeAt *time.Time
+  if minutes, ok := input.Data["minutes"].(float64); ok {
+    if minutes <= 0 {
+      return &OperationResult{
+        Success: false,
+        Error:   "minutes must be positive",
+      }
+    }
+    at := time.Now().Add(time.Duration(minutes * float64(time.Minute)))
+    resumeAt = &at
+  }
+  reason, _ := input.Data["reason"].(string)
+
+  if err := oh.database.PauseChat(chat.String(), resumeAt, reason); err != nil {
+    return &OperationResult{
+      Success: false,
+      Error:   fmt.Sprintf("Failed to pause chat: %v", err),
+    }
+  }
+
+  message := fmt.Sprintf("Handlers paused for %s until resumed", chat)
+  if resumeAt != nil {
+    message = fmt.Sprintf("Handlers paused for %s until %s", chat, resumeAt.Format(time.RFC3339))
+  }
+  return oh.pausedChatsResult(message)
+}
+
+// handleResumeChatHandlers handles the resume_chat_handlers operation
+func (oh *OperationHandler) handleResumeChatHandlers(input *OperationInput) *OperationResult {
+  chatStr, _ := input.Data["chat"].(string)
+  if chatStr == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing chat",
+    }
+  }
+  chat, err := parseJID(chatStr)
+  if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing or invalid handler_id",
+      Error:   fmt.Sprintf("Invalid chat JID: %v", err),
     }
   }
 
-  if _, ok := input.Data["event_filter"]; !ok {
+  resumed, err := oh.database.ResumeChat(chat.String())
+  if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing event_filter",
+      Error:   fmt.Sprintf("Failed to resume chat: %v", err),
     }
   }
 
-  if _, ok := input.Data["action"]; !ok {
+  message := fmt.Sprintf("Handlers resumed for %s", chat)
+  if !resumed {
+    message = fmt.Sprintf("Handlers were not paused for %s", chat)
+  }
+  return oh.pausedChatsResult(message)
+}
+
+// handleListRunningHandlers handles the list_running_handlers operation
+func (oh *OperationHandler) handleListRunningHandlers(input *OperationInput) *OperationResult {
+  if global_action_executor == nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing action",
+      Error:   "Action executor not initialized",
     }
   }
 
-  // Set defaults
-  if _, ok := input.Data["enabled"]; !ok {
-    input.Data["enabled"] = true
+  executions := global_action_executor.RunningExecutions()
+  return &OperationResult{
+    Success: true,
+    Message: fmt.Sprintf("%d handler executions running", len(executions)),
+    Data: map[string]interface{}{
+      "executions": executions,
+      "count":      len(executions),
+    },
   }
-  if _, ok := input.Data["priority"]; !ok {
-    input.Data["priority"] = 0
+}
+
+// handleCancelHandlerExecution handles the cancel_handler_execution operation
+func (oh *OperationHandler) handleCancelHandlerExecution(input *OperationInput) *OperationResult {
+  executionID, _ := input.Data["execution_id"].(string)
+  if executionID == "" {
+    return &OperationResult{
+      Success: false,
+      Error:   "Missing execution_id",
+    }
   }
-  if _, ok := input.Data["timeout_seconds"]; !ok {
-    input.Data["timeout_seconds"] = 30
+  if global_action_executor == nil {
+    return &OperationResult{
+      Success: false,
+      Error:   "Action executor not initialized",
+    }
   }
 
-  // Save to database
-  err := oh.database.SaveHandler(input.Data)
-  if err != nil {
+  handlerID, ok := global_action_executor.CancelExecution(executionID)
+  if !ok {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to save handler: %v", err),
+      Error:   fmt.Sprintf("No running handler execution with ID %s", executionID),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Handler '%s' registered successfully", handlerID),
+    Message: fmt.Sprintf("Cancelled execution %s of handler '%s'", executionID, handlerID),
     Data: map[string]interface{}{
-      "handler_id": handlerID,
+      "execution_id": executionID,
+      "handler_id":   handlerID,
     },
   }
 }
 
-// handleListHandlers handles the list_handlers operation
-func (oh *OperationHandler) handleListHandlers(input *OperationInput) *OperationResult {
-  enabledOnly := false
+// handleGetDeadLetters handles the get_dead_letters operation
+func (oh *OperationHandler) handleGetDeadLetters(input *OperationInput) *OperationResult {
+  limit := 50
+  var handlerID *string
+  includeResolved := false
+
   if input.Data != nil {
-    if e, ok := input.Data["enabled_only"].(bool); ok {
-      enabledOnly = e
+    if limitVal, ok := input.Data["limit"].(float64); ok && limitVal > 0 {
+      limit = int(limitVal)
+    }
+    if h, ok := input.Data["handler_id"].(string); ok && h != "" {
+      handlerID = &h
     }
+    includeResolved, _ = input.Data["include_resolved"].(bool)
   }
 
-  handlers, err := oh.database.ListHandlers(enabledOnly)
+  letters, err := oh.database.GetDeadLetters(limit, handlerID, includeResolved)
   if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to retrieve handlers: %v", err),
+      Error:   fmt.Sprintf("Failed to retrieve dead letters: %v", err),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Retrieved %d handlers", len(handlers)),
+    Message: fmt.Sprintf("Retrieved %d dead letter(s)", len(letters)),
     Data: map[string]interface{}{
-      "handlers": handlers,
-      "count":    len(handlers),
+      "dead_letters": letters,
+      "count":        len(letters),
     },
   }
 }
 
-// handleGetHandler handles the get_handler operation
-func (oh *OperationHandler) handleGetHandler(input *OperationInput) *OperationResult {
-  if input.Data == nil {
+// handleRetryDeadLetter handles the retry_dead_letter operation: it sends a failed action
+// again as it was recorded, marking it resolved if the send succeeds
+func (oh *OperationHandler) handleRetryDeadLetter(input *OperationInput) *OperationResult {
+  idVal, ok := input.Data["id"].(float64)
+  if !ok {
     return &OperationResult{
       Success: false,
-      Error:   "Missing handler_id",
+      Error:   "id required (number)",
     }
   }
-
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
+  id := int64(idVal)
+  if global_action_executor == nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing or invalid handler_id",
+      Error:   "Action executor not initialized",
     }
   }
 
-  handler, err := oh.database.GetHandler(handlerID)
+  letter, err := oh.database.GetDeadLetter(id)
   if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to retrieve handler: %v", err),
+      Error:   err.Error(),
     }
   }
-
-  return &OperationResult{
-    Success: true,
-    Message: fmt.Sprintf("Retrieved handler '%s'", handlerID),
-    Data:    handler,
-  }
-}
-
-// handleUpdateHandler handles the update_handler operation
-func (oh *OperationHandler) handleUpdateHandler(input *OperationInput) *OperationResult {
-  if input.Data == nil {
+  if resolved, _ := letter["resolved"].(bool); resolved {
     return &OperationResult{
       Success: false,
-      Error:   "Missing handler data",
+      Error:   fmt.Sprintf("Dead letter %d was already retried successfully", id),
     }
   }
 
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
+  actionType, _ := letter["action_type"].(string)
+  definition := lookupAction(actionType)
+  if definition == nil || definition.send == nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing or invalid handler_id",
+      Error:   fmt.Sprintf("Action type %s can't be retried", actionType),
     }
   }
+  action, _ := letter["action"].(map[string]interface{})
 
-  // Check if handler exists
-  existing, err := oh.database.GetHandler(handlerID)
-  if err != nil {
+  err = definition.send(global_action_executor, action)
+  if errors.Is(err, errDuplicateSend) {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Handler not found: %v", err),
+      Error:   fmt.Sprintf("Suppressed: the same content was already sent to this recipient within outbound_dedup_window (%s)", global_config.GetOutboundDedupWindow()),
     }
   }
 
-  // Merge updates into existing handler
-  for key, value := range input.Data {
-    existing[key] = value
+  errorMsg := ""
+  if err != nil {
+    errorMsg = err.Error()
+  }
+  if markErr := oh.database.MarkDeadLetterRetry(id, errorMsg); markErr != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "retry_dead_letter", "Failed to record retry", markErr.Error())
   }
-
-  // Save updated handler
-  err = oh.database.SaveHandler(existing)
   if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to update handler: %v", err),
+      Error:   fmt.Sprintf("Retry failed: %v", err),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Handler '%s' updated successfully", handlerID),
+    Message: fmt.Sprintf("Retried %s action from dead letter %d", actionType, id),
     Data: map[string]interface{}{
-      "handler_id": handlerID,
+      "id":          id,
+      "action_type": actionType,
+      "handler_id":  letter["handler_id"],
     },
   }
 }
 
-// handleDeleteHandler handles the delete_handler operation
-func (oh *OperationHandler) handleDeleteHandler(input *OperationInput) *OperationResult {
-  if input.Data == nil {
-    return &OperationResult{
-      Success: false,
-      Error:   "Missing handler_id",
-    }
-  }
-
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
-    return &OperationResult{
-      Success: false,
-      Error:   "Missing or invalid handler_id",
+// pausedChatsResult reloads the executor's paused chats and lists them
+func (oh *OperationHandler) pausedChatsResult(message string) *OperationResult {
+  if global_action_executor != nil {
+    if err := global_action_executor.LoadPausedChats(); err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to reload paused chats: %v", err),
+      }
     }
   }
 
-  err := oh.database.DeleteHandler(handlerID)
+  chats, err := oh.database.GetPausedChats()
   if err != nil {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to delete handler: %v", err),
+      Error:   fmt.Sprintf("Failed to list paused chats: %v", err),
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Handler '%s' deleted successfully", handlerID),
+    Message: message,
     Data: map[string]interface{}{
-      "handler_id": handlerID,
+      "paused_chats": chats,
+      "count":        len(chats),
     },
   }
 }
 
-// handleEnableHandler handles the enable_handler operation
-func (oh *OperationHandler) handleEnableHandler(input *OperationInput) *OperationResult {
+// autoreplyHandlerID is the handler set_autoreply manages
+const autoreplyHandlerID = "autoreply"
+
+// defaultAutoreplyCooldownHours is how long set_autoreply waits before answering the same
+// sender again, unless cooldown_hours is given
+const defaultAutoreplyCooldownHours = 12
+
+// handleSetAutoreply handles the set_autoreply operation: it creates or updates the managed
+// "autoreply" handler, which answers direct messages outside office_hours with message (which
+// may use {event.field} placeholders), at most once per sender per cooldown_hours. Settings
+// that are not given keep their current values.
+func (oh *OperationHandler) handleSetAutoreply(input *OperationInput) *OperationResult {
   if input.Data == nil {
-    return &OperationResult{
-      Success: false,
-      Error:   "Missing handler_id",
+    input.Data = map[string]interface{}{}
+  }
+
+  config := oh.autoreplyConfig()
+  for _, key := range []string{"enabled", "message", "office_hours", "cooldown_hours", "include_groups"} {
+    if value, ok := input.Data[key]; ok {
+      config[key] = value
     }
   }
 
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
+  message, _ := config["message"].(string)
+  if message == "" {
     return &OperationResult{
       Success: false,
-      Error:   "Missing or invalid handler_id",
+      Error:   "Missing message",
     }
   }
 
-  err := oh.database.UpdateHandlerEnabled(handlerID, true)
-  if err != nil {
+  officeHours, ok := config["office_hours"].(map[string]interface{})
+  if !ok {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to enable handler: %v", err),
+      Error:   "Missing office_hours (e.g. {\"days\": [\"mon\", \"tue\", \"wed\", \"thu\", \"fri\"], \"start\": \"09:00\", \"end\": \"17:00\"})",
     }
   }
-
-  return &OperationResult{
-    Success: true,
-    Message: fmt.Sprintf("Handler '%s' enabled", handlerID),
-    Data: map[string]interface{}{
-      "handler_id": handlerID,
-      "enabled":    true,
-    },
-  }
-}
-
-// handleDisableHandler handles the disable_handler operation
-func (oh *OperationHandler) handleDisableHandler(input *OperationInput) *OperationResult {
-  if input.Data == nil {
+  if err := validateActiveHours(officeHours); err != nil {
     return &OperationResult{
       Success: false,
-      Error:   "Missing handler_id",
+      Error:   fmt.Sprintf("office_hours.%v", err),
     }
   }
 
-  handlerID, ok := input.Data["handler_id"].(string)
-  if !ok || handlerID == "" {
+  cooldownHours, _ := config["cooldown_hours"].(float64)
+  if cooldownHours < 0 {
     return &OperationResult{
       Success: false,
-      Error:   "Missing or invalid handler_id",
+      Error:   "cooldown_hours cannot be negative",
     }
   }
+  enabled, _ := config["enabled"].(bool)
+  includeGroups, _ := config["include_groups"].(bool)
 
-  err := oh.database.UpdateHandlerEnabled(handlerID, false)
-  if err != nil {
-    return &OperationResult{
-      Success: false,
-      Error:   fmt.Sprintf("Failed to disable handler: %v", err),
+  // Match whenever the office hours window is not active
+  activeHours := map[string]interface{}{"outside": true}
+  for key, value := range officeHours {
+    if key != "outside" {
+      activeHours[key] = value
+    }
+  }
+  eventFilter := map[string]interface{}{
+    "event_types":  []interface{}{"message"},
+    "is_from_me":   false,
+    "active_hours": activeHours,
+  }
+  if !includeGroups {
+    eventFilter["is_group"] = false
+  }
+
+  result := oh.saveHandlerDefinition(map[string]interface{}{
+    "handler_id":   autoreplyHandlerID,
+    "description":  "Out-of-office auto-reply (managed by set_autoreply)",
+    "event_filter": eventFilter,
+    "action": map[string]interface{}{
+      "type": "actions",
+      "actions": []interface{}{
+        map[string]interface{}{
+          "type":                "send_message",
+          "to":                  "{event.chat}",
+          "message":             map[string]interface{}{"conversation": message},
+          "inline_placeholders": true,
+        },
+      },
+    },
+    "enabled":                 enabled,
+    "priority":                -100,
+    "sender_cooldown_seconds": int64(cooldownHours * 3600),
+  })
+  if !result.Success {
+    return result
+  }
+
+  if global_event_matcher != nil {
+    if err := global_event_matcher.LoadHandlers(); err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Auto-reply saved but reloading handlers failed: %v", err),
+      }
     }
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Handler '%s' disabled", handlerID),
-    Data: map[string]interface{}{
-      "handler_id": handlerID,
-      "enabled":    false,
-    },
+    Message: fmt.Sprintf("Auto-reply %s", map[bool]string{true: "enabled", false: "disabled"}[enabled]),
+    Data:    config,
   }
 }
 
-// handleGetHandlerExecutions handles the get_handler_executions operation
-func (oh *OperationHandler) handleGetHandlerExecutions(input *OperationInput) *OperationResult {
-  limit := 50 // default
-  var handlerID *string
+// handleGetAutoreply handles the get_autoreply operation
+func (oh *OperationHandler) handleGetAutoreply(input *OperationInput) *OperationResult {
+  config := oh.autoreplyConfig()
+  _, configured := config["message"]
+  config["configured"] = configured
 
-  if input.Data != nil {
-    if l, ok := input.Data["limit"].(float64); ok {
-      limit = int(l)
+  return &OperationResult{
+    Success: true,
+    Message: "Retrieved auto-reply configuration",
+    Data:    config,
+  }
+}
+
+// autoreplyConfig reads the set_autoreply settings back from the managed handler, or returns
+// the defaults if it hasn't been created yet
+func (oh *OperationHandler) autoreplyConfig() map[string]interface{} {
+  config := map[string]interface{}{
+    "enabled":        true,
+    "cooldown_hours": float64(defaultAutoreplyCooldownHours),
+    "include_groups": false,
+  }
+
+  handler, err := oh.database.GetHandler(autoreplyHandlerID)
+  if err != nil {
+    return config
+  }
+
+  config["enabled"], _ = handler["enabled"].(bool)
+  seconds, _ := handler["sender_cooldown_seconds"].(int64)
+  config["cooldown_hours"] = float64(seconds) / 3600
+
+  if filter, ok := handler["event_filter"].(map[string]interface{}); ok {
+    _, groupsExcluded := filter["is_group"]
+    config["include_groups"] = !groupsExcluded
+    if activeHours, ok := filter["active_hours"].(map[string]interface{}); ok {
+      officeHours := map[string]interface{}{}
+      for key, value := range activeHours {
+        if key != "outside" {
+          officeHours[key] = value
+        }
+      }
+      config["office_hours"] = officeHours
     }
-    if h, ok := input.Data["handler_id"].(string); ok && h != "" {
-      handlerID = &h
+  }
+
+  if action, ok := handler["action"].(map[string]interface{}); ok {
+    if actions, ok := action["actions"].([]interface{}); ok && len(actions) > 0 {
+      if send, ok := actions[0].(map[string]interface{}); ok {
+        if message, ok := send["message"].(map[string]interface{}); ok {
+          config["message"], _ = message["conversation"].(string)
+        }
+      }
     }
   }
 
-  executions, err := oh.database.GetHandlerExecutions(handlerID, limit)
+  return config
+}
+
+// FormatOperationResult formats an operation result as JSON
+func FormatOperationResult(result *OperationResult) (string, error) {
+  jsonBytes, err := json.MarshalIndent(result, "", "  ")
   if err != nil {
+    return "", err
+  }
+  return string(jsonBytes), nil
+}
+
+// handleGetMyGroups handles the get_my_groups operation: every group the account is in, with
+// its participant count and whether we're an admin. Results are cached for joinedGroupsCacheTTL
+// unless refresh is set.
+func (oh *OperationHandler) handleGetMyGroups(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsLoggedIn() {
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to retrieve executions: %v", err),
+      Error:   "Not logged in",
+    }
+  }
+
+  refresh, _ := input.Data["refresh"].(bool)
+
+  oh.groupsMutex.Lock()
+  defer oh.groupsMutex.Unlock()
+
+  cached := !refresh && oh.groupsCache != nil && time.Since(oh.groupsCachedAt) < joinedGroupsCacheTTL
+  if !cached {
+    client := global_whatsapp_client.Client()
+    joined, err := client.GetJoinedGroups(input.Context())
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to get joined groups: %v", err),
+      }
+    }
+
+    ownPN := client.Store.GetJID().ToNonAD()
+    ownLID := client.Store.GetLID().ToNonAD()
+
+    groups := make([]map[string]interface{}, 0, len(joined))
+    for _, info := range joined {
+      isAdmin, isSuperAdmin := false, false
+      for _, participant := range info.Participants {
+        if (!ownPN.IsEmpty() && (participant.JID.ToNonAD() == ownPN || participant.PhoneNumber.ToNonAD() == ownPN)) ||
+          (!ownLID.IsEmpty() && (participant.JID.ToNonAD() == ownLID || participant.LID.ToNonAD() == ownLID)) {
+          isAdmin = participant.IsAdmin || participant.IsSuperAdmin
+          isSuperAdmin = participant.IsSuperAdmin
+          break
+        }
+      }
+
+      groups = append(groups, map[string]interface{}{
+        "jid":               info.JID.String(),
+        "name":              info.Name,
+        "participant_count": len(info.Participants),
+        "is_admin":          isAdmin,
+        "is_super_admin":    isSuperAdmin,
+        "is_announce":       info.IsAnnounce,
+        "is_community":      info.IsParent,
+      })
     }
+
+    sort.Slice(groups, func(i, j int) bool {
+      return strings.ToLower(groups[i]["name"].(string)) < strings.ToLower(groups[j]["name"].(string))
+    })
+
+    oh.groupsCache = groups
+    oh.groupsCachedAt = time.Now()
   }
 
   return &OperationResult{
     Success: true,
-    Message: fmt.Sprintf("Retrieved %d executions", len(executions)),
+    Message: fmt.Sprintf("Member of %d group(s)", len(oh.groupsCache)),
     Data: map[string]interface{}{
-      "executions": executions,
-      "count":      len(executions),
+      "groups":    oh.groupsCache,
+      "cached":    cached,
+      "cached_at": oh.groupsCachedAt.Format(time.RFC3339),
     },
   }
 }
 
-// handleReloadHandlers handles the reload_handlers operation
-func (oh *OperationHandler) handleReloadHandlers(input *OperationInput) *OperationResult {
-  if global_event_matcher == nil {
+// handleSetProfilePicture handles the set_profile_picture operation. The image (image_base64
+// or a local path) is cropped and resized to WhatsApp's requirements and set as our own
+// profile picture, or as a group's picture when group is given (requires admin).
+// remove:true clears the picture instead.
+func (oh *OperationHandler) handleSetProfilePicture(input *OperationInput) *OperationResult {
+  if global_whatsapp_client == nil || !global_whatsapp_client.IsLoggedIn() {
     return &OperationResult{
       Success: false,
-      Error:   "Event matcher not initialized",
+      Error:   "Not logged in",
     }
   }
 
-  err := global_event_matcher.LoadHandlers()
+  // An empty target sets our own picture
+  target := types.EmptyJID
+  if groupStr, ok := input.Data["group"].(string); ok && groupStr != "" {
+    groupJID, err := parseJID(groupStr)
+    if err != nil || groupJID.Server != types.GroupServer {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Invalid group: %s", groupStr),
+      }
+    }
+    target = groupJID
+  }
+
+  var avatar []byte
+  if remove, _ := input.Data["remove"].(bool); !remove {
+    var data []byte
+    var err error
+    if encoded, ok := input.Data["image_base64"].(string); ok && encoded != "" {
+      data, err = base64.StdEncoding.DecodeString(encoded)
+    } else if path, ok := input.Data["path"].(string); ok && path != "" {
+      data, err = os.ReadFile(path)
+    } else {
+      return &OperationResult{
+        Success: false,
+        Error:   "image_base64 or path required (or remove: true)",
+      }
+    }
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   fmt.Sprintf("Failed to read image: %v", err),
+      }
+    }
+
+    avatar, err = prepareProfilePicture(data)
+    if err != nil {
+      return &OperationResult{
+        Success: false,
+        Error:   err.Error(),
+      }
+    }
+  }
+
+  pictureID, err := global_whatsapp_client.Client().SetGroupPhoto(input.Context(), target, avatar)
   if err != nil {
+    oh.error_state.LogError(ErrorSeverityWarning, "set_profile_picture", "Failed to set profile picture", err.Error())
     return &OperationResult{
       Success: false,
-      Error:   fmt.Sprintf("Failed to reload handlers: %v", err),
+      Error:   fmt.Sprintf("Failed to set profile picture: %v", err),
     }
   }
 
-  count := len(global_event_matcher.handlers)
-  return &OperationResult{
-    Success: true,
-    Message: fmt.Sprintf("Reloaded %d handlers", count),
-    Data: map[string]interface{}{
-      "count": count,
-    },
+  data := map[string]interface{}{
+    "picture_id": pictureID,
+  }
+  if !target.IsEmpty() {
+    data["group"] = target.String()
   }
-}
 
-// FormatOperationResult formats an operation result as JSON
-func FormatOperationResult(result *OperationResult) (string, error) {
-  jsonBytes, err := json.MarshalIndent(result, "", "  ")
-  if err != nil {
-    return "", err
+  message := "Profile picture updated"
+  if avatar == nil {
+    message = "Profile picture removed"
   }
-  return string(jsonBytes), nil
-}
 
+  return &OperationResult{
+    Success: true,
+    Message: message,
+    Data:    data,
+  }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "context"
+  "encoding/hex"
+  "fmt"
+
+  "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/types/events"
+)
+
+// maxPollOptions is the most options WhatsApp allows in a poll
+const maxPollOptions = 12
+
+// pollCreation returns the poll a message creates, whichever message version carries it,
+// or nil if it isn't a poll
+func pollCreation(message *waE2E.Message) *waE2E.PollCreationMessage {
+  for _, poll := range []*waE2E.PollCreationMessage{
+    message.GetPollCreationMessage(),
+    message.GetPollCreationMessageV2(),
+    message.GetPollCreationMessageV3(),
+    message.GetPollCreationMessageV5(),
+  } {
+    if poll != nil {
+      return poll
+    }
+  }
+  return nil
+}
+
+// pollContent is the structured content of a poll: its question, option names and how many
+// options a voter may pick (0 means any number)
+func pollContent(poll *waE2E.PollCreationMessage) map[string]interface{} {
+  options := make([]string, 0, len(poll.GetOptions()))
+  for _, option := range poll.GetOptions() {
+    options = append(options, option.GetOptionName())
+  }
+  return map[string]interface{}{
+    "question":       poll.GetName(),
+    "options":        options,
+    "max_selections": int(poll.GetSelectableOptionsCount()),
+  }
+}
+
+// storedPollOptions reads a stored poll's option names and max_selections from its content
+func storedPollOptions(stored map[string]interface{}) ([]string, int, bool) {
+  content, _ := stored["content"].(map[string]interface{})
+  rawOptions, ok := content["options"].([]interface{})
+  if stored["message_type"] != "poll" || !ok {
+    return nil, 0, false
+  }
+
+  options := make([]string, 0, len(rawOptions))
+  for _, option := range rawOptions {
+    name, _ := option.(string)
+    options = append(options, name)
+  }
+  maxSelections, _ := content["max_selections"].(float64)
+  return options, int(maxSelections), true
+}
+
+// handlePollVote decrypts a poll vote with the poll's message secret, stores the voter's
+// current selection by option name and dispatches a poll_vote event. Each vote replaces the
+// voter's previous one; an empty selection withdraws it.
+func (wac *WhatsAppClient) handlePollVote(v *events.Message, update *waE2E.PollUpdateMessage) {
+  pollID := update.GetPollCreationMessageKey().GetID()
+  excluded := global_config.IsStorageExcluded(v.Info.Chat.String(), v.Info.Sender.String())
+
+  vote, err := wac.Client().DecryptPollVote(context.Background(), v)
+  if err != nil {
+    // Usually a poll created before this device was linked, whose secret we never saw
+    global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to decrypt poll vote", fmt.Sprintf("Poll: %s: %v", pollID, err))
+    return
+  }
+
+  // Votes carry SHA-256 hashes of the option names
+  byHash := map[string]string{}
+  if stored, err := global_database.GetMessage(pollID); err == nil {
+    if options, _, ok := storedPollOptions(stored); ok {
+      for i, hash := range whatsmeow.HashPollOptions(options) {
+        byHash[string(hash)] = options[i]
+      }
+    }
+  }
+  selected := make([]string, 0, len(vote.GetSelectedOptions()))
+  for _, hash := range vote.GetSelectedOptions() {
+    if name, ok := byHash[string(hash)]; ok {
+      selected = append(selected, name)
+    } else {
+      selected = append(selected, "unknown:"+hex.EncodeToString(hash))
+    }
+  }
+
+  voter := v.Info.Sender.ToNonAD().String()
+  if !excluded {
+    if err := global_database.SavePollVote(pollID, voter, v.Info.Chat.String(), selected, v.Info.Timestamp); err != nil {
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save poll vote", err.Error())
+    }
+  }
+
+  if global_action_executor != nil && !(excluded && global_config.GetStoreExcludeSkipHandlers()) {
+    eventData := map[string]interface{}{
+      "event_type":       "poll_vote",
+      "message_id":       pollID,
+      "vote_message_id":  v.Info.ID,
+      "timestamp":        v.Info.Timestamp,
+      "from":             voter,
+      "chat":             v.Info.Chat.String(),
+      "sender_name":      v.Info.PushName,
+      "is_group":         v.Info.IsGroup,
+      "is_from_me":       v.Info.IsFromMe,
+      "selected_options": selected,
+    }
+
+    go global_action_executor.ExecuteHandlersForEvent(eventData)
+  }
+}
+
+// tallyPoll counts the stored votes for each option, with who picked it
+func tallyPoll(options []string, votes []map[string]interface{}) []map[string]interface{} {
+  voters := make(map[string][]string, len(options))
+  for _, vote := range votes {
+    voter, _ := vote["voter"].(string)
+    selected, _ := vote["selected_options"].([]string)
+    for _, option := range selected {
+      voters[option] = append(voters[option], voter)
+    }
+  }
+
+  results := make([]map[string]interface{}, 0, len(options))
+  for _, option := range options {
+    optionVoters := voters[option]
+    if optionVoters == nil {
+      optionVoters = []string{}
+    }
+    results = append(results, map[string]interface{}{
+      "option": option,
+      "votes":  len(optionVoters),
+      "voters": optionVoters,
+    })
+  }
+  return results
+}
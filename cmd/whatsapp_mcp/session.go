@@ -0,0 +1,159 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "io"
+  "os"
+  "time"
+
+  "go.mau.fi/whatsmeow/types"
+)
+
+// BackupSession writes a consistent copy of the session database (device keys and Signal
+// sessions) to path, which must not exist yet. The client is disconnected while the copy is
+// taken so no session state changes underneath it, then reconnected if it was connected.
+func (wac *WhatsAppClient) BackupSession(ctx context.Context, path string) (int64, error) {
+  if _, err := os.Stat(path); err == nil {
+    return 0, fmt.Errorf("%s already exists", path)
+  }
+
+  if client := wac.Client(); client.IsConnected() {
+    client.Disconnect()
+    defer func() {
+      if err := wac.Connect(); err != nil {
+        global_error_state.LogError(ErrorSeverityWarning, "backup_session", "Failed to reconnect after backup", err.Error())
+      }
+    }()
+  }
+
+  db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", wac.db_path))
+  if err != nil {
+    return 0, fmt.Errorf("failed to open session database: %w", err)
+  }
+  defer db.Close()
+
+  // VACUUM INTO writes a compacted snapshot, including anything still in the WAL
+  if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+    return 0, fmt.Errorf("failed to copy session database: %w", err)
+  }
+
+  info, err := os.Stat(path)
+  if err != nil {
+    return 0, err
+  }
+  global_error_state.LogError(ErrorSeverityInfo, "backup_session", "Session backed up", path)
+  return info.Size(), nil
+}
+
+// validateSessionBackup checks that path is an intact session database holding a paired
+// device, and returns the device's JID
+func validateSessionBackup(ctx context.Context, path string) (types.JID, error) {
+  if _, err := os.Stat(path); err != nil {
+    return types.EmptyJID, err
+  }
+
+  db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+  if err != nil {
+    return types.EmptyJID, err
+  }
+  defer db.Close()
+
+  var integrity string
+  if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity); err != nil {
+    return types.EmptyJID, fmt.Errorf("not a readable SQLite database: %w", err)
+  }
+  if integrity != "ok" {
+    return types.EmptyJID, fmt.Errorf("database is corrupt: %s", integrity)
+  }
+
+  var jid string
+  if err := db.QueryRowContext(ctx, `SELECT jid FROM whatsmeow_device LIMIT 1`).Scan(&jid); err != nil {
+    return types.EmptyJID, fmt.Errorf("no paired device in backup: %w", err)
+  }
+  return types.ParseJID(jid)
+}
+
+// RestoreSession replaces the session database with a backup made by BackupSession and
+// reopens the client on it, disconnected. The session it replaces is moved aside to the
+// returned path, and put back if the backup can't be opened. The caller reconnects to
+// confirm WhatsApp still accepts the restored session.
+func (wac *WhatsAppClient) RestoreSession(ctx context.Context, path string) (types.JID, string, error) {
+  jid, err := validateSessionBackup(ctx, path)
+  if err != nil {
+    return types.EmptyJID, "", fmt.Errorf("invalid session backup: %w", err)
+  }
+
+  old := wac.Client()
+  old.Disconnect()
+  old.RemoveEventHandler(wac.event_handler_id)
+  if err := wac.container.Close(); err != nil {
+    wac.SetupEventHandlers()
+    return types.EmptyJID, "", fmt.Errorf("failed to close session database: %w", err)
+  }
+
+  // Closing the last connection checkpoints the WAL, so the main file holds everything
+  previous := fmt.Sprintf("%s.before-restore-%s", wac.db_path, time.Now().Format("20060102-150405"))
+  if err := os.Rename(wac.db_path, previous); err != nil && !os.IsNotExist(err) {
+    wac.reopenSession()
+    return types.EmptyJID, "", fmt.Errorf("failed to move current session aside: %w", err)
+  }
+  os.Remove(wac.db_path + "-wal")
+  os.Remove(wac.db_path + "-shm")
+
+  if err := copyFile(path, wac.db_path); err != nil {
+    os.Rename(previous, wac.db_path)
+    wac.reopenSession()
+    return types.EmptyJID, "", fmt.Errorf("failed to copy session backup: %w", err)
+  }
+
+  if err := wac.reopenSession(); err != nil {
+    os.Remove(wac.db_path)
+    os.Rename(previous, wac.db_path)
+    wac.reopenSession()
+    return types.EmptyJID, "", fmt.Errorf("failed to open restored session: %w", err)
+  }
+
+  global_whatsapp_state.mu.Lock()
+  global_whatsapp_state.connection_state = StateDisconnected
+  global_whatsapp_state.phone_number = jid.User
+  global_whatsapp_state.device_id = fmt.Sprintf("%d", jid.Device)
+  global_whatsapp_state.mu.Unlock()
+  global_whatsapp_state.ResetAppStateSync()
+
+  global_error_state.LogError(ErrorSeverityInfo, "restore_session", "Session restored", fmt.Sprintf("From: %s, previous session kept at %s", path, previous))
+  global_database.LogConnectionEvent("restore_session", "Session restored from backup")
+  return jid, previous, nil
+}
+
+// reopenSession opens the session database again after it was closed and swaps in a client
+// for it with our event handlers
+func (wac *WhatsAppClient) reopenSession() error {
+  container, client, err := openSessionStore(wac.db_path)
+  if err != nil {
+    return err
+  }
+  wac.swapClient(container, client)
+  wac.SetupEventHandlers()
+  return nil
+}
+
+// copyFile copies src to a new file at dst
+func copyFile(src string, dst string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+
+  out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  return out.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "strconv"
+  "strings"
+
+  "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/types"
+  "google.golang.org/protobuf/proto"
+)
+
+// parseARGB parses a #RRGGBB or #AARRGGBB color into the ARGB value status messages use.
+// Colors without alpha are opaque.
+func parseARGB(color string) (uint32, error) {
+  hex := strings.TrimPrefix(color, "#")
+  if len(hex) != 6 && len(hex) != 8 {
+    return 0, fmt.Errorf("invalid color %q (use #RRGGBB or #AARRGGBB)", color)
+  }
+  value, err := strconv.ParseUint(hex, 16, 32)
+  if err != nil {
+    return 0, fmt.Errorf("invalid color %q (use #RRGGBB or #AARRGGBB)", color)
+  }
+  if len(hex) == 6 {
+    value |= 0xFF000000
+  }
+  return uint32(value), nil
+}
+
+// buildTextStatus builds a text status. backgroundColor and textColor are #RRGGBB colors and
+// font is an ExtendedTextMessage font name such as SYSTEM or FB_SCRIPT; empty values are
+// left to WhatsApp's defaults.
+func buildTextStatus(text string, backgroundColor string, textColor string, font string) (*waE2E.Message, error) {
+  status := &waE2E.ExtendedTextMessage{Text: proto.String(text)}
+  if backgroundColor != "" {
+    argb, err := parseARGB(backgroundColor)
+    if err != nil {
+      return nil, fmt.Errorf("background_color: %w", err)
+    }
+    status.BackgroundArgb = proto.Uint32(argb)
+  }
+  if textColor != "" {
+    argb, err := parseARGB(textColor)
+    if err != nil {
+      return nil, fmt.Errorf("text_color: %w", err)
+    }
+    status.TextArgb = proto.Uint32(argb)
+  }
+  if font != "" {
+    value, ok := waE2E.ExtendedTextMessage_FontType_value[strings.ToUpper(font)]
+    if !ok {
+      return nil, fmt.Errorf("unknown font %q", font)
+    }
+    status.Font = waE2E.ExtendedTextMessage_FontType(value).Enum()
+  }
+  return &waE2E.Message{ExtendedTextMessage: status}, nil
+}
+
+// statusAudience works out who will receive a status the way whatsmeow does when sending to
+// status@broadcast: the allow list in whitelist mode, otherwise address book contacts minus
+// any exclusions. Returns the privacy mode and how many contacts can view the status.
+func statusAudience(ctx context.Context, client *whatsmeow.Client) (types.StatusPrivacyType, int, error) {
+  privacy, err := client.GetStatusPrivacy(ctx)
+  if err != nil {
+    return "", 0, fmt.Errorf("failed to get status privacy: %w", err)
+  }
+  setting := privacy[0]
+  if setting.Type == types.StatusPrivacyTypeWhitelist {
+    return setting.Type, len(setting.List), nil
+  }
+
+  contacts, err := client.Store.Contacts.GetAllContacts(ctx)
+  if err != nil {
+    return "", 0, fmt.Errorf("failed to read contacts: %w", err)
+  }
+  excluded := make(map[types.JID]bool, len(setting.List))
+  if setting.Type == types.StatusPrivacyTypeBlacklist {
+    for _, jid := range setting.List {
+      excluded[jid] = true
+    }
+  }
+  // Only address book entries count; the contact store also holds push names of strangers
+  viewers := 0
+  for jid, contact := range contacts {
+    if contact.FullName != "" && !excluded[jid] {
+      viewers++
+    }
+  }
+  return setting.Type, viewers, nil
+}
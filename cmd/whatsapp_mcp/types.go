@@ -1,8 +1,11 @@
 package main
 
 import (
+  "context"
   "sync"
   "time"
+
+  "go.mau.fi/whatsmeow/appstate"
 )
 
 // ErrorSeverity represents the severity level of an error
@@ -15,6 +18,45 @@ const (
   ErrorSeverityCritical ErrorSeverity = "critical"
 )
 
+// errorSeverityRank orders severities, for comparing against db_log_min_severity
+var errorSeverityRank = map[ErrorSeverity]int{
+  ErrorSeverityInfo:     0,
+  ErrorSeverityWarning:  1,
+  ErrorSeverityError:    2,
+  ErrorSeverityCritical: 3,
+}
+
+// Stack trace capture levels for the capture_stack_traces config
+const (
+  StackTracesAll          = "all"
+  StackTracesCriticalOnly = "critical-only"
+  StackTracesNone         = "none"
+)
+
+// QR display modes for the qr_display_mode config. Auto shows both when an MCP connection
+// (and so the user popup tool) is available, and only the console QR otherwise.
+const (
+  QRDisplayAuto  = "auto"
+  QRDisplayPopup = "popup"
+  QRDisplayASCII = "ascii"
+  QRDisplayBoth  = "both"
+  QRDisplayNone  = "none"
+)
+
+// Log formats for the log_format config
+const (
+  LogFormatConsole = "console"
+  LogFormatJSON    = "json"
+)
+
+// Handler execution modes for the handler_execution_mode config. Parallel starts every matched
+// handler at once; sequential runs them one at a time in priority order, so a handler can
+// return halt to keep lower-priority handlers from seeing the event.
+const (
+  HandlerExecutionParallel   = "parallel"
+  HandlerExecutionSequential = "sequential"
+)
+
 // ErrorEntry represents a single error in the error log
 type ErrorEntry struct {
   ID        string        `json:"id"`
@@ -47,6 +89,53 @@ type Config struct {
   auto_presence         bool
   handler_timeout       int
   max_parallel_handlers int
+  outbound_queue_ttl    int
+  capture_stack_traces  string
+  message_webhook_url   string
+  message_webhook_secret string
+  operation_timeout     int
+  ignore_own_messages   bool
+  qr_auto_refresh       bool
+  hash_jids_in_logs     bool
+  max_handler_event_age_seconds int
+  mcp_tls_insecure      bool
+  mcp_tls_ca_cert       string
+  mcp_retry_attempts    int
+  mcp_retry_backoff_ms  int
+  method_registry_path  string
+  store_exclude_chats   []string
+  store_exclude_senders []string
+  store_exclude_skip_handlers bool
+  presence_on_send      bool
+  action_method_allowlist []string
+  default_chat_scope    []string
+  reverse_backlog_limit int
+  handlers_file         string
+  humanize_sends        bool
+  humanize_max_delay_ms int
+  outbound_dedup        bool
+  outbound_dedup_window int
+  max_concurrent_downloads int
+  qr_display_mode       string
+  log_format            string
+  composing_timeout     int
+  handler_execution_mode string
+  clock_skew_warning    int
+  max_handlers          int
+  serialized_method_categories []string
+  transcription_tool    string
+  transcription_operation string
+  max_handler_input_bytes int
+  track_message_status  bool
+  auto_download_media   bool
+  auto_download_media_types []string
+  auto_download_max_bytes int
+  enrich_message_names  bool
+  db_log_min_severity   ErrorSeverity
+  register_retry_attempts int
+  register_retry_backoff_ms int
+  dead_letter_actions   bool
+  missing_tool_attention bool
 }
 
 // ConnectionState represents the WhatsApp connection state
@@ -60,6 +149,40 @@ const (
   StateError        ConnectionState = "error"
 )
 
+// PairingState represents the progress of QR code pairing
+type PairingState string
+
+const (
+  PairingIdle           PairingState = "idle"
+  PairingWaitingForScan PairingState = "waiting_for_scan"
+  PairingScanned        PairingState = "scanned"
+  PairingPaired         PairingState = "paired"
+  PairingFailed         PairingState = "failed"
+)
+
+// Pairing attempt outcomes recorded in pairing_attempts
+const (
+  PairingOutcomeSuccess = "success"
+  PairingOutcomeTimeout = "timeout"
+  PairingOutcomeError   = "error"
+)
+
+// Delivery statuses of messages we sent, stored in messages.status. A message only moves
+// forward through messageStatusOrder, so a late or duplicate receipt can't undo a later one.
+const (
+  MessageStatusPending   = "pending"
+  MessageStatusFailed    = "failed"
+  MessageStatusSent      = "sent"
+  MessageStatusDelivered = "delivered"
+  MessageStatusRead      = "read"
+  MessageStatusPlayed    = "played"
+)
+
+var messageStatusOrder = []string{
+  MessageStatusPending, MessageStatusFailed, MessageStatusSent,
+  MessageStatusDelivered, MessageStatusRead, MessageStatusPlayed,
+}
+
 // WhatsAppState represents the current state of the WhatsApp client
 type WhatsAppState struct {
   mu                sync.RWMutex
@@ -69,12 +192,44 @@ type WhatsAppState struct {
   last_connected    time.Time
   last_disconnected time.Time
   reconnect_attempts int
+  pairing_state     PairingState
+  pairing_updated   time.Time
+  pairing_error     string
+  pairing_started   time.Time // zero unless an attempt awaits its outcome
+  pairing_popup     bool
+  disconnect_reason      string
+  disconnect_description string
+  disconnect_terminal    bool
+  app_state_synced       map[appstate.WAPatchName]appStateSync
+  app_state_changed      chan struct{} // closed and replaced whenever sync progress changes
 }
 
 // OperationInput represents the input for all operations
 type OperationInput struct {
   Operation string                 `json:"operation"`
   Data      map[string]interface{} `json:"data,omitempty"`
+
+  ctx      context.Context
+  progress ProgressFunc
+}
+
+// ProgressFunc receives interim progress for a long-running operation.
+// total is 0 when the amount of work isn't known up front.
+type ProgressFunc func(current int, total int, message string)
+
+// Context returns the operation's context, which is cancelled when the operation times out
+func (oi *OperationInput) Context() context.Context {
+  if oi.ctx == nil {
+    return context.Background()
+  }
+  return oi.ctx
+}
+
+// ReportProgress sends an interim progress update to the caller, if it asked for them
+func (oi *OperationInput) ReportProgress(current int, total int, message string) {
+  if oi.progress != nil {
+    oi.progress(current, total, message)
+  }
 }
 
 // OperationResult represents the result of an operation
@@ -83,5 +238,12 @@ type OperationResult struct {
   Message string                 `json:"message,omitempty"`
   Data    map[string]interface{} `json:"data,omitempty"`
   Error   string                 `json:"error,omitempty"`
+
+  // Binary payload (base64) returned to the MCP caller as image/resource content
+  ContentType string `json:"content_type,omitempty"`
+  BinaryData  string `json:"-"`
+
+  // Time spent handling the operation, set by HandleOperation
+  DurationMs int64 `json:"duration_ms,omitempty"`
 }
 
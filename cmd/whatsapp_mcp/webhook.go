@@ -0,0 +1,77 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "time"
+)
+
+const (
+  webhookMaxAttempts = 3
+  webhookTimeout     = 10 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// postMessageWebhook POSTs a stored message to the configured message_webhook_url.
+// The body is signed with HMAC-SHA256 in the X-Webhook-Signature header when a secret is set.
+func postMessageWebhook(msg map[string]interface{}) {
+  webhookURL, secret := global_config.GetMessageWebhook()
+  if webhookURL == "" {
+    return
+  }
+
+  body, err := json.Marshal(msg)
+  if err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "message_webhook", "Failed to encode message for webhook", err.Error())
+    return
+  }
+
+  var lastErr error
+  for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+    lastErr = sendWebhookRequest(webhookURL, secret, body)
+    if lastErr == nil {
+      return
+    }
+
+    if attempt < webhookMaxAttempts {
+      time.Sleep(time.Duration(attempt) * 2 * time.Second)
+    }
+  }
+
+  global_error_state.LogError(ErrorSeverityWarning, "message_webhook",
+    fmt.Sprintf("Webhook delivery failed after %d attempts", webhookMaxAttempts), lastErr.Error())
+}
+
+// sendWebhookRequest performs a single signed webhook POST
+func sendWebhookRequest(webhookURL string, secret string, body []byte) error {
+  req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", ToolName, ToolVersion))
+  if secret != "" {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+    req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+  }
+
+  resp, err := webhookClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+  }
+
+  return nil
+}
@@ -3,15 +3,22 @@ package main
 import (
   "bytes"
   "context"
+  "database/sql"
   "encoding/base64"
   "encoding/json"
   "fmt"
   "image/png"
   "os"
   "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+  "sync/atomic"
   "time"
 
   "go.mau.fi/whatsmeow"
+  "go.mau.fi/whatsmeow/proto/waE2E"
+  "go.mau.fi/whatsmeow/proto/waHistorySync"
   "go.mau.fi/whatsmeow/store/sqlstore"
   "go.mau.fi/whatsmeow/types"
   "go.mau.fi/whatsmeow/types/events"
@@ -20,15 +27,34 @@ import (
   _ "github.com/mattn/go-sqlite3"
 )
 
+// global_excluded_messages counts incoming messages dropped because their chat or sender is
+// excluded from storage; get_health_status reports it instead of logging each one
+var global_excluded_messages atomic.Int64
+
 // WhatsAppClient wraps the whatsmeow client with our error handling
 type WhatsAppClient struct {
+  mu            sync.RWMutex // guards client and container, which ResetSession and RestoreSession replace
   client        *whatsmeow.Client
   container     *sqlstore.Container
+  db_path       string // session database the container was opened on
   event_handler_id uint32
   qr_channel    chan string
   connected_channel chan bool
+  history_sync_channel chan int
+
+  receipts_mu    sync.Mutex
+  early_receipts map[types.MessageID]earlyReceipt // receipts that arrived before their message was stored
+}
+
+// earlyReceipt is a delivery status for a sent message that wasn't stored yet
+type earlyReceipt struct {
+  status     string
+  receivedAt time.Time
 }
 
+// earlyReceiptTTL is how long an early receipt waits for storeSentMessage to save its message
+const earlyReceiptTTL = 2 * time.Minute
+
 // NewWhatsAppClient creates a new WhatsApp client
 func NewWhatsAppClient(dbPath string) (*WhatsAppClient, error) {
   // Ensure directory exists
@@ -37,31 +63,60 @@ func NewWhatsAppClient(dbPath string) (*WhatsAppClient, error) {
     return nil, fmt.Errorf("failed to create database directory: %w", err)
   }
 
-  // Create database container
-  container, err := sqlstore.New(context.Background(), "sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), waLog.Noop)
-  if err != nil {
-    return nil, fmt.Errorf("failed to create database container: %w", err)
-  }
-
-  // Get first device (or create new one)
-  deviceStore, err := container.GetFirstDevice(context.Background())
+  container, client, err := openSessionStore(dbPath)
   if err != nil {
-    return nil, fmt.Errorf("failed to get device: %w", err)
+    return nil, err
   }
 
-  // Create client
-  client := whatsmeow.NewClient(deviceStore, waLog.Noop)
-
   wac := &WhatsAppClient{
     client:        client,
     container:     container,
+    db_path:       dbPath,
     qr_channel:    make(chan string, 1),
     connected_channel: make(chan bool, 1),
+    history_sync_channel: make(chan int, 1),
   }
 
   return wac, nil
 }
 
+// Client returns the current whatsmeow client. ResetSession and RestoreSession replace it,
+// so fetch it for each use rather than keeping it around.
+func (wac *WhatsAppClient) Client() *whatsmeow.Client {
+  wac.mu.RLock()
+  defer wac.mu.RUnlock()
+  return wac.client
+}
+
+// swapClient publishes a replacement client and the container its device came from. The old
+// client must already be disconnected with its event handler removed.
+func (wac *WhatsAppClient) swapClient(container *sqlstore.Container, client *whatsmeow.Client) {
+  wac.mu.Lock()
+  wac.container = container
+  wac.client = client
+  wac.mu.Unlock()
+}
+
+// openSessionStore opens the session database and creates a client for its first device
+// (or a new, unpaired one if it has none)
+func openSessionStore(dbPath string) (*sqlstore.Container, *whatsmeow.Client, error) {
+  // Create database container
+  container, err := sqlstore.New(context.Background(), "sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), waLog.Noop)
+  if err != nil {
+    return nil, nil, fmt.Errorf("failed to create database container: %w", err)
+  }
+
+  // Get first device (or create new one)
+  deviceStore, err := container.GetFirstDevice(context.Background())
+  if err != nil {
+    container.Close()
+    return nil, nil, fmt.Errorf("failed to get device: %w", err)
+  }
+
+  // Create client
+  return container, whatsmeow.NewClient(deviceStore, waLog.Noop), nil
+}
+
 // SetupEventHandlers sets up the event handlers for the client
 func (wac *WhatsAppClient) SetupEventHandlers() {
   handler := func(evt interface{}) {
@@ -77,21 +132,45 @@ func (wac *WhatsAppClient) SetupEventHandlers() {
     case *events.PairSuccess:
       // Successfully paired
       global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Paired successfully", fmt.Sprintf("ID: %s", v.ID))
+      global_whatsapp_state.SetPairingState(PairingScanned, "")
+      global_whatsapp_state.ResetAppStateSync()
+      recordPairingOutcome(PairingOutcomeSuccess, "")
       global_whatsapp_state.mu.Lock()
       global_whatsapp_state.phone_number = v.ID.User
       global_whatsapp_state.device_id = fmt.Sprintf("%d", v.ID.Device)
       global_whatsapp_state.mu.Unlock()
 
+    case *events.PairError:
+      // Pairing failed after the QR code was scanned
+      global_error_state.LogError(ErrorSeverityError, "whatsapp_event", "Pairing failed", v.Error.Error())
+      global_whatsapp_state.SetPairingState(PairingFailed, v.Error.Error())
+      recordPairingOutcome(PairingOutcomeError, v.Error.Error())
+
     case *events.Connected:
       // Connected to WhatsApp
       global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Connected to WhatsApp", "")
+      if global_whatsapp_state.GetPairingState() == PairingScanned {
+        global_whatsapp_state.SetPairingState(PairingPaired, "")
+      } else {
+        // A freshly paired device is still mid full sync, which reports its own completion
+        wac.seedAppStateSync(context.Background())
+      }
       global_whatsapp_state.mu.Lock()
       global_whatsapp_state.connection_state = StateConnected
       global_whatsapp_state.last_connected = time.Now()
       global_whatsapp_state.reconnect_attempts = 0
       global_whatsapp_state.mu.Unlock()
+      global_whatsapp_state.SetDisconnectReason("", "", false)
+
+      // Re-enable auto-reconnect if a terminal disconnect had turned it off
+      wac.Client().EnableAutoReconnect = global_config.GetAutoReconnect()
       
       global_database.LogConnectionEvent("connected", "Successfully connected to WhatsApp")
+
+      // Deliver anything queued while we were offline
+      if global_action_executor != nil {
+        go global_action_executor.FlushOutboundQueue()
+      }
       
       select {
       case wac.connected_channel <- true:
@@ -99,111 +178,179 @@ func (wac *WhatsAppClient) SetupEventHandlers() {
       }
 
     case *events.Disconnected:
-      // Disconnected from WhatsApp
+      // Disconnected from WhatsApp (websocket closed; whatsmeow will retry if auto-reconnect is on)
       global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Disconnected from WhatsApp", "")
       global_whatsapp_state.mu.Lock()
       global_whatsapp_state.connection_state = StateDisconnected
       global_whatsapp_state.last_disconnected = time.Now()
       global_whatsapp_state.mu.Unlock()
-      
-      global_database.LogConnectionEvent("disconnected", "Disconnected from WhatsApp")
+      wac.recordDisconnect("disconnected", "connection_lost", "Connection to WhatsApp was lost", false)
 
     case *events.LoggedOut:
       // Logged out
-      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Logged out from WhatsApp", fmt.Sprintf("Reason: %v", v.Reason))
+      reason, description := classifyLogout(v)
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Logged out from WhatsApp", description)
       global_whatsapp_state.mu.Lock()
       global_whatsapp_state.connection_state = StateDisconnected
+      global_whatsapp_state.last_disconnected = time.Now()
       global_whatsapp_state.phone_number = ""
       global_whatsapp_state.device_id = ""
       global_whatsapp_state.mu.Unlock()
-      
-      global_database.LogConnectionEvent("logged_out", fmt.Sprintf("Reason: %v", v.Reason))
+      global_whatsapp_state.ResetAppStateSync()
+      wac.recordDisconnect("logged_out", reason, description, true)
 
-    case *events.Message:
-      // Message received - store in database
-      msg := map[string]interface{}{
-        "message_id":  v.Info.ID,
-        "timestamp":   v.Info.Timestamp,
-        "from":        v.Info.Sender.String(),
-        "chat":        v.Info.Chat.String(),
-        "sender_name": v.Info.PushName,
-        "is_group":    v.Info.IsGroup,
-        "is_from_me":  v.Info.IsFromMe,
-        "message_type": "text", // Default, will be updated based on message content
+    case *events.TemporaryBan:
+      // Account temporarily banned - reconnecting won't help until the ban expires
+      global_error_state.LogError(ErrorSeverityCritical, "whatsapp_event", "Account temporarily banned", v.String())
+      wac.markDisconnected()
+      wac.recordDisconnect("temporary_ban", "temporary_ban", v.String(), true)
+
+    case *events.StreamReplaced:
+      // Another client connected with the same session; reconnecting would just kick it off again
+      global_error_state.LogError(ErrorSeverityError, "whatsapp_event", "Session replaced by another client", "")
+      wac.markDisconnected()
+      wac.recordDisconnect("stream_replaced", "stream_replaced", "Another client connected with the same session", true)
+
+    case *events.ClientOutdated:
+      global_error_state.LogError(ErrorSeverityCritical, "whatsapp_event", "WhatsApp rejected the client as outdated", "")
+      wac.markDisconnected()
+      wac.recordDisconnect("client_outdated", "client_outdated", "Client version is out of date - update whatsmeow", true)
+
+    case *events.ConnectFailure:
+      // Server errors (5xx) are transient; anything else needs attention, so it is raised as
+      // a critical error telling the AI what to do instead of letting it retry forever
+      terminal := v.Reason < 500
+      description := fmt.Sprintf("%s - %s", v.Reason.String(), explainConnectFailure(v.Reason))
+      if v.Message != "" {
+        description = fmt.Sprintf("%s (server message: %s)", description, v.Message)
+      }
+      severity := ErrorSeverityError
+      if terminal {
+        severity = ErrorSeverityCritical
       }
+      global_error_state.LogError(severity, "whatsapp_event", "Connection to WhatsApp failed", description)
+      wac.markDisconnected()
+      wac.recordDisconnect("connect_failure", fmt.Sprintf("connect_failure_%d", int(v.Reason)), description, terminal)
+
+    case *events.StreamError:
+      // whatsmeow handles the known codes itself (515 restart, 401 logout, conflicts) and
+      // reconnects after anything else
+      description := fmt.Sprintf("Stream error code %s - %s", v.Code, explainStreamError(v.Code))
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "WhatsApp stream error", description)
+      wac.recordDisconnect("stream_error", "stream_error_"+v.Code, description, false)
 
-      // Extract text content
-      if v.Message.Conversation != nil && *v.Message.Conversation != "" {
-        msg["text_content"] = *v.Message.Conversation
-        msg["message_type"] = "conversation"
-      } else if v.Message.ExtendedTextMessage != nil && v.Message.ExtendedTextMessage.Text != nil {
-        msg["text_content"] = *v.Message.ExtendedTextMessage.Text
-        msg["message_type"] = "extended_text"
-        if v.Message.ExtendedTextMessage.ContextInfo != nil && v.Message.ExtendedTextMessage.ContextInfo.StanzaID != nil {
-          msg["quoted_message_id"] = *v.Message.ExtendedTextMessage.ContextInfo.StanzaID
+    case *events.HistorySync:
+      // Only on-demand syncs (requested via request_chat_history) are imported
+      if v.Data.GetSyncType() == waHistorySync.HistorySync_ON_DEMAND {
+        imported := wac.importHistorySync(v)
+        global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "On-demand history sync received", fmt.Sprintf("Imported: %d", imported))
+        select {
+        case wac.history_sync_channel <- imported:
+        default:
         }
       }
 
-      // Check for media
-      if v.Message.ImageMessage != nil {
-        msg["message_type"] = "image"
-        msg["media_type"] = "image"
-        if v.Message.ImageMessage.Mimetype != nil {
-          msg["media_mime_type"] = *v.Message.ImageMessage.Mimetype
-        }
-        if v.Message.ImageMessage.FileLength != nil {
-          msg["media_size"] = *v.Message.ImageMessage.FileLength
-        }
-        if v.Message.ImageMessage.Caption != nil {
-          msg["text_content"] = *v.Message.ImageMessage.Caption
-        }
-      } else if v.Message.VideoMessage != nil {
-        msg["message_type"] = "video"
-        msg["media_type"] = "video"
-        if v.Message.VideoMessage.Mimetype != nil {
-          msg["media_mime_type"] = *v.Message.VideoMessage.Mimetype
-        }
-        if v.Message.VideoMessage.FileLength != nil {
-          msg["media_size"] = *v.Message.VideoMessage.FileLength
-        }
-        if v.Message.VideoMessage.Caption != nil {
-          msg["text_content"] = *v.Message.VideoMessage.Caption
-        }
-      } else if v.Message.DocumentMessage != nil {
-        msg["message_type"] = "document"
-        msg["media_type"] = "document"
-        if v.Message.DocumentMessage.Mimetype != nil {
-          msg["media_mime_type"] = *v.Message.DocumentMessage.Mimetype
-        }
-        if v.Message.DocumentMessage.FileLength != nil {
-          msg["media_size"] = *v.Message.DocumentMessage.FileLength
-        }
-      } else if v.Message.AudioMessage != nil {
-        msg["message_type"] = "audio"
-        msg["media_type"] = "audio"
-        if v.Message.AudioMessage.Mimetype != nil {
-          msg["media_mime_type"] = *v.Message.AudioMessage.Mimetype
+    case *events.AppStateSyncComplete:
+      // Full sync of one app-state type (contacts, chat settings, ...) finished
+      global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "App state sync complete", string(v.Name))
+      global_whatsapp_state.MarkAppStateSynced(v.Name, time.Now())
+
+    case *events.Contact:
+      // Contact added or renamed in the address book (app state sync)
+      names := map[string]string{
+        "full_name":  v.Action.GetFullName(),
+        "first_name": v.Action.GetFirstName(),
+      }
+      if err := global_database.SaveContact(v.JID.String(), names); err != nil {
+        global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save contact", err.Error())
+      }
+
+    case *events.PushName:
+      // A contact changed their profile name
+      for _, jid := range []types.JID{v.JID, v.JIDAlt} {
+        if jid.IsEmpty() {
+          continue
         }
-        if v.Message.AudioMessage.FileLength != nil {
-          msg["media_size"] = *v.Message.AudioMessage.FileLength
+        if err := global_database.SaveContact(jid.String(), map[string]string{"push_name": v.NewPushName}); err != nil {
+          global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save push name", err.Error())
         }
       }
 
-      // Store raw message for media downloads
-      msgBytes, _ := json.Marshal(v.Message)
-      msg["raw_message"] = string(msgBytes)
+    case *events.BusinessName:
+      if err := global_database.SaveContact(v.JID.String(), map[string]string{"business_name": v.NewBusinessName}); err != nil {
+        global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save business name", err.Error())
+      }
+
+    case *events.GroupInfo:
+      // Group membership or settings changed - store and dispatch each change
+      wac.handleGroupInfo(v)
+
+    case *events.Receipt:
+      wac.handleReceipt(v)
+
+    case *events.Message:
+      global_clock_skew.observe(v.Info.Timestamp)
+
+      // Deletions are recorded against the original message rather than stored as messages
+      if protocol := v.Message.GetProtocolMessage(); protocol != nil && protocol.GetType() == waE2E.ProtocolMessage_REVOKE {
+        wac.handleRevoke(v, protocol)
+        break
+      }
+
+      // Edits update the original message's text instead of being stored as new messages
+      if protocol := v.Message.GetProtocolMessage(); protocol != nil && protocol.GetType() == waE2E.ProtocolMessage_MESSAGE_EDIT {
+        wac.handleEdit(v, protocol)
+        break
+      }
+
+      // Poll votes are tallied against the poll rather than stored as messages
+      if update := v.Message.GetPollUpdateMessage(); update != nil {
+        wac.handlePollVote(v, update)
+        break
+      }
+
+      // Message received - store in database
+      msg := parseMessageEvent(v)
+      if v.Info.IsGroup {
+        msg["sender_name"] = wac.resolveSenderName(v.Info)
+      }
+
+      // Chats and senders excluded from storage are never written to the database
+      excluded := global_config.IsStorageExcluded(v.Info.Chat.String(), v.Info.Sender.String())
+
+      // Record reactions so they can be queried per message
+      if reaction := v.Message.ReactionMessage; reaction != nil && !excluded {
+        if err := global_database.SaveReaction(reaction.GetKey().GetID(), v.Info.Sender.String(), v.Info.Chat.String(), reaction.GetText(), v.Info.Timestamp); err != nil {
+          global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save reaction", err.Error())
+        }
+      }
 
       // Save to database
-      if err := global_database.SaveMessage(msg); err != nil {
+      if excluded {
+        global_excluded_messages.Add(1)
+      } else if err := global_database.SaveMessage(msg); err != nil {
         global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save message", err.Error())
       } else {
         global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Message received and stored", fmt.Sprintf("From: %s, Type: %s", v.Info.Sender, msg["message_type"]))
+
+        // Forward to the ingestion webhook if one is configured
+        go postMessageWebhook(msg)
+
+        // Save incoming media locally if auto_download_media is on
+        if !v.Info.IsFromMe {
+          go autoDownloadMedia(v)
+        }
       }
 
       // Execute handlers for this event (in background)
-      if global_action_executor != nil {
+      if global_action_executor != nil && !(excluded && global_config.GetStoreExcludeSkipHandlers()) {
+        // Contacts' status updates arrive as messages in status@broadcast
+        eventType := "message"
+        if v.Info.Chat == types.StatusBroadcastJID {
+          eventType = "status"
+        }
         eventData := map[string]interface{}{
-          "event_type":   "message",
+          "event_type":   eventType,
           "message_id":   msg["message_id"],
           "timestamp":    msg["timestamp"],
           "from":         msg["from"],
@@ -230,6 +377,24 @@ func (wac *WhatsAppClient) SetupEventHandlers() {
         if quotedID, ok := msg["quoted_message_id"]; ok {
           eventData["quoted_message_id"] = quotedID
         }
+        if linkPreview, ok := msg["link_preview"]; ok {
+          eventData["link_preview"] = linkPreview
+        }
+        if mentioned, ok := msg["mentioned_jids"]; ok {
+          eventData["mentioned_jids"] = mentioned
+        }
+        if content, ok := msg["content"]; ok {
+          eventData["content"] = content
+        }
+        if participantJID, ok := msg["participant_jid"]; ok {
+          eventData["participant_jid"] = participantJID
+        }
+        if isViewOnce, ok := msg["is_view_once"]; ok {
+          eventData["is_view_once"] = isViewOnce
+        }
+        if selectedID, ok := msg["selected_id"]; ok {
+          eventData["selected_id"] = selectedID
+        }
         if rawMsg, ok := msg["raw_message"]; ok {
           eventData["raw_message"] = rawMsg
         }
@@ -240,12 +405,874 @@ func (wac *WhatsAppClient) SetupEventHandlers() {
     }
   }
 
-  wac.event_handler_id = wac.client.AddEventHandler(handler)
+  wac.event_handler_id = wac.Client().AddEventHandler(handler)
+}
+
+// handleRevoke marks a message deleted by its sender as revoked and dispatches message_revoked
+func (wac *WhatsAppClient) handleRevoke(v *events.Message, protocol *waE2E.ProtocolMessage) {
+  targetID := protocol.GetKey().GetID()
+  if targetID == "" {
+    return
+  }
+
+  excluded := global_config.IsStorageExcluded(v.Info.Chat.String(), v.Info.Sender.String())
+  if !excluded {
+    found, err := global_database.MarkMessageRevoked(targetID, v.Info.Timestamp)
+    if err != nil {
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to mark message revoked", err.Error())
+    } else if found {
+      global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Message revoked", fmt.Sprintf("Chat: %s, Message: %s", v.Info.Chat, targetID))
+    }
+  }
+
+  if global_action_executor != nil && !(excluded && global_config.GetStoreExcludeSkipHandlers()) {
+    eventData := map[string]interface{}{
+      "event_type":        "message_revoked",
+      "message_id":        targetID,
+      "revoke_message_id": v.Info.ID,
+      "timestamp":         v.Info.Timestamp,
+      "revoked_at":        v.Info.Timestamp,
+      "from":              v.Info.Sender.String(),
+      "chat":              v.Info.Chat.String(),
+      "is_group":          v.Info.IsGroup,
+      "is_from_me":        v.Info.IsFromMe,
+    }
+
+    go global_action_executor.ExecuteHandlersForEvent(eventData)
+  }
+}
+
+// handleEdit updates the stored text and content of a message its sender edited and dispatches
+// message_edited with both the old and the new text
+func (wac *WhatsAppClient) handleEdit(v *events.Message, protocol *waE2E.ProtocolMessage) {
+  targetID := protocol.GetKey().GetID()
+  if targetID == "" {
+    return
+  }
+
+  newText := editedMessageText(protocol.GetEditedMessage())
+  newContent := parseMessageContent(protocol.GetEditedMessage())
+  editedAt := time.UnixMilli(protocol.GetTimestampMS())
+  if protocol.GetTimestampMS() == 0 {
+    editedAt = v.Info.Timestamp
+  }
+
+  var oldText interface{}
+  excluded := global_config.IsStorageExcluded(v.Info.Chat.String(), v.Info.Sender.String())
+  if !excluded {
+    previous, err := global_database.UpdateEditedMessage(targetID, newText, newContent, editedAt)
+    if err == nil {
+      oldText = previous
+      global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Message edited", fmt.Sprintf("Chat: %s, Message: %s", v.Info.Chat, targetID))
+    } else if err != sql.ErrNoRows {
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to update edited message", err.Error())
+    }
+  }
+
+  if global_action_executor != nil && !(excluded && global_config.GetStoreExcludeSkipHandlers()) {
+    eventData := map[string]interface{}{
+      "event_type":      "message_edited",
+      "message_id":      targetID,
+      "edit_message_id": v.Info.ID,
+      "timestamp":       v.Info.Timestamp,
+      "edited_at":       editedAt,
+      "from":            v.Info.Sender.String(),
+      "chat":            v.Info.Chat.String(),
+      "sender_name":     v.Info.PushName,
+      "is_group":        v.Info.IsGroup,
+      "is_from_me":      v.Info.IsFromMe,
+      "text_content":    newText,
+      "old_text":        oldText, // nil if the original message isn't stored
+    }
+    if v.Info.IsGroup {
+      eventData["sender_name"] = wac.resolveSenderName(v.Info)
+    }
+
+    go global_action_executor.ExecuteHandlersForEvent(eventData)
+  }
+}
+
+// editedMessageText returns the new text or caption of an edited message
+func editedMessageText(message *waE2E.Message) string {
+  switch {
+  case message.GetConversation() != "":
+    return message.GetConversation()
+  case message.GetExtendedTextMessage() != nil:
+    return message.GetExtendedTextMessage().GetText()
+  case message.GetImageMessage() != nil:
+    return message.GetImageMessage().GetCaption()
+  case message.GetVideoMessage() != nil:
+    return message.GetVideoMessage().GetCaption()
+  case message.GetDocumentMessage() != nil:
+    return message.GetDocumentMessage().GetCaption()
+  }
+  return ""
+}
+
+// markDisconnected updates the connection state after a connection failure event
+func (wac *WhatsAppClient) markDisconnected() {
+  global_whatsapp_state.mu.Lock()
+  global_whatsapp_state.connection_state = StateDisconnected
+  global_whatsapp_state.last_disconnected = time.Now()
+  global_whatsapp_state.mu.Unlock()
+}
+
+// recordDisconnect stores a classified disconnect in connection_log and the WhatsApp state.
+// Terminal disconnects switch off whatsmeow's auto-reconnect so it doesn't loop on a banned
+// or logged-out account.
+func (wac *WhatsAppClient) recordDisconnect(eventType string, reason string, description string, terminal bool) {
+  global_whatsapp_state.SetDisconnectReason(reason, description, terminal)
+
+  details := fmt.Sprintf("%s: %s (recoverable)", reason, description)
+  if terminal {
+    details = fmt.Sprintf("%s: %s (terminal)", reason, description)
+    wac.Client().EnableAutoReconnect = false
+  }
+  global_database.LogConnectionEvent(eventType, details)
+}
+
+// explainConnectFailure says what a connect failure code means for the operator. Logout,
+// temporary ban and client outdated arrive as their own events and aren't listed.
+func explainConnectFailure(reason events.ConnectFailureReason) string {
+  switch reason {
+  case events.ConnectFailureGeneric:
+    return "WhatsApp refused the connection without a specific reason; check the account on the phone before retrying"
+  case events.ConnectFailureBadUserAgent:
+    return "WhatsApp rejected the client's user agent; update the tool (whatsmeow) rather than retrying"
+  case events.ConnectFailureCATExpired, events.ConnectFailureCATInvalid:
+    return "the crypto auth token is no longer valid; relink the device"
+  case events.ConnectFailureNotFound:
+    return "WhatsApp doesn't recognise this device; relink the device"
+  case events.ConnectFailureClientUnknown:
+    return "WhatsApp doesn't recognise this client; update the tool (whatsmeow) or relink"
+  case events.ConnectFailureInternalServerError, events.ConnectFailureExperimental, events.ConnectFailureServiceUnavailable:
+    return "WhatsApp server problem; reconnection will be retried automatically"
+  default:
+    if reason >= 500 {
+      return "WhatsApp server problem; reconnection will be retried automatically"
+    }
+    return "unrecognised failure code; check the account on the phone and relink if it persists"
+  }
+}
+
+// explainStreamError says what an unhandled stream error code means for the operator
+func explainStreamError(code string) string {
+  switch code {
+  case "500", "503":
+    return "WhatsApp server problem; reconnecting automatically"
+  case "":
+    return "the server closed the stream without a code; reconnecting automatically"
+  default:
+    return "unrecognised stream error; reconnecting automatically, check get_connection_log if it repeats"
+  }
+}
+
+// classifyLogout maps a LoggedOut event to a reason code and description
+func classifyLogout(v *events.LoggedOut) (string, string) {
+  if !v.OnConnect {
+    return "logged_out", "Device was logged out (removed from linked devices)"
+  }
+
+  switch v.Reason {
+  case events.ConnectFailureLoggedOut:
+    return "logged_out", "Logged out from another device"
+  case events.ConnectFailureMainDeviceGone:
+    return "main_device_gone", "Primary phone was logged out, switched or the account is locked"
+  case events.ConnectFailureUnknownLogout:
+    return "banned", "Logged out by WhatsApp - the account may be banned"
+  default:
+    return "logged_out", v.Reason.String()
+  }
+}
+
+// handleGroupInfo records each change in a group info event and dispatches it as a group_update event
+func (wac *WhatsAppClient) handleGroupInfo(v *events.GroupInfo) {
+  actor := ""
+  if v.Sender != nil {
+    actor = v.Sender.String()
+  }
+  own := wac.GetJID()
+
+  for _, change := range parseGroupInfoEvent(v) {
+    action := change["action"].(string)
+    participants := change["participants"].([]string)
+    details, _ := change["details"].(string)
+
+    if err := global_database.SaveGroupEvent(v.JID.String(), v.Timestamp, actor, action, participants, details); err != nil {
+      global_error_state.LogError(ErrorSeverityWarning, "whatsapp_event", "Failed to save group event", err.Error())
+    } else {
+      global_error_state.LogError(ErrorSeverityInfo, "whatsapp_event", "Group update received", fmt.Sprintf("Group: %s, Action: %s", v.JID, action))
+    }
+
+    if global_action_executor != nil {
+      eventData := map[string]interface{}{
+        "event_type":   "group_update",
+        "message_id":   fmt.Sprintf("%s:%s:%d", v.JID.String(), action, v.Timestamp.UnixNano()),
+        "timestamp":    v.Timestamp,
+        "from":         actor,
+        "chat":         v.JID.String(),
+        "is_group":     true,
+        "is_from_me":   v.Sender != nil && !own.IsEmpty() && v.Sender.User == own.User,
+        "action":       action,
+        "participants": participants,
+      }
+      if details != "" {
+        eventData["details"] = details
+      }
+      if v.JoinReason != "" {
+        eventData["join_reason"] = v.JoinReason
+      }
+
+      go global_action_executor.ExecuteHandlersForEvent(eventData)
+    }
+  }
+}
+
+// parseGroupInfoEvent splits a group info event into individual changes (join, leave, subject, ...)
+func parseGroupInfoEvent(v *events.GroupInfo) []map[string]interface{} {
+  var changes []map[string]interface{}
+  addChange := func(action string, jids []types.JID, details string) {
+    participants := make([]string, 0, len(jids))
+    for _, jid := range jids {
+      participants = append(participants, jid.String())
+    }
+    changes = append(changes, map[string]interface{}{
+      "action":       action,
+      "participants": participants,
+      "details":      details,
+    })
+  }
+
+  if len(v.Join) > 0 {
+    addChange("join", v.Join, "")
+  }
+  if len(v.Leave) > 0 {
+    addChange("leave", v.Leave, "")
+  }
+  if len(v.Promote) > 0 {
+    addChange("promote", v.Promote, "")
+  }
+  if len(v.Demote) > 0 {
+    addChange("demote", v.Demote, "")
+  }
+  if v.Name != nil {
+    addChange("subject", nil, v.Name.Name)
+  }
+  if v.Topic != nil {
+    addChange("description", nil, v.Topic.Topic)
+  }
+  if v.Announce != nil {
+    addChange("announce", nil, fmt.Sprintf("%t", v.Announce.IsAnnounce))
+  }
+  if v.Locked != nil {
+    addChange("locked", nil, fmt.Sprintf("%t", v.Locked.IsLocked))
+  }
+  if v.Ephemeral != nil {
+    addChange("ephemeral", nil, formatDisappearingTimer(time.Duration(v.Ephemeral.DisappearingTimer)*time.Second))
+  }
+  if v.Delete != nil {
+    addChange("delete", nil, v.Delete.DeleteReason)
+  }
+  if v.NewInviteLink != nil {
+    addChange("invite_link", nil, *v.NewInviteLink)
+  }
+
+  return changes
+}
+
+// resolveSenderName finds a display name for a group participant. PushName may be stale or
+// missing for people we haven't chatted with, so the contact store is checked first
+// (including the participant's alternate LID/phone address), falling back to the phone number.
+func (wac *WhatsAppClient) resolveSenderName(info types.MessageInfo) string {
+  ctx := context.Background()
+  candidates := []types.JID{info.Sender.ToNonAD()}
+  if !info.SenderAlt.IsEmpty() {
+    candidates = append(candidates, info.SenderAlt.ToNonAD())
+  }
+
+  for _, jid := range candidates {
+    contact, err := wac.Client().Store.Contacts.GetContact(ctx, jid)
+    if err != nil || !contact.Found {
+      continue
+    }
+    if contact.FullName != "" {
+      return contact.FullName
+    }
+    if info.PushName == "" && contact.PushName != "" {
+      return contact.PushName
+    }
+    if info.PushName == "" && contact.BusinessName != "" {
+      return contact.BusinessName
+    }
+  }
+
+  if info.PushName != "" {
+    return info.PushName
+  }
+
+  // Names captured from contact sync events
+  for _, jid := range candidates {
+    if contact, err := global_database.GetContact(jid.String()); err == nil {
+      for _, field := range []string{"full_name", "push_name", "business_name"} {
+        if name, ok := contact[field].(string); ok && name != "" {
+          return name
+        }
+      }
+    }
+  }
+
+  // Fall back to the phone number
+  for _, jid := range candidates {
+    if jid.Server == types.DefaultUserServer {
+      return "+" + jid.User
+    }
+  }
+  if pn, err := wac.Client().Store.LIDs.GetPNForLID(ctx, info.Sender.ToNonAD()); err == nil && !pn.IsEmpty() {
+    return "+" + pn.User
+  }
+  return info.Sender.User
+}
+
+// storeSentMessage records a message this client sent in the messages table, so the local
+// history includes our own side of the conversation. Edits and revokes aren't stored as rows.
+func (wac *WhatsAppClient) storeSentMessage(to types.JID, message *waE2E.Message, resp whatsmeow.SendResponse) {
+  // The send receipt carries the server time, which also feeds the clock skew estimate
+  global_clock_skew.observe(resp.Timestamp)
+
+  // Reactions are stored against the message they react to, not as messages of their own
+  if reaction := message.GetReactionMessage(); reaction != nil {
+    own := wac.GetJID().ToNonAD()
+    if own.IsEmpty() || global_config.IsStorageExcluded(to.String(), own.String()) {
+      return
+    }
+    if err := global_database.SaveReaction(reaction.GetKey().GetID(), own.String(), to.String(), reaction.GetText(), resp.Timestamp); err != nil {
+      global_error_state.LogError(ErrorSeverityWarning, "send_message", "Failed to save sent reaction", err.Error())
+    }
+    return
+  }
+
+  msg := wac.outgoingMessage(to, message, resp.ID, resp.Timestamp)
+  if msg == nil {
+    return
+  }
+
+  if err := global_database.SaveMessage(msg); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "send_message", "Failed to save sent message", err.Error())
+  }
+  // A message stored as pending before the send keeps that status through SaveMessage
+  wac.advanceMessageStatus([]string{resp.ID}, MessageStatusSent)
+
+  // A receipt can arrive before the send returns and the message is saved
+  if status, ok := wac.takeEarlyReceipt(resp.ID); ok {
+    wac.advanceMessageStatus([]string{resp.ID}, status)
+  }
+}
+
+// storePendingMessage records a message about to be sent with status pending, so a send that
+// never completes is still visible. storeSentMessage replaces it once the server accepts it.
+func (wac *WhatsAppClient) storePendingMessage(to types.JID, message *waE2E.Message, id types.MessageID) {
+  if !global_config.GetTrackMessageStatus() {
+    return
+  }
+  msg := wac.outgoingMessage(to, message, id, time.Now())
+  if msg == nil {
+    return
+  }
+  msg["status"] = MessageStatusPending
+  if err := global_database.SaveMessage(msg); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "send_message", "Failed to save pending message", err.Error())
+  }
+}
+
+// outgoingMessage builds the stored form of a message we send, or returns nil if it isn't
+// stored (edits, revokes, reactions, poll votes, excluded chats, or not logged in)
+func (wac *WhatsAppClient) outgoingMessage(to types.JID, message *waE2E.Message, id types.MessageID, timestamp time.Time) map[string]interface{} {
+  if message.GetProtocolMessage() != nil || message.GetEditedMessage() != nil || message.GetReactionMessage() != nil || message.GetPollUpdateMessage() != nil {
+    return nil
+  }
+  ownJID := wac.GetJID()
+  if ownJID.IsEmpty() {
+    return nil
+  }
+
+  own := ownJID.ToNonAD()
+  if global_config.IsStorageExcluded(to.String(), own.String()) {
+    return nil
+  }
+
+  return parseMessageEvent(&events.Message{
+    Info: types.MessageInfo{
+      MessageSource: types.MessageSource{
+        Chat:     to,
+        Sender:   own,
+        IsFromMe: true,
+        IsGroup:  to.Server == types.GroupServer,
+      },
+      ID:        id,
+      PushName:  wac.Client().Store.PushName,
+      Timestamp: timestamp,
+    },
+    Message: message,
+  })
+}
+
+// handleReceipt moves our sent messages through delivered, read and played as recipients'
+// receipts arrive. In groups the first recipient's receipt advances the status.
+func (wac *WhatsAppClient) handleReceipt(v *events.Receipt) {
+  if v.IsFromMe {
+    return // our other devices reporting on messages we received
+  }
+
+  switch v.Type {
+  case types.ReceiptTypeDelivered:
+    wac.advanceMessageStatus(v.MessageIDs, MessageStatusDelivered)
+  case types.ReceiptTypeRead:
+    wac.advanceMessageStatus(v.MessageIDs, MessageStatusRead)
+  case types.ReceiptTypePlayed:
+    wac.advanceMessageStatus(v.MessageIDs, MessageStatusPlayed)
+  }
+}
+
+// advanceMessageStatus records a delivery status for sent messages when track_message_status is on
+func (wac *WhatsAppClient) advanceMessageStatus(messageIDs []types.MessageID, status string) {
+  if !global_config.GetTrackMessageStatus() {
+    return
+  }
+  updated, err := global_database.AdvanceMessageStatus(messageIDs, status)
+  if err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "message_status", fmt.Sprintf("Failed to mark messages %s", status), err.Error())
+    return
+  }
+  // Some messages may not be stored yet; keep recipients' receipts for storeSentMessage
+  if int(updated) < len(messageIDs) && slices.Index(messageStatusOrder, status) > slices.Index(messageStatusOrder, MessageStatusSent) {
+    wac.holdEarlyReceipt(messageIDs, status)
+  }
+}
+
+// holdEarlyReceipt remembers a receipt status for messages that may not be stored yet,
+// keeping the most advanced status per message and dropping ones older than earlyReceiptTTL
+func (wac *WhatsAppClient) holdEarlyReceipt(messageIDs []types.MessageID, status string) {
+  wac.receipts_mu.Lock()
+  defer wac.receipts_mu.Unlock()
+
+  now := time.Now()
+  if wac.early_receipts == nil {
+    wac.early_receipts = make(map[types.MessageID]earlyReceipt)
+  }
+  for id, receipt := range wac.early_receipts {
+    if now.Sub(receipt.receivedAt) > earlyReceiptTTL {
+      delete(wac.early_receipts, id)
+    }
+  }
+  for _, id := range messageIDs {
+    if held, ok := wac.early_receipts[id]; ok && slices.Index(messageStatusOrder, held.status) >= slices.Index(messageStatusOrder, status) {
+      continue
+    }
+    wac.early_receipts[id] = earlyReceipt{status: status, receivedAt: now}
+  }
+}
+
+// takeEarlyReceipt returns and forgets the receipt status held for a message, if any
+func (wac *WhatsAppClient) takeEarlyReceipt(id types.MessageID) (string, bool) {
+  wac.receipts_mu.Lock()
+  defer wac.receipts_mu.Unlock()
+
+  receipt, ok := wac.early_receipts[id]
+  if !ok || time.Since(receipt.receivedAt) > earlyReceiptTTL {
+    return "", false
+  }
+  delete(wac.early_receipts, id)
+  return receipt.status, true
+}
+
+// parseMessageEvent converts a whatsmeow message event into the map stored in the messages table
+func parseMessageEvent(v *events.Message) map[string]interface{} {
+  msg := map[string]interface{}{
+    "message_id":  v.Info.ID,
+    "timestamp":   v.Info.Timestamp,
+    "from":        v.Info.Sender.String(),
+    "chat":        v.Info.Chat.String(),
+    "sender_name": v.Info.PushName,
+    "is_group":    v.Info.IsGroup,
+    "is_from_me":  v.Info.IsFromMe,
+    "message_type": "text", // Default, will be updated based on message content
+  }
+
+  // Our own messages, including those sent from the phone, have at least reached the server
+  if v.Info.IsFromMe && global_config.GetTrackMessageStatus() {
+    msg["status"] = MessageStatusSent
+  }
+
+  // View-once media can only be downloaded once, so handlers need to know up front
+  if v.IsViewOnce {
+    msg["is_view_once"] = true
+  }
+
+  // In groups the chat is the group, so keep the participant who sent it separately
+  if v.Info.IsGroup {
+    msg["participant_jid"] = v.Info.Sender.String()
+  }
+
+  // Extract text content
+  if v.Message.Conversation != nil && *v.Message.Conversation != "" {
+    msg["text_content"] = *v.Message.Conversation
+    msg["message_type"] = "conversation"
+  } else if v.Message.ExtendedTextMessage != nil && v.Message.ExtendedTextMessage.Text != nil {
+    msg["text_content"] = *v.Message.ExtendedTextMessage.Text
+    msg["message_type"] = "extended_text"
+    if v.Message.ExtendedTextMessage.ContextInfo != nil && v.Message.ExtendedTextMessage.ContextInfo.StanzaID != nil {
+      msg["quoted_message_id"] = *v.Message.ExtendedTextMessage.ContextInfo.StanzaID
+    }
+    if preview := parseLinkPreview(v.Message.ExtendedTextMessage); preview != nil {
+      msg["link_preview"] = preview
+    }
+  }
+
+  // Users @-mentioned in the text or caption
+  if mentioned := messageContextInfo(v.Message).GetMentionedJID(); len(mentioned) > 0 {
+    msg["mentioned_jids"] = mentioned
+  }
+
+  // Reactions reference the message they react to
+  if v.Message.ReactionMessage != nil {
+    msg["message_type"] = "reaction"
+    msg["text_content"] = v.Message.ReactionMessage.GetText()
+    msg["quoted_message_id"] = v.Message.ReactionMessage.GetKey().GetID()
+  }
+
+  // Check for media
+  if v.Message.ImageMessage != nil {
+    msg["message_type"] = "image"
+    msg["media_type"] = "image"
+    if v.Message.ImageMessage.Mimetype != nil {
+      msg["media_mime_type"] = *v.Message.ImageMessage.Mimetype
+    }
+    if v.Message.ImageMessage.FileLength != nil {
+      msg["media_size"] = *v.Message.ImageMessage.FileLength
+    }
+    if v.Message.ImageMessage.Caption != nil {
+      msg["text_content"] = *v.Message.ImageMessage.Caption
+    }
+  } else if v.Message.VideoMessage != nil {
+    msg["message_type"] = "video"
+    msg["media_type"] = "video"
+    if v.Message.VideoMessage.Mimetype != nil {
+      msg["media_mime_type"] = *v.Message.VideoMessage.Mimetype
+    }
+    if v.Message.VideoMessage.FileLength != nil {
+      msg["media_size"] = *v.Message.VideoMessage.FileLength
+    }
+    if v.Message.VideoMessage.Caption != nil {
+      msg["text_content"] = *v.Message.VideoMessage.Caption
+    }
+  } else if v.Message.DocumentMessage != nil {
+    msg["message_type"] = "document"
+    msg["media_type"] = "document"
+    if v.Message.DocumentMessage.Mimetype != nil {
+      msg["media_mime_type"] = *v.Message.DocumentMessage.Mimetype
+    }
+    if v.Message.DocumentMessage.FileLength != nil {
+      msg["media_size"] = *v.Message.DocumentMessage.FileLength
+    }
+  } else if v.Message.AudioMessage != nil {
+    msg["message_type"] = "audio"
+    msg["media_type"] = "audio"
+    if v.Message.AudioMessage.Mimetype != nil {
+      msg["media_mime_type"] = *v.Message.AudioMessage.Mimetype
+    }
+    if v.Message.AudioMessage.FileLength != nil {
+      msg["media_size"] = *v.Message.AudioMessage.FileLength
+    }
+  } else if v.Message.StickerMessage != nil {
+    msg["message_type"] = "sticker"
+    msg["media_type"] = "sticker"
+    msg["media_mime_type"] = v.Message.StickerMessage.GetMimetype()
+    msg["media_size"] = v.Message.StickerMessage.GetFileLength()
+  } else if v.Message.LocationMessage != nil {
+    msg["message_type"] = "location"
+    msg["text_content"] = strings.TrimSpace(v.Message.LocationMessage.GetName() + " " + v.Message.LocationMessage.GetAddress())
+  } else if v.Message.LiveLocationMessage != nil {
+    msg["message_type"] = "live_location"
+    msg["text_content"] = v.Message.LiveLocationMessage.GetCaption()
+  } else if v.Message.ContactMessage != nil {
+    msg["message_type"] = "contact"
+    msg["text_content"] = v.Message.ContactMessage.GetDisplayName()
+  } else if poll := pollCreation(v.Message); poll != nil {
+    msg["message_type"] = "poll"
+    msg["text_content"] = poll.GetName()
+  } else if selectedID, text, ok := interactiveReply(v.Message); ok {
+    // A tap on a button or list row; the option's ID is what handlers branch on
+    msg["message_type"] = "button_reply"
+    if v.Message.ListResponseMessage != nil {
+      msg["message_type"] = "list_reply"
+    }
+    msg["selected_id"] = selectedID
+    msg["text_content"] = text
+    if stanzaID := messageContextInfo(v.Message).GetStanzaID(); stanzaID != "" {
+      msg["quoted_message_id"] = stanzaID
+    }
+  }
+
+  // Structured, type-specific payload; text_content stays the plain-text projection
+  if content := parseMessageContent(v.Message); content != nil {
+    msg["content"] = content
+  }
+
+  // Store raw message for media downloads
+  msgBytes, _ := json.Marshal(v.Message)
+  msg["raw_message"] = string(msgBytes)
+
+  return msg
+}
+
+// parseMessageContent builds the structured content of a message, keyed by what the
+// field means for its type (body, caption, coordinates, ...), or nil for unsupported types
+func parseMessageContent(message *waE2E.Message) map[string]interface{} {
+  switch {
+  case message.Conversation != nil:
+    return map[string]interface{}{"body": message.GetConversation()}
+  case message.ExtendedTextMessage != nil:
+    ext := message.GetExtendedTextMessage()
+    content := map[string]interface{}{"body": ext.GetText()}
+    if ext.GetMatchedText() != "" {
+      content["url"] = ext.GetMatchedText()
+    }
+    return content
+  case message.ReactionMessage != nil:
+    return map[string]interface{}{
+      "emoji":             message.GetReactionMessage().GetText(),
+      "target_message_id": message.GetReactionMessage().GetKey().GetID(),
+    }
+  case message.ImageMessage != nil:
+    img := message.GetImageMessage()
+    return map[string]interface{}{
+      "caption":  img.GetCaption(),
+      "mimetype": img.GetMimetype(),
+      "width":    img.GetWidth(),
+      "height":   img.GetHeight(),
+    }
+  case message.VideoMessage != nil:
+    video := message.GetVideoMessage()
+    return map[string]interface{}{
+      "caption":  video.GetCaption(),
+      "mimetype": video.GetMimetype(),
+      "width":    video.GetWidth(),
+      "height":   video.GetHeight(),
+      "seconds":  video.GetSeconds(),
+      "gif":      video.GetGifPlayback(),
+    }
+  case message.DocumentMessage != nil:
+    doc := message.GetDocumentMessage()
+    return map[string]interface{}{
+      "file_name":  doc.GetFileName(),
+      "title":      doc.GetTitle(),
+      "caption":    doc.GetCaption(),
+      "mimetype":   doc.GetMimetype(),
+      "page_count": doc.GetPageCount(),
+    }
+  case message.AudioMessage != nil:
+    audio := message.GetAudioMessage()
+    return map[string]interface{}{
+      "mimetype":   audio.GetMimetype(),
+      "seconds":    audio.GetSeconds(),
+      "voice_note": audio.GetPTT(),
+    }
+  case message.StickerMessage != nil:
+    sticker := message.GetStickerMessage()
+    return map[string]interface{}{
+      "mimetype": sticker.GetMimetype(),
+      "animated": sticker.GetIsAnimated(),
+    }
+  case message.LocationMessage != nil:
+    loc := message.GetLocationMessage()
+    return map[string]interface{}{
+      "latitude":  loc.GetDegreesLatitude(),
+      "longitude": loc.GetDegreesLongitude(),
+      "name":      loc.GetName(),
+      "address":   loc.GetAddress(),
+      "url":       loc.GetURL(),
+    }
+  case message.LiveLocationMessage != nil:
+    loc := message.GetLiveLocationMessage()
+    return map[string]interface{}{
+      "latitude":  loc.GetDegreesLatitude(),
+      "longitude": loc.GetDegreesLongitude(),
+      "caption":   loc.GetCaption(),
+      "live":      true,
+    }
+  case message.ContactMessage != nil:
+    return map[string]interface{}{
+      "display_name": message.GetContactMessage().GetDisplayName(),
+      "vcard":        message.GetContactMessage().GetVcard(),
+    }
+  case pollCreation(message) != nil:
+    return pollContent(pollCreation(message))
+  case message.ButtonsResponseMessage != nil:
+    reply := message.GetButtonsResponseMessage()
+    return map[string]interface{}{
+      "selected_id":  reply.GetSelectedButtonID(),
+      "display_text": reply.GetSelectedDisplayText(),
+    }
+  case message.TemplateButtonReplyMessage != nil:
+    reply := message.GetTemplateButtonReplyMessage()
+    return map[string]interface{}{
+      "selected_id":  reply.GetSelectedID(),
+      "display_text": reply.GetSelectedDisplayText(),
+      "index":        reply.GetSelectedIndex(),
+    }
+  case message.ListResponseMessage != nil:
+    reply := message.GetListResponseMessage()
+    return map[string]interface{}{
+      "selected_id":  reply.GetSingleSelectReply().GetSelectedRowID(),
+      "title":        reply.GetTitle(),
+      "description":  reply.GetDescription(),
+    }
+  }
+  return nil
+}
+
+// interactiveReply returns the chosen option's ID and text when a message is a reply to a
+// buttons, template buttons or list message
+func interactiveReply(message *waE2E.Message) (string, string, bool) {
+  switch {
+  case message.GetButtonsResponseMessage() != nil:
+    reply := message.GetButtonsResponseMessage()
+    return reply.GetSelectedButtonID(), reply.GetSelectedDisplayText(), true
+  case message.GetTemplateButtonReplyMessage() != nil:
+    reply := message.GetTemplateButtonReplyMessage()
+    return reply.GetSelectedID(), reply.GetSelectedDisplayText(), true
+  case message.GetListResponseMessage() != nil:
+    reply := message.GetListResponseMessage()
+    return reply.GetSingleSelectReply().GetSelectedRowID(), reply.GetTitle(), true
+  }
+  return "", "", false
+}
+
+// messageContextInfo returns the ContextInfo of whichever content type a message carries, or nil
+func messageContextInfo(message *waE2E.Message) *waE2E.ContextInfo {
+  switch {
+  case message.GetExtendedTextMessage() != nil:
+    return message.GetExtendedTextMessage().GetContextInfo()
+  case message.GetImageMessage() != nil:
+    return message.GetImageMessage().GetContextInfo()
+  case message.GetVideoMessage() != nil:
+    return message.GetVideoMessage().GetContextInfo()
+  case message.GetDocumentMessage() != nil:
+    return message.GetDocumentMessage().GetContextInfo()
+  case message.GetAudioMessage() != nil:
+    return message.GetAudioMessage().GetContextInfo()
+  case message.GetStickerMessage() != nil:
+    return message.GetStickerMessage().GetContextInfo()
+  case message.GetButtonsResponseMessage() != nil:
+    return message.GetButtonsResponseMessage().GetContextInfo()
+  case message.GetTemplateButtonReplyMessage() != nil:
+    return message.GetTemplateButtonReplyMessage().GetContextInfo()
+  case message.GetListResponseMessage() != nil:
+    return message.GetListResponseMessage().GetContextInfo()
+  }
+  return nil
+}
+
+// importHistorySync stores the messages from a history sync blob and returns how many were saved
+func (wac *WhatsAppClient) importHistorySync(evt *events.HistorySync) int {
+  imported := 0
+  for _, conv := range evt.Data.GetConversations() {
+    chatJID, err := types.ParseJID(conv.GetID())
+    if err != nil {
+      continue
+    }
+
+    for _, historyMsg := range conv.GetMessages() {
+      parsed, err := wac.Client().ParseWebMessage(chatJID, historyMsg.GetMessage())
+      if err != nil {
+        continue
+      }
+
+      msg := parseMessageEvent(parsed)
+      if parsed.Info.IsGroup {
+        msg["sender_name"] = wac.resolveSenderName(parsed.Info)
+      }
+
+      if err := global_database.SaveMessage(msg); err == nil {
+        imported++
+      }
+    }
+  }
+  return imported
+}
+
+// RequestChatHistory asks the phone for count messages before the anchor message and
+// waits for the resulting on-demand history sync. Returns how many messages were imported.
+// progress, if set, is told when the request is sent and periodically while waiting.
+func (wac *WhatsAppClient) RequestChatHistory(ctx context.Context, anchor *types.MessageInfo, count int, timeout time.Duration, progress ProgressFunc) (int, error) {
+  if progress == nil {
+    progress = func(int, int, string) {}
+  }
+
+  client := wac.Client()
+  if client.Store.ID == nil {
+    return 0, fmt.Errorf("not logged in")
+  }
+
+  // Drain any stale result from a previous request
+  select {
+  case <-wac.history_sync_channel:
+  default:
+  }
+
+  request := client.BuildHistorySyncRequest(anchor, count)
+  _, err := client.SendMessage(ctx, client.Store.ID.ToNonAD(), request, whatsmeow.SendRequestExtra{Peer: true})
+  if err != nil {
+    return 0, fmt.Errorf("failed to send history sync request: %w", err)
+  }
+  progress(0, count, fmt.Sprintf("Requested %d messages from phone", count))
+
+  ticker := time.NewTicker(5 * time.Second)
+  defer ticker.Stop()
+  deadline := time.After(timeout)
+  started := time.Now()
+
+  for {
+    select {
+    case imported := <-wac.history_sync_channel:
+      progress(imported, count, fmt.Sprintf("Imported %d messages", imported))
+      return imported, nil
+    case <-ticker.C:
+      progress(0, count, fmt.Sprintf("Waiting for phone history (%ds elapsed)", int(time.Since(started).Seconds())))
+    case <-ctx.Done():
+      return 0, ctx.Err()
+    case <-deadline:
+      return 0, fmt.Errorf("timeout waiting for history from phone")
+    }
+  }
+}
+
+// parseLinkPreview extracts the link preview from an extended text message, or nil if there isn't one
+func parseLinkPreview(ext *waE2E.ExtendedTextMessage) map[string]interface{} {
+  if ext.GetMatchedText() == "" {
+    return nil
+  }
+
+  preview := map[string]interface{}{
+    "matched_text": ext.GetMatchedText(),
+    "url":          ext.GetMatchedText(),
+  }
+  if ext.Title != nil {
+    preview["title"] = ext.GetTitle()
+  }
+  if ext.Description != nil {
+    preview["description"] = ext.GetDescription()
+  }
+  if ext.PreviewType != nil {
+    preview["preview_type"] = ext.GetPreviewType().String()
+  }
+  return preview
 }
 
 // Connect connects to WhatsApp (auto-login if session exists)
 func (wac *WhatsAppClient) Connect() error {
-  if wac.client.Store.ID == nil {
+  client := wac.Client()
+  if client.Store.ID == nil {
     // No session, need to pair
     global_error_state.LogError(ErrorSeverityInfo, "whatsapp_connect", "No session found, pairing required", "")
     return fmt.Errorf("no session found, call get_qr_code to pair")
@@ -257,7 +1284,7 @@ func (wac *WhatsAppClient) Connect() error {
   global_whatsapp_state.connection_state = StateConnecting
   global_whatsapp_state.mu.Unlock()
 
-  err := wac.client.Connect()
+  err := client.Connect()
   if err != nil {
     global_error_state.LogError(ErrorSeverityError, "whatsapp_connect", "Failed to connect", err.Error())
     global_whatsapp_state.mu.Lock()
@@ -269,65 +1296,150 @@ func (wac *WhatsAppClient) Connect() error {
   return nil
 }
 
-// GetQRCode initiates pairing and returns QR code as base64 PNG
-func (wac *WhatsAppClient) GetQRCode(timeout int) (string, string, error) {
-  if wac.client.Store.ID != nil {
+// GetQRCode initiates pairing and returns QR code as base64 PNG.
+// If onRefresh is set, the QR channel keeps being watched after the first code and
+// onRefresh is called with each rotated code until pairing succeeds or the timeout passes.
+func (wac *WhatsAppClient) GetQRCode(timeout int, onRefresh func(qrText string, qrBase64 string)) (string, string, error) {
+  client := wac.Client()
+  if client.Store.ID != nil {
     return "", "", fmt.Errorf("already logged in")
   }
 
   // Start connection to get QR code
+  global_whatsapp_state.BeginPairingAttempt()
   global_whatsapp_state.mu.Lock()
   global_whatsapp_state.connection_state = StateConnecting
   global_whatsapp_state.mu.Unlock()
 
-  qrChan, err := wac.client.GetQRChannel(context.Background())
+  qrChan, err := client.GetQRChannel(context.Background())
   if err != nil {
     global_error_state.LogError(ErrorSeverityCritical, "get_qr_code", "Failed to get QR channel", err.Error())
+    recordPairingOutcome(PairingOutcomeError, err.Error())
     return "", "", err
   }
 
-  err = wac.client.Connect()
+  err = client.Connect()
   if err != nil {
     global_error_state.LogError(ErrorSeverityCritical, "get_qr_code", "Failed to connect for QR", err.Error())
+    recordPairingOutcome(PairingOutcomeError, err.Error())
     return "", "", err
   }
 
   // Wait for QR code with timeout
   timeoutDuration := time.Duration(timeout) * time.Second
+  deadline := time.Now().Add(timeoutDuration)
   select {
   case evt := <-qrChan:
     if evt.Event == "code" {
-      // Generate QR code image
       qrCode := evt.Code
-      
-      // Generate PNG image from QR code
-      img, err := generateQRCodeImage(qrCode)
+      base64Image, err := renderQRCodePNG(qrCode)
       if err != nil {
-        global_error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to generate QR image", err.Error())
-        return qrCode, "", err
-      }
-
-      // Convert to base64
-      var buf bytes.Buffer
-      if err := png.Encode(&buf, img); err != nil {
-        global_error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to encode QR image", err.Error())
+        recordPairingOutcome(PairingOutcomeError, err.Error())
         return qrCode, "", err
       }
 
-      base64Image := base64.StdEncoding.EncodeToString(buf.Bytes())
-      
       global_error_state.LogError(ErrorSeverityInfo, "get_qr_code", "QR code generated successfully", "")
-      
+      global_whatsapp_state.SetPairingState(PairingWaitingForScan, "")
+
+      // Always follow the channel, so the attempt's outcome is recorded even without refreshing
+      go wac.watchQRRotation(qrChan, deadline, onRefresh)
+
       return qrCode, base64Image, nil
     }
+    recordPairingOutcome(PairingOutcomeError, evt.Event)
   case <-time.After(timeoutDuration):
     global_error_state.LogError(ErrorSeverityError, "get_qr_code", "Timeout waiting for QR code", "")
+    global_whatsapp_state.SetPairingState(PairingFailed, "timeout waiting for QR code")
+    recordPairingOutcome(PairingOutcomeTimeout, "timeout waiting for QR code")
     return "", "", fmt.Errorf("timeout waiting for QR code")
   }
 
   return "", "", fmt.Errorf("failed to get QR code")
 }
 
+// watchQRRotation follows the QR channel after the first code until pairing finishes or
+// the channel closes, recording the outcome. Until the deadline passes, each new code is
+// passed to onRefresh (if set).
+func (wac *WhatsAppClient) watchQRRotation(qrChan <-chan whatsmeow.QRChannelItem, deadline time.Time, onRefresh func(string, string)) {
+  timer := time.NewTimer(time.Until(deadline))
+  defer timer.Stop()
+
+  for {
+    select {
+    case evt, ok := <-qrChan:
+      if !ok {
+        return
+      }
+
+      switch evt.Event {
+      case "code":
+        if onRefresh == nil {
+          continue
+        }
+        base64Image, err := renderQRCodePNG(evt.Code)
+        if err != nil {
+          continue
+        }
+        global_error_state.LogError(ErrorSeverityInfo, "get_qr_code", "QR code rotated", "")
+        onRefresh(evt.Code, base64Image)
+      case "success":
+        global_error_state.LogError(ErrorSeverityInfo, "get_qr_code", "QR code scanned, pairing succeeded", "")
+        recordPairingOutcome(PairingOutcomeSuccess, "")
+        return
+      case "timeout":
+        global_error_state.LogError(ErrorSeverityWarning, "get_qr_code", "QR pairing ended", evt.Event)
+        global_whatsapp_state.SetPairingState(PairingFailed, evt.Event)
+        recordPairingOutcome(PairingOutcomeTimeout, "QR codes expired before one was scanned")
+        return
+      default:
+        reason := evt.Event
+        if evt.Error != nil {
+          reason = fmt.Sprintf("%s: %v", evt.Event, evt.Error)
+        }
+        global_error_state.LogError(ErrorSeverityWarning, "get_qr_code", "QR pairing ended", reason)
+        global_whatsapp_state.SetPairingState(PairingFailed, evt.Event)
+        recordPairingOutcome(PairingOutcomeError, reason)
+        return
+      }
+
+    case <-timer.C:
+      if onRefresh != nil {
+        global_error_state.LogError(ErrorSeverityWarning, "get_qr_code", "Stopped refreshing QR code after timeout", "")
+        onRefresh = nil
+      }
+    }
+  }
+}
+
+// recordPairingOutcome stores the result of the pending QR pairing attempt, if any.
+// Whichever of the QR channel and the pair events reports first decides the outcome.
+func recordPairingOutcome(outcome string, reason string) {
+  started, popupShown, ok := global_whatsapp_state.FinishPairingAttempt()
+  if !ok || global_database == nil {
+    return
+  }
+  if err := global_database.LogPairingAttempt(started, time.Now(), outcome, reason, popupShown); err != nil {
+    global_error_state.LogError(ErrorSeverityWarning, "get_qr_code", "Failed to record pairing attempt", err.Error())
+  }
+}
+
+// renderQRCodePNG renders a QR code string as a base64-encoded PNG
+func renderQRCodePNG(qrCode string) (string, error) {
+  img, err := generateQRCodeImage(qrCode)
+  if err != nil {
+    global_error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to generate QR image", err.Error())
+    return "", err
+  }
+
+  var buf bytes.Buffer
+  if err := png.Encode(&buf, img); err != nil {
+    global_error_state.LogError(ErrorSeverityError, "get_qr_code", "Failed to encode QR image", err.Error())
+    return "", err
+  }
+
+  return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
 // WaitForConnection waits for successful connection after QR scan
 func (wac *WhatsAppClient) WaitForConnection(timeout int) error {
   timeoutDuration := time.Duration(timeout) * time.Second
@@ -344,36 +1456,38 @@ func (wac *WhatsAppClient) WaitForConnection(timeout int) error {
 
 // IsLoggedIn checks if the client is logged in
 func (wac *WhatsAppClient) IsLoggedIn() bool {
-  return wac.client.Store.ID != nil
+  return wac.Client().Store.ID != nil
 }
 
 // IsConnected checks if the client is connected
 func (wac *WhatsAppClient) IsConnected() bool {
-  return wac.client.IsConnected()
+  return wac.Client().IsConnected()
 }
 
 // GetJID returns the user's JID
 func (wac *WhatsAppClient) GetJID() types.JID {
-  if wac.client.Store.ID == nil {
+  id := wac.Client().Store.ID
+  if id == nil {
     return types.EmptyJID
   }
-  return *wac.client.Store.ID
+  return *id
 }
 
 // Disconnect disconnects from WhatsApp
 func (wac *WhatsAppClient) Disconnect() {
-  if wac.client != nil {
-    wac.client.Disconnect()
+  if client := wac.Client(); client != nil {
+    client.Disconnect()
   }
 }
 
 // Logout logs out and clears the session
 func (wac *WhatsAppClient) Logout() error {
-  if wac.client.Store.ID == nil {
+  client := wac.Client()
+  if client.Store.ID == nil {
     return fmt.Errorf("not logged in")
   }
 
-  err := wac.client.Logout(context.Background())
+  err := client.Logout(context.Background())
   if err != nil {
     global_error_state.LogError(ErrorSeverityError, "logout", "Failed to logout", err.Error())
     return err
@@ -389,10 +1503,45 @@ func (wac *WhatsAppClient) Logout() error {
   return nil
 }
 
+// ResetSession drops the local device keys without telling WhatsApp (unlike Logout) and
+// replaces the client with one for a fresh device, ready to pair again. Stored messages,
+// handlers and config live in separate databases and are untouched.
+func (wac *WhatsAppClient) ResetSession(ctx context.Context) error {
+  old := wac.Client()
+  old.Disconnect()
+  old.RemoveEventHandler(wac.event_handler_id)
+
+  if old.Store.ID != nil {
+    if err := old.Store.Delete(ctx); err != nil {
+      // Keep using the old client so we're not left without event handlers
+      wac.SetupEventHandlers()
+      return fmt.Errorf("failed to clear session keys: %w", err)
+    }
+  }
+
+  wac.swapClient(wac.container, whatsmeow.NewClient(wac.container.NewDevice(), waLog.Noop))
+  wac.SetupEventHandlers()
+
+  global_whatsapp_state.mu.Lock()
+  global_whatsapp_state.connection_state = StateDisconnected
+  global_whatsapp_state.last_disconnected = time.Now()
+  global_whatsapp_state.phone_number = ""
+  global_whatsapp_state.device_id = ""
+  global_whatsapp_state.disconnect_reason = ""
+  global_whatsapp_state.disconnect_description = ""
+  global_whatsapp_state.disconnect_terminal = false
+  global_whatsapp_state.mu.Unlock()
+  global_whatsapp_state.SetPairingState(PairingIdle, "")
+
+  global_error_state.LogError(ErrorSeverityInfo, "relink", "Session keys cleared, ready to pair", "")
+  global_database.LogConnectionEvent("relink", "Session keys cleared for re-pairing")
+  return nil
+}
+
 // Close closes the client and container
 func (wac *WhatsAppClient) Close() error {
-  if wac.client != nil {
-    wac.client.Disconnect()
+  if client := wac.Client(); client != nil {
+    client.Disconnect()
   }
   if wac.container != nil {
     return wac.container.Close()